@@ -0,0 +1,220 @@
+package geminiagentassemble
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/////////
+// Agent tool argument decoding routines
+/////////
+
+// returned by tool handlers when the model supplied arguments cannot be decoded
+// the error is reported to the model as the tool result so it can correct the call
+var ErrInvalidArgs = errors.New("invalid tool arguments")
+
+// decode a json arguments blob from the model into target
+// tolerant decoding repairs minor mistakes (trailing commas, unquoted keys, single quotes)
+// when strict decoding fails
+func DecodeToolArgs(data string, target any, tolerant bool) error {
+	err := json.Unmarshal([]byte(data), target)
+	if err == nil {
+		return nil
+	}
+	if tolerant {
+		if json.Unmarshal([]byte(repairJSON(data)), target) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %w", ErrInvalidArgs, err)
+}
+
+// get a function call argument as a string, numbers and booleans are formatted
+// a missing argument is an ErrInvalidArgs error, reported to the model by the agent
+func ArgString(args map[string]any, name string) (string, error) {
+	switch value := args[name].(type) {
+	case string:
+		return value, nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case json.Number:
+		return value.String(), nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case nil:
+		return "", fmt.Errorf("%w: missing %s", ErrInvalidArgs, name)
+	}
+	return "", fmt.Errorf("%w: %s is not a string", ErrInvalidArgs, name)
+}
+
+// get a function call argument as an exact json.Number, e.g. for big.Float parsing
+// json.Number args (decoded with UseNumber) and numeric strings keep every digit, float64 args are
+// formatted exactly but note the Gemini api sends numbers as doubles, so send big values as strings
+func ArgNumber(args map[string]any, name string) (json.Number, error) {
+	switch value := args[name].(type) {
+	case json.Number:
+		if !validNumber(value) {
+			return "", fmt.Errorf("%w: %s is not a number", ErrInvalidArgs, name)
+		}
+		return value, nil
+	case float64:
+		return json.Number(strconv.FormatFloat(value, 'f', -1, 64)), nil
+	case string:
+		number := json.Number(strings.TrimSpace(value))
+		if !validNumber(number) {
+			return "", fmt.Errorf("%w: %s is not a number", ErrInvalidArgs, name)
+		}
+		return number, nil
+	case nil:
+		return "", fmt.Errorf("%w: missing %s", ErrInvalidArgs, name)
+	}
+	return "", fmt.Errorf("%w: %s is not a number", ErrInvalidArgs, name)
+}
+
+// check a json.Number holds a number, values past the float64 range are kept for exact parsing
+func validNumber(number json.Number) bool {
+	if _, err := number.Int64(); err == nil {
+		return true
+	}
+	_, err := number.Float64()
+	return err == nil || errors.Is(err, strconv.ErrRange)
+}
+
+// get a function call argument as a number, json numbers arrive as float64 and numeric strings are parsed
+func ArgFloat(args map[string]any, name string) (float64, error) {
+	switch value := args[name].(type) {
+	case float64:
+		return value, nil
+	case json.Number:
+		number, err := value.Float64()
+		if err != nil {
+			return 0, fmt.Errorf("%w: %s is not a number", ErrInvalidArgs, name)
+		}
+		return number, nil
+	case string:
+		number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %s is not a number", ErrInvalidArgs, name)
+		}
+		return number, nil
+	case nil:
+		return 0, fmt.Errorf("%w: missing %s", ErrInvalidArgs, name)
+	}
+	return 0, fmt.Errorf("%w: %s is not a number", ErrInvalidArgs, name)
+}
+
+// get a function call argument as an integer, a number with a fraction is an error
+func ArgInt(args map[string]any, name string) (int, error) {
+	// a json.Number integer is parsed exactly
+	if value, ok := args[name].(json.Number); ok {
+		if integer, err := strconv.ParseInt(value.String(), 10, strconv.IntSize); err == nil {
+			return int(integer), nil
+		}
+	}
+	number, err := ArgFloat(args, name)
+	if err != nil {
+		return 0, err
+	}
+	if number != math.Trunc(number) || number < math.MinInt || number >= -math.MinInt {
+		return 0, fmt.Errorf("%w: %s is not an integer", ErrInvalidArgs, name)
+	}
+	return int(number), nil
+}
+
+// get a function call argument as a boolean, "true" and "false" strings are accepted
+func ArgBool(args map[string]any, name string) (bool, error) {
+	switch value := args[name].(type) {
+	case bool:
+		return value, nil
+	case string:
+		flag, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return false, fmt.Errorf("%w: %s is not a boolean", ErrInvalidArgs, name)
+		}
+		return flag, nil
+	case nil:
+		return false, fmt.Errorf("%w: missing %s", ErrInvalidArgs, name)
+	}
+	return false, fmt.Errorf("%w: %s is not a boolean", ErrInvalidArgs, name)
+}
+
+// best effort repair of almost valid json, string contents are left untouched
+func repairJSON(data string) string {
+	var out strings.Builder
+	runes := []rune(data)
+	var quote rune
+	last := rune(0) // last significant rune written outside a string
+	for idx := 0; idx < len(runes); idx++ {
+		r := runes[idx]
+
+		// inside a string copy through, converting single quoted strings to double quoted
+		if quote != 0 {
+			switch {
+			case r == '\\' && idx+1 < len(runes):
+				idx++
+				// an escaped single quote needs no escape in a double quoted string
+				if runes[idx] != '\'' {
+					out.WriteRune(r)
+				}
+				out.WriteRune(runes[idx])
+			case r == quote:
+				out.WriteRune('"')
+				quote = 0
+				last = '"'
+			case r == '"':
+				out.WriteString(`\"`)
+			default:
+				out.WriteRune(r)
+			}
+			continue
+		}
+
+		switch {
+		case r == '"' || r == '\'':
+			quote = r
+			out.WriteRune('"')
+		case r == ',':
+			// drop a trailing comma before a closing bracket
+			next := nextSignificant(runes, idx+1)
+			if next == '}' || next == ']' {
+				continue
+			}
+			out.WriteRune(r)
+			last = r
+		case (last == '{' || last == ',') && (unicode.IsLetter(r) || r == '_'):
+			// quote a bare object key
+			end := idx
+			for end < len(runes) && (unicode.IsLetter(runes[end]) || unicode.IsDigit(runes[end]) || runes[end] == '_') {
+				end++
+			}
+			if nextSignificant(runes, end) != ':' {
+				out.WriteString(string(runes[idx:end]))
+			} else {
+				out.WriteString(`"` + string(runes[idx:end]) + `"`)
+			}
+			idx = end - 1
+			last = 'k'
+		default:
+			out.WriteRune(r)
+			if !unicode.IsSpace(r) {
+				last = r
+			}
+		}
+	}
+	return out.String()
+}
+
+// next non space rune from idx, 0 at the end
+func nextSignificant(runes []rune, idx int) rune {
+	for ; idx < len(runes); idx++ {
+		if !unicode.IsSpace(runes[idx]) {
+			return runes[idx]
+		}
+	}
+	return 0
+}
@@ -0,0 +1,225 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// arguments as the model sends them for a number typed parameter, a string typed one and a
+// caller decoding with UseNumber
+var testArgs = map[string]any{
+	"float":    2.5,
+	"integral": 3.0,
+	"number":   json.Number("0.10000000000000000001"),
+	"big":      json.Number("9007199254740993"),
+	"huge":     json.Number("1e400"),
+	"garbled":  json.Number("12abc"),
+	"string":   " 4.25 ",
+	"word":     "four",
+	"flag":     true,
+	"list":     []any{1.0},
+}
+
+func TestArgString(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		err  bool
+	}{
+		{name: "float", want: "2.5"},
+		{name: "integral", want: "3"},
+		{name: "number", want: "0.10000000000000000001"},
+		{name: "string", want: " 4.25 "},
+		{name: "flag", want: "true"},
+		{name: "list", err: true},
+		{name: "missing", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ArgString(testArgs, test.name)
+			if test.err {
+				if !errors.Is(err, ErrInvalidArgs) {
+					t.Fatalf("error = %v, want ErrInvalidArgs", err)
+				}
+				return
+			}
+			if err != nil || got != test.want {
+				t.Errorf("ArgString = %q, %v, want %q", got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestArgNumbers(t *testing.T) {
+	tests := []struct {
+		name      string
+		float     float64
+		number    json.Number
+		integer   int
+		notFloat  bool
+		notNumber bool
+		notInt    bool
+	}{
+		{name: "float", float: 2.5, number: "2.5", notInt: true},
+		{name: "integral", float: 3, number: "3", integer: 3},
+		{name: "number", float: 0.1, number: "0.10000000000000000001", notInt: true},
+		{name: "big", float: 9007199254740992, number: "9007199254740993", integer: 9007199254740993},
+		{name: "huge", notFloat: true, number: "1e400", notInt: true},
+		{name: "garbled", notFloat: true, notNumber: true, notInt: true},
+		{name: "string", float: 4.25, number: "4.25", notInt: true},
+		{name: "word", notFloat: true, notNumber: true, notInt: true},
+		{name: "flag", notFloat: true, notNumber: true, notInt: true},
+		{name: "missing", notFloat: true, notNumber: true, notInt: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			float, err := ArgFloat(testArgs, test.name)
+			if test.notFloat != (err != nil) || float != test.float {
+				t.Errorf("ArgFloat = %v, %v, want %v", float, err, test.float)
+			}
+			number, err := ArgNumber(testArgs, test.name)
+			if test.notNumber != (err != nil) || number != test.number {
+				t.Errorf("ArgNumber = %q, %v, want %q", number, err, test.number)
+			}
+			integer, err := ArgInt(testArgs, test.name)
+			if test.notInt != (err != nil) || integer != test.integer {
+				t.Errorf("ArgInt = %v, %v, want %v", integer, err, test.integer)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidArgs) {
+				t.Errorf("error = %v, want ErrInvalidArgs", err)
+			}
+		})
+	}
+}
+
+// an integer past 2^53 keeps every digit from a request, through the agent reply and the agent
+// client decoding into a tool handler
+func TestExactNumberRoundTrip(t *testing.T) {
+	requireModelCalls(t)
+	var number json.Number
+	var integer int
+	big := ToolFunc{Declaration: &genai.FunctionDeclaration{Name: "big"}, Handler: func(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+		var err error
+		if number, err = ArgNumber(funcall.Args, "n"); err != nil {
+			return "", err
+		}
+		integer, err = ArgInt(funcall.Args, "n")
+		return number.String(), err
+	}}
+	agent := newMockAgent(t, newMockGemini(t, textReply("noted")), WithToolFuncs(big))
+	server := httptest.NewServer(http.HandlerFunc(agent.HandleAgentRequest))
+	defer server.Close()
+
+	body := `{"input":"question","history":[
+		{"role":"user","parts":[{"text":"add it"}]},
+		{"role":"model","parts":[{"function_call":{"name":"big","args":{"n":9007199254740993}}}]},
+		{"role":"user","parts":[{"function_response":{"name":"big","response":{"result":"9007199254740993"}}}]},
+		{"role":"model","parts":[{"text":"added"}]}]}`
+	res, err := server.Client().Post(server.URL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(res.Body)
+		t.Fatalf("status = %d: %s", res.StatusCode, data)
+	}
+	// decoded as the agent client decodes replies
+	response := Response{}
+	if err := (JSONCodec{UseNumber: true}).Decode(res.Body, &response); err != nil {
+		t.Fatal(err)
+	}
+	var funcall *genai.FunctionCall
+	for _, turn := range response.History {
+		for _, part := range turn.Parts {
+			if part.FunctionCall != nil {
+				funcall = part.FunctionCall
+			}
+		}
+	}
+	if funcall == nil {
+		t.Fatalf("history = %+v, want the function call", response.History)
+	}
+
+	if _, err := agent.callTool(context.Background(), *funcall); err != nil {
+		t.Fatal(err)
+	}
+	if number != "9007199254740993" || integer != 9007199254740993 {
+		t.Errorf("tool args = %q, %d, want 9007199254740993", number, integer)
+	}
+}
+
+func TestArgBool(t *testing.T) {
+	args := map[string]any{"flag": true, "text": "false", "word": "maybe", "number": 1.0}
+	tests := []struct {
+		name string
+		want bool
+		err  bool
+	}{
+		{name: "flag", want: true},
+		{name: "text", want: false},
+		{name: "word", err: true},
+		{name: "number", err: true},
+		{name: "missing", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ArgBool(args, test.name)
+			if test.err != (err != nil) || got != test.want {
+				t.Errorf("ArgBool = %v, %v, want %v", got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeToolArgs(t *testing.T) {
+	type args struct {
+		A    float64 `json:"a"`
+		B    float64 `json:"b"`
+		Note string  `json:"note"`
+	}
+	tests := []struct {
+		name     string
+		data     string
+		tolerant bool
+		want     args
+		err      bool
+	}{
+		{name: "valid", data: `{"a": 1, "b": 2}`, want: args{A: 1, B: 2}},
+		{name: "valid tolerant", data: `{"a": 1, "b": 2}`, tolerant: true, want: args{A: 1, B: 2}},
+		{name: "trailing comma strict", data: `{"a": 1, "b": 2,}`, err: true},
+		{name: "trailing comma", data: `{"a": 1, "b": 2,}`, tolerant: true, want: args{A: 1, B: 2}},
+		{name: "bare keys", data: `{a: 1, b_2: 3, b: 2}`, tolerant: true, want: args{A: 1, B: 2}},
+		{name: "single quotes", data: `{'a': 1, 'note': 'say "hi"'}`, tolerant: true, want: args{A: 1, Note: `say "hi"`}},
+		{name: "string contents untouched", data: `{"note": "x, }", b: 2,}`, tolerant: true, want: args{B: 2, Note: "x, }"}},
+		{name: "escaped quote", data: `{'note': 'it\'s', a: 1}`, tolerant: true, want: args{A: 1, Note: "it's"}},
+		{name: "beyond repair", data: `{"a": 1`, tolerant: true, err: true},
+		{name: "wrong type", data: `{"a": "one"}`, tolerant: true, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := args{}
+			err := DecodeToolArgs(test.data, &got, test.tolerant)
+			if test.err {
+				if !errors.Is(err, ErrInvalidArgs) {
+					t.Fatalf("error = %v, want ErrInvalidArgs", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("args = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Agent attachment routines
+/////////
+
+// inline file sent to the model with a request message, e.g. an image
+// Data is base64 encoded in the request json
+type Attachment struct {
+	MIMEType string `json:"mime_type"`
+	Data     []byte `json:"data"`
+}
+
+// position of the attachments relative to the message text in the content sent to the model
+type PartOrder string
+
+const (
+	// attachments before the text, suits questions about an image and is the default
+	AttachmentsFirst PartOrder = "attachments_first"
+	// text before the attachments
+	TextFirst PartOrder = "text_first"
+)
+
+// context key for the attachments of a call
+type attachmentsKey struct{}
+
+// request attachments with their order
+type attachments struct {
+	order PartOrder
+	files []Attachment
+}
+
+// attach files to the message of a call made with ctx, e.g. CallAgentContext
+// an empty order is AttachmentsFirst
+func WithAttachments(ctx context.Context, order PartOrder, files ...Attachment) context.Context {
+	return context.WithValue(ctx, attachmentsKey{}, attachments{order: order, files: files})
+}
+
+// check a requested part order is known
+func validPartOrder(order PartOrder) error {
+	switch order {
+	case "", AttachmentsFirst, TextFirst:
+		return nil
+	}
+	return fmt.Errorf("unknown part order %q", order)
+}
+
+// parts of the user message, the text with any attachments from ctx in the requested order
+func inputParts(ctx context.Context, message string) []genai.Part {
+	attached, _ := ctx.Value(attachmentsKey{}).(attachments)
+	if len(attached.files) == 0 {
+		return []genai.Part{genai.Text(message)}
+	}
+	var files []genai.Part
+	for _, file := range attached.files {
+		files = append(files, genai.Blob{MIMEType: file.MIMEType, Data: file.Data})
+	}
+	if attached.order == TextFirst {
+		return append([]genai.Part{genai.Text(message)}, files...)
+	}
+	return append(files, genai.Text(message))
+}
+
+// request context carrying the request attachments and system override, if any
+func (request *Request) context(ctx context.Context) context.Context {
+	if len(request.Attachments) > 0 {
+		ctx = WithAttachments(ctx, request.PartOrder, request.Attachments...)
+	}
+	if request.SystemOverride != "" {
+		ctx = withSystemOverride(ctx, request.SystemOverride)
+	}
+	if request.schema != nil {
+		ctx = withResponseSchema(ctx, request.schema)
+	}
+	return ctx
+}
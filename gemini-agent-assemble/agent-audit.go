@@ -0,0 +1,78 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Agent tool call audit routines
+/////////
+
+// bytes of a tool result kept in its audit record
+const auditResultBytes = 256
+
+// audit record written to the agent AuditSink for every tool call
+type ToolAudit struct {
+	Time      time.Time      `json:"time"`
+	SessionID string         `json:"session_id,omitempty"`
+	Agent     string         `json:"agent,omitempty"`
+	Function  string         `json:"function"`
+	Args      map[string]any `json:"args,omitempty"`
+	Result    string         `json:"result,omitempty"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// context key for the id of the session a turn runs on
+type sessionIDKey struct{}
+
+// session id of the turn running with ctx, empty for the NewSession() session or a stateless call
+func sessionIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(sessionIDKey{}).(string)
+	return id
+}
+
+// write a json line audit record of a tool call to the AuditSink
+// the general logger is not used so the audit trail can be kept apart, e.g. in an append-only file
+func (agent *Agent) audit(ctx context.Context, funcall genai.FunctionCall, result string, err error) {
+	if agent.AuditSink == nil {
+		return
+	}
+	record := ToolAudit{
+		Time:      agent.clock().Now(),
+		SessionID: sessionIDFrom(ctx),
+		Agent:     agent.Name,
+		Function:  funcall.Name,
+		Args:      funcall.Args,
+		Result:    truncateUTF8(result, auditResultBytes),
+	}
+	if agent.RedactAuditArgs {
+		record.Args = map[string]any{"redacted": true}
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	// a streamed call writes its records once the answer has been streamed
+	if post := streamPostFrom(ctx); post != nil {
+		post.queueAudit(record)
+		return
+	}
+	agent.writeAudit(record)
+}
+
+// write an audit record to the AuditSink as a json line
+func (agent *Agent) writeAudit(record ToolAudit) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		agent.logger().Error("audit record not encoded", "function", record.Function, "error", err)
+		return
+	}
+	agent.auditMu.Lock()
+	defer agent.auditMu.Unlock()
+	if _, err := agent.AuditSink.Write(append(data, '\n')); err != nil {
+		agent.logger().Error("audit record not written", "function", record.Function, "error", err)
+	}
+}
@@ -0,0 +1,101 @@
+package geminiagentassemble
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+func TestToolAudit(t *testing.T) {
+	long := strings.Repeat("é", auditResultBytes)
+	tools := WithToolFuncs(
+		ToolFunc{
+			Declaration: &genai.FunctionDeclaration{Name: "fail"},
+			Handler: func(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+				return "", errors.New("tool failed")
+			},
+		},
+		ToolFunc{
+			Declaration: &genai.FunctionDeclaration{Name: "long"},
+			Handler: func(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+				return long, nil
+			},
+		},
+	)
+	tests := []struct {
+		name    string
+		funcall genai.FunctionCall
+		session string
+		redact  bool
+		want    ToolAudit
+	}{
+		{
+			name:    "tool result",
+			funcall: genai.FunctionCall{Name: "echo", Args: map[string]any{"text": "hi"}},
+			session: "s1",
+			want:    ToolAudit{SessionID: "s1", Function: "echo", Args: map[string]any{"text": "hi"}, Result: "hi"},
+		},
+		{
+			name:    "default session",
+			funcall: genai.FunctionCall{Name: "echo", Args: map[string]any{"text": "hi"}},
+			want:    ToolAudit{Function: "echo", Args: map[string]any{"text": "hi"}, Result: "hi"},
+		},
+		{
+			name:    "redacted args",
+			funcall: genai.FunctionCall{Name: "echo", Args: map[string]any{"text": "secret"}},
+			redact:  true,
+			want:    ToolAudit{Function: "echo", Args: map[string]any{"redacted": true}, Result: "secret"},
+		},
+		{
+			name:    "tool error",
+			funcall: genai.FunctionCall{Name: "fail"},
+			want:    ToolAudit{Function: "fail", Error: "tool failed"},
+		},
+		{
+			name:    "long result truncated",
+			funcall: genai.FunctionCall{Name: "long"},
+			want:    ToolAudit{Function: "long", Result: strings.Repeat("é", auditResultBytes/2)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newMockAgent(t, newMockGemini(t), tools)
+			clock := newFakeClock()
+			agent.Clock = clock
+			agent.Name = "auditor"
+			agent.RedactAuditArgs = test.redact
+			sink := &bytes.Buffer{}
+			agent.AuditSink = sink
+
+			ctx := context.Background()
+			if test.session != "" {
+				ctx = context.WithValue(ctx, sessionIDKey{}, test.session)
+			}
+			agent.callTool(ctx, test.funcall)
+
+			lines := strings.Split(strings.TrimSuffix(sink.String(), "\n"), "\n")
+			if len(lines) != 1 {
+				t.Fatalf("audit lines = %q, want one record", lines)
+			}
+			got := ToolAudit{}
+			if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+				t.Fatalf("audit record %q: %v", lines[0], err)
+			}
+			want := test.want
+			want.Time, want.Agent = clock.Now(), "auditor"
+			if !got.Time.Equal(want.Time) {
+				t.Errorf("time = %v, want %v", got.Time, want.Time)
+			}
+			got.Time = want.Time
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("audit = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
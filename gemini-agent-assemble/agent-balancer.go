@@ -0,0 +1,157 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/////////
+// Agent load balancing client routines
+/////////
+
+// default time between /health probes of an unhealthy replica
+const DefaultProbeInterval = 5 * time.Second
+
+// replica endpoint and its passive health state
+type endpoint struct {
+	url     string
+	healthy bool
+}
+
+// client spreading calls round-robin over the healthy replicas of a downstream agent
+// a replica that is unreachable or overloaded is skipped until its /health probe succeeds
+type AgentClient struct {
+	mu        sync.Mutex
+	endpoints []*endpoint
+	next      int
+	done      chan struct{}
+	closed    bool
+
+	// http client used for agent calls and health probes
+	HTTPClient *http.Client
+	// time between /health probes of an unhealthy replica
+	ProbeInterval time.Duration
+}
+
+// create a client over the full endpoint urls of the replicas, e.g. http://<hostname>:<port>/agent
+// the options set the http client limits, see NewHTTPClient
+func NewAgentClient(endpoints []string, options ...ClientOption) *AgentClient {
+	client := &AgentClient{
+		done:          make(chan struct{}),
+		HTTPClient:    NewHTTPClient(options...),
+		ProbeInterval: DefaultProbeInterval,
+	}
+	for _, url := range endpoints {
+		client.endpoints = append(client.endpoints, &endpoint{url: url, healthy: true})
+	}
+	return client
+}
+
+// call the agent on the next healthy replica, failing over to the others when a replica is unavailable
+// ErrDownstreamUnavailable is returned when no replica could serve the call
+func (client *AgentClient) CallAgent(ctx context.Context, message string) (string, error) {
+	tried := map[*endpoint]bool{}
+	for {
+		target := client.pick(tried)
+		if target == nil {
+			return "", fmt.Errorf("%w: no healthy replica", ErrDownstreamUnavailable)
+		}
+		tried[target] = true
+		result, err := callRemoteAgent(ctx, client.HTTPClient, target.url, message)
+		if err == nil {
+			return result, nil
+		}
+		if !errors.Is(err, ErrDownstreamUnavailable) || ctx.Err() != nil {
+			return "", err
+		}
+		slog.Warn("agent replica unavailable", "url", target.url, "error", err)
+		client.markUnhealthy(target)
+	}
+}
+
+// stop the health probes
+func (client *AgentClient) Close() {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if !client.closed {
+		client.closed = true
+		close(client.done)
+	}
+}
+
+// next healthy replica in round-robin order not yet tried for this call, nil when none remain
+func (client *AgentClient) pick(tried map[*endpoint]bool) *endpoint {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	for range client.endpoints {
+		target := client.endpoints[client.next%len(client.endpoints)]
+		client.next++
+		if target.healthy && !tried[target] {
+			return target
+		}
+	}
+	return nil
+}
+
+// take a replica out of rotation and probe it until it recovers
+func (client *AgentClient) markUnhealthy(target *endpoint) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if !target.healthy || client.closed {
+		return
+	}
+	target.healthy = false
+	go client.probe(target)
+}
+
+// poll the replica /health route until it reports healthy or the client is closed
+func (client *AgentClient) probe(target *endpoint) {
+	ticker := time.NewTicker(client.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-client.done:
+			return
+		case <-ticker.C:
+		}
+		if client.checkHealth(target) {
+			slog.Info("agent replica recovered", "url", target.url)
+			client.mu.Lock()
+			target.healthy = true
+			client.mu.Unlock()
+			return
+		}
+	}
+}
+
+// probe the health route alongside the replica agent route
+func (client *AgentClient) checkHealth(target *endpoint) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), client.ProbeInterval)
+	defer cancel()
+	return isHealthy(ctx, client.HTTPClient, target.url)
+}
+
+// check the health route of an agent endpoint url replies ok
+func isHealthy(ctx context.Context, client *http.Client, url string) bool {
+	req, err := http.NewRequestWithContext(ctx, "GET", healthURL(url), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// health url for an agent endpoint url, <base path>/agent becomes <base path>/health
+func healthURL(url string) string {
+	return strings.TrimSuffix(url, "/agent") + "/health"
+}
@@ -0,0 +1,114 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "http://localhost:8080/agent", want: "http://localhost:8080/health"},
+		{url: "http://localhost:8080/math/agent", want: "http://localhost:8080/math/health"},
+		{url: "http://localhost:8080", want: "http://localhost:8080/health"},
+	}
+	for _, test := range tests {
+		if got := healthURL(test.url); got != test.want {
+			t.Errorf("healthURL(%q) = %q, want %q", test.url, got, test.want)
+		}
+	}
+}
+
+// replica answering agent calls, unavailable while down is set, counting the calls it served
+type replica struct {
+	server *httptest.Server
+	down   atomic.Bool
+	served atomic.Int32
+}
+
+func newReplica(t *testing.T) *replica {
+	replica := &replica{}
+	replica.server = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if replica.down.Load() {
+			http.Error(res, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if req.URL.Path == "/health" {
+			return
+		}
+		replica.served.Add(1)
+		res.Header().Set("Content-Type", "application/json")
+		res.Write([]byte(`{"content":"42"}`))
+	}))
+	t.Cleanup(replica.server.Close)
+	return replica
+}
+
+// calls rotate over the healthy replicas, an unavailable one rejoins once its health probe passes
+func TestAgentClientRotation(t *testing.T) {
+	tests := []struct {
+		name   string
+		down   []bool
+		calls  int
+		served []int32
+	}{
+		{name: "all healthy", down: []bool{false, false, false}, calls: 6, served: []int32{2, 2, 2}},
+		{name: "one down", down: []bool{false, true, false}, calls: 6, served: []int32{3, 0, 3}},
+		{name: "single replica", down: []bool{false}, calls: 3, served: []int32{3}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var replicas []*replica
+			var urls []string
+			for _, down := range test.down {
+				replica := newReplica(t)
+				replica.down.Store(down)
+				replicas = append(replicas, replica)
+				urls = append(urls, replica.server.URL+"/agent")
+			}
+			client := NewAgentClient(urls)
+			client.ProbeInterval = 10 * time.Millisecond
+			defer client.Close()
+
+			for call := 0; call < test.calls; call++ {
+				if _, err := client.CallAgent(context.Background(), "question"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for idx, replica := range replicas {
+				if got := replica.served.Load(); got != test.served[idx] {
+					t.Errorf("replica %d served %d, want %d", idx, got, test.served[idx])
+				}
+			}
+
+			// recovered replicas are probed back into rotation
+			for _, replica := range replicas {
+				replica.down.Store(false)
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				healthy := 0
+				client.mu.Lock()
+				for _, target := range client.endpoints {
+					if target.healthy {
+						healthy++
+					}
+				}
+				client.mu.Unlock()
+				if healthy == len(replicas) {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("healthy replicas = %d, want %d", healthy, len(replicas))
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		})
+	}
+}
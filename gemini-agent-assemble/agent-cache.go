@@ -0,0 +1,107 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Agent context cache routines
+/////////
+
+// cached system instruction, tools and static examples with the model that references them
+type contextCache struct {
+	model    *genai.GenerativeModel
+	ttl      time.Duration
+	examples []*genai.Content
+	expires  time.Time
+}
+
+// cache the system instruction, tools and optional static examples so they are not re-sent
+// (and billed in full) on every turn. examples must alternate user and model turns.
+// calls on the default model use the cache, routed models and NewSessionWithTools sessions
+// send the full configuration. an expired cache is re-created when a call fails
+func (agent *Agent) EnableContextCache(ctx context.Context, ttl time.Duration, examples ...*genai.Content) error {
+	if err := agent.checkAgent(); err != nil {
+		agent.logger().Error(err.Error())
+		return err
+	}
+	if ttl <= 0 {
+		return errors.New("context cache ttl must be positive")
+	}
+	if err := validateHistory(examples); err != nil {
+		agent.logger().Error(err.Error())
+		return err
+	}
+	cache, err := agent.createContextCache(ctx, ttl, examples)
+	if err != nil {
+		return err
+	}
+	agent.mu.Lock()
+	agent.cache = cache
+	agent.mu.Unlock()
+	return nil
+}
+
+// create the cached content and a model using it
+func (agent *Agent) createContextCache(ctx context.Context, ttl time.Duration, examples []*genai.Content) (*contextCache, error) {
+	cached, err := agent.Client.CreateCachedContent(ctx, &genai.CachedContent{
+		Model:             agent.modelName,
+		SystemInstruction: agent.model.SystemInstruction,
+		Contents:          examples,
+		Tools:             agent.model.Tools,
+		ToolConfig:        agent.model.ToolConfig,
+		Expiration:        genai.ExpireTimeOrTTL{TTL: ttl},
+	})
+	if err != nil {
+		agent.logger().Error("context cache failed", "error", err)
+		return nil, wrapModelError(err)
+	}
+	model := agent.Client.GenerativeModelFromCachedContent(cached)
+	model.GenerationConfig = agent.model.GenerationConfig
+	model.SafetySettings = agent.model.SafetySettings
+	agent.logger().Info("context cache created", "cache", cached.Name, "expires", cached.Expiration.ExpireTime)
+	return &contextCache{
+		model:    model,
+		ttl:      ttl,
+		examples: examples,
+		expires:  cached.Expiration.ExpireTime,
+	}, nil
+}
+
+// model using the context cache, nil when caching is not enabled
+func (agent *Agent) cachedModel() *genai.GenerativeModel {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	if agent.cache == nil {
+		return nil
+	}
+	return agent.cache.model
+}
+
+// re-create an expired context cache after a failed send and return a chat to retry on
+// the chat history is restored to its length before the failed send
+func (agent *Agent) recoverContextCache(ctx context.Context, chat *genai.ChatSession, sent int) (*genai.ChatSession, bool) {
+	agent.mu.Lock()
+	cache := agent.cache
+	agent.mu.Unlock()
+	if cache == nil || (!cache.expires.IsZero() && agent.clock().Now().Before(cache.expires)) {
+		return nil, false
+	}
+
+	agent.logger().Warn("context cache expired, re-creating")
+	refreshed, err := agent.createContextCache(ctx, cache.ttl, cache.examples)
+	if err != nil {
+		return nil, false
+	}
+	agent.mu.Lock()
+	agent.cache = refreshed
+	agent.mu.Unlock()
+
+	retry := refreshed.model.StartChat()
+	retry.History = chat.History[:sent]
+	return retry, true
+}
@@ -0,0 +1,145 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	pb "cloud.google.com/go/ai/generativelanguage/apiv1beta/generativelanguagepb"
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// stand in for the cache service, genai creates cached content over grpc
+type mockCache struct {
+	pb.UnimplementedCacheServiceServer
+	mu       sync.Mutex
+	requests []*pb.CachedContent
+	// code of a failed create, codes.OK creates
+	code codes.Code
+}
+
+func (cache *mockCache) CreateCachedContent(ctx context.Context, req *pb.CreateCachedContentRequest) (*pb.CachedContent, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.requests = append(cache.requests, req.CachedContent)
+	if cache.code != codes.OK {
+		return nil, status.Error(cache.code, "mock error")
+	}
+	name := "cachedContents/mock"
+	created := &pb.CachedContent{
+		Name:       &name,
+		Model:      req.CachedContent.Model,
+		Expiration: &pb.CachedContent_ExpireTime{ExpireTime: timestamppb.New(time.Now().Add(req.CachedContent.GetTtl().AsDuration()))},
+	}
+	return created, nil
+}
+
+// the create requests received so far
+func (cache *mockCache) received() []*pb.CachedContent {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return append([]*pb.CachedContent(nil), cache.requests...)
+}
+
+// agent with the cache service on a local grpc server, it makes no model calls
+func newCacheAgent(t *testing.T, cache *mockCache) *Agent {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the api key is only sent over tls, borrow the httptest certificate
+	certs := httptest.NewTLSServer(http.NotFoundHandler())
+	certs.Close()
+	server := grpc.NewServer(grpc.Creds(credentials.NewServerTLSFromCert(&certs.TLS.Certificates[0])))
+	pb.RegisterCacheServiceServer(server, cache)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	ctx := context.Background()
+	roots := certs.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	client, err := genai.NewClient(ctx, option.WithAPIKey("test"), option.WithEndpoint(listener.Addr().String()),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: roots}))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := []*genai.Tool{{FunctionDeclarations: []*genai.FunctionDeclaration{echoTool}}}
+	agent, err := InitAgentWithClient(ctx, client, nil, tools, echoCall, WithoutPreflight())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { agent.Close() })
+	return agent
+}
+
+func TestEnableContextCache(t *testing.T) {
+	examples := []*genai.Content{
+		genai.NewUserContent(genai.Text("what is 2+2?")),
+		{Role: "model", Parts: []genai.Part{genai.Text("4")}},
+	}
+	tests := []struct {
+		name     string
+		ttl      time.Duration
+		examples []*genai.Content
+		code     codes.Code
+		sent     bool
+		err      error
+	}{
+		{name: "instruction and tools", ttl: time.Hour, sent: true},
+		{name: "with examples", ttl: time.Hour, examples: examples, sent: true},
+		{name: "no ttl"},
+		{name: "examples ending on user", ttl: time.Hour, examples: examples[:1], err: ErrInvalidHistory},
+		{name: "api rejects", ttl: time.Hour, code: codes.InvalidArgument, sent: true, err: ErrModelFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := &mockCache{code: test.code}
+			agent := newCacheAgent(t, cache)
+
+			err := agent.EnableContextCache(context.Background(), test.ttl, test.examples...)
+			failed := test.err != nil || test.ttl <= 0
+			if failed != (err != nil) || (test.err != nil && !errors.Is(err, test.err)) {
+				t.Fatalf("error = %v, want %v", err, test.err)
+			}
+			requests := cache.received()
+			if sent := len(requests) == 1; sent != test.sent {
+				t.Fatalf("cache requests = %d, want sent %v", len(requests), test.sent)
+			}
+			if failed {
+				if agent.cachedModel() != nil {
+					t.Error("cache enabled after an error")
+				}
+				return
+			}
+
+			// the cache carries the tools and examples, chats use the cached model
+			if len(requests[0].Tools) != 1 {
+				t.Errorf("cached tools = %d, want the echo tool", len(requests[0].Tools))
+			}
+			if len(requests[0].Contents) != len(test.examples) {
+				t.Errorf("cached contents = %d, want %d", len(requests[0].Contents), len(test.examples))
+			}
+			if agent.cachedModel() == nil {
+				t.Fatal("no cached model")
+			}
+			agent.mu.Lock()
+			expires := agent.cache.expires
+			agent.mu.Unlock()
+			if expires.Before(time.Now()) || expires.After(time.Now().Add(test.ttl)) {
+				t.Errorf("cache expires %v, want within the ttl", expires)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Agent per-call tool routines
+/////////
+
+// returned by CallAgentWithTools for a granted tool not registered with WithGrantableTools
+var ErrToolNotGrantable = errors.New("tool not grantable")
+
+// register handlers for tools that are not declared to the model, a call offers them by granting
+// their declarations with CallAgentWithTools and they are refused on any other call
+func WithGrantableTools(funcs ...ToolFunc) Option {
+	return func(agent *Agent) {
+		for _, toolFunc := range funcs {
+			agent.handlers[toolFunc.Declaration.Name] = toolFunc.Handler
+			agent.granted[toolFunc.Declaration.Name] = true
+			if toolFunc.Final {
+				agent.finals[toolFunc.Declaration.Name] = true
+			}
+		}
+	}
+}
+
+// context key for tools granted to a single call
+type extraToolsKey struct{}
+
+// grant extra tools for a call made with ctx
+func withExtraTools(ctx context.Context, extra []*genai.Tool) context.Context {
+	return context.WithValue(ctx, extraToolsKey{}, extra)
+}
+
+// tools granted for the call, nil when none
+func extraToolsFrom(ctx context.Context) []*genai.Tool {
+	extra, _ := ctx.Value(extraToolsKey{}).([]*genai.Tool)
+	if len(extra) == 0 {
+		return nil
+	}
+	return extra
+}
+
+// call agent on the NewSession() session with extra tools offered for this call only
+// each granted tool must be registered with WithGrantableTools, its calls are routed to that
+// handler by function name. the session keeps its tools for later calls
+func (agent *Agent) CallAgentWithTools(ctx context.Context, message string, extra []*genai.Tool) (string, error) {
+	if err := agent.checkAgent(); err != nil {
+		return "", err
+	}
+	for _, tool := range extra {
+		for _, declaration := range tool.FunctionDeclarations {
+			if !agent.granted[declaration.Name] {
+				return "", fmt.Errorf("%w: %s", ErrToolNotGrantable, declaration.Name)
+			}
+		}
+	}
+	result, err := agent.callAgent(withExtraTools(ctx, extra), "", message)
+	if err != nil {
+		return "", err
+	}
+	return result.text, nil
+}
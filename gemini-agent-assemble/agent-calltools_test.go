@@ -0,0 +1,87 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// a granted tool is declared and run for one call only, later plain calls neither see nor run it
+func TestCallAgentWithTools(t *testing.T) {
+	requireModelCalls(t)
+	var runs atomic.Int32
+	stats := ToolFunc{Declaration: &genai.FunctionDeclaration{Name: "stats"}, Handler: func(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+		runs.Add(1)
+		return "7", nil
+	}}
+	mock := newMockGemini(t, callReply("stats", nil), textReply("seven"), callReply("stats", nil), textReply("no stats"))
+	agent := newMockAgent(t, mock, WithGrantableTools(stats))
+	if err := agent.NewSession(); err != nil {
+		t.Fatal(err)
+	}
+	grant := []*genai.Tool{{FunctionDeclarations: []*genai.FunctionDeclaration{stats.Declaration}}}
+
+	// the granted call declares and runs the tool
+	reply, err := agent.CallAgentWithTools(context.Background(), "question", grant)
+	if err != nil || reply != "seven" {
+		t.Fatalf("granted call = %q, %v, want seven", reply, err)
+	}
+	if runs.Load() != 1 {
+		t.Errorf("granted tool runs = %d, want 1", runs.Load())
+	}
+	for idx, req := range mock.received() {
+		if !slices.Contains(req.toolNames(), "stats") {
+			t.Errorf("granted request %d tools = %v, want stats declared", idx, req.toolNames())
+		}
+	}
+
+	// the next plain call neither declares nor runs it
+	granted := len(mock.received())
+	reply, err = agent.CallAgentContext(context.Background(), "question")
+	if err != nil || reply != "no stats" {
+		t.Fatalf("plain call = %q, %v, want no stats", reply, err)
+	}
+	if runs.Load() != 1 {
+		t.Errorf("tool runs after the plain call = %d, want 1", runs.Load())
+	}
+	for idx, req := range mock.received()[granted:] {
+		if slices.Contains(req.toolNames(), "stats") {
+			t.Errorf("plain request %d tools = %v, want stats not declared", idx, req.toolNames())
+		}
+	}
+}
+
+// only tools registered with WithGrantableTools can be granted, anything else fails before the model is called
+func TestCallAgentWithToolsNotGrantable(t *testing.T) {
+	stats := ToolFunc{Declaration: &genai.FunctionDeclaration{Name: "stats"}, Handler: func(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+		return "7", nil
+	}}
+	tests := []struct {
+		name        string
+		declaration *genai.FunctionDeclaration
+	}{
+		{name: "unregistered tool", declaration: &genai.FunctionDeclaration{Name: "other"}},
+		{name: "session tool", declaration: echoTool},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := newMockGemini(t)
+			agent := newMockAgent(t, mock, WithGrantableTools(stats))
+			if err := agent.NewSession(); err != nil {
+				t.Fatal(err)
+			}
+			grant := []*genai.Tool{{FunctionDeclarations: []*genai.FunctionDeclaration{stats.Declaration, test.declaration}}}
+			_, err := agent.CallAgentWithTools(context.Background(), "question", grant)
+			if !errors.Is(err, ErrToolNotGrantable) {
+				t.Errorf("error = %v, want ErrToolNotGrantable", err)
+			}
+			if got := len(mock.received()); got != 0 {
+				t.Errorf("model requests = %d, want 0", got)
+			}
+		})
+	}
+}
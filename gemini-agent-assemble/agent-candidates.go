@@ -0,0 +1,63 @@
+package geminiagentassemble
+
+import (
+	"context"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Agent candidate selection routines
+/////////
+
+// ask the model for several candidate replies per turn, the agent CandidateSelector picks the
+// one the call continues with
+func WithCandidateCount(count int32) Option {
+	return func(agent *Agent) {
+		agent.candidates = count
+	}
+}
+
+// send on a chat, continuing with the CandidateSelector choice when the model replies with several candidates
+func (agent *Agent) sendChat(ctx context.Context, chat *genai.ChatSession, parts ...genai.Part) (*genai.GenerateContentResponse, error) {
+	resp, err := chat.SendMessage(ctx, parts...)
+	if err != nil {
+		return resp, err
+	}
+	agent.selectCandidate(chat, resp)
+	return resp, nil
+}
+
+// true when the model replies with several candidates for a CandidateSelector to choose from
+func (agent *Agent) selectsCandidates() bool {
+	return agent.CandidateSelector != nil && agent.candidates > 1
+}
+
+// move the CandidateSelector choice first in the reply and continue the chat history with it
+func (agent *Agent) selectCandidate(chat *genai.ChatSession, resp *genai.GenerateContentResponse) {
+	if agent.CandidateSelector == nil || len(resp.Candidates) < 2 {
+		return
+	}
+	choice := agent.CandidateSelector(resp.Candidates)
+	if choice <= 0 || choice >= len(resp.Candidates) || resp.Candidates[choice].Content == nil {
+		return
+	}
+	agent.logger().Debug("candidate selected", "candidate", choice, "candidates", len(resp.Candidates))
+
+	// move the choice first and put it in the history in place of the first candidate
+	candidates := []*genai.Candidate{resp.Candidates[choice]}
+	for idx, candidate := range resp.Candidates {
+		if idx != choice {
+			candidates = append(candidates, candidate)
+		}
+	}
+	resp.Candidates = candidates
+	content := *candidates[0].Content
+	content.Role = "model"
+	last := len(chat.History) - 1
+	if last >= 0 && chat.History[last].Role == "model" {
+		chat.History[last] = &content
+	} else {
+		chat.History = append(chat.History, &content)
+	}
+}
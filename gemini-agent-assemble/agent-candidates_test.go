@@ -0,0 +1,97 @@
+package geminiagentassemble
+
+import (
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+func TestSelectCandidate(t *testing.T) {
+	// a candidate replying with the given text, no content when text is empty
+	candidate := func(text string) *genai.Candidate {
+		if text == "" {
+			return &genai.Candidate{}
+		}
+		return &genai.Candidate{Content: &genai.Content{Role: "model", Parts: []genai.Part{genai.Text(text)}}}
+	}
+	tests := []struct {
+		name       string
+		selector   func(candidates []*genai.Candidate) int
+		candidates []string
+		want       []string
+		history    string
+	}{
+		{name: "no selector", candidates: []string{"a", "b"}, want: []string{"a", "b"}, history: "a"},
+		{name: "single candidate", selector: func([]*genai.Candidate) int { return 1 }, candidates: []string{"a"}, want: []string{"a"}, history: "a"},
+		{name: "first kept", selector: func([]*genai.Candidate) int { return 0 }, candidates: []string{"a", "b"}, want: []string{"a", "b"}, history: "a"},
+		{name: "second chosen", selector: func([]*genai.Candidate) int { return 1 }, candidates: []string{"a", "b"}, want: []string{"b", "a"}, history: "b"},
+		{name: "last chosen", selector: func([]*genai.Candidate) int { return 2 }, candidates: []string{"a", "b", "c"}, want: []string{"c", "a", "b"}, history: "c"},
+		{name: "out of range", selector: func([]*genai.Candidate) int { return 5 }, candidates: []string{"a", "b"}, want: []string{"a", "b"}, history: "a"},
+		{name: "negative", selector: func([]*genai.Candidate) int { return -1 }, candidates: []string{"a", "b"}, want: []string{"a", "b"}, history: "a"},
+		{name: "no content", selector: func([]*genai.Candidate) int { return 1 }, candidates: []string{"a", ""}, want: []string{"a", ""}, history: "a"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := &Agent{CandidateSelector: test.selector}
+			resp := &genai.GenerateContentResponse{}
+			for _, text := range test.candidates {
+				resp.Candidates = append(resp.Candidates, candidate(text))
+			}
+			// the chat history as SendMessage leaves it, continued with the first candidate
+			chat := &genai.ChatSession{History: []*genai.Content{
+				genai.NewUserContent(genai.Text("hello")),
+				{Role: "model", Parts: []genai.Part{genai.Text(test.candidates[0])}},
+			}}
+
+			agent.selectCandidate(chat, resp)
+			got := []string{}
+			for _, cand := range resp.Candidates {
+				text := ""
+				if cand.Content != nil {
+					text = string(cand.Content.Parts[0].(genai.Text))
+				}
+				got = append(got, text)
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("candidates = %q, want %q", got, test.want)
+			}
+			for idx := range got {
+				if got[idx] != test.want[idx] {
+					t.Errorf("candidates = %q, want %q", got, test.want)
+					break
+				}
+			}
+			if len(chat.History) != 2 {
+				t.Fatalf("history length = %d, want 2", len(chat.History))
+			}
+			last := chat.History[1]
+			if last.Role != "model" || string(last.Parts[0].(genai.Text)) != test.history {
+				t.Errorf("history = %s %v, want model [%s]", last.Role, last.Parts, test.history)
+			}
+		})
+	}
+}
+
+func TestWithCandidateCount(t *testing.T) {
+	tests := []struct {
+		name  string
+		count int32
+		want  *int32
+	}{
+		{name: "unset"},
+		{name: "three", count: 3, want: genai.Ptr[int32](3)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var options []Option
+			if test.count != 0 {
+				options = append(options, WithCandidateCount(test.count))
+			}
+			agent := newMockAgent(t, newMockGemini(t), options...)
+			got := agent.model.CandidateCount
+			if (got == nil) != (test.want == nil) || (got != nil && *got != *test.want) {
+				t.Errorf("candidate count = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
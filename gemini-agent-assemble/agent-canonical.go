@@ -0,0 +1,178 @@
+package geminiagentassemble
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+/////////
+// Agent canonical json routines
+/////////
+
+// stable json encoding of a value for cache and dedup keys, e.g. tool call arguments
+// object keys are sorted at every level and numbers are normalized exactly, so 2, 2.0, int64(2)
+// and json.Number("2.0") encode alike while json.Number("0.10000000000000000001") and 0.1 do not,
+// strings are not html escaped
+func CanonicalJSON(value any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeCanonical(&buf, value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// write the canonical form of a value, types other than the json decoded ones are
+// round tripped through encoding/json first
+func writeCanonical(buf *bytes.Buffer, value any) error {
+	switch value := value.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(value))
+	case string:
+		return writeCanonicalString(buf, value)
+	case json.Number:
+		return writeCanonicalNumber(buf, string(value))
+	case float64:
+		return writeCanonicalFloat(buf, value)
+	case float32:
+		return writeCanonicalFloat(buf, float64(value))
+	case int, int8, int16, int32, int64:
+		buf.WriteString(strconv.FormatInt(reflect.ValueOf(value).Int(), 10))
+	case uint, uint8, uint16, uint32, uint64:
+		buf.WriteString(strconv.FormatUint(reflect.ValueOf(value).Uint(), 10))
+	case map[string]any:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		buf.WriteByte('{')
+		for idx, key := range keys {
+			if idx > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonicalString(buf, key); err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			if err := writeCanonical(buf, value[key]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case []any:
+		buf.WriteByte('[')
+		for idx, item := range value {
+			if idx > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonical(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	default:
+		// structs, typed maps and slices are decoded into the generic json types
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		var generic any
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&generic); err != nil {
+			return err
+		}
+		return writeCanonical(buf, generic)
+	}
+	return nil
+}
+
+// write a float as the canonical form of its shortest decimal
+func writeCanonicalFloat(buf *bytes.Buffer, f float64) error {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Errorf("unsupported number %v", f)
+	}
+	return writeCanonicalNumber(buf, strconv.FormatFloat(f, 'g', -1, 64))
+}
+
+// write a json number literal in an exact canonical form, normalizing the text rather than
+// parsing it so no digit is lost. leading and trailing zeros are dropped, and the value is
+// written as a plain decimal unless it is very large or small, e.g. 1.50e2 as 150, 0.0001 as
+// 0.0001 and 1e-7 as 1e-7
+func writeCanonicalNumber(buf *bytes.Buffer, literal string) error {
+	invalid := fmt.Errorf("invalid number %q", literal)
+	negative := strings.HasPrefix(literal, "-")
+	mantissa, exponent, scientific := strings.Cut(strings.ToLower(strings.TrimPrefix(literal, "-")), "e")
+	exp := 0
+	if scientific {
+		var err error
+		exp, err = strconv.Atoi(exponent)
+		if err != nil || exp > math.MaxInt32 || exp < math.MinInt32 {
+			return invalid
+		}
+	}
+	whole, fraction, point := strings.Cut(mantissa, ".")
+	if !isDigits(whole) || (point && !isDigits(fraction)) {
+		return invalid
+	}
+
+	// the significant digits and the position of the decimal point within them
+	digits := strings.TrimLeft(whole+fraction, "0")
+	place := len(whole) + exp - (len(whole) + len(fraction) - len(digits))
+	digits = strings.TrimRight(digits, "0")
+	if digits == "" {
+		buf.WriteByte('0')
+		return nil
+	}
+	if negative {
+		buf.WriteByte('-')
+	}
+	switch {
+	case place >= len(digits) && place <= 21:
+		buf.WriteString(digits + strings.Repeat("0", place-len(digits)))
+	case place > 0 && place < len(digits):
+		buf.WriteString(digits[:place] + "." + digits[place:])
+	case place <= 0 && place > -6:
+		buf.WriteString("0." + strings.Repeat("0", -place) + digits)
+	default:
+		buf.WriteString(digits[:1])
+		if len(digits) > 1 {
+			buf.WriteString("." + digits[1:])
+		}
+		buf.WriteString("e" + strconv.Itoa(place-1))
+	}
+	return nil
+}
+
+// check for a non-empty run of decimal digits
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// write a json string without html escaping
+func writeCanonicalString(buf *bytes.Buffer, s string) error {
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(s); err != nil {
+		return err
+	}
+	// drop the newline Encode adds
+	buf.Truncate(buf.Len() - 1)
+	return nil
+}
@@ -0,0 +1,153 @@
+package geminiagentassemble
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		value any
+		want  string
+	}{
+		{name: "int", value: 2, want: "2"},
+		{name: "integral float", value: 2.0, want: "2"},
+		{name: "number with a fraction of zero", value: json.Number("2.0"), want: "2"},
+		{name: "number with an exponent", value: json.Number("1.50e2"), want: "150"},
+		{name: "uppercase exponent", value: json.Number("15E1"), want: "150"},
+		{name: "negative zero", value: json.Number("-0.0"), want: "0"},
+		{name: "decimal", value: json.Number("0.10"), want: "0.1"},
+		{name: "float decimal", value: 0.1, want: "0.1"},
+		{name: "long decimal", value: json.Number("0.10000000000000000001"), want: "0.10000000000000000001"},
+		{name: "small decimal", value: json.Number("0.0001"), want: "0.0001"},
+		{name: "tiny decimal", value: json.Number("0.0000001"), want: "1e-7"},
+		{name: "tiny float", value: 1e-7, want: "1e-7"},
+		{name: "big integer", value: json.Number("12345678901234567890123"), want: "1.2345678901234567890123e22"},
+		{name: "large float", value: 1e20, want: "100000000000000000000"},
+		{name: "large number", value: json.Number("1e20"), want: "100000000000000000000"},
+		{name: "negative", value: json.Number("-12.500"), want: "-12.5"},
+		{name: "uint64", value: uint64(18446744073709551615), want: "18446744073709551615"},
+		{name: "nested keys are sorted", value: map[string]any{"b": 1, "a": map[string]any{"d": []any{true, nil}, "c": "<x>"}}, want: `{"a":{"c":"<x>","d":[true,null]},"b":1}`},
+		{name: "struct", value: struct {
+			B string `json:"b"`
+			A int    `json:"a"`
+		}{B: "x", A: 1}, want: `{"a":1,"b":"x"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := CanonicalJSON(test.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("CanonicalJSON = %s, want %s", got, test.want)
+			}
+			if !json.Valid(got) {
+				t.Errorf("CanonicalJSON = %s is not valid json", got)
+			}
+		})
+	}
+}
+
+func TestCanonicalJSONInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		value any
+	}{
+		{name: "not a number", value: json.Number("abc")},
+		{name: "empty number", value: json.Number("")},
+		{name: "missing fraction", value: json.Number("1.")},
+		{name: "huge exponent", value: json.Number("1e99999999999")},
+		{name: "float nan", value: map[string]any{"x": nanFloat()}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got, err := CanonicalJSON(test.value); err == nil {
+				t.Errorf("CanonicalJSON = %s, want an error", got)
+			}
+		})
+	}
+}
+
+func nanFloat() float64 {
+	zero := 0.0
+	return zero / zero
+}
+
+// values that differ must never share a key, however close they are as float64
+func TestCanonicalJSONCollisions(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b any
+	}{
+		{name: "decimal past float64 precision", a: json.Number("0.10000000000000000001"), b: json.Number("0.1")},
+		{name: "decimal past float64 precision against a float", a: json.Number("0.10000000000000000001"), b: 0.1},
+		{name: "big integers one apart", a: json.Number("9007199254740993"), b: json.Number("9007199254740992")},
+		{name: "big integer against its float", a: json.Number("9007199254740993"), b: float64(9007199254740993)},
+		{name: "huge integers one apart", a: json.Number("123456789012345678901234567890"), b: json.Number("123456789012345678901234567891")},
+		{name: "number against a string", a: json.Number("1"), b: "1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, err := CanonicalJSON(map[string]any{"x": test.a})
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := CanonicalJSON(map[string]any{"x": test.b})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(a) == string(b) {
+				t.Errorf("%v and %v both encode as %s", test.a, test.b, a)
+			}
+		})
+	}
+}
+
+// the same arguments built in any order give the same key
+func TestCanonicalJSONInsertionOrder(t *testing.T) {
+	keys := []string{"operator", "valueOne", "valueTwo", "precision", "nested"}
+	values := map[string]any{
+		"operator":  "+",
+		"valueOne":  json.Number("1.0"),
+		"valueTwo":  2.5,
+		"precision": 10,
+		"nested":    map[string]any{"z": 1, "a": 2},
+	}
+	build := func(order []int) map[string]any {
+		args := map[string]any{}
+		for _, idx := range order {
+			args[keys[idx]] = values[keys[idx]]
+		}
+		return args
+	}
+	orders := [][]int{{0, 1, 2, 3, 4}, {4, 3, 2, 1, 0}, {2, 0, 4, 1, 3}, {1, 3, 0, 4, 2}}
+	want := ""
+	for _, order := range orders {
+		got, err := CanonicalJSON(build(order))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want == "" {
+			want = string(got)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("order %v encodes as %s, want %s", order, got, want)
+		}
+	}
+
+	// equal calls share a dedup key, unequal ones do not
+	one := genai.FunctionCall{Name: "calc", Args: build(orders[0])}
+	two := genai.FunctionCall{Name: "calc", Args: build(orders[1])}
+	if callKey(one) != callKey(two) {
+		t.Errorf("callKey differs by insertion order: %s, %s", callKey(one), callKey(two))
+	}
+	two.Args["valueOne"] = json.Number("1.00000000000000000001")
+	if callKey(one) == callKey(two) {
+		t.Errorf("callKey collides for different values: %s", callKey(one))
+	}
+}
@@ -0,0 +1,44 @@
+package geminiagentassemble
+
+import (
+	"context"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Agent clarification routines
+/////////
+
+// name of the function the model calls to ask the caller a clarifying question
+const ClarificationTool = "requestClarification"
+
+// declaration offered to the model by WithClarification
+var clarificationDeclaration = &genai.FunctionDeclaration{
+	Name:        ClarificationTool,
+	Description: "Ask the caller a clarifying question when the request cannot be answered without more information. Use instead of replying with a question.",
+	Parameters: &genai.Schema{
+		Type: genai.TypeObject,
+		Properties: map[string]*genai.Schema{
+			"question": {
+				Type:        genai.TypeString,
+				Description: "The question for the caller",
+			},
+		},
+		Required: []string{"question"},
+	},
+}
+
+// let the model ask for clarification instead of answering, for headless agent to agent use
+// the model is offered a requestClarification tool, calling it ends the call with the question
+// as the reply and NeedsInput set on the Response so the orchestrating agent can decide what to do
+func WithClarification() Option {
+	return func(agent *Agent) {
+		WithToolFuncs(ToolFunc{Declaration: clarificationDeclaration, Handler: clarificationQuestion, Final: true})(agent)
+	}
+}
+
+// the question asked through requestClarification
+func clarificationQuestion(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+	return ArgString(funcall.Args, "question")
+}
@@ -0,0 +1,100 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+func TestClarificationQuestion(t *testing.T) {
+	tests := []struct {
+		name string
+		args map[string]any
+		want string
+		err  error
+	}{
+		{name: "question", args: map[string]any{"question": "which city?"}, want: "which city?"},
+		{name: "missing question", args: map[string]any{}, err: ErrInvalidArgs},
+		{name: "not a string", args: map[string]any{"question": []any{"which"}}, err: ErrInvalidArgs},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := clarificationQuestion(context.Background(), genai.FunctionCall{Name: ClarificationTool, Args: test.args})
+			if !errors.Is(err, test.err) {
+				t.Fatalf("error = %v, want %v", err, test.err)
+			}
+			if got != test.want {
+				t.Errorf("question = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// a clarifying question ends the call marked NeedsInput, untransformed and without another model turn
+func TestClarification(t *testing.T) {
+	requireModelCalls(t)
+	tests := []struct {
+		name       string
+		replies    []mockReply
+		content    string
+		needsInput bool
+	}{
+		{
+			name:       "question",
+			replies:    []mockReply{callReply(ClarificationTool, map[string]any{"question": "which city?"})},
+			content:    "which city?",
+			needsInput: true,
+		},
+		{
+			name:    "answer",
+			replies: []mockReply{textReply("sunny")},
+			content: "SUNNY",
+		},
+		{
+			name:    "answer after a tool",
+			replies: []mockReply{callReply("echo", map[string]any{"text": "paris"}), textReply("sunny in paris")},
+			content: "SUNNY IN PARIS",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := newMockGemini(t, test.replies...)
+			agent := newMockAgent(t, mock, WithClarification())
+			agent.ResponseTransformer = func(text string) (string, error) { return strings.ToUpper(text), nil }
+			if err := agent.NewSession(); err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/agent", strings.NewReader(`{"input":"weather?"}`))
+			req.Header.Set("Content-Type", "application/json")
+			res := httptest.NewRecorder()
+			agent.HandleAgentRequest(res, req)
+			if res.Code != http.StatusOK {
+				t.Fatalf("status = %d %q, want 200", res.Code, res.Body.String())
+			}
+			response := Response{}
+			if err := json.Unmarshal(res.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Content != test.content || response.NeedsInput != test.needsInput {
+				t.Errorf("response = %q needs input %v, want %q needs input %v", response.Content, response.NeedsInput, test.content, test.needsInput)
+			}
+			question := ""
+			if test.needsInput {
+				question = test.content
+			}
+			if response.Question != question {
+				t.Errorf("question = %q, want %q", response.Question, question)
+			}
+			if got := len(mock.received()); got != len(test.replies) {
+				t.Errorf("model requests = %d, want %d", got, len(test.replies))
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package geminiagentassemble
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/////////
+// Agent client routines
+/////////
+
+// limit on the body read from a downstream agent reply or stream
+const DefaultMaxResponseBytes = 10 << 20
+
+// call a remote agent at the full endpoint url, e.g. http://<hostname>:<port>/agent
+// the hop count from ctx is forwarded to catch agent call cycles
+func CallRemoteAgent(ctx context.Context, url string, message string) (string, error) {
+	return callRemoteAgent(ctx, DefaultHTTPClient, url, message)
+}
+
+// call a remote agent with the given http client
+func callRemoteAgent(ctx context.Context, client *http.Client, url string, message string) (string, error) {
+	message, err := beforeAgentCall(ctx, url, message)
+	if err != nil {
+		return "", err
+	}
+	response, err := postRemoteAgent(ctx, client, url, message, "", DefaultMaxResponseBytes)
+	if err != nil {
+		return "", err
+	}
+	return response.Content, nil
+}
+
+// single remote agent request with the given http client, optional bearer token and reply size limit
+func postRemoteAgent(ctx context.Context, client *http.Client, url string, message string, token string, limit int64) (Response, error) {
+
+	// build the payload
+	request := Request{
+		Input: message,
+	}
+	reqDat, err := json.Marshal(request)
+	if err != nil {
+		return Response{}, err
+	}
+
+	// prepare the request
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(reqDat))
+	if err != nil {
+		return Response{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	SetHopsHeader(ctx, req.Header)
+	SetTimeoutHeader(ctx, req.Header)
+	SetRequestIDHeader(ctx, req.Header)
+	injectTrace(ctx, req.Header)
+	setAuthHeader(req.Header, token)
+
+	// send the post, failing fast once the request budget is spent
+	if err := chainTimeout(ctx, 0); err != nil {
+		return Response{}, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if timeout := chainTimeout(ctx, 0); timeout != nil {
+			return Response{}, timeout
+		}
+		return Response{}, fmt.Errorf("%w: %v", ErrDownstreamUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if err := chainTimeout(ctx, resp.StatusCode); err != nil {
+		return Response{}, err
+	}
+	if isUnavailableStatus(resp.StatusCode) {
+		return Response{}, fmt.Errorf("%w: %s", ErrDownstreamUnavailable, resp.Status)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		// a downstream agent out of quota, passed up with its back off
+		delay, _ := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		return Response{}, &AgentError{Code: CodeQuotaExceeded, Err: fmt.Errorf("%w: downstream agent", ErrQuotaExceeded), RetryAfter: delay}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return Response{}, downstreamError(resp)
+	}
+
+	// extract and decode the reply, a body that is not a Response is a misbehaving agent
+	response := Response{}
+	respDat, err := io.ReadAll(limitBody(resp.Body, limit))
+	if err != nil {
+		return Response{}, err
+	}
+	err = JSONCodec{UseNumber: true}.Decode(bytes.NewReader(respDat), &response)
+	if err != nil {
+		return Response{}, &AgentError{Code: CodeDownstream, Err: fmt.Errorf("%w: invalid reply: %w: %s", ErrDownstreamFailed, err, excerpt(respDat))}
+	}
+
+	return response, nil
+}
+
+// bytes of a failed downstream reply body kept in its error
+const downstreamBodyExcerpt = 512
+
+// CodeDownstream error for a failed downstream reply, with its status and the start of its body
+func downstreamError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, downstreamBodyExcerpt))
+	return &AgentError{Code: CodeDownstream, Err: fmt.Errorf("%w: %s: %s", ErrDownstreamFailed, resp.Status, excerpt(body))}
+}
+
+// the start of a body for an error message
+func excerpt(body []byte) string {
+	return strings.TrimSpace(truncateUTF8(string(body), downstreamBodyExcerpt))
+}
+
+// reader over a downstream body failing with ErrResponseTooLarge past its limit
+type limitedBody struct {
+	reader io.Reader
+	read   int64
+	limit  int64
+}
+
+// cap the bytes read from a downstream body, never reading more than one byte past the limit
+func limitBody(body io.Reader, limit int64) io.Reader {
+	return &limitedBody{reader: io.LimitReader(body, limit+1), limit: limit}
+}
+
+func (body *limitedBody) Read(p []byte) (int, error) {
+	n, err := body.reader.Read(p)
+	body.read += int64(n)
+	if body.read > body.limit {
+		return n, fmt.Errorf("%w: over %d bytes", ErrResponseTooLarge, body.limit)
+	}
+	return n, err
+}
+
+// gateway and overload statuses mean the downstream agent is not serving
+func isUnavailableStatus(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// set a bearer token on an agent to agent request, nothing is set for an empty token
+func setAuthHeader(header http.Header, token string) {
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// call a remote agent by its logical name through the DefaultResolver
+func CallAgentByName(ctx context.Context, name string, message string) (string, error) {
+	url, err := DefaultResolver.Resolve(name)
+	if err != nil {
+		slog.Error(err.Error())
+		return "", err
+	}
+	slog.Info("calling agent", "name", name, "url", url)
+	response, err := (&RemoteAgent{Name: name, URL: url, Retries: DefaultRemoteRetries}).Call(ctx, message)
+	if err != nil {
+		return "", err
+	}
+	return response.Content, nil
+}
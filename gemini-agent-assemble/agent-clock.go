@@ -0,0 +1,38 @@
+package geminiagentassemble
+
+import (
+	"time"
+)
+
+/////////
+// Agent clock routines
+/////////
+
+// time source for ttls, expiry and retry backoff
+// replace with a fake clock in tests to advance time without sleeping
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// wall clock
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// clock used when an agent has no Clock set
+var RealClock Clock = realClock{}
+
+// the agent clock, the real clock when not set
+func (agent *Agent) clock() Clock {
+	if agent.Clock == nil {
+		return RealClock
+	}
+	return agent.Clock
+}
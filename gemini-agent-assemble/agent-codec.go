@@ -0,0 +1,98 @@
+package geminiagentassemble
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+/////////
+// Agent request / response codec routines
+/////////
+
+// wire format of the agent Request and Response bodies, e.g. a faster json encoder
+type Codec interface {
+	// media type of the bodies, checked against the request Content-Type
+	ContentType() string
+	Decode(r io.Reader, v any) error
+	Encode(w io.Writer, v any) error
+}
+
+// encoding/json codec, the agent default
+type JSONCodec struct {
+	// reject objects with fields the target does not have
+	DisallowUnknownFields bool
+	// decode numbers in untyped fields (e.g. inline history function call args) as json.Number
+	// instead of float64, so numbers past 2^53 keep every digit
+	UseNumber bool
+}
+
+func (codec JSONCodec) ContentType() string {
+	return "application/json"
+}
+
+func (codec JSONCodec) Decode(r io.Reader, v any) error {
+	decoder := json.NewDecoder(r)
+	if codec.DisallowUnknownFields {
+		decoder.DisallowUnknownFields()
+	}
+	if codec.UseNumber {
+		decoder.UseNumber()
+	}
+	return decoder.Decode(v)
+}
+
+func (codec JSONCodec) Encode(w io.Writer, v any) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+// the agent codec, a JSONCodec following StrictDecoding and keeping exact numbers when not set
+func (agent *Agent) codec() Codec {
+	if agent.Codec != nil {
+		return agent.Codec
+	}
+	return JSONCodec{DisallowUnknownFields: agent.StrictDecoding, UseNumber: true}
+}
+
+// check the client asked for a bare text reply with Accept: text/plain
+// the first supported media type listed wins, anything else gets the codec body
+func (agent *Agent) acceptsPlainText(req *http.Request) bool {
+	for _, accepted := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "text/plain":
+			return true
+		case agent.codec().ContentType(), "*/*", "application/*":
+			return false
+		}
+	}
+	return false
+}
+
+// write a reply, the bare content for a text/plain client otherwise the codec body
+func (agent *Agent) writeResponse(res http.ResponseWriter, plain bool, response Response) {
+	if !plain {
+		agent.writeBody(res, http.StatusOK, response)
+		return
+	}
+	res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	res.WriteHeader(http.StatusOK)
+	if _, err := io.WriteString(res, response.Content); err != nil {
+		agent.logger().Error("reply write failed", "error", err)
+	}
+}
+
+// write a reply body with the agent codec
+func (agent *Agent) writeBody(res http.ResponseWriter, status int, v any) {
+	codec := agent.codec()
+	res.Header().Set("Content-Type", codec.ContentType())
+	res.WriteHeader(status)
+	if err := codec.Encode(res, v); err != nil {
+		agent.logger().Error("reply encode failed", "error", err)
+	}
+}
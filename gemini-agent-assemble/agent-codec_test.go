@@ -0,0 +1,71 @@
+package geminiagentassemble
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptsPlainText(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{accept: "", want: false},
+		{accept: "text/plain", want: true},
+		{accept: "text/plain; charset=utf-8", want: true},
+		{accept: "application/json", want: false},
+		{accept: "application/json, text/plain", want: false},
+		{accept: "text/plain, application/json", want: true},
+		{accept: "text/html, text/plain;q=0.9", want: true},
+		{accept: "*/*", want: false},
+		{accept: "application/*, text/plain", want: false},
+		{accept: "text/html", want: false},
+		{accept: "not a media type;;, text/plain", want: true},
+	}
+	agent := &Agent{}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/agent", nil)
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		if got := agent.acceptsPlainText(req); got != test.want {
+			t.Errorf("acceptsPlainText(%q) = %v, want %v", test.accept, got, test.want)
+		}
+	}
+}
+
+func TestWriteResponse(t *testing.T) {
+	response := Response{Content: "42", Model: "gemini"}
+	tests := []struct {
+		name        string
+		plain       bool
+		contentType string
+	}{
+		{name: "codec body", contentType: "application/json"},
+		{name: "plain text", plain: true, contentType: "text/plain; charset=utf-8"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := httptest.NewRecorder()
+			(&Agent{}).writeResponse(res, test.plain, response)
+			if res.Code != http.StatusOK {
+				t.Errorf("status = %d, want 200", res.Code)
+			}
+			if got := res.Header().Get("Content-Type"); got != test.contentType {
+				t.Errorf("content type = %q, want %q", got, test.contentType)
+			}
+			if test.plain {
+				if got := res.Body.String(); got != "42" {
+					t.Errorf("body = %q, want the bare content", got)
+				}
+				return
+			}
+			got := Response{}
+			if err := json.Unmarshal(res.Body.Bytes(), &got); err != nil || got.Content != response.Content || got.Model != response.Model {
+				t.Errorf("body = %q, want the encoded response", res.Body.String())
+			}
+		})
+	}
+}
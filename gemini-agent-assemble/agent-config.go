@@ -0,0 +1,44 @@
+package geminiagentassemble
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+/////////
+// Agent configuration routines
+/////////
+
+// returned when required environment configuration is missing or malformed
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+// required environment variable, Port values must be numeric and in the tcp port range
+type EnvVar struct {
+	Name string
+	Port bool
+}
+
+// check every required environment variable up front
+// all missing or malformed values are reported together in one error
+func ValidateEnv(vars ...EnvVar) error {
+	var problems []error
+	for _, envVar := range vars {
+		value, ok := os.LookupEnv(envVar.Name)
+		if !ok || value == "" {
+			problems = append(problems, fmt.Errorf("environment variable %s not set", envVar.Name))
+			continue
+		}
+		if envVar.Port {
+			port, err := strconv.Atoi(value)
+			if err != nil || port < 1 || port > 65535 {
+				problems = append(problems, fmt.Errorf("environment variable %s is not a valid port: %q", envVar.Name, value))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w:\n%w", ErrInvalidConfig, errors.Join(problems...))
+	}
+	return nil
+}
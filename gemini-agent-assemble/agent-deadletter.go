@@ -0,0 +1,88 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/////////
+// Agent dead-letter routines
+/////////
+
+// request header carrying the caller request id, one is generated when absent
+const RequestIDHeader = "X-Request-ID"
+
+// input recorded in place of the request input when RedactDeadLetters is set
+const redactedInput = "[redacted]"
+
+// failed request record passed to the agent DeadLetter hook
+type FailedRequest struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	SessionID string    `json:"session_id,omitempty"`
+	Input     string    `json:"input"`
+	Status    int       `json:"status"`
+	Error     string    `json:"error"`
+}
+
+// dead-letter hook writing each failed request as a json line to w, e.g. a log file
+func DeadLetterWriter(w io.Writer) func(FailedRequest) {
+	var mu sync.Mutex
+	return func(record FailedRequest) {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		w.Write(append(data, '\n'))
+	}
+}
+
+// the request id from the request header, or a new one
+func requestID(req *http.Request) string {
+	if id := req.Header.Get(RequestIDHeader); id != "" {
+		return id
+	}
+	id, _ := newSessionID()
+	return id
+}
+
+// context key for the id of the request being served
+type requestIDKey struct{}
+
+// carry the request id in ctx so downstream agent calls are correlated with it
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// set the outbound request id header on an agent to agent request to the id of the request
+// being served, so one id follows a request through every agent hop
+func SetRequestIDHeader(ctx context.Context, header http.Header) {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok && id != "" {
+		header.Set(RequestIDHeader, id)
+	}
+}
+
+// pass a failed request to the DeadLetter hook
+func (agent *Agent) deadLetter(id string, reqBody *Request, status int, err error) {
+	if agent.DeadLetter == nil {
+		return
+	}
+	input := reqBody.Input
+	if agent.RedactDeadLetters {
+		input = redactedInput
+	}
+	agent.DeadLetter(FailedRequest{
+		Time:      agent.clock().Now(),
+		RequestID: id,
+		SessionID: reqBody.SessionID,
+		Input:     input,
+		Status:    status,
+		Error:     err.Error(),
+	})
+}
@@ -0,0 +1,39 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+/////////
+// Agent dependency routines
+/////////
+
+// time between health polls of a dependency that is not ready
+const DefaultDependencyPoll = time.Second
+
+// wait for the downstream agents at the endpoint urls, e.g. http://<hostname>:<port>/agent, to
+// reply ok on their <base path>/health route. the agent health route replies 503 until they all
+// have, and stays unavailable if ctx expires first
+func (agent *Agent) WaitForDependencies(ctx context.Context, endpoints []string) error {
+	if err := agent.checkAgent(); err != nil {
+		agent.logger().Error(err.Error())
+		return err
+	}
+	agent.waiting.Store(true)
+	for _, url := range endpoints {
+		for !isHealthy(ctx, DefaultHTTPClient, url) {
+			agent.logger().Info("waiting for dependency", "url", url)
+			select {
+			case <-agent.clock().After(DefaultDependencyPoll):
+			case <-ctx.Done():
+				agent.logger().Error("dependency not ready", "url", url)
+				return fmt.Errorf("%w: %s: %w", ErrDownstreamUnavailable, url, ctx.Err())
+			}
+		}
+		agent.logger().Info("dependency ready", "url", url)
+	}
+	agent.waiting.Store(false)
+	return nil
+}
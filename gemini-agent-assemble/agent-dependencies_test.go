@@ -0,0 +1,87 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dependency whose health route fails the given number of probes before replying ok, -1 never does
+func newDependency(t *testing.T, failures int32) (string, *atomic.Int32) {
+	var probes atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/health" {
+			http.NotFound(res, req)
+			return
+		}
+		if probe := probes.Add(1); failures < 0 || probe <= failures {
+			http.Error(res, "Service Unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/agent", &probes
+}
+
+func TestWaitForDependencies(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures []int32
+		timeout  time.Duration
+		probes   []int32
+		wantErr  error
+		health   string // health route reply, empty when ok
+	}{
+		{name: "no dependencies"},
+		{name: "all ready", failures: []int32{0, 0}, probes: []int32{1, 1}},
+		{name: "ready after polls", failures: []int32{2, 1}, probes: []int32{3, 2}},
+		{name: "never ready", failures: []int32{0, -1}, timeout: 100 * time.Millisecond, wantErr: ErrDownstreamUnavailable, health: "Waiting For Dependencies"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := newFakeClock()
+			done := make(chan struct{})
+			defer close(done)
+			clock.autoAdvance(DefaultDependencyPoll, done)
+			agent := newMockAgent(t, newMockGemini(t))
+			agent.Clock = clock
+			endpoints := []string{}
+			probes := []*atomic.Int32{}
+			for _, failures := range test.failures {
+				url, count := newDependency(t, failures)
+				endpoints = append(endpoints, url)
+				probes = append(probes, count)
+			}
+
+			ctx := context.Background()
+			if test.timeout > 0 {
+				// real time, the fake clock only paces the polls
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.timeout)
+				defer cancel()
+			}
+			err := agent.WaitForDependencies(ctx, endpoints)
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("error = %v, want %v", err, test.wantErr)
+			}
+			if test.wantErr != nil && !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("error = %v, want the context error", err)
+			}
+			for idx, want := range test.probes {
+				if got := probes[idx].Load(); got != want {
+					t.Errorf("dependency %d probes = %d, want %d", idx, got, want)
+				}
+			}
+
+			res := httptest.NewRecorder()
+			agent.HandleHealthRequest(res, httptest.NewRequest(http.MethodGet, "/health", nil))
+			if got := strings.TrimSpace(res.Body.String()); got != test.health {
+				t.Errorf("health = %d %q, want %q", res.Code, got, test.health)
+			}
+		})
+	}
+}
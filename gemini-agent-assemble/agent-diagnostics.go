@@ -0,0 +1,36 @@
+package geminiagentassemble
+
+/////////
+// Agent response diagnostics routines
+/////////
+
+// how a reply was generated, returned on a Response when the request sets "diagnostics"
+type Diagnostics struct {
+	// model that served the reply, after any fallback
+	Model string `json:"model"`
+	// model turns that called tools before the reply
+	Iterations int `json:"iterations"`
+	// retries of an overloaded or rate limited model
+	Retries int `json:"retries"`
+	// regenerations of an empty reply
+	EmptyRetries int `json:"empty_retries"`
+	// moves down the agent FallbackModels
+	Fallbacks int `json:"fallbacks"`
+	// finish reason of the final model reply, e.g. FinishReasonStop
+	FinishReason string `json:"finish_reason,omitempty"`
+}
+
+// diagnostics of a call
+func (result *callResult) diagnostics() *Diagnostics {
+	diagnostics := &Diagnostics{
+		Model:        result.model,
+		Iterations:   result.iterations,
+		Retries:      result.retries,
+		EmptyRetries: result.empty,
+		Fallbacks:    result.fallbacks,
+	}
+	if result.raw != nil && len(result.raw.Candidates) > 0 {
+		diagnostics.FinishReason = result.raw.Candidates[0].FinishReason.String()
+	}
+	return diagnostics
+}
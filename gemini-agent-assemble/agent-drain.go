@@ -0,0 +1,66 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+)
+
+/////////
+// Agent connection draining routines
+/////////
+
+// stop accepting new agent requests and wait until the in-flight ones finish or ctx is done
+// new requests get 503 with a Retry-After and /health reports 503, so a calling AgentClient
+// fails over to another replica, use before stopping a replica during a rollout
+func (agent *Agent) Drain(ctx context.Context) error {
+	if err := agent.checkAgent(); err != nil {
+		return err
+	}
+	agent.mu.Lock()
+	if agent.draining == nil {
+		agent.draining = make(chan struct{})
+		if agent.active == 0 {
+			close(agent.draining)
+		}
+		agent.logger().Info("agent draining", "in_flight", agent.active)
+	}
+	drained := agent.draining
+	agent.mu.Unlock()
+
+	select {
+	case <-drained:
+		agent.logger().Info("agent drained")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// true once Drain has been called
+func (agent *Agent) isDraining() bool {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	return agent.draining != nil
+}
+
+// count a request as in flight, writing the 503 reply when the agent is draining
+// the returned function must be called when the request ends
+func (agent *Agent) beginRequest(res http.ResponseWriter) (func(), bool) {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	if agent.draining != nil {
+		res.Header().Set("Retry-After", strconv.Itoa(inFlightRetryAfter))
+		http.Error(res, "Service Unavailable: draining", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	agent.active++
+	return func() {
+		agent.mu.Lock()
+		defer agent.mu.Unlock()
+		agent.active--
+		if agent.active == 0 && agent.draining != nil {
+			close(agent.draining)
+		}
+	}, true
+}
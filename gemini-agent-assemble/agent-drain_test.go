@@ -0,0 +1,90 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Drain waits for the in-flight requests, new ones and the health route get 503 from the start
+func TestDrain(t *testing.T) {
+	tests := []struct {
+		name     string
+		inFlight int
+		finish   bool // the in-flight requests end while draining
+		err      error
+	}{
+		{name: "idle"},
+		{name: "in flight requests finish", inFlight: 2, finish: true},
+		{name: "in flight requests outlast ctx", inFlight: 1, err: context.DeadlineExceeded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newMockAgent(t, newMockGemini(t))
+			ends := []func(){}
+			for range test.inFlight {
+				end, ok := agent.beginRequest(httptest.NewRecorder())
+				if !ok {
+					t.Fatal("request refused before draining")
+				}
+				ends = append(ends, end)
+			}
+
+			timeout := 50 * time.Millisecond
+			if test.finish {
+				timeout = 10 * time.Second
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			drained := make(chan error, 1)
+			go func() { drained <- agent.Drain(ctx) }()
+			waitDraining(t, agent)
+
+			// new work is refused while draining
+			res := httptest.NewRecorder()
+			if _, ok := agent.beginRequest(res); ok {
+				t.Error("request accepted while draining")
+			}
+			if res.Code != http.StatusServiceUnavailable || res.Header().Get("Retry-After") != strconv.Itoa(inFlightRetryAfter) {
+				t.Errorf("new request = %d Retry-After %q, want 503 with a Retry-After", res.Code, res.Header().Get("Retry-After"))
+			}
+			health := httptest.NewRecorder()
+			agent.HandleHealthRequest(health, httptest.NewRequest(http.MethodGet, "/health", nil))
+			if health.Code != http.StatusServiceUnavailable || !strings.Contains(health.Body.String(), "Draining") {
+				t.Errorf("health = %d %q, want 503 draining", health.Code, health.Body.String())
+			}
+
+			if test.finish {
+				for _, end := range ends {
+					end()
+				}
+			}
+			if err := <-drained; !errors.Is(err, test.err) {
+				t.Errorf("Drain error = %v, want %v", err, test.err)
+			}
+			// a second Drain waits on the same requests
+			if test.err == nil {
+				if err := agent.Drain(context.Background()); err != nil {
+					t.Errorf("second Drain error = %v, want nil", err)
+				}
+			}
+		})
+	}
+}
+
+// wait until Drain has started
+func waitDraining(t *testing.T, agent *Agent) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !agent.isDraining() {
+		if time.Now().After(deadline) {
+			t.Fatal("agent not draining")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,84 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Agent dry run routines
+/////////
+
+// the request a call would send to the model, returned by BuildRequest
+type DryRun struct {
+	Model             string                       `json:"model"`
+	SystemInstruction string                       `json:"system_instruction,omitempty"`
+	Tools             []*genai.FunctionDeclaration `json:"tools,omitempty"`
+	History           []Turn                       `json:"history"`
+	Input             Turn                         `json:"input"`
+	// estimate from CountTokens of the system instruction, tools, history and input
+	EstimatedTokens int32 `json:"estimated_tokens"`
+}
+
+// assemble what a call on the session with the given id would send to the model, without generating
+// for prompt debugging and pre-flight cost checks. ctx options such as WithAttachments apply as they
+// would to the call. an empty id is the NewSession() session. only the token count reaches the api,
+// it is an estimate as the count api takes the history turns as a single input
+func (agent *Agent) BuildRequest(ctx context.Context, sessionID string, message string) (*DryRun, error) {
+	if err := agent.checkAgent(); err != nil {
+		return nil, err
+	}
+	sess, err := agent.lookupSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	message = agent.prepareInput(message)
+
+	// resolve the model as the call would, under the session lock for a consistent history
+	sess.mu.Lock()
+	restore := agent.overrideTurn(ctx, sess)
+	name := agent.modelName
+	if agent.ModelRouter != nil {
+		if routed := agent.ModelRouter(message); routed != "" {
+			name = routed
+		}
+	}
+	model := agent.sessionModel(sess, name)
+	history := append([]*genai.Content(nil), sess.chat.History...)
+	restore()
+	sess.mu.Unlock()
+
+	input := genai.NewUserContent(inputParts(ctx, message)...)
+	dryRun := &DryRun{
+		Model:   name,
+		History: historyToTurns(history),
+		Input:   historyToTurns([]*genai.Content{input})[0],
+	}
+	if model.SystemInstruction != nil {
+		var system []string
+		for _, part := range model.SystemInstruction.Parts {
+			if text, ok := part.(genai.Text); ok {
+				system = append(system, string(text))
+			}
+		}
+		dryRun.SystemInstruction = strings.Join(system, "\n")
+	}
+	for _, tool := range model.Tools {
+		dryRun.Tools = append(dryRun.Tools, tool.FunctionDeclarations...)
+	}
+
+	// count the whole request, the model adds its system instruction and tools
+	var parts []genai.Part
+	for _, content := range history {
+		parts = append(parts, content.Parts...)
+	}
+	parts = append(parts, input.Parts...)
+	resp, err := model.CountTokens(ctx, parts...)
+	if err != nil {
+		return nil, wrapModelError(err)
+	}
+	dryRun.EstimatedTokens = resp.TotalTokens
+	return dryRun, nil
+}
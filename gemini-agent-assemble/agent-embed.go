@@ -0,0 +1,181 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Agent embedding and token counting routines
+/////////
+
+// embedding model used by Embed when the agent EmbeddingModel is not set
+const DefaultEmbeddingModel = "text-embedding-004"
+
+// largest batch the embedding api accepts in one request
+const MaxEmbedBatch = 100
+
+// upstream embedding requests and the texts they carried, served at <base path>/metrics
+var (
+	embedRequestsMetric = expvar.NewMap("agent_embed_requests")
+	embedTextsMetric    = expvar.NewMap("agent_embed_texts")
+)
+
+// embed a text with the agent EmbeddingModel
+// with EnableEmbedBatching concurrent calls are coalesced into batched upstream requests
+func (agent *Agent) Embed(ctx context.Context, text string) ([]float32, error) {
+	if err := agent.checkAgent(); err != nil {
+		return nil, err
+	}
+	agent.mu.Lock()
+	batcher := agent.embedder
+	agent.mu.Unlock()
+	if batcher == nil {
+		values, err := agent.embedBatch(ctx, []string{text})
+		if err != nil {
+			return nil, err
+		}
+		return values[0], nil
+	}
+	return batcher.embed(ctx, text)
+}
+
+// count the tokens of a text on the agent model
+// the api returns one total per request, so counts are not batched
+func (agent *Agent) CountTokens(ctx context.Context, text string) (int32, error) {
+	if err := agent.checkAgent(); err != nil {
+		return 0, err
+	}
+	resp, err := agent.model.CountTokens(ctx, genai.Text(text))
+	if err != nil {
+		return 0, wrapModelError(err)
+	}
+	return resp.TotalTokens, nil
+}
+
+// coalesce concurrent Embed calls made within window into one upstream request of up to size texts
+// a full batch is sent at once, a zero size uses MaxEmbedBatch
+func (agent *Agent) EnableEmbedBatching(window time.Duration, size int) error {
+	if err := agent.checkAgent(); err != nil {
+		return err
+	}
+	if window <= 0 {
+		return errors.New("embed batching window must be positive")
+	}
+	if size <= 0 || size > MaxEmbedBatch {
+		size = MaxEmbedBatch
+	}
+	agent.mu.Lock()
+	agent.embedder = &embedBatcher{agent: agent, window: window, size: size}
+	agent.mu.Unlock()
+	agent.logger().Info("embed batching enabled", "window", window, "size", size)
+	return nil
+}
+
+// one upstream embedding request for the texts, in order
+func (agent *Agent) embedBatch(ctx context.Context, texts []string) ([][]float32, error) {
+	name := agent.EmbeddingModel
+	if name == "" {
+		name = DefaultEmbeddingModel
+	}
+	model := agent.Client.EmbeddingModel(name)
+	batch := model.NewBatch()
+	for _, text := range texts {
+		batch.AddContent(genai.Text(text))
+	}
+	embedRequestsMetric.Add(agent.metricLabel(), 1)
+	embedTextsMetric.Add(agent.metricLabel(), int64(len(texts)))
+	resp, err := model.BatchEmbedContents(ctx, batch)
+	if err != nil {
+		return nil, wrapModelError(err)
+	}
+	if len(resp.Embeddings) != len(texts) {
+		return nil, fmt.Errorf("%w: %d embeddings for %d texts", ErrModelFailed, len(resp.Embeddings), len(texts))
+	}
+	values := make([][]float32, len(texts))
+	for idx, embedding := range resp.Embeddings {
+		values[idx] = embedding.Values
+	}
+	return values, nil
+}
+
+// Embed call waiting on a batch
+type embedCall struct {
+	text   string
+	values []float32
+	err    error
+	done   chan struct{}
+}
+
+// pending Embed calls, sent when the window closes or the batch is full
+type embedBatcher struct {
+	agent   *Agent
+	window  time.Duration
+	size    int
+	mu      sync.Mutex
+	pending []*embedCall
+	timer   *time.Timer
+}
+
+// add a text to the pending batch and wait for its embedding
+func (batcher *embedBatcher) embed(ctx context.Context, text string) ([]float32, error) {
+	call := &embedCall{text: text, done: make(chan struct{})}
+	batcher.mu.Lock()
+	batcher.pending = append(batcher.pending, call)
+	switch {
+	case len(batcher.pending) >= batcher.size:
+		batcher.flushLocked()
+	case len(batcher.pending) == 1:
+		batcher.timer = time.AfterFunc(batcher.window, batcher.flush)
+	}
+	batcher.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.values, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// send the pending batch when the window closes
+func (batcher *embedBatcher) flush() {
+	batcher.mu.Lock()
+	defer batcher.mu.Unlock()
+	batcher.flushLocked()
+}
+
+// send the pending batch, the batcher mutex must be held
+// the request runs on the agent context so one caller giving up does not fail the others
+func (batcher *embedBatcher) flushLocked() {
+	if batcher.timer != nil {
+		batcher.timer.Stop()
+		batcher.timer = nil
+	}
+	calls := batcher.pending
+	batcher.pending = nil
+	if len(calls) == 0 {
+		return
+	}
+	go func() {
+		texts := make([]string, len(calls))
+		for idx, call := range calls {
+			texts[idx] = call.text
+		}
+		values, err := batcher.agent.embedBatch(batcher.agent.ctx, texts)
+		for idx, call := range calls {
+			if err != nil {
+				call.err = err
+			} else {
+				call.values = values[idx]
+			}
+			close(call.done)
+		}
+	}()
+}
@@ -0,0 +1,164 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// concurrent Embed calls are coalesced into batches, each caller getting the embedding of its own text
+func TestEmbed(t *testing.T) {
+	texts := []string{"a", "bb", "ccc", "dddd"}
+	tests := []struct {
+		name    string
+		size    int // batch size, 0 sends each call on its own
+		flush   bool
+		status  int
+		batches []int
+		err     error
+	}{
+		{name: "unbatched", batches: []int{1, 1, 1, 1}},
+		{name: "full batches", size: 2, batches: []int{2, 2}},
+		{name: "window closes", size: MaxEmbedBatch, flush: true, batches: []int{4}},
+		{name: "oversized batch capped", size: MaxEmbedBatch + 1, flush: true, batches: []int{4}},
+		{name: "unbatched api error", status: http.StatusInternalServerError, batches: []int{1, 1, 1, 1}, err: ErrModelFailed},
+		{name: "batched api error", size: 4, status: http.StatusInternalServerError, batches: []int{4}, err: ErrModelFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := newMockGemini(t)
+			mock.embedError = test.status
+			agent := newMockAgent(t, mock)
+			if test.size > 0 {
+				// the window never closes by itself, the test flushes once every call is pending
+				if err := agent.EnableEmbedBatching(time.Hour, test.size); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var wg sync.WaitGroup
+			errs := make([]error, len(texts))
+			values := make([][]float32, len(texts))
+			for idx, text := range texts {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					values[idx], errs[idx] = agent.Embed(context.Background(), text)
+				}()
+			}
+			if test.flush {
+				waitEmbedPending(t, agent, len(texts))
+				agent.embedder.flush()
+			}
+			wg.Wait()
+
+			for idx, text := range texts {
+				if !errors.Is(errs[idx], test.err) {
+					t.Errorf("Embed(%q) error = %v, want %v", text, errs[idx], test.err)
+					continue
+				}
+				if test.err == nil && (len(values[idx]) != 1 || values[idx][0] != float32(len(text))) {
+					t.Errorf("Embed(%q) = %v, want [%d]", text, values[idx], len(text))
+				}
+			}
+			sizes := []int{}
+			for _, batch := range mock.embedded() {
+				sizes = append(sizes, len(batch))
+			}
+			sort.Ints(sizes)
+			if len(sizes) != len(test.batches) {
+				t.Fatalf("batches = %v, want %v", sizes, test.batches)
+			}
+			for idx := range sizes {
+				if sizes[idx] != test.batches[idx] {
+					t.Errorf("batches = %v, want %v", sizes, test.batches)
+					break
+				}
+			}
+		})
+	}
+}
+
+// wait until count Embed calls are pending in the batch
+func waitEmbedPending(t *testing.T, agent *Agent, count int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		agent.embedder.mu.Lock()
+		pending := len(agent.embedder.pending)
+		agent.embedder.mu.Unlock()
+		if pending == count {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pending embed calls = %d, want %d", pending, count)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestEnableEmbedBatching(t *testing.T) {
+	tests := []struct {
+		name   string
+		window time.Duration
+		size   int
+		want   int
+		err    bool
+	}{
+		{name: "size", window: time.Second, size: 10, want: 10},
+		{name: "default size", window: time.Second, want: MaxEmbedBatch},
+		{name: "size capped", window: time.Second, size: MaxEmbedBatch * 2, want: MaxEmbedBatch},
+		{name: "no window", size: 10, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newMockAgent(t, newMockGemini(t))
+			err := agent.EnableEmbedBatching(test.window, test.size)
+			if (err != nil) != test.err {
+				t.Fatalf("error = %v, want error %v", err, test.err)
+			}
+			if test.err {
+				if agent.embedder != nil {
+					t.Error("batching enabled after an error")
+				}
+				return
+			}
+			if agent.embedder.size != test.want || agent.embedder.window != test.window {
+				t.Errorf("batching = %d per %v, want %d per %v", agent.embedder.size, agent.embedder.window, test.want, test.window)
+			}
+		})
+	}
+}
+
+func TestCountTokens(t *testing.T) {
+	tests := []struct {
+		name   string
+		tokens int
+		status int
+		want   int32
+		err    error
+	}{
+		{name: "count", tokens: 7, want: 7},
+		{name: "empty text", tokens: 0, want: 0},
+		{name: "api error", status: http.StatusInternalServerError, err: ErrModelFailed},
+		{name: "quota", status: http.StatusTooManyRequests, err: ErrQuotaExceeded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := newMockGemini(t)
+			agent := newMockAgent(t, mock)
+			mock.tokens, mock.countError = test.tokens, test.status
+			got, err := agent.CountTokens(context.Background(), "some text")
+			if !errors.Is(err, test.err) {
+				t.Fatalf("error = %v, want %v", err, test.err)
+			}
+			if got != test.want {
+				t.Errorf("tokens = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/googleapi"
+)
+
+/////////
+// Agent error routines
+/////////
+
+// agent state errors
+var (
+	ErrAgentNotInitialized = errors.New("agent not initialized. run InitAgent() first")
+	ErrAgentClosed         = errors.New("agent closed")
+)
+
+// agent startup errors from the init preflight check
+var (
+	// the gemini api rejected the api key, it is invalid, expired or lacks access to the model
+	ErrInvalidCredentials = errors.New("gemini api credentials rejected")
+	// the gemini api could not be reached, e.g. no network, dns failure or a proxy refusing the connection
+	ErrAPIUnreachable = errors.New("gemini api unreachable")
+)
+
+// agent call errors, returned errors wrap these so errors.Is can classify them
+var (
+	// the prompt or the response was blocked by the model safety filters
+	ErrBlockedByFilter = errors.New("blocked by content filter")
+	// the model request failed
+	ErrModelFailed = errors.New("model request failed")
+	// a tool handler returned an error
+	ErrToolFailed = errors.New("tool call failed")
+	// the agent client could not reach a downstream agent or it is overloaded
+	ErrDownstreamUnavailable = errors.New("downstream agent unavailable")
+	// a downstream agent reply was over the client size limit
+	ErrResponseTooLarge = errors.New("downstream response too large")
+	// the model kept calling tools past the loop limit
+	ErrMaxIterations = errors.New("message cycles exceeded")
+	// the model kept replying with no text and no function call
+	ErrEmptyResponse = errors.New("empty model response")
+	// the reply was over the agent MaxResponseLength with TruncateError set
+	ErrResponseTooLong = errors.New("response too long")
+	// the model kept answering directly with EnforceToolUse set
+	ErrToolNotUsed = errors.New("model answered without calling a tool")
+	// the request deadline passed here or at a downstream agent in the chain
+	ErrChainTimeout = errors.New("request deadline exceeded")
+	// a downstream agent replied with an error status or a body that is not a Response
+	ErrDownstreamFailed = errors.New("downstream agent failed")
+	// the gemini api quota or rate limit stayed exhausted after any retries
+	ErrQuotaExceeded = errors.New("quota exceeded")
+)
+
+// category of an agent error
+type ErrorCode string
+
+const (
+	CodeCancelled  ErrorCode = "cancelled"
+	CodeModelError ErrorCode = "model_error"
+	CodeTimeout    ErrorCode = "timeout"
+	// the api quota is exhausted, monitoring can alert on it and clients back off for RetryAfter
+	CodeQuotaExceeded ErrorCode = "quota_exceeded"
+	// a downstream agent misbehaved, replying with an error or an unreadable body
+	CodeDownstream ErrorCode = "downstream"
+)
+
+// agent error carrying a category code, the underlying error is kept for errors.Is / errors.As
+type AgentError struct {
+	Code ErrorCode
+	Err  error
+	// wait before retrying asked for by the api, 0 when not known
+	RetryAfter time.Duration
+}
+
+func (agentErr *AgentError) Error() string {
+	return string(agentErr.Code) + ": " + agentErr.Err.Error()
+}
+
+func (agentErr *AgentError) Unwrap() error {
+	return agentErr.Err
+}
+
+// tool call made by a generation loop, reported when the loop gives up
+type ToolCallTrace struct {
+	Name   string         `json:"name"`
+	Args   map[string]any `json:"args,omitempty"`
+	Result string         `json:"result,omitempty"`
+	Error  string         `json:"error,omitempty"`
+}
+
+// returned when the model keeps calling tools past the loop limit, wrapping ErrMaxIterations
+// with the work done so far so callers can still show something useful
+type MaxIterationsError struct {
+	// best available text, the text the model wrote alongside its tool calls or else the last tool result
+	Partial string
+	// tool calls made in order
+	Calls []ToolCallTrace
+}
+
+func (maxErr *MaxIterationsError) Error() string {
+	return fmt.Sprintf("%s after %d tool calls", ErrMaxIterations.Error(), len(maxErr.Calls))
+}
+
+func (maxErr *MaxIterationsError) Unwrap() error {
+	return ErrMaxIterations
+}
+
+// max iterations error from the interim text and tool calls of a loop
+func maxIterationsError(interim []string, calls []ToolCallTrace) error {
+	partial := strings.Join(interim, "\n")
+	if partial == "" && len(calls) > 0 {
+		last := calls[len(calls)-1]
+		partial = last.Result
+	}
+	return &MaxIterationsError{Partial: partial, Calls: calls}
+}
+
+// trace of a tool call and the response sent back to the model
+func traceToolCall(funcall genai.FunctionCall, result genai.Part) ToolCallTrace {
+	trace := ToolCallTrace{Name: funcall.Name, Args: funcall.Args}
+	if response, ok := result.(genai.FunctionResponse); ok {
+		trace.Result, _ = response.Response["result"].(string)
+		trace.Error, _ = response.Response["error"].(string)
+	}
+	return trace
+}
+
+// get the code of an agent error, empty when err is not an AgentError
+func ErrorCodeOf(err error) ErrorCode {
+	var agentErr *AgentError
+	if errors.As(err, &agentErr) {
+		return agentErr.Code
+	}
+	return ""
+}
+
+// classify a genai request error
+func wrapModelError(err error) error {
+	var blocked *genai.BlockedError
+	if errors.As(err, &blocked) {
+		return fmt.Errorf("%w: %w", ErrBlockedByFilter, err)
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusTooManyRequests {
+		delay, _ := retryDelay(apiErr, time.Now())
+		return &AgentError{Code: CodeQuotaExceeded, Err: fmt.Errorf("%w: %w", ErrQuotaExceeded, err), RetryAfter: delay}
+	}
+	return fmt.Errorf("%w: %w", ErrModelFailed, err)
+}
+
+// classify a preflight error as rejected credentials, an unreachable api or a model request failure
+func wrapStartupError(err error) error {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		if isCredentialsError(apiErr) {
+			return fmt.Errorf("%w: %w", ErrInvalidCredentials, err)
+		}
+		return wrapModelError(err)
+	}
+	var netErr net.Error
+	var urlErr *url.Error
+	if errors.As(err, &netErr) || errors.As(err, &urlErr) {
+		return fmt.Errorf("%w: %w", ErrAPIUnreachable, err)
+	}
+	return err
+}
+
+// 401 and 403 replies, and the 400 the gemini api sends for a malformed or unknown api key
+func isCredentialsError(apiErr *googleapi.Error) bool {
+	switch apiErr.Code {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return true
+	case http.StatusBadRequest:
+		for _, detail := range apiErr.Details {
+			info, ok := detail.(map[string]any)
+			if ok && info["reason"] == "API_KEY_INVALID" {
+				return true
+			}
+		}
+		return strings.Contains(apiErr.Message, "API key not valid")
+	}
+	return false
+}
+
+// ask the client to back off for the RetryAfter of an agent error, e.g. an exhausted quota
+func setRetryAfter(res http.ResponseWriter, err error) {
+	var agentErr *AgentError
+	if errors.As(err, &agentErr) && agentErr.RetryAfter > 0 {
+		res.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(agentErr.RetryAfter.Seconds()))))
+	}
+}
+
+// classify the error of a failed call by how its context ended, a cancelled call is CodeCancelled
+// and one past its deadline CodeTimeout unless the error already carries a code
+func contextError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return &AgentError{Code: CodeCancelled, Err: err}
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) && ErrorCodeOf(err) == "" {
+		return &AgentError{Code: CodeTimeout, Err: err}
+	}
+	return err
+}
+
+// map an agent call error to the http reply status
+func errorStatus(ctx context.Context, err error) int {
+	switch {
+	case ErrorCodeOf(err) == CodeCancelled:
+		return http.StatusConflict
+	case ErrorCodeOf(err) == CodeQuotaExceeded:
+		return http.StatusTooManyRequests
+	case ErrorCodeOf(err) == CodeDownstream:
+		return http.StatusBadGateway
+	case ErrorCodeOf(err) == CodeTimeout, deadlineExceeded(ctx, err):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ErrAgentNotInitialized), errors.Is(err, ErrAgentClosed):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrSessionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrBlockedByFilter):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrDownstreamUnavailable):
+		return http.StatusBadGateway
+	case errors.Is(err, ErrModelFailed), errors.Is(err, ErrToolFailed), errors.Is(err, ErrMaxIterations), errors.Is(err, ErrResponseTooLong),
+		errors.Is(err, ErrToolNotUsed):
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
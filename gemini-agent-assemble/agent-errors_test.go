@@ -0,0 +1,214 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+func TestMaxIterationsError(t *testing.T) {
+	calls := []ToolCallTrace{
+		{Name: "lookup", Args: map[string]any{"city": "Paris"}, Result: "12C"},
+		{Name: "lookup", Args: map[string]any{"city": "Rome"}, Error: "tool timed out"},
+		{Name: "convert", Result: "54F"},
+	}
+	tests := []struct {
+		name    string
+		interim []string
+		calls   []ToolCallTrace
+		partial string
+	}{
+		{name: "interim text", interim: []string{"checking Paris", "now Rome"}, calls: calls, partial: "checking Paris\nnow Rome"},
+		{name: "last tool result", calls: calls, partial: "54F"},
+		{name: "last call failed", calls: calls[:2], partial: ""},
+		{name: "nothing done", partial: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := fmt.Errorf("call failed: %w", maxIterationsError(test.interim, test.calls))
+			if !errors.Is(err, ErrMaxIterations) {
+				t.Errorf("%v does not match ErrMaxIterations", err)
+			}
+			var maxErr *MaxIterationsError
+			if !errors.As(err, &maxErr) {
+				t.Fatalf("%v is not a MaxIterationsError", err)
+			}
+			if maxErr.Partial != test.partial {
+				t.Errorf("partial = %q, want %q", maxErr.Partial, test.partial)
+			}
+			if len(maxErr.Calls) != len(test.calls) {
+				t.Errorf("calls = %d, want %d", len(maxErr.Calls), len(test.calls))
+			}
+			if want := fmt.Sprintf("message cycles exceeded after %d tool calls", len(test.calls)); maxErr.Error() != want {
+				t.Errorf("error = %q, want %q", maxErr.Error(), want)
+			}
+		})
+	}
+}
+
+func TestContextError(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	failed := errors.New("failed")
+	coded := &AgentError{Code: CodeDownstream, Err: failed}
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		code ErrorCode
+	}{
+		{name: "live", ctx: context.Background(), err: failed},
+		{name: "cancelled", ctx: cancelled, err: failed, code: CodeCancelled},
+		{name: "cancelled with a code", ctx: cancelled, err: coded, code: CodeCancelled},
+		{name: "deadline", ctx: expired, err: failed, code: CodeTimeout},
+		{name: "deadline with a code", ctx: expired, err: coded, code: CodeDownstream},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := contextError(test.ctx, test.err)
+			if got := ErrorCodeOf(err); got != test.code {
+				t.Errorf("code = %q, want %q", got, test.code)
+			}
+			if !errors.Is(err, failed) {
+				t.Errorf("error = %v, want it wrapped", err)
+			}
+		})
+	}
+}
+
+func TestTraceToolCall(t *testing.T) {
+	funcall := genai.FunctionCall{Name: "lookup", Args: map[string]any{"city": "Paris"}}
+	tests := []struct {
+		name   string
+		result genai.Part
+		want   ToolCallTrace
+	}{
+		{name: "result", result: genai.FunctionResponse{Name: "lookup", Response: map[string]any{"result": "12C"}}, want: ToolCallTrace{Name: "lookup", Result: "12C"}},
+		{name: "error", result: genai.FunctionResponse{Name: "lookup", Response: map[string]any{"error": "failed"}}, want: ToolCallTrace{Name: "lookup", Error: "failed"}},
+		{name: "not a function response", result: genai.Text("x"), want: ToolCallTrace{Name: "lookup"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := traceToolCall(funcall, test.result)
+			if got.Name != test.want.Name || got.Result != test.want.Result || got.Error != test.want.Error || got.Args["city"] != "Paris" {
+				t.Errorf("trace = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+// a model that never stops calling tools ends with the work done so far
+func TestCallAgentMaxIterations(t *testing.T) {
+	requireModelCalls(t)
+	mock := newMockGemini(t, joinReplies(textReply("let me check"), callReply("echo", map[string]any{"text": "result 0"})))
+	for idx := 1; idx <= 25; idx++ {
+		mock.push(callReply("echo", map[string]any{"text": fmt.Sprintf("result %d", idx)}))
+	}
+	agent := newMockAgent(t, mock)
+	if err := agent.NewSession(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := agent.CallAgentContext(context.Background(), "loop forever")
+	var maxErr *MaxIterationsError
+	if !errors.As(err, &maxErr) || !errors.Is(err, ErrMaxIterations) {
+		t.Fatalf("error = %v, want a MaxIterationsError", err)
+	}
+	if maxErr.Partial != "let me check" {
+		t.Errorf("partial = %q, want the interim text", maxErr.Partial)
+	}
+	if len(maxErr.Calls) != 25 {
+		t.Fatalf("calls = %d, want 25", len(maxErr.Calls))
+	}
+	for idx, call := range maxErr.Calls {
+		if want := fmt.Sprintf("result %d", idx); call.Name != "echo" || call.Result != want || call.Args["text"] != want {
+			t.Errorf("call %d = %+v, want echo %q", idx, call, want)
+		}
+	}
+	if status := errorStatus(context.Background(), err); status != http.StatusInternalServerError {
+		t.Errorf("http status = %d, want 500", status)
+	}
+}
+
+// each error category reaches callers as its sentinel and code, and http clients as its status
+func TestErrorCategories(t *testing.T) {
+	downstream := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		http.Error(res, "Unauthorized", http.StatusUnauthorized)
+	}))
+	defer downstream.Close()
+	tests := []struct {
+		name    string
+		reply   mockReply
+		timeout time.Duration
+		cancel  bool // the tool cancels the call while it runs
+		err     error
+		code    ErrorCode
+		status  int
+	}{
+		{name: "filtered", reply: blockedReply(), err: ErrBlockedByFilter, status: http.StatusUnprocessableEntity},
+		{name: "cancelled", reply: callReply("wait", nil), cancel: true, err: context.Canceled, code: CodeCancelled, status: http.StatusConflict},
+		{name: "quota", reply: errorReply(http.StatusTooManyRequests), err: ErrQuotaExceeded, code: CodeQuotaExceeded, status: http.StatusTooManyRequests},
+		{name: "downstream", reply: callReply("remote", nil), err: ErrDownstreamFailed, code: CodeDownstream, status: http.StatusBadGateway},
+		{name: "timeout", reply: callReply("wait", nil), timeout: 20 * time.Millisecond, err: context.DeadlineExceeded, code: CodeTimeout, status: http.StatusGatewayTimeout},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.reply.status == 0 {
+				requireModelCalls(t)
+			}
+			// a fresh agent and call context for each route, the tools end the call as the test asks
+			start := func() (*Agent, context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				if test.timeout > 0 {
+					ctx, cancel = context.WithTimeout(ctx, test.timeout)
+				}
+				wait := ToolFunc{Declaration: &genai.FunctionDeclaration{Name: "wait"}, Handler: func(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+					if test.cancel {
+						cancel()
+					}
+					<-ctx.Done()
+					return "", ctx.Err()
+				}}
+				remote := ToolFunc{Declaration: &genai.FunctionDeclaration{Name: "remote"}, Handler: func(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+					response, err := (&RemoteAgent{URL: downstream.URL, HTTPClient: downstream.Client()}).Call(ctx, "question")
+					return response.Content, err
+				}}
+				agent := newMockAgent(t, newMockGemini(t, test.reply), WithToolFuncs(wait, remote))
+				agent.ModelRetries = 0
+				if err := agent.NewSession(); err != nil {
+					t.Fatal(err)
+				}
+				return agent, ctx, cancel
+			}
+
+			agent, ctx, cancel := start()
+			defer cancel()
+			_, err := agent.CallAgentContext(ctx, "question")
+			if !errors.Is(err, test.err) {
+				t.Errorf("error = %v, want %v", err, test.err)
+			}
+			if got := ErrorCodeOf(err); got != test.code {
+				t.Errorf("code = %q, want %q", got, test.code)
+			}
+
+			agent, ctx, cancel = start()
+			defer cancel()
+			req := httptest.NewRequest(http.MethodPost, "/agent", strings.NewReader(`{"input":"question"}`)).WithContext(ctx)
+			req.Header.Set("Content-Type", "application/json")
+			res := httptest.NewRecorder()
+			agent.HandleAgentRequest(res, req)
+			if res.Code != test.status {
+				t.Errorf("http status = %d, want %d: %s", res.Code, test.status, res.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/googleapi"
+)
+
+/////////
+// Agent model retry and fallback routines
+/////////
+
+// default retries of an overloaded model and the first retry delay, doubled on each retry
+const (
+	DefaultModelRetries = 2
+	DefaultModelBackoff = time.Second
+)
+
+// default retries of an empty model reply and the delay before each
+const (
+	DefaultEmptyRetries = 2
+	DefaultEmptyBackoff = 200 * time.Millisecond
+)
+
+// check for a reply with no text and no function call
+func isEmptyResponse(resp *genai.GenerateContentResponse) bool {
+	if resp == nil || len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
+		return true
+	}
+	for _, part := range resp.Candidates[0].Content.Parts {
+		switch part := part.(type) {
+		case genai.FunctionCall:
+			return false
+		case genai.Text:
+			if strings.TrimSpace(string(part)) != "" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// check for a model overloaded or rate limited reply
+func isOverloaded(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && (apiErr.Code == http.StatusServiceUnavailable || apiErr.Code == http.StatusTooManyRequests)
+}
+
+// wait before a retry, returning early when ctx is done
+// a Retry-After on the failed reply sets the wait, otherwise the exponential backoff is jittered
+// so agents failing together do not retry together
+func (agent *Agent) waitBackoff(ctx context.Context, retry int, err error) {
+	delay, ok := agent.retryAfter(err)
+	if !ok {
+		backoff := DefaultModelBackoff << (retry - 1)
+		delay = backoff/2 + rand.N(backoff/2+1)
+	}
+	select {
+	case <-agent.clock().After(delay):
+	case <-ctx.Done():
+	}
+}
+
+// wait requested by a failed reply, see retryDelay
+func (agent *Agent) retryAfter(err error) (time.Duration, bool) {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return 0, false
+	}
+	return retryDelay(apiErr, agent.clock().Now())
+}
+
+// wait requested by the Retry-After header of a failed reply, in seconds or as an http date,
+// or else by the google.rpc.RetryInfo detail of the error body
+func retryDelay(apiErr *googleapi.Error, now time.Time) (time.Duration, bool) {
+	if delay, ok := parseRetryAfter(apiErr.Header.Get("Retry-After"), now); ok {
+		return delay, true
+	}
+	for _, detail := range apiErr.Details {
+		info, ok := detail.(map[string]any)
+		if !ok || info["@type"] != "type.googleapis.com/google.rpc.RetryInfo" {
+			continue
+		}
+		value, _ := info["retryDelay"].(string)
+		if delay, err := time.ParseDuration(value); err == nil && delay >= 0 {
+			return delay, true
+		}
+	}
+	return 0, false
+}
+
+// parse a Retry-After header value in seconds or as an http date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
+}
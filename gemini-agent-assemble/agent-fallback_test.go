@@ -0,0 +1,202 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// an overloaded model is retried, then each fallback model is tried in turn
+func TestModelRetryAndFallback(t *testing.T) {
+	tests := []struct {
+		name      string
+		retries   int
+		fallbacks []string
+		replies   []mockReply
+		model     bool
+		models    []string
+		err       bool
+	}{
+		{
+			name:    "retries exhausted",
+			retries: 2,
+			replies: []mockReply{errorReply(http.StatusServiceUnavailable), errorReply(http.StatusServiceUnavailable), errorReply(http.StatusServiceUnavailable)},
+			models:  []string{DefaultModel, DefaultModel, DefaultModel},
+			err:     true,
+		},
+		{
+			name:      "fallbacks in order",
+			fallbacks: []string{"gemini-a", "gemini-b"},
+			replies:   []mockReply{errorReply(http.StatusTooManyRequests), errorReply(http.StatusTooManyRequests), errorReply(http.StatusTooManyRequests)},
+			models:    []string{DefaultModel, "gemini-a", "gemini-b"},
+			err:       true,
+		},
+		{
+			name:      "retries on each fallback",
+			retries:   1,
+			fallbacks: []string{"gemini-a"},
+			replies:   []mockReply{errorReply(http.StatusServiceUnavailable), errorReply(http.StatusServiceUnavailable), errorReply(http.StatusServiceUnavailable), errorReply(http.StatusServiceUnavailable)},
+			models:    []string{DefaultModel, DefaultModel, "gemini-a", "gemini-a"},
+			err:       true,
+		},
+		{
+			name:      "bad request is not retried",
+			retries:   2,
+			fallbacks: []string{"gemini-a"},
+			replies:   []mockReply{errorReply(http.StatusBadRequest)},
+			models:    []string{DefaultModel},
+			err:       true,
+		},
+		{
+			name:      "fallback answers",
+			retries:   1,
+			fallbacks: []string{"gemini-a"},
+			replies:   []mockReply{errorReply(http.StatusServiceUnavailable), errorReply(http.StatusServiceUnavailable), textReply("42")},
+			model:     true,
+			models:    []string{DefaultModel, DefaultModel, "gemini-a"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.model {
+				requireModelCalls(t)
+			}
+			mock := newMockGemini(t, test.replies...)
+			agent := newMockAgent(t, mock)
+			agent.ModelRetries, agent.FallbackModels = test.retries, test.fallbacks
+			clock := newFakeClock()
+			done := make(chan struct{})
+			defer close(done)
+			clock.autoAdvance(time.Minute, done)
+			agent.Clock = clock
+			if err := agent.NewSession(); err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := agent.callAgent(context.Background(), "", "question")
+			if test.err != (err != nil) {
+				t.Fatalf("error = %v, want error %v", err, test.err)
+			}
+			var models []string
+			for _, req := range mock.received() {
+				models = append(models, req.Model)
+			}
+			if strings.Join(models, ",") != strings.Join(test.models, ",") {
+				t.Errorf("models = %v, want %v", models, test.models)
+			}
+			if err == nil && (result.text != "42" || result.model != "gemini-a" || result.retries != 1 || result.fallbacks != 1) {
+				t.Errorf("result = %q from %s, %d retries, %d fallbacks", result.text, result.model, result.retries, result.fallbacks)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	retryInfo := func(delay string) []any {
+		return []any{map[string]any{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": delay}}
+	}
+	tests := []struct {
+		name    string
+		header  string
+		details []any
+		delay   time.Duration
+		ok      bool
+	}{
+		{name: "none"},
+		{name: "seconds", header: "30", delay: 30 * time.Second, ok: true},
+		{name: "http date", header: now.Add(time.Minute).Format(http.TimeFormat), delay: time.Minute, ok: true},
+		{name: "past date", header: now.Add(-time.Minute).Format(http.TimeFormat), ok: true},
+		{name: "negative seconds", header: "-5"},
+		{name: "garbage", header: "soon"},
+		{name: "retry info", details: retryInfo("1.5s"), delay: 1500 * time.Millisecond, ok: true},
+		{name: "header before retry info", header: "2", details: retryInfo("9s"), delay: 2 * time.Second, ok: true},
+		{name: "bad retry info", details: retryInfo("later")},
+		{name: "other detail", details: []any{map[string]any{"@type": "type.googleapis.com/google.rpc.ErrorInfo"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			apiErr := &googleapi.Error{Code: http.StatusTooManyRequests, Header: http.Header{}, Details: test.details}
+			if test.header != "" {
+				apiErr.Header.Set("Retry-After", test.header)
+			}
+			delay, ok := retryDelay(apiErr, now)
+			if delay != test.delay || ok != test.ok {
+				t.Errorf("delay = %v, %v, want %v, %v", delay, ok, test.delay, test.ok)
+			}
+		})
+	}
+}
+
+// the delay a backoff waits on the clock
+func backoffDelay(t *testing.T, agent *Agent, clock *fakeClock, retry int, err error) time.Duration {
+	t.Helper()
+	waited := make(chan struct{})
+	go func() {
+		defer close(waited)
+		agent.waitBackoff(context.Background(), retry, err)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for clock.Waiting() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("backoff is not waiting on the clock")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	clock.mu.Lock()
+	delay := clock.waiters[0].at.Sub(clock.now)
+	clock.mu.Unlock()
+	clock.Advance(delay)
+	<-waited
+	return delay
+}
+
+// the backoff follows a requested Retry-After, otherwise it doubles with jitter
+func TestWaitBackoff(t *testing.T) {
+	header := func(value string) error {
+		return &googleapi.Error{Code: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {value}}}
+	}
+	tests := []struct {
+		name     string
+		retry    int
+		err      error
+		min, max time.Duration
+	}{
+		{name: "first retry", retry: 1, err: errors.New("overloaded"), min: DefaultModelBackoff / 2, max: DefaultModelBackoff},
+		{name: "second retry", retry: 2, err: &googleapi.Error{Code: http.StatusServiceUnavailable}, min: DefaultModelBackoff, max: 2 * DefaultModelBackoff},
+		{name: "third retry", retry: 3, min: 2 * DefaultModelBackoff, max: 4 * DefaultModelBackoff},
+		{name: "retry after", retry: 1, err: header("7"), min: 7 * time.Second, max: 7 * time.Second},
+		{name: "retry after over the backoff", retry: 3, err: header("1"), min: time.Second, max: time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := newFakeClock()
+			agent := newMockAgent(t, newMockGemini(t))
+			agent.Clock = clock
+			delays := map[time.Duration]bool{}
+			for sample := 0; sample < 20; sample++ {
+				delay := backoffDelay(t, agent, clock, test.retry, test.err)
+				if delay < test.min || delay > test.max {
+					t.Fatalf("delay = %v, want %v to %v", delay, test.min, test.max)
+				}
+				delays[delay] = true
+			}
+			// a jittered backoff spreads the retries of agents failing together
+			if test.min != test.max && len(delays) < 2 {
+				t.Errorf("delays = %v, want jitter", delays)
+			}
+		})
+	}
+
+	// a cancelled call stops waiting
+	agent := newMockAgent(t, newMockGemini(t))
+	agent.Clock = newFakeClock()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	agent.waitBackoff(ctx, 1, nil)
+}
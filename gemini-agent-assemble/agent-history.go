@@ -0,0 +1,106 @@
+package geminiagentassemble
+
+import (
+	"context"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Agent inline history routines
+/////////
+
+// json form of a conversation turn carried in stateless requests and responses
+type Turn struct {
+	Role  string     `json:"role"`
+	Parts []TurnPart `json:"parts"`
+}
+
+// json form of a turn part, one of the fields is set
+type TurnPart struct {
+	Text             string                  `json:"text,omitempty"`
+	FunctionCall     *genai.FunctionCall     `json:"function_call,omitempty"`
+	FunctionResponse *genai.FunctionResponse `json:"function_response,omitempty"`
+}
+
+// call agent statelessly on the supplied prior turns, nothing is kept on the server
+// the history must alternate user and model turns, the updated history is returned for the next call
+func (agent *Agent) CallAgentWithHistory(ctx context.Context, history []*genai.Content, message string) (string, []*genai.Content, error) {
+	if err := agent.checkAgent(); err != nil {
+		return "", nil, err
+	}
+	result, updated, err := agent.callAgentHistory(ctx, history, message)
+	if err != nil {
+		return "", nil, err
+	}
+	return result.text, updated, nil
+}
+
+// run the graph flow on a throwaway session seeded with the history
+func (agent *Agent) callAgentHistory(ctx context.Context, history []*genai.Content, message string) (result *callResult, updated []*genai.Content, err error) {
+	requestsMetric.Add(agent.metricLabel(), 1)
+	defer func() {
+		if err != nil {
+			errorsMetric.Add(agent.metricLabel(), 1)
+		}
+	}()
+
+	// check the agent is usable
+	if err := agent.checkAgent(); err != nil {
+		agent.logger().Error(err.Error())
+		return nil, nil, err
+	}
+	if err := validateHistory(history); err != nil {
+		agent.logger().Error(err.Error())
+		return nil, nil, err
+	}
+
+	// copy the history so the caller can reuse their slice
+	sess := &session{chat: agent.model.StartChat()}
+	sess.chat.History = append([]*genai.Content(nil), history...)
+	result, err = agent.callSession(ctx, sess, message)
+	if err != nil {
+		return nil, nil, err
+	}
+	return result, sess.chat.History, nil
+}
+
+// convert request turns to genai history
+func turnsToHistory(turns []Turn) []*genai.Content {
+	history := []*genai.Content{}
+	for _, turn := range turns {
+		content := &genai.Content{Role: turn.Role}
+		for _, part := range turn.Parts {
+			switch {
+			case part.FunctionCall != nil:
+				content.Parts = append(content.Parts, *part.FunctionCall)
+			case part.FunctionResponse != nil:
+				content.Parts = append(content.Parts, *part.FunctionResponse)
+			default:
+				content.Parts = append(content.Parts, genai.Text(part.Text))
+			}
+		}
+		history = append(history, content)
+	}
+	return history
+}
+
+// convert genai history to response turns, parts other than text and function calls are dropped
+func historyToTurns(history []*genai.Content) []Turn {
+	turns := []Turn{}
+	for _, content := range history {
+		turn := Turn{Role: content.Role}
+		for _, part := range content.Parts {
+			switch part := part.(type) {
+			case genai.Text:
+				turn.Parts = append(turn.Parts, TurnPart{Text: string(part)})
+			case genai.FunctionCall:
+				turn.Parts = append(turn.Parts, TurnPart{FunctionCall: &part})
+			case genai.FunctionResponse:
+				turn.Parts = append(turn.Parts, TurnPart{FunctionResponse: &part})
+			}
+		}
+		turns = append(turns, turn)
+	}
+	return turns
+}
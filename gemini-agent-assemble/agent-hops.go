@@ -0,0 +1,65 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+/////////
+// Agent hop tracking routines
+/////////
+
+// header carrying the number of agent to agent hops a request has travelled
+const HopsHeader = "X-Agent-Hops"
+
+// default maximum hops accepted by an agent service
+const DefaultMaxHops = 8
+
+// returned when a request has travelled more than MaxHops agents
+var ErrMaxHopsExceeded = errors.New("maximum agent hops exceeded. possible agent call cycle")
+
+// context key for the inbound hop count
+type hopsKey struct{}
+
+// attach the inbound hop count to a context
+func WithHops(ctx context.Context, hops int) context.Context {
+	return context.WithValue(ctx, hopsKey{}, hops)
+}
+
+// get the inbound hop count from a context, 0 when not set
+func HopsFromContext(ctx context.Context) int {
+	hops, ok := ctx.Value(hopsKey{}).(int)
+	if !ok {
+		return 0
+	}
+	return hops
+}
+
+// set the outbound hop header on an agent to agent request
+// the inbound hop count from ctx is forwarded incremented by one
+func SetHopsHeader(ctx context.Context, header http.Header) {
+	header.Set(HopsHeader, strconv.Itoa(HopsFromContext(ctx)+1))
+}
+
+// read the inbound hop header and return the request context carrying it and any caller trace,
+// so a call ends when its client goes away. an error reply is written when the hop count is
+// invalid or exceeds MaxHops
+func (agent *Agent) checkHops(res http.ResponseWriter, req *http.Request) (context.Context, bool) {
+	hops := 0
+	if value := req.Header.Get(HopsHeader); value != "" {
+		var err error
+		hops, err = strconv.Atoi(value)
+		if err != nil || hops < 0 {
+			http.Error(res, "Bad Request", http.StatusBadRequest)
+			return nil, false
+		}
+	}
+	if agent.MaxHops > 0 && hops > agent.MaxHops {
+		agent.logger().Warn(ErrMaxHopsExceeded.Error(), "hops", hops)
+		http.Error(res, ErrMaxHopsExceeded.Error(), http.StatusLoopDetected)
+		return nil, false
+	}
+	return extractTrace(WithHops(req.Context(), hops), req.Header), true
+}
@@ -0,0 +1,83 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestCheckHops(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		maxHops int
+		hops    int
+		status  int
+	}{
+		{name: "no header", maxHops: DefaultMaxHops, hops: 0},
+		{name: "under the limit", header: "3", maxHops: DefaultMaxHops, hops: 3},
+		{name: "at the limit", header: "8", maxHops: DefaultMaxHops, hops: 8},
+		{name: "over the limit", header: "9", maxHops: DefaultMaxHops, status: http.StatusLoopDetected},
+		{name: "no limit", header: "100", maxHops: 0, hops: 100},
+		{name: "not a number", header: "many", maxHops: DefaultMaxHops, status: http.StatusBadRequest},
+		{name: "negative", header: "-1", maxHops: DefaultMaxHops, status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newMockAgent(t, newMockGemini(t))
+			agent.MaxHops = test.maxHops
+			req := httptest.NewRequest(http.MethodPost, "/agent", nil)
+			if test.header != "" {
+				req.Header.Set(HopsHeader, test.header)
+			}
+			res := httptest.NewRecorder()
+
+			ctx, ok := agent.checkHops(res, req)
+			if test.status != 0 {
+				if ok || res.Code != test.status {
+					t.Fatalf("ok = %v, status = %d, want %d", ok, res.Code, test.status)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("rejected with %d", res.Code)
+			}
+			if got := HopsFromContext(ctx); got != test.hops {
+				t.Errorf("hops = %d, want %d", got, test.hops)
+			}
+			header := http.Header{}
+			SetHopsHeader(ctx, header)
+			if got, want := header.Get(HopsHeader), strconv.Itoa(test.hops+1); got != want {
+				t.Errorf("outbound hops = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+// the call context is the request context, ending when the client goes away
+func TestCheckHopsUsesRequestContext(t *testing.T) {
+	agent := newMockAgent(t, newMockGemini(t))
+	type valueKey struct{}
+	reqCtx, cancel := context.WithCancel(context.WithValue(context.Background(), valueKey{}, "request"))
+	req := httptest.NewRequest(http.MethodPost, "/agent", nil).WithContext(reqCtx)
+	req.Header.Set(HopsHeader, "2")
+
+	ctx, ok := agent.checkHops(httptest.NewRecorder(), req)
+	if !ok {
+		t.Fatal("rejected")
+	}
+	if ctx.Value(valueKey{}) != "request" {
+		t.Error("request context values are lost")
+	}
+	if HopsFromContext(ctx) != 2 {
+		t.Errorf("hops = %d, want 2", HopsFromContext(ctx))
+	}
+	cancel()
+	select {
+	case <-ctx.Done():
+	default:
+		t.Error("call context outlives the request")
+	}
+}
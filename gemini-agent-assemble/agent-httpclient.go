@@ -0,0 +1,134 @@
+package geminiagentassemble
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+)
+
+/////////
+// Agent inter-agent http client routines
+/////////
+
+// default limits for agent to agent calls so a downstream that never replies cannot hang the caller
+const (
+	DefaultClientTimeout = 30 * time.Second
+	DefaultDialTimeout   = 5 * time.Second
+)
+
+// default connection reuse for agent to agent calls, sized for many calls to few downstream agents
+// the stdlib keeps 2 idle connections per host, so a busy caller opens and closes a connection for
+// most calls and can run out of ephemeral ports
+const (
+	DefaultMaxIdleConns        = 256
+	DefaultMaxIdleConnsPerHost = 64
+	DefaultIdleConnTimeout     = 90 * time.Second
+	DefaultKeepAlive           = 30 * time.Second
+)
+
+// inter-agent http client limits
+type clientConfig struct {
+	timeout         time.Duration
+	dialTimeout     time.Duration
+	idleTotal       int
+	idlePerHost     int
+	idleConnTimeout time.Duration
+	keepAlive       time.Duration
+	http2           bool
+}
+
+// optional inter-agent http client configuration
+type ClientOption func(config *clientConfig)
+
+// total time allowed for a call including reading the reply, 0 disables the limit
+func WithClientTimeout(timeout time.Duration) ClientOption {
+	return func(config *clientConfig) {
+		config.timeout = timeout
+	}
+}
+
+// time allowed to connect to the downstream agent
+func WithDialTimeout(timeout time.Duration) ClientOption {
+	return func(config *clientConfig) {
+		config.dialTimeout = timeout
+	}
+}
+
+// idle connections kept open per downstream agent for reuse and how long they are kept
+func WithIdleConns(perHost int, timeout time.Duration) ClientOption {
+	return func(config *clientConfig) {
+		config.idlePerHost = perHost
+		config.idleConnTimeout = timeout
+	}
+}
+
+// idle connections kept open over all downstream agents
+func WithMaxIdleConns(total int) ClientOption {
+	return func(config *clientConfig) {
+		config.idleTotal = total
+	}
+}
+
+// interval of the tcp keep-alive probes on agent connections, negative disables them
+func WithKeepAlive(interval time.Duration) ClientOption {
+	return func(config *clientConfig) {
+		config.keepAlive = interval
+	}
+}
+
+// negotiate HTTP/2 with https downstream agents, on by default
+func WithHTTP2(enabled bool) ClientOption {
+	return func(config *clientConfig) {
+		config.http2 = enabled
+	}
+}
+
+// create an inter-agent http client, by default limited to DefaultClientTimeout per call
+// and DefaultDialTimeout per connection, keeping DefaultMaxIdleConnsPerHost idle connections
+// per downstream agent and DefaultMaxIdleConns in all for DefaultIdleConnTimeout
+func NewHTTPClient(options ...ClientOption) *http.Client {
+	config := clientConfig{
+		timeout:         DefaultClientTimeout,
+		dialTimeout:     DefaultDialTimeout,
+		idleTotal:       DefaultMaxIdleConns,
+		idlePerHost:     DefaultMaxIdleConnsPerHost,
+		idleConnTimeout: DefaultIdleConnTimeout,
+		keepAlive:       DefaultKeepAlive,
+		http2:           true,
+	}
+	for _, apply := range options {
+		apply(&config)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   config.dialTimeout,
+		KeepAlive: config.keepAlive,
+	}).DialContext
+	transport.ResponseHeaderTimeout = config.timeout
+	transport.MaxIdleConnsPerHost = config.idlePerHost
+	transport.MaxIdleConns = config.idleTotal
+	if config.idleTotal > 0 {
+		// a total under the per host limit would cap it, 0 is unlimited
+		transport.MaxIdleConns = max(config.idleTotal, config.idlePerHost)
+	}
+	transport.IdleConnTimeout = config.idleConnTimeout
+	transport.ForceAttemptHTTP2 = config.http2
+	if !config.http2 {
+		// a non-nil empty map turns off the HTTP/2 upgrade
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   config.timeout,
+	}
+}
+
+// client used by CallRemoteAgent and CallAgentByName, replace to change the limits
+var DefaultHTTPClient = NewHTTPClient()
+
+// client for streamed replies, the body may be read for longer than the call timeout
+// so only the connection and first response are limited
+func streamHTTPClient() *http.Client {
+	return &http.Client{Transport: DefaultHTTPClient.Transport}
+}
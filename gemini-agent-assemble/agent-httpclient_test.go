@@ -0,0 +1,344 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewHTTPClient(t *testing.T) {
+	tests := []struct {
+		name        string
+		options     []ClientOption
+		timeout     time.Duration
+		idlePerHost int
+		idleTotal   int
+		idleTimeout time.Duration
+		http2       bool
+	}{
+		{name: "defaults", timeout: DefaultClientTimeout, idlePerHost: DefaultMaxIdleConnsPerHost, idleTotal: DefaultMaxIdleConns, idleTimeout: DefaultIdleConnTimeout, http2: true},
+		{name: "timeout", options: []ClientOption{WithClientTimeout(time.Second)}, timeout: time.Second, idlePerHost: DefaultMaxIdleConnsPerHost, idleTotal: DefaultMaxIdleConns, idleTimeout: DefaultIdleConnTimeout, http2: true},
+		{name: "no timeout", options: []ClientOption{WithClientTimeout(0)}, idlePerHost: DefaultMaxIdleConnsPerHost, idleTotal: DefaultMaxIdleConns, idleTimeout: DefaultIdleConnTimeout, http2: true},
+		{name: "idle conns", options: []ClientOption{WithIdleConns(8, time.Minute)}, timeout: DefaultClientTimeout, idlePerHost: 8, idleTotal: DefaultMaxIdleConns, idleTimeout: time.Minute, http2: true},
+		{name: "total under per host", options: []ClientOption{WithIdleConns(100, time.Minute), WithMaxIdleConns(10)}, timeout: DefaultClientTimeout, idlePerHost: 100, idleTotal: 100, idleTimeout: time.Minute, http2: true},
+		{name: "unlimited total", options: []ClientOption{WithMaxIdleConns(0)}, timeout: DefaultClientTimeout, idlePerHost: DefaultMaxIdleConnsPerHost, idleTimeout: DefaultIdleConnTimeout, http2: true},
+		{name: "no http2", options: []ClientOption{WithHTTP2(false)}, timeout: DefaultClientTimeout, idlePerHost: DefaultMaxIdleConnsPerHost, idleTotal: DefaultMaxIdleConns, idleTimeout: DefaultIdleConnTimeout},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := NewHTTPClient(test.options...)
+			transport := client.Transport.(*http.Transport)
+			if client.Timeout != test.timeout || transport.ResponseHeaderTimeout != test.timeout {
+				t.Errorf("timeout = %v / %v, want %v", client.Timeout, transport.ResponseHeaderTimeout, test.timeout)
+			}
+			if transport.MaxIdleConnsPerHost != test.idlePerHost || transport.MaxIdleConns != test.idleTotal {
+				t.Errorf("idle conns = %d per host, %d total, want %d, %d", transport.MaxIdleConnsPerHost, transport.MaxIdleConns, test.idlePerHost, test.idleTotal)
+			}
+			if transport.IdleConnTimeout != test.idleTimeout {
+				t.Errorf("idle timeout = %v, want %v", transport.IdleConnTimeout, test.idleTimeout)
+			}
+			if transport.ForceAttemptHTTP2 != test.http2 || (transport.TLSNextProto != nil) == test.http2 {
+				t.Errorf("http2 = %v, want %v", transport.ForceAttemptHTTP2, test.http2)
+			}
+		})
+	}
+}
+
+// the agent client negotiates HTTP/2 with an https downstream agent unless it is turned off
+func TestHTTPClientProtocol(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []ClientOption
+		proto   int
+	}{
+		{name: "default", proto: 2},
+		{name: "http2 on", options: []ClientOption{WithHTTP2(true)}, proto: 2},
+		{name: "http2 off", options: []ClientOption{WithHTTP2(false)}, proto: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var proto atomic.Int32
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				proto.Store(int32(req.ProtoMajor))
+				res.Header().Set("Content-Type", "application/json")
+				res.Write([]byte(`{"content":"42"}`))
+			}))
+			server.EnableHTTP2 = true
+			server.StartTLS()
+			defer server.Close()
+
+			client := NewHTTPClient(test.options...)
+			client.Transport.(*http.Transport).TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+			remote := &RemoteAgent{URL: server.URL, HTTPClient: client}
+			if _, err := remote.Call(context.Background(), "question"); err != nil {
+				t.Fatal(err)
+			}
+			if got := int(proto.Load()); got != test.proto {
+				t.Errorf("protocol = HTTP/%d, want HTTP/%d", got, test.proto)
+			}
+		})
+	}
+}
+
+// a downstream that never replies is cut off by the client timeout and retried as unavailable
+func TestHTTPClientTimeout(t *testing.T) {
+	var attempts atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		attempts.Add(1)
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	clock := newFakeClock()
+	done := make(chan struct{})
+	defer close(done)
+	clock.autoAdvance(DefaultRemoteBackoff, done)
+	remote := &RemoteAgent{
+		URL:        server.URL,
+		HTTPClient: NewHTTPClient(WithClientTimeout(50 * time.Millisecond)),
+		Retries:    2,
+		Clock:      clock,
+	}
+
+	start := time.Now()
+	_, err := remote.Call(context.Background(), "question")
+	if !errors.Is(err, ErrDownstreamUnavailable) {
+		t.Fatalf("error = %v, want ErrDownstreamUnavailable", err)
+	}
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("attempts = %d, want 3", got)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("call took %v, the timeout did not apply", elapsed)
+	}
+}
+
+// calls fail over to the next replica while one is unavailable
+func TestAgentClientFailover(t *testing.T) {
+	tests := []struct {
+		name     string
+		replicas []int
+		err      error
+		served   int
+	}{
+		{name: "healthy", replicas: []int{http.StatusOK, http.StatusOK}, served: 1},
+		{name: "first unavailable", replicas: []int{http.StatusServiceUnavailable, http.StatusOK}, served: 2},
+		{name: "first unreachable", replicas: []int{0, http.StatusOK}, served: 1},
+		{name: "all unavailable", replicas: []int{http.StatusServiceUnavailable, http.StatusBadGateway}, err: ErrDownstreamUnavailable, served: 2},
+		{name: "client error is not retried", replicas: []int{http.StatusBadRequest, http.StatusOK}, err: ErrDownstreamFailed, served: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var served atomic.Int32
+			var urls []string
+			for _, status := range test.replicas {
+				if status == 0 {
+					// nothing listening
+					closed := httptest.NewServer(http.NotFoundHandler())
+					closed.Close()
+					urls = append(urls, closed.URL+"/agent")
+					continue
+				}
+				server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+					served.Add(1)
+					if status != http.StatusOK {
+						http.Error(res, http.StatusText(status), status)
+						return
+					}
+					res.Header().Set("Content-Type", "application/json")
+					res.Write([]byte(`{"content":"42"}`))
+				}))
+				defer server.Close()
+				urls = append(urls, server.URL+"/agent")
+			}
+			client := NewAgentClient(urls, WithClientTimeout(time.Second))
+			defer client.Close()
+
+			result, err := client.CallAgent(context.Background(), "question")
+			if !errors.Is(err, test.err) {
+				t.Fatalf("error = %v, want %v", err, test.err)
+			}
+			if test.err == nil && result != "42" {
+				t.Errorf("result = %q, want 42", result)
+			}
+			if got := int(served.Load()); got != test.served {
+				t.Errorf("replicas served = %d, want %d", got, test.served)
+			}
+		})
+	}
+}
+
+// agent endpoint counting the connections opened to it
+func newCountingServer(tb testing.TB) (*httptest.Server, *atomic.Int64) {
+	var conns atomic.Int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		res.Write([]byte(`{"content":"42"}`))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.Start()
+	tb.Cleanup(server.Close)
+	return server, &conns
+}
+
+// concurrent calls to one downstream agent reuse their connections, where the stdlib keeps only 2 idle
+func TestHTTPClientConnectionReuse(t *testing.T) {
+	tests := []struct {
+		name     string
+		client   *http.Client
+		minConns int64
+		maxConns int64
+	}{
+		{name: "agent client", client: NewHTTPClient()},
+		{name: "no idle conns", client: NewHTTPClient(WithIdleConns(-1, 0)), minConns: 8 * 20 / 2, maxConns: 8 * 20},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, conns := newCountingServer(t)
+			remote := &RemoteAgent{URL: server.URL, HTTPClient: test.client}
+			// 8 workers making 20 calls each
+			load := func() {
+				var wg sync.WaitGroup
+				for worker := 0; worker < 8; worker++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for call := 0; call < 20; call++ {
+							if _, err := remote.Call(context.Background(), "question"); err != nil {
+								t.Error(err)
+								return
+							}
+						}
+					}()
+				}
+				wg.Wait()
+			}
+			// warm up first, dials racing at the start can leave a few spare connections
+			// and the agent client then serves every call on the idle ones
+			load()
+			warm := conns.Load()
+			load()
+			got := conns.Load() - warm
+			if got > test.maxConns {
+				t.Errorf("connections after warm up = %d, want at most %d", got, test.maxConns)
+			}
+			if got < test.minConns {
+				t.Errorf("connections after warm up = %d, want at least %d without idle conns", got, test.minConns)
+			}
+		})
+	}
+}
+
+// go test -bench ConnectionReuse -run ^$ reports the connections opened per call
+func BenchmarkConnectionReuse(b *testing.B) {
+	clients := []struct {
+		name   string
+		client *http.Client
+	}{
+		{name: "agent client", client: NewHTTPClient()},
+		{name: "no reuse", client: NewHTTPClient(WithIdleConns(-1, 0))},
+	}
+	for _, bench := range clients {
+		b.Run(bench.name, func(b *testing.B) {
+			server, conns := newCountingServer(b)
+			remote := &RemoteAgent{URL: server.URL, HTTPClient: bench.client}
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := remote.Call(context.Background(), "question"); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.ReportMetric(float64(conns.Load())/float64(b.N), "conns/op")
+			bench.client.CloseIdleConnections()
+		})
+	}
+}
+
+// a downstream that stalls fails a call at the client timeout, while a stream that keeps
+// sending is read for longer than the timeout
+func TestDefaultHTTPClientLimits(t *testing.T) {
+	defaultClient := DefaultHTTPClient
+	DefaultHTTPClient = NewHTTPClient(WithClientTimeout(100*time.Millisecond), WithDialTimeout(time.Second))
+	t.Cleanup(func() { DefaultHTTPClient = defaultClient })
+
+	tests := []struct {
+		name   string
+		stream bool
+		delay  time.Duration
+		err    error
+	}{
+		{name: "call in time", delay: 0},
+		{name: "call stalls", delay: time.Second, err: ErrDownstreamUnavailable},
+		{name: "stream outlasts the timeout", stream: true, delay: 50 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			release := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				if !test.stream {
+					select {
+					case <-time.After(test.delay):
+					case <-release:
+						return
+					}
+					res.Header().Set("Content-Type", "application/json")
+					res.Write([]byte(`{"content":"42"}`))
+					return
+				}
+				// five chunks, 250ms in all
+				res.Header().Set("Content-Type", "text/event-stream")
+				for chunk := 0; chunk < 5; chunk++ {
+					writeStreamEvent(res, "chunk", Response{Content: "4"})
+					time.Sleep(test.delay)
+				}
+				writeStreamEvent(res, "done", Response{})
+			}))
+			defer server.Close()
+			defer close(release)
+
+			if test.stream {
+				chunks, err := CallRemoteAgentStream(context.Background(), server.URL, "question")
+				if err != nil {
+					t.Fatal(err)
+				}
+				text := ""
+				for chunk := range chunks {
+					if chunk.Err != nil {
+						t.Fatalf("stream error = %v", chunk.Err)
+					}
+					text += chunk.Text
+				}
+				if text != "44444" {
+					t.Errorf("stream text = %q, want 44444", text)
+				}
+				return
+			}
+			result, err := CallRemoteAgent(context.Background(), server.URL, "question")
+			if !errors.Is(err, test.err) {
+				t.Fatalf("error = %v, want %v", err, test.err)
+			}
+			if test.err == nil && result != "42" {
+				t.Errorf("result = %q, want 42", result)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+/////////
+// Agent idempotency key routines
+/////////
+
+// request header naming a client retry-safe operation, repeats within the ttl replay the first reply
+const IdempotencyHeader = "Idempotency-Key"
+
+// default time a reply is kept for a repeated Idempotency-Key
+const DefaultIdempotencyTTL = 10 * time.Minute
+
+// idempotency keys are scoped to the session they were sent for
+type idempotencyKey struct {
+	session string
+	key     string
+}
+
+// reply to an idempotent request, done is closed once it is complete
+type idempotentEntry struct {
+	id       idempotencyKey
+	hash     string // of the request that claimed the key, a repeat must match it
+	done     chan struct{}
+	status   int
+	response Response
+	expires  time.Time
+}
+
+// hash of a decoded request, repeats of a key are compared on it
+func requestHash(reqBody *Request) string {
+	body, _ := json.Marshal(reqBody)
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// claim an idempotency key of a session, returning the existing entry to replay when the key was
+// seen before. a nil entry is returned when the request has no key
+func (agent *Agent) claimIdempotencyKey(sessionID string, key string, hash string) (*idempotentEntry, bool) {
+	if key == "" || agent.IdempotencyTTL <= 0 {
+		return nil, false
+	}
+	id := idempotencyKey{session: sessionID, key: key}
+	now := agent.clock().Now()
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	// drop expired replies
+	for stale, entry := range agent.replies {
+		if !entry.expires.IsZero() && now.After(entry.expires) {
+			delete(agent.replies, stale)
+		}
+	}
+	if entry, ok := agent.replies[id]; ok {
+		return entry, true
+	}
+	entry := &idempotentEntry{id: id, hash: hash, done: make(chan struct{})}
+	agent.replies[id] = entry
+	return entry, false
+}
+
+// record the reply to an idempotent request and release any waiting repeats
+// failed calls are not kept so a later retry runs again
+func (agent *Agent) completeIdempotent(entry *idempotentEntry, status int, response Response) {
+	if entry == nil {
+		return
+	}
+	agent.mu.Lock()
+	entry.status = status
+	entry.response = response
+	if status == http.StatusOK {
+		entry.expires = agent.clock().Now().Add(agent.IdempotencyTTL)
+	} else {
+		delete(agent.replies, entry.id)
+	}
+	agent.mu.Unlock()
+	close(entry.done)
+}
+
+// write the reply of an earlier request with the same key, waiting while it is in flight
+// a repeat with a different request is refused with 422 rather than given the other reply
+func (agent *Agent) replayIdempotent(ctx context.Context, res http.ResponseWriter, plain bool, hash string, entry *idempotentEntry) {
+	if hash != entry.hash {
+		agent.logger().Warn("idempotency key reused with a different request", "key", entry.id.key)
+		http.Error(res, "Unprocessable Entity: Idempotency-Key reused with a different request", http.StatusUnprocessableEntity)
+		return
+	}
+	select {
+	case <-entry.done:
+	case <-ctx.Done():
+		status := errorStatus(ctx, ctx.Err())
+		http.Error(res, http.StatusText(status), status)
+		return
+	}
+	agent.logger().Info("idempotent reply replayed", "key", entry.id.key)
+	agent.mu.Lock()
+	status, response := entry.status, entry.response
+	agent.mu.Unlock()
+	if status != http.StatusOK {
+		http.Error(res, http.StatusText(status), status)
+		return
+	}
+	agent.writeResponse(res, plain, response)
+}
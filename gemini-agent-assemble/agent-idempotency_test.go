@@ -0,0 +1,180 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// repeats of a key replay the first successful reply until it expires
+func TestIdempotencyKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		ttl    time.Duration
+		key    string
+		status int
+		after  time.Duration
+		replay bool
+	}{
+		{name: "repeat replays", ttl: time.Minute, key: "k1", status: http.StatusOK, after: 30 * time.Second, replay: true},
+		{name: "expired runs again", ttl: time.Minute, key: "k1", status: http.StatusOK, after: 2 * time.Minute},
+		{name: "failure runs again", ttl: time.Minute, key: "k1", status: http.StatusBadGateway},
+		{name: "no key", ttl: time.Minute, status: http.StatusOK},
+		{name: "disabled", key: "k1", status: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := newFakeClock()
+			agent := newMockAgent(t, newMockGemini(t))
+			agent.Clock = clock
+			agent.IdempotencyTTL = test.ttl
+
+			entry, seen := agent.claimIdempotencyKey("", test.key, "hash")
+			if seen {
+				t.Fatal("first claim was seen")
+			}
+			agent.completeIdempotent(entry, test.status, Response{Content: "42"})
+			clock.Advance(test.after)
+
+			repeat, seen := agent.claimIdempotencyKey("", test.key, "hash")
+			if seen != test.replay {
+				t.Fatalf("repeat seen = %v, want %v", seen, test.replay)
+			}
+			if !test.replay {
+				return
+			}
+			res := httptest.NewRecorder()
+			agent.replayIdempotent(context.Background(), res, true, "hash", repeat)
+			if res.Code != http.StatusOK || res.Body.String() != "42" {
+				t.Errorf("replay = %d %q, want the first reply", res.Code, res.Body.String())
+			}
+		})
+	}
+}
+
+// a repeat arriving while the first request is in flight waits for its reply
+func TestIdempotencyKeyInFlight(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		cancel bool
+		want   int
+	}{
+		{name: "completed", status: http.StatusOK, want: http.StatusOK},
+		{name: "failed", status: http.StatusBadGateway, want: http.StatusBadGateway},
+		{name: "repeat gives up", cancel: true, want: errorStatus(context.Background(), context.Canceled)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newMockAgent(t, newMockGemini(t))
+			entry, _ := agent.claimIdempotencyKey("", "k1", "hash")
+			repeat, seen := agent.claimIdempotencyKey("", "k1", "hash")
+			if !seen || repeat != entry {
+				t.Fatal("in flight key was not seen")
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			res := httptest.NewRecorder()
+			replayed := make(chan struct{})
+			go func() {
+				defer close(replayed)
+				agent.replayIdempotent(ctx, res, true, "hash", repeat)
+			}()
+			if test.cancel {
+				cancel()
+			} else {
+				agent.completeIdempotent(entry, test.status, Response{Content: "42"})
+			}
+			<-replayed
+			if res.Code != test.want {
+				t.Errorf("replay status = %d, want %d", res.Code, test.want)
+			}
+			if test.want == http.StatusOK && res.Body.String() != "42" {
+				t.Errorf("replay = %q, want 42", res.Body.String())
+			}
+		})
+	}
+}
+
+// repeated requests with one key reach the model once
+func TestHandleAgentRequestIdempotent(t *testing.T) {
+	requireModelCalls(t)
+	mock := newMockGemini(t, textReply("42"))
+	agent := newMockAgent(t, mock)
+	if err := agent.NewSession(); err != nil {
+		t.Fatal(err)
+	}
+	for attempt := 0; attempt < 3; attempt++ {
+		req := httptest.NewRequest(http.MethodPost, "/agent", strings.NewReader(`{"input":"question"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(IdempotencyHeader, "k1")
+		res := httptest.NewRecorder()
+		agent.HandleAgentRequest(res, req)
+		if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), "42") {
+			t.Errorf("attempt %d = %d %q, want the reply", attempt, res.Code, res.Body.String())
+		}
+	}
+	if got := len(mock.received()); got != 1 {
+		t.Errorf("model requests = %d, want 1", got)
+	}
+}
+
+// a key is scoped to its session, and a repeat with a different request is refused
+func TestHandleAgentRequestIdempotentScope(t *testing.T) {
+	requireModelCalls(t)
+	tests := []struct {
+		name    string
+		session bool // the repeat is sent on another session
+		input   string
+		status  int
+		content string
+		calls   int
+	}{
+		{name: "same request replays", input: "question", status: http.StatusOK, content: "first", calls: 1},
+		{name: "other session runs", session: true, input: "question", status: http.StatusOK, content: "second", calls: 2},
+		{name: "different request refused", input: "another question", status: http.StatusUnprocessableEntity, calls: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := newMockGemini(t, textReply("first"), textReply("second"))
+			agent := newMockAgent(t, mock)
+			if err := agent.NewSession(); err != nil {
+				t.Fatal(err)
+			}
+			other, err := agent.NewSessionID()
+			if err != nil {
+				t.Fatal(err)
+			}
+			send := func(body string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodPost, "/agent", strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set(IdempotencyHeader, "k1")
+				res := httptest.NewRecorder()
+				agent.HandleAgentRequest(res, req)
+				return res
+			}
+			if res := send(`{"input":"question"}`); res.Code != http.StatusOK {
+				t.Fatalf("first status = %d", res.Code)
+			}
+
+			body := `{"input":"` + test.input + `"}`
+			if test.session {
+				body = `{"input":"` + test.input + `","session_id":"` + other + `"}`
+			}
+			res := send(body)
+			if res.Code != test.status {
+				t.Fatalf("repeat status = %d, want %d: %s", res.Code, test.status, res.Body.String())
+			}
+			if test.content != "" && !strings.Contains(res.Body.String(), test.content) {
+				t.Errorf("repeat = %q, want %q", res.Body.String(), test.content)
+			}
+			if got := len(mock.received()); got != test.calls {
+				t.Errorf("model requests = %d, want %d", got, test.calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package geminiagentassemble
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/////////
+// Agent in-flight request limit routines
+/////////
+
+// in-flight generations per agent, served at <base path>/metrics as agent_in_flight
+var inFlightMetric = expvar.NewMap("agent_in_flight")
+
+// seconds a rejected client is asked to wait before retrying
+const inFlightRetryAfter = 1
+
+// bound the generations served at once over http to limit, later requests wait up to
+// wait for a slot and are then rejected with 503 and a Retry-After, a zero wait rejects at once
+func (agent *Agent) EnableInFlightLimit(limit int, wait time.Duration) error {
+	if err := agent.checkAgent(); err != nil {
+		return err
+	}
+	if limit <= 0 {
+		return errors.New("in-flight limit must be positive")
+	}
+	agent.mu.Lock()
+	agent.inFlight = make(chan struct{}, limit)
+	agent.inFlightWait = wait
+	agent.mu.Unlock()
+	agent.logger().Info("in-flight limit enabled", "limit", limit, "wait", wait)
+	return nil
+}
+
+// take an in-flight slot for a request, writing the 503 reply when none frees up in time, the wait
+// is timed by the agent Clock. the returned function releases the slot and must be called when the
+// generation ends, for an async job when the job finishes
+func (agent *Agent) acquireInFlight(res http.ResponseWriter, req *http.Request) (func(), bool) {
+	agent.mu.Lock()
+	slots, wait := agent.inFlight, agent.inFlightWait
+	agent.mu.Unlock()
+	if slots == nil {
+		return func() {}, true
+	}
+
+	acquired := false
+	select {
+	case slots <- struct{}{}:
+		acquired = true
+	default:
+		if wait > 0 {
+			select {
+			case slots <- struct{}{}:
+				acquired = true
+			case <-agent.clock().After(wait):
+			case <-req.Context().Done():
+			}
+		}
+	}
+	if !acquired {
+		agent.logger().Warn("request rejected, in-flight limit reached", "limit", cap(slots))
+		res.Header().Set("Retry-After", strconv.Itoa(inFlightRetryAfter))
+		http.Error(res, "Service Unavailable", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	inFlightMetric.Add(agent.metricLabel(), 1)
+	return func() {
+		inFlightMetric.Add(agent.metricLabel(), -1)
+		<-slots
+	}, true
+}
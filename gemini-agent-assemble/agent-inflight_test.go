@@ -0,0 +1,131 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// a request over the limit waits on the agent clock for a slot, and is rejected when none frees up
+func TestAcquireInFlight(t *testing.T) {
+	tests := []struct {
+		name     string
+		wait     time.Duration
+		free     bool // the held slot is released while the request waits
+		advance  bool // the clock passes the wait
+		cancel   bool // the request ends while it waits
+		acquired bool
+	}{
+		{name: "no wait rejects at once"},
+		{name: "slot frees up", wait: time.Minute, free: true, acquired: true},
+		{name: "wait passes", wait: time.Minute, advance: true},
+		{name: "request ends", wait: time.Minute, cancel: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newMockAgent(t, newMockGemini(t))
+			clock := newFakeClock()
+			agent.Clock = clock
+			if err := agent.EnableInFlightLimit(1, test.wait); err != nil {
+				t.Fatal(err)
+			}
+			held, ok := agent.acquireInFlight(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/agent", nil))
+			if !ok {
+				t.Fatal("first request was rejected")
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			res := httptest.NewRecorder()
+			acquired := make(chan bool)
+			go func() {
+				release, ok := agent.acquireInFlight(res, httptest.NewRequest(http.MethodPost, "/agent", nil).WithContext(ctx))
+				if ok {
+					release()
+				}
+				acquired <- ok
+			}()
+			if test.wait > 0 {
+				// the request is waiting once its timer is set on the clock
+				deadline := time.Now().Add(10 * time.Second)
+				for clock.Waiting() == 0 {
+					if time.Now().After(deadline) {
+						t.Fatal("request did not wait")
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}
+			switch {
+			case test.free:
+				held()
+			case test.advance:
+				clock.Advance(test.wait)
+			case test.cancel:
+				cancel()
+			}
+			if got := <-acquired; got != test.acquired {
+				t.Fatalf("acquired = %v, want %v", got, test.acquired)
+			}
+			if !test.acquired && (res.Code != http.StatusServiceUnavailable || res.Header().Get("Retry-After") != strconv.Itoa(inFlightRetryAfter)) {
+				t.Errorf("rejection = %d retry after %q, want 503", res.Code, res.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
+
+// an async job holds an in-flight slot until its generation ends
+func TestHandleJobRequestInFlight(t *testing.T) {
+	requireModelCalls(t)
+	proceed := make(chan struct{})
+	wait := ToolFunc{Declaration: &genai.FunctionDeclaration{Name: "wait"}, Handler: func(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+		<-proceed
+		return "done", nil
+	}}
+	agent := newMockAgent(t, newMockGemini(t, callReply("wait", nil), textReply("42"), textReply("43")), WithToolFuncs(wait))
+	if err := agent.EnableInFlightLimit(1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.NewSession(); err != nil {
+		t.Fatal(err)
+	}
+	submit := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/agent/jobs", strings.NewReader(`{"input":"question"}`))
+		req.Header.Set("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		agent.HandleJobRequest(res, req)
+		return res
+	}
+
+	if res := submit(); res.Code != http.StatusAccepted {
+		t.Fatalf("first job status = %d, want 202", res.Code)
+	}
+	res := submit()
+	if res.Code != http.StatusServiceUnavailable {
+		t.Fatalf("job over the limit status = %d, want 503", res.Code)
+	}
+	agent.mu.Lock()
+	jobs := len(agent.jobs)
+	agent.mu.Unlock()
+	if jobs != 1 {
+		t.Errorf("jobs = %d, want the rejected job not registered", jobs)
+	}
+
+	// the slot frees up once the running job finishes
+	close(proceed)
+	deadline := time.Now().Add(10 * time.Second)
+	for len(agent.inFlight) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("job kept its in-flight slot")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if job := runJob(t, agent, `{"input":"question"}`); job.Status != JobDone || job.Response.Content != "43" {
+		t.Errorf("job after the slot freed = %+v", job)
+	}
+}
@@ -0,0 +1,70 @@
+package geminiagentassemble
+
+import (
+	"net/http"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Agent introspection routines
+/////////
+
+// agent configuration served at GET <base path>/agent/info
+type AgentInfo struct {
+	Name              string     `json:"name,omitempty"`
+	Model             string     `json:"model"`
+	FallbackModels    []string   `json:"fallback_models,omitempty"`
+	Tools             []ToolInfo `json:"tools"`
+	FunctionCalling   string     `json:"function_calling"`
+	SystemInstruction string     `json:"system_instruction,omitempty"`
+}
+
+// a function declaration offered to the model
+type ToolInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// describe the agent model, tools and function calling mode
+// the system instruction is left out when RedactSystemInstruction is set, empty when the agent
+// is not initialized or closed
+func (agent *Agent) Info() AgentInfo {
+	if err := agent.checkAgent(); err != nil {
+		return AgentInfo{}
+	}
+	info := AgentInfo{
+		Name:            agent.Name,
+		Model:           agent.modelName,
+		FallbackModels:  agent.FallbackModels,
+		Tools:           []ToolInfo{},
+		FunctionCalling: genai.FunctionCallingAuto.String(),
+	}
+	for _, tool := range agent.model.Tools {
+		for _, declaration := range tool.FunctionDeclarations {
+			info.Tools = append(info.Tools, ToolInfo{Name: declaration.Name, Description: declaration.Description})
+		}
+	}
+	if config := agent.model.ToolConfig; config != nil && config.FunctionCallingConfig != nil &&
+		config.FunctionCallingConfig.Mode != genai.FunctionCallingUnspecified {
+		info.FunctionCalling = config.FunctionCallingConfig.Mode.String()
+	}
+	if system := agent.model.SystemInstruction; system != nil && !agent.RedactSystemInstruction {
+		for _, part := range system.Parts {
+			if text, ok := part.(genai.Text); ok {
+				info.SystemInstruction += string(text)
+			}
+		}
+	}
+	return info
+}
+
+// introspection handler for GET <base path>/agent/info
+func (agent *Agent) HandleInfoRequest(res http.ResponseWriter, req *http.Request) {
+	agent.setNameHeader(res)
+	if err := agent.checkAgent(); err != nil {
+		http.Error(res, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	agent.writeBody(res, http.StatusOK, agent.Info())
+}
@@ -0,0 +1,304 @@
+package geminiagentassemble
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+/////////
+// Agent async job routines
+/////////
+
+// header carrying the hex hmac-sha256 of the callback body, keyed by the agent WebhookSecret
+const SignatureHeader = "X-Agent-Signature"
+
+// callback delivery attempts and the first retry delay, doubled on each retry
+const (
+	DefaultWebhookAttempts = 5
+	DefaultWebhookBackoff  = time.Second
+)
+
+// default time a finished job is kept for polling
+const DefaultJobTTL = time.Hour
+
+// async job states
+const (
+	JobPending = "pending"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// async job status, returned when polling and posted to the callback url
+type Job struct {
+	ID       string    `json:"job_id"`
+	Status   string    `json:"status"`
+	Response *Response `json:"response,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	expires  time.Time // when a finished job is dropped, zero while it runs
+}
+
+// async job request handler for POST <base path>/agent/jobs
+// replies 202 with the job id, the result is polled or posted to the request callback_url
+func (agent *Agent) HandleJobRequest(res http.ResponseWriter, req *http.Request) {
+	agent.setNameHeader(res)
+
+	// check the agent is usable
+	if err := agent.checkAgent(); err != nil {
+		http.Error(res, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	// refuse new jobs while draining, an accepted job counts as in flight until it finishes
+	done, ok := agent.beginRequest(res)
+	if !ok {
+		return
+	}
+	// validate and decode the request
+	reqBody, ok := agent.decodeAgentRequest(res, req)
+	if !ok {
+		done()
+		return
+	}
+	// refuse callbacks the agent may not post to
+	if err := agent.checkCallback(reqBody.CallbackURL); err != nil {
+		done()
+		http.Error(res, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// reject requests that have travelled too many agent hops
+	ctx, ok := agent.checkHops(res, req)
+	if !ok {
+		done()
+		return
+	}
+	// bound the generations running at once, the job holds its slot until it finishes
+	release, ok := agent.acquireInFlight(res, req)
+	if !ok {
+		done()
+		return
+	}
+	ctx, detach := agent.detachJob(ctx)
+	// apply any client requested time limit to the whole generation
+	ctx, cancel, ok := agent.requestTimeout(ctx, res, req)
+	if !ok {
+		detach()
+		release()
+		done()
+		return
+	}
+	ctx = reqBody.context(ctx)
+
+	// register the job
+	id, err := newSessionID()
+	if err != nil {
+		cancel()
+		detach()
+		release()
+		done()
+		http.Error(res, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	ctx = withRequestID(ctx, id)
+	job := &Job{ID: id, Status: JobPending}
+	agent.mu.Lock()
+	agent.dropExpiredJobs()
+	agent.jobs[id] = job
+	agent.mu.Unlock()
+	agent.logger().Info("job accepted", "job", id)
+
+	// run the agent in the background
+	go func() {
+		defer done()
+		defer detach()
+		defer cancel()
+		result, err := agent.callAgent(ctx, reqBody.SessionID, reqBody.Input)
+		if err == nil {
+			result.text, err = agent.limitResponse(result.text)
+		}
+		// the generation is over, the callback is delivered without holding a slot
+		release()
+		agent.mu.Lock()
+		if err != nil {
+			job.Status = JobFailed
+			job.Error = err.Error()
+		} else {
+			job.Status = JobDone
+			job.Response = &Response{Content: result.text, Model: result.model, Reasoning: result.reasoning}
+			if result.needsInput {
+				job.Response.NeedsInput, job.Response.Question = true, result.text
+			}
+			if reqBody.Diagnostics {
+				job.Response.Diagnostics = result.diagnostics()
+			}
+		}
+		if agent.JobTTL > 0 {
+			job.expires = agent.clock().Now().Add(agent.JobTTL)
+		}
+		final := *job
+		agent.mu.Unlock()
+		agent.logger().Info("job finished", "job", id, "status", final.Status)
+		if err != nil {
+			agent.deadLetter(id, reqBody, errorStatus(ctx, err), err)
+		}
+
+		if reqBody.CallbackURL != "" {
+			agent.deliverCallback(reqBody.CallbackURL, final)
+		}
+	}()
+
+	agent.writeBody(res, http.StatusAccepted, Job{ID: id, Status: JobPending})
+}
+
+// detach a job from the request that started it, the job keeps the request values but runs on
+// after the reply is sent, until the agent context ends
+func (agent *Agent) detachJob(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(agent.ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// job polling handler for GET <base path>/agent/jobs/{id}
+func (agent *Agent) HandleJobStatus(res http.ResponseWriter, req *http.Request) {
+	agent.setNameHeader(res)
+	if err := agent.checkAgent(); err != nil {
+		http.Error(res, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	agent.mu.Lock()
+	agent.dropExpiredJobs()
+	job, ok := agent.jobs[req.PathValue("id")]
+	var status Job
+	if ok {
+		status = *job
+	}
+	agent.mu.Unlock()
+	if !ok {
+		http.Error(res, "Not Found", http.StatusNotFound)
+		return
+	}
+	agent.writeBody(res, http.StatusOK, status)
+}
+
+// drop the finished jobs past the JobTTL, the agent lock must be held
+func (agent *Agent) dropExpiredJobs() {
+	now := agent.clock().Now()
+	for id, job := range agent.jobs {
+		if !job.expires.IsZero() && now.After(job.expires) {
+			delete(agent.jobs, id)
+		}
+	}
+}
+
+// check a job callback url is an http(s) url on one of the WebhookHosts and that callbacks can be
+// signed, an empty url is no callback
+func (agent *Agent) checkCallback(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	if len(agent.WebhookSecret) == 0 {
+		return errors.New("callbacks need a WebhookSecret")
+	}
+	target, err := url.Parse(raw)
+	if err != nil {
+		return errors.New("invalid callback_url")
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return fmt.Errorf("callback_url scheme %q not allowed", target.Scheme)
+	}
+	if target.User != nil || !slices.Contains(agent.WebhookHosts, target.Host) {
+		return fmt.Errorf("callback_url host %q not allowed", target.Host)
+	}
+	return nil
+}
+
+// the http client for callbacks, DefaultHTTPClient when not set
+func (agent *Agent) webhookClient() *http.Client {
+	if agent.WebhookClient == nil {
+		return DefaultHTTPClient
+	}
+	return agent.WebhookClient
+}
+
+// post the finished job to the callback url, retrying with backoff while it is unreachable
+// delivery is abandoned when the agent closes
+func (agent *Agent) deliverCallback(url string, job Job) {
+	body, err := json.Marshal(job)
+	if err != nil {
+		agent.logger().Error("callback encode failed", "job", job.ID, "error", err)
+		return
+	}
+	ctx, cancel := context.WithCancel(agent.ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-agent.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	backoff := DefaultWebhookBackoff
+	for attempt := 1; attempt <= DefaultWebhookAttempts; attempt++ {
+		err = agent.postCallback(ctx, url, body)
+		if err == nil {
+			agent.logger().Info("callback delivered", "job", job.ID)
+			return
+		}
+		agent.logger().Warn("callback failed", "job", job.ID, "attempt", attempt, "error", err)
+		if attempt < DefaultWebhookAttempts {
+			select {
+			case <-agent.clock().After(backoff):
+			case <-ctx.Done():
+				agent.logger().Warn("callback abandoned, agent stopped", "job", job.ID)
+				return
+			}
+			backoff *= 2
+		}
+	}
+	agent.logger().Error("callback abandoned, job remains available for polling", "job", job.ID)
+}
+
+// single signed callback post, non-2xx replies are errors
+func (agent *Agent) postCallback(ctx context.Context, url string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, signPayload(agent.WebhookSecret, body))
+	resp, err := agent.webhookClient().Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback replied %s", resp.Status)
+	}
+	return nil
+}
+
+// hex hmac-sha256 of a payload, receivers recompute it with the shared secret to verify a callback
+func signPayload(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify a callback signature header against the body and shared secret
+func VerifySignature(secret []byte, body []byte, signature string) bool {
+	return hmac.Equal([]byte(signPayload(secret, body)), []byte(signature))
+}
@@ -0,0 +1,249 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// submit a job and poll it until it finishes
+func runJob(t *testing.T, agent *Agent, body string) Job {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/agent/jobs", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	res := httptest.NewRecorder()
+	agent.HandleJobRequest(res, req)
+	if res.Code != http.StatusAccepted {
+		t.Fatalf("submit status = %d: %s", res.Code, res.Body.String())
+	}
+	accepted := Job{}
+	if err := json.Unmarshal(res.Body.Bytes(), &accepted); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		status, job := pollJob(t, agent, accepted.ID)
+		if status == http.StatusOK && job.Status != JobPending {
+			return job
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("job did not finish")
+	return Job{}
+}
+
+// poll a job, returning the reply status and the job
+func pollJob(t *testing.T, agent *Agent, id string) (int, Job) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/agent/jobs/"+id, nil)
+	req.SetPathValue("id", id)
+	res := httptest.NewRecorder()
+	agent.HandleJobStatus(res, req)
+	job := Job{}
+	if res.Code == http.StatusOK {
+		if err := json.Unmarshal(res.Body.Bytes(), &job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res.Code, job
+}
+
+func TestJobTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   mockReply
+		ttl     time.Duration
+		status  string
+		content string
+		evicted bool
+	}{
+		{name: "done job is evicted", reply: textReply("42"), ttl: time.Hour, status: JobDone, content: "42", evicted: true},
+		{name: "failed job is evicted", reply: errorReply(http.StatusBadRequest), ttl: time.Hour, status: JobFailed, evicted: true},
+		{name: "no ttl keeps the job", reply: textReply("42"), ttl: 0, status: JobDone, content: "42"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.status == JobDone {
+				requireModelCalls(t)
+			}
+			agent := newMockAgent(t, newMockGemini(t, test.reply))
+			clock := newFakeClock()
+			agent.Clock = clock
+			agent.JobTTL = test.ttl
+			if err := agent.NewSession(); err != nil {
+				t.Fatal(err)
+			}
+
+			job := runJob(t, agent, `{"input":"question"}`)
+			if job.Status != test.status {
+				t.Fatalf("status = %s, want %s (%s)", job.Status, test.status, job.Error)
+			}
+			if test.content != "" && (job.Response == nil || job.Response.Content != test.content) {
+				t.Fatalf("response = %+v, want %q", job.Response, test.content)
+			}
+
+			// kept until the ttl has passed
+			clock.Advance(59 * time.Minute)
+			if status, _ := pollJob(t, agent, job.ID); status != http.StatusOK {
+				t.Fatalf("status inside the ttl = %d", status)
+			}
+			clock.Advance(2 * time.Minute)
+			status, _ := pollJob(t, agent, job.ID)
+			if test.evicted && status != http.StatusNotFound {
+				t.Errorf("status past the ttl = %d, want 404", status)
+			}
+			if !test.evicted && status != http.StatusOK {
+				t.Errorf("status = %d, want the job kept", status)
+			}
+		})
+	}
+}
+
+// a running job is never evicted, however long it takes
+func TestJobTTLKeepsRunningJobs(t *testing.T) {
+	agent := newMockAgent(t, newMockGemini(t))
+	clock := newFakeClock()
+	agent.Clock = clock
+	agent.mu.Lock()
+	agent.jobs["running"] = &Job{ID: "running", Status: JobPending}
+	agent.mu.Unlock()
+	clock.Advance(24 * time.Hour)
+	if status, job := pollJob(t, agent, "running"); status != http.StatusOK || job.Status != JobPending {
+		t.Errorf("running job = %d %+v", status, job)
+	}
+}
+
+// a job keeps the request values but outlives the request, ending with the agent context
+func TestDetachJob(t *testing.T) {
+	agent := newMockAgent(t, newMockGemini(t))
+	agentCtx, stopAgent := context.WithCancel(context.Background())
+	agent.ctx = agentCtx
+	type valueKey struct{}
+	reqCtx, endRequest := context.WithCancel(context.WithValue(context.Background(), valueKey{}, "request"))
+
+	ctx, detach := agent.detachJob(reqCtx)
+	defer detach()
+	endRequest()
+	if ctx.Err() != nil {
+		t.Fatal("job ended with its request")
+	}
+	if ctx.Value(valueKey{}) != "request" {
+		t.Error("request values are lost")
+	}
+	stopAgent()
+	<-ctx.Done()
+}
+
+// a callback_url is only accepted for an allowed host when callbacks can be signed, and the
+// finished job is posted signed with the agent webhook client
+func TestJobCallback(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		received <- req
+		bodies <- body
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	tests := []struct {
+		name   string
+		secret string
+		hosts  []string
+		url    string
+		status int
+	}{
+		{name: "allowed host", secret: "secret", hosts: []string{host}, url: server.URL + "/done", status: http.StatusAccepted},
+		{name: "no secret", hosts: []string{host}, url: server.URL + "/done", status: http.StatusBadRequest},
+		{name: "host not allowed", secret: "secret", hosts: []string{"example.com"}, url: server.URL + "/done", status: http.StatusBadRequest},
+		{name: "no hosts", secret: "secret", url: server.URL + "/done", status: http.StatusBadRequest},
+		{name: "internal address", secret: "secret", hosts: []string{host}, url: "http://169.254.169.254/latest", status: http.StatusBadRequest},
+		{name: "scheme not allowed", secret: "secret", hosts: []string{host}, url: "file://" + host + "/etc/passwd", status: http.StatusBadRequest},
+		{name: "user info", secret: "secret", hosts: []string{host}, url: "http://user@" + host + "/done", status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newMockAgent(t, newMockGemini(t, errorReply(http.StatusBadRequest)))
+			agent.WebhookSecret = []byte(test.secret)
+			agent.WebhookHosts = test.hosts
+			agent.WebhookClient = server.Client()
+			if err := agent.NewSession(); err != nil {
+				t.Fatal(err)
+			}
+
+			body := `{"input":"question","callback_url":"` + test.url + `"}`
+			req := httptest.NewRequest(http.MethodPost, "/agent/jobs", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			res := httptest.NewRecorder()
+			agent.HandleJobRequest(res, req)
+			if res.Code != test.status {
+				t.Fatalf("status = %d, want %d: %s", res.Code, test.status, res.Body.String())
+			}
+			if test.status != http.StatusAccepted {
+				agent.mu.Lock()
+				jobs := len(agent.jobs)
+				agent.mu.Unlock()
+				if jobs != 0 {
+					t.Errorf("jobs = %d, want the refused job not registered", jobs)
+				}
+				return
+			}
+
+			select {
+			case callback := <-received:
+				payload := <-bodies
+				if !VerifySignature(agent.WebhookSecret, payload, callback.Header.Get(SignatureHeader)) {
+					t.Errorf("signature %q does not verify", callback.Header.Get(SignatureHeader))
+				}
+				job := Job{}
+				if err := json.Unmarshal(payload, &job); err != nil {
+					t.Fatal(err)
+				}
+				if job.Status != JobFailed {
+					t.Errorf("callback status = %s, want %s", job.Status, JobFailed)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("callback not delivered")
+			}
+		})
+	}
+}
+
+// a callback retrying against an unreachable receiver gives up when the agent closes
+func TestDeliverCallbackStops(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		http.Error(res, "Service Unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	agent := newMockAgent(t, newMockGemini(t))
+	clock := newFakeClock()
+	agent.Clock = clock
+	agent.WebhookSecret = []byte("secret")
+	agent.WebhookClient = server.Client()
+
+	delivered := make(chan struct{})
+	go func() {
+		defer close(delivered)
+		agent.deliverCallback(server.URL, Job{ID: "job", Status: JobDone})
+	}()
+	// wait for the first retry backoff
+	deadline := time.Now().Add(10 * time.Second)
+	for clock.Waiting() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("callback did not back off")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	agent.Close()
+	select {
+	case <-delivered:
+	case <-time.After(10 * time.Second):
+		t.Fatal("callback kept retrying after the agent closed")
+	}
+}
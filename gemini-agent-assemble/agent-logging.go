@@ -0,0 +1,116 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"log/slog"
+	"os"
+)
+
+/////////
+// Agent logging routines
+/////////
+
+// agent logging configuration
+type LogConfig struct {
+	// minimum level logged
+	Level slog.Level
+	// output sink and format, nil writes text lines to stderr
+	Handler slog.Handler
+	// include tool call arguments at info level, by default they are only logged at debug
+	// shorthand for a DefaultArgRule logging every argument
+	LogToolArgs bool
+	// arguments of a tool call logged at info level by tool name, the rest are redacted
+	ToolArgRules map[string]ArgRule
+	// rule for tools without one in ToolArgRules, by default every argument is redacted
+	DefaultArgRule ArgRule
+}
+
+// which arguments of a tool call are logged at info level, the others are logged as "[redacted]"
+// every argument is always logged at debug level
+type ArgRule struct {
+	// log every argument
+	All bool
+	// names of the arguments logged, e.g. numeric values that carry no personal data
+	Fields []string
+}
+
+// configure the agent logger level, sink and tool argument logging
+func WithLogConfig(config LogConfig) Option {
+	return func(agent *Agent) {
+		handler := config.Handler
+		if handler == nil {
+			handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: config.Level})
+		} else {
+			handler = &levelHandler{Handler: handler, level: config.Level}
+		}
+		agent.baseLogger = slog.New(handler)
+		agent.argRules = config.ToolArgRules
+		agent.defaultArgs = config.DefaultArgRule
+		if config.LogToolArgs {
+			agent.defaultArgs = ArgRule{All: true}
+		}
+	}
+}
+
+// filter a caller supplied handler to the configured minimum level
+type levelHandler struct {
+	slog.Handler
+	level slog.Level
+}
+
+func (handler *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= handler.level && handler.Handler.Enabled(ctx, level)
+}
+
+func (handler *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{Handler: handler.Handler.WithAttrs(attrs), level: handler.level}
+}
+
+func (handler *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{Handler: handler.Handler.WithGroup(name), level: handler.level}
+}
+
+// agent scoped structured logger, every line carries the agent name
+func (agent *Agent) logger() *slog.Logger {
+	logger := slog.Default()
+	if agent == nil {
+		return logger
+	}
+	if agent.baseLogger != nil {
+		logger = agent.baseLogger
+	}
+	if agent.Name != "" {
+		logger = logger.With("agent", agent.Name)
+	}
+	return logger
+}
+
+// log a tool call, at info the arguments follow the tool ArgRule and at debug they are all logged
+// tool handlers are dispatched from here so they do not need to log their own arguments
+func (agent *Agent) logToolCall(name string, args map[string]any) {
+	logger := agent.logger()
+	rule, ok := agent.argRules[name]
+	if !ok {
+		rule = agent.defaultArgs
+	}
+	if rule.All {
+		logger.Info("tool call", "function", name, "args", args)
+		return
+	}
+	logger.Info("tool call", "function", name, "args", rule.redact(args))
+	logger.Debug("tool call args", "function", name, "args", args)
+}
+
+// copy of the arguments with those the rule does not log redacted
+func (rule ArgRule) redact(args map[string]any) map[string]any {
+	redacted := make(map[string]any, len(args))
+	for key := range args {
+		redacted[key] = "[redacted]"
+	}
+	for _, field := range rule.Fields {
+		if value, ok := args[field]; ok {
+			redacted[field] = value
+		}
+	}
+	return redacted
+}
@@ -0,0 +1,39 @@
+package geminiagentassemble
+
+import (
+	"expvar"
+	"fmt"
+)
+
+/////////
+// Agent metrics routines
+/////////
+
+// process wide counters labelled by agent name, served at <base path>/metrics
+var (
+	requestsMetric  = expvar.NewMap("agent_requests")
+	errorsMetric    = expvar.NewMap("agent_errors")
+	toolCallsMetric = expvar.NewMap("agent_tool_calls")
+)
+
+// counters for sessions started with labels, one entry per <agent>/<label>=<value>
+var (
+	labelRequestsMetric = expvar.NewMap("agent_label_requests")
+	labelErrorsMetric   = expvar.NewMap("agent_label_errors")
+	labelTokensMetric   = expvar.NewMap("agent_label_tokens")
+)
+
+// metric label for the agent
+func (agent *Agent) metricLabel() string {
+	if agent == nil || agent.Name == "" {
+		return "unnamed"
+	}
+	return agent.Name
+}
+
+// add to a label counter for each label of a session
+func (agent *Agent) addLabelMetric(metric *expvar.Map, sess *session, delta int64) {
+	for key, value := range sess.labels {
+		metric.Add(fmt.Sprintf("%s/%s=%s", agent.metricLabel(), key, value), delta)
+	}
+}
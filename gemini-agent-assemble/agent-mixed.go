@@ -0,0 +1,32 @@
+package geminiagentassemble
+
+import (
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Agent mixed text and function call routines
+/////////
+
+// handling of text the model returns in the same turn as function calls
+// when not set blocking calls drop the text and streaming calls send it as it is generated
+type MixedTextPolicy string
+
+const (
+	// drop the text
+	MixedTextIgnore MixedTextPolicy = "ignore"
+	// keep the text and put it before the final answer, on a stream once the answer starts
+	MixedTextPrepend MixedTextPolicy = "prepend"
+	// send the text to streaming callers as a commentary chunk / "commentary" event, blocking calls drop it
+	MixedTextCommentary MixedTextPolicy = "commentary"
+)
+
+// check a model turn calls a tool
+func hasFunctionCall(parts []genai.Part) bool {
+	for _, part := range parts {
+		if _, ok := part.(genai.FunctionCall); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package geminiagentassemble
+
+import (
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+func TestHasFunctionCall(t *testing.T) {
+	tests := []struct {
+		name  string
+		parts []genai.Part
+		want  bool
+	}{
+		{name: "no parts"},
+		{name: "text only", parts: []genai.Part{genai.Text("answer")}},
+		{name: "call only", parts: []genai.Part{genai.FunctionCall{Name: "echo"}}, want: true},
+		{name: "text and call", parts: []genai.Part{genai.Text("checking"), genai.FunctionCall{Name: "echo"}}, want: true},
+		{name: "function response", parts: []genai.Part{genai.FunctionResponse{Name: "echo"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := hasFunctionCall(test.parts); got != test.want {
+				t.Errorf("hasFunctionCall = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// blocking calls drop the interim text unless it is prepended, commentary only goes to streams
+func TestMixedTextPolicy(t *testing.T) {
+	requireModelCalls(t)
+	tests := []struct {
+		name    string
+		policy  MixedTextPolicy
+		replies []mockReply
+		want    string
+	}{
+		{name: "not set", replies: []mockReply{joinReplies(textReply("checking"), callReply("echo", nil)), textReply("done")}, want: "done"},
+		{name: "ignore", policy: MixedTextIgnore, replies: []mockReply{joinReplies(textReply("checking"), callReply("echo", nil)), textReply("done")}, want: "done"},
+		{name: "commentary", policy: MixedTextCommentary, replies: []mockReply{joinReplies(textReply("checking"), callReply("echo", nil)), textReply("done")}, want: "done"},
+		{name: "prepend", policy: MixedTextPrepend, replies: []mockReply{joinReplies(textReply("checking"), callReply("echo", nil)), textReply("done")}, want: "checking\ndone"},
+		{
+			name:   "prepend over turns",
+			policy: MixedTextPrepend,
+			replies: []mockReply{
+				joinReplies(textReply("first"), callReply("echo", nil)),
+				joinReplies(callReply("echo", nil), textReply("second")),
+				textReply("done"),
+			},
+			want: "first\nsecond\ndone",
+		},
+		{name: "prepend without tools", policy: MixedTextPrepend, replies: []mockReply{textReply("done")}, want: "done"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := newMockGemini(t, test.replies...)
+			agent := newMockAgent(t, mock)
+			agent.MixedTextPolicy = test.policy
+			if err := agent.NewSession(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := agent.CallAgent("question")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("reply = %q, want %q", got, test.want)
+			}
+			if requests := len(mock.received()); requests != len(test.replies) {
+				t.Errorf("requests = %d, want %d", requests, len(test.replies))
+			}
+		})
+	}
+}
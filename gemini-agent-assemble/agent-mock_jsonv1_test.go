@@ -0,0 +1,6 @@
+//go:build !goexperiment.jsonv2
+
+package geminiagentassemble
+
+// encoding/json is the v1 decoder, see requireModelCalls
+const jsonv2Decoder = false
@@ -0,0 +1,6 @@
+//go:build goexperiment.jsonv2
+
+package geminiagentassemble
+
+// encoding/json is backed by json v2, see requireModelCalls
+const jsonv2Decoder = true
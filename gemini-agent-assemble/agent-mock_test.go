@@ -0,0 +1,414 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/option"
+)
+
+/////////
+// Agent test helpers, a scripted gemini rest api and a fake clock
+/////////
+
+// one scripted generate reply, an api error when status is set
+type mockReply struct {
+	status int
+	parts  []map[string]any
+	// stream all the parts in one response, genai merges the texts of separate responses
+	oneChunk bool
+	// parts of further candidates, sent with the first in one response
+	alternates [][]map[string]any
+	// finish reason of the first candidate, sent in one response, STOP when not set
+	finishReason int
+}
+
+// model reply with the given text parts
+func textReply(texts ...string) mockReply {
+	reply := mockReply{}
+	for _, text := range texts {
+		reply.parts = append(reply.parts, map[string]any{"text": text})
+	}
+	return reply
+}
+
+// model reply with one text candidate per text
+func candidatesReply(texts ...string) mockReply {
+	reply := textReply(texts[0])
+	for _, text := range texts[1:] {
+		reply.alternates = append(reply.alternates, textReply(text).parts)
+	}
+	return reply
+}
+
+// model reply calling the named tool
+func callReply(name string, args map[string]any) mockReply {
+	return mockReply{parts: []map[string]any{{"functionCall": map[string]any{"name": name, "args": args}}}}
+}
+
+// model reply with the parts of all the given replies
+func joinReplies(replies ...mockReply) mockReply {
+	joined := mockReply{}
+	for _, reply := range replies {
+		joined.parts = append(joined.parts, reply.parts...)
+	}
+	return joined
+}
+
+// model reply stopped by the safety filters
+func blockedReply() mockReply {
+	reply := textReply("")
+	reply.finishReason = int(genai.FinishReasonSafety)
+	return reply
+}
+
+// api error reply with the given http status
+func errorReply(status int) mockReply {
+	return mockReply{status: status}
+}
+
+// scripted stand in for the gemini rest api, generate and stream calls take the replies in order
+type mockGemini struct {
+	t        testing.TB
+	server   *httptest.Server
+	mu       sync.Mutex
+	replies  []mockReply
+	requests []mockRequest
+	tokens   int
+	// status of a failed token count, e.g. 401 for a rejected key, 0 counts
+	countError int
+	// texts of each embedding request, and the status of failed ones, 0 embeds
+	embedBatches [][]string
+	embedError   int
+}
+
+// a generate request received by the mock
+type mockRequest struct {
+	// model named in the request path
+	Model    string `json:"-"`
+	Contents []struct {
+		Role  string           `json:"role"`
+		Parts []map[string]any `json:"parts"`
+	} `json:"contents"`
+	SystemInstruction *struct {
+		Parts []map[string]any `json:"parts"`
+	} `json:"systemInstruction"`
+	Tools []struct {
+		FunctionDeclarations []struct {
+			Name string `json:"name"`
+		} `json:"functionDeclarations"`
+	} `json:"tools"`
+}
+
+// the names of the functions declared in the request
+func (req mockRequest) toolNames() []string {
+	names := []string{}
+	for _, tool := range req.Tools {
+		for _, declaration := range tool.FunctionDeclarations {
+			names = append(names, declaration.Name)
+		}
+	}
+	return names
+}
+
+// the text of the system instruction sent in the request
+func (req mockRequest) systemText() string {
+	if req.SystemInstruction == nil || len(req.SystemInstruction.Parts) == 0 {
+		return ""
+	}
+	text, _ := req.SystemInstruction.Parts[0]["text"].(string)
+	return text
+}
+
+// the text of the last part sent in the request
+func (req mockRequest) lastText() string {
+	if len(req.Contents) == 0 {
+		return ""
+	}
+	parts := req.Contents[len(req.Contents)-1].Parts
+	if len(parts) == 0 {
+		return ""
+	}
+	text, _ := parts[len(parts)-1]["text"].(string)
+	return text
+}
+
+// start a mock gemini api with the given replies, closed when the test ends
+func newMockGemini(t testing.TB, replies ...mockReply) *mockGemini {
+	mock := &mockGemini{t: t, replies: replies, tokens: 1}
+	mock.server = httptest.NewServer(http.HandlerFunc(mock.handle))
+	t.Cleanup(mock.server.Close)
+	return mock
+}
+
+// queue more replies
+func (mock *mockGemini) push(replies ...mockReply) {
+	mock.mu.Lock()
+	defer mock.mu.Unlock()
+	mock.replies = append(mock.replies, replies...)
+}
+
+// the generate requests received so far
+func (mock *mockGemini) received() []mockRequest {
+	mock.mu.Lock()
+	defer mock.mu.Unlock()
+	return append([]mockRequest(nil), mock.requests...)
+}
+
+func (mock *mockGemini) handle(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	switch {
+	case strings.HasSuffix(req.URL.Path, ":countTokens"):
+		if mock.countError != 0 {
+			writeMockError(res, mock.countError)
+			return
+		}
+		fmt.Fprintf(res, `{"totalTokens":%d}`, mock.tokens)
+		return
+	case strings.HasSuffix(req.URL.Path, ":batchEmbedContents"):
+		mock.embed(res, req)
+		return
+	case strings.HasSuffix(req.URL.Path, ":generateContent"), strings.HasSuffix(req.URL.Path, ":streamGenerateContent"):
+	default:
+		http.NotFound(res, req)
+		return
+	}
+
+	// take the next reply
+	body := mockRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		mock.t.Errorf("mock gemini: bad request body: %v", err)
+	}
+	body.Model, _, _ = strings.Cut(req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:], ":")
+	mock.mu.Lock()
+	mock.requests = append(mock.requests, body)
+	if len(mock.replies) == 0 {
+		mock.mu.Unlock()
+		mock.t.Errorf("mock gemini: no reply scripted for request %d", len(mock.requests))
+		writeMockError(res, http.StatusInternalServerError)
+		return
+	}
+	reply := mock.replies[0]
+	mock.replies = mock.replies[1:]
+	mock.mu.Unlock()
+
+	if reply.status != 0 {
+		writeMockError(res, reply.status)
+		return
+	}
+	if strings.HasSuffix(req.URL.Path, ":generateContent") {
+		json.NewEncoder(res).Encode(mockCandidates(reply))
+		return
+	}
+	// a stream sends each part as its own response, the last carrying the usage
+	stream := []map[string]any{}
+	for pos, part := range reply.parts {
+		stream = append(stream, mockResponse([]map[string]any{part}, pos == len(reply.parts)-1))
+	}
+	if len(stream) == 0 || reply.oneChunk || len(reply.alternates) > 0 || reply.finishReason != 0 {
+		stream = []map[string]any{mockCandidates(reply)}
+	}
+	json.NewEncoder(res).Encode(stream)
+}
+
+// embed each text of a batch as a one value vector of its length
+func (mock *mockGemini) embed(res http.ResponseWriter, req *http.Request) {
+	body := struct {
+		Requests []struct {
+			Content struct {
+				Parts []map[string]any `json:"parts"`
+			} `json:"content"`
+		} `json:"requests"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		mock.t.Errorf("mock gemini: bad embed request body: %v", err)
+	}
+	texts := []string{}
+	embeddings := []map[string]any{}
+	for _, request := range body.Requests {
+		text, _ := request.Content.Parts[0]["text"].(string)
+		texts = append(texts, text)
+		embeddings = append(embeddings, map[string]any{"values": []float32{float32(len(text))}})
+	}
+	mock.mu.Lock()
+	mock.embedBatches = append(mock.embedBatches, texts)
+	mock.mu.Unlock()
+	if mock.embedError != 0 {
+		writeMockError(res, mock.embedError)
+		return
+	}
+	json.NewEncoder(res).Encode(map[string]any{"embeddings": embeddings})
+}
+
+// the texts of the embedding requests received so far
+func (mock *mockGemini) embedded() [][]string {
+	mock.mu.Lock()
+	defer mock.mu.Unlock()
+	return append([][]string(nil), mock.embedBatches...)
+}
+
+// fail a test that gets a model reply when the json decoder cannot read it
+// genai sends blocking generate calls as streams too, and the gax stream reader relies on the
+// decoder recovering from a failed Decode at the closing bracket, which the json v2 backed
+// decoder of newer toolchains does not. no reply body avoids it, so the tests are run with
+// GOEXPERIMENT=nojsonv2 as the CI workflow pins, rather than passing without the model calls
+func requireModelCalls(t testing.TB) {
+	t.Helper()
+	if jsonv2Decoder {
+		t.Fatal("model replies are not readable with GOEXPERIMENT=jsonv2, run with GOEXPERIMENT=nojsonv2")
+	}
+}
+
+// a generate response body with the parts in a single candidate
+func mockResponse(parts []map[string]any, last bool) map[string]any {
+	response := map[string]any{
+		"candidates": []map[string]any{{
+			"content": map[string]any{"role": "model", "parts": parts},
+			"index":   0,
+		}},
+	}
+	if last {
+		response["candidates"].([]map[string]any)[0]["finishReason"] = 1
+		response["usageMetadata"] = map[string]any{"totalTokenCount": 10}
+	}
+	return response
+}
+
+// a whole reply in one response, the alternates following the first candidate
+func mockCandidates(reply mockReply) map[string]any {
+	response := mockResponse(reply.parts, true)
+	candidates := response["candidates"].([]map[string]any)
+	if reply.finishReason != 0 {
+		candidates[0]["finishReason"] = reply.finishReason
+	}
+	for idx, parts := range reply.alternates {
+		candidates = append(candidates, map[string]any{
+			"content":      map[string]any{"role": "model", "parts": parts},
+			"index":        idx + 1,
+			"finishReason": 1,
+		})
+	}
+	response["candidates"] = candidates
+	return response
+}
+
+// a google api error body
+func writeMockError(res http.ResponseWriter, status int) {
+	res.WriteHeader(status)
+	fmt.Fprintf(res, `{"error":{"code":%d,"message":"mock error","status":"%s"}}`, status, http.StatusText(status))
+}
+
+// the echo tool of the mock agents, replies with its text argument
+var echoTool = &genai.FunctionDeclaration{
+	Name:        "echo",
+	Description: "echo the text back",
+	Parameters: &genai.Schema{
+		Type:       genai.TypeObject,
+		Properties: map[string]*genai.Schema{"text": {Type: genai.TypeString}},
+	},
+}
+
+// echo tool handler
+func echoCall(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+	text, _ := funcall.Args["text"].(string)
+	return text, nil
+}
+
+// agent on the mock api with the echo tool, closed when the test ends
+func newMockAgent(t testing.TB, mock *mockGemini, options ...Option) *Agent {
+	t.Helper()
+	ctx := context.Background()
+	client, err := genai.NewClient(ctx, option.WithAPIKey("test"), option.WithEndpoint(mock.server.URL), option.WithHTTPClient(mock.server.Client()))
+	if err != nil {
+		t.Fatalf("genai client: %v", err)
+	}
+	tools := []*genai.Tool{{FunctionDeclarations: []*genai.FunctionDeclaration{echoTool}}}
+	agent, err := InitAgentWithClient(ctx, client, nil, tools, echoCall, options...)
+	if err != nil {
+		t.Fatalf("init agent: %v", err)
+	}
+	t.Cleanup(func() { agent.Close() })
+	return agent
+}
+
+// clock advanced by hand, timers fire once the time passes their deadline
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.now
+}
+
+func (clock *fakeClock) After(d time.Duration) <-chan time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- clock.now
+		return ch
+	}
+	clock.waiters = append(clock.waiters, fakeWaiter{at: clock.now.Add(d), ch: ch})
+	return ch
+}
+
+// move the clock on, firing the timers that are due
+func (clock *fakeClock) Advance(d time.Duration) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	clock.now = clock.now.Add(d)
+	pending := clock.waiters[:0]
+	for _, waiter := range clock.waiters {
+		if waiter.at.After(clock.now) {
+			pending = append(pending, waiter)
+			continue
+		}
+		waiter.ch <- clock.now
+	}
+	clock.waiters = pending
+}
+
+// the number of timers waiting to fire
+func (clock *fakeClock) Waiting() int {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return len(clock.waiters)
+}
+
+// advance the clock by d each time a timer is waiting until done is closed
+// lets retry and backoff loops run without sleeping
+func (clock *fakeClock) autoAdvance(d time.Duration, done <-chan struct{}) {
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+				if clock.Waiting() > 0 {
+					clock.Advance(d)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,56 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+)
+
+/////////
+// Agent outbound call policy routines
+/////////
+
+// returned when the agent BeforeAgentCall hook denies a downstream agent call
+// a tool handler failing with it is reported to the model as the tool result
+var ErrAgentCallBlocked = errors.New("agent call blocked by policy")
+
+// outbound call hook and metadata of the turn running with a ctx
+type agentCallPolicy struct {
+	hook     func(name string, message *string, metadata map[string]string) error
+	metadata map[string]string
+}
+
+// context key for the outbound call policy
+type agentCallPolicyKey struct{}
+
+// carry the BeforeAgentCall hook and the turn metadata in ctx for the agent client calls made by tools
+// the metadata holds the session labels (e.g. tenant_id) with the agent name, session id and request id
+func (agent *Agent) withAgentCallPolicy(ctx context.Context, sess *session) context.Context {
+	if agent.BeforeAgentCall == nil {
+		return ctx
+	}
+	metadata := maps.Clone(sess.labels)
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	metadata["agent"] = agent.Name
+	metadata["session_id"] = sess.id
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		metadata["request_id"] = id
+	}
+	return context.WithValue(ctx, agentCallPolicyKey{}, &agentCallPolicy{hook: agent.BeforeAgentCall, metadata: metadata})
+}
+
+// run the BeforeAgentCall hook of the calling agent on a downstream call to the named agent
+// returning the message to send, which the hook may have rewritten
+func beforeAgentCall(ctx context.Context, name string, message string) (string, error) {
+	policy, ok := ctx.Value(agentCallPolicyKey{}).(*agentCallPolicy)
+	if !ok {
+		return message, nil
+	}
+	if err := policy.hook(name, &message, maps.Clone(policy.metadata)); err != nil {
+		return "", fmt.Errorf("%w: %s: %w", ErrAgentCallBlocked, name, err)
+	}
+	return message, nil
+}
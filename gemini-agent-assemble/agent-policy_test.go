@@ -0,0 +1,136 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// downstream calls made by a tool pass the BeforeAgentCall hook, which may rewrite or block them
+func TestBeforeAgentCall(t *testing.T) {
+	type seen struct {
+		name     string
+		message  string
+		metadata map[string]string
+	}
+	tests := []struct {
+		name    string
+		remote  string // RemoteAgent Name, the tool name is used when empty
+		hook    func(name string, message *string, metadata map[string]string) error
+		sent    string // message the downstream agent received, empty when blocked
+		blocked bool
+		seen    *seen
+	}{
+		{name: "no hook", sent: "hello"},
+		{
+			name: "allowed",
+			hook: func(name string, message *string, metadata map[string]string) error { return nil },
+			sent: "hello",
+			seen: &seen{name: "weather", message: "hello", metadata: map[string]string{"tenant": "acme", "agent": "caller", "session_id": "s1", "request_id": "r1"}},
+		},
+		{
+			name:   "named remote agent",
+			remote: "weather-service",
+			hook:   func(name string, message *string, metadata map[string]string) error { return nil },
+			sent:   "hello",
+			seen:   &seen{name: "weather-service", message: "hello", metadata: map[string]string{"tenant": "acme", "agent": "caller", "session_id": "s1", "request_id": "r1"}},
+		},
+		{
+			name: "message rewritten",
+			hook: func(name string, message *string, metadata map[string]string) error {
+				*message = strings.ToUpper(*message)
+				return nil
+			},
+			sent: "HELLO",
+		},
+		{
+			name: "metadata changes not kept",
+			hook: func(name string, message *string, metadata map[string]string) error {
+				metadata["tenant"] = "other"
+				return nil
+			},
+			sent: "hello",
+		},
+		{
+			name: "blocked",
+			hook: func(name string, message *string, metadata map[string]string) error {
+				if metadata["tenant"] == "acme" {
+					return errors.New("tenant not allowed")
+				}
+				return nil
+			},
+			blocked: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			received := []string{}
+			server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				body := Request{}
+				json.NewDecoder(req.Body).Decode(&body)
+				mu.Lock()
+				received = append(received, body.Input)
+				mu.Unlock()
+				res.Header().Set("Content-Type", "application/json")
+				res.Write([]byte(`{"content":"sunny"}`))
+			}))
+			defer server.Close()
+
+			remote := &RemoteAgent{Name: test.remote, URL: server.URL}
+			agent := newMockAgent(t, newMockGemini(t), WithToolFuncs(remote.Tool("weather", "the weather agent")))
+			agent.Name = "caller"
+			var calls []seen
+			if test.hook != nil {
+				agent.BeforeAgentCall = func(name string, message *string, metadata map[string]string) error {
+					calls = append(calls, seen{name: name, message: *message, metadata: maps.Clone(metadata)})
+					return test.hook(name, message, metadata)
+				}
+			}
+			sess := &session{id: "s1", labels: map[string]string{"tenant": "acme"}}
+			ctx, end := agent.beginTurn(withRequestID(context.Background(), "r1"), sess)
+			defer end()
+
+			part, err := agent.callTool(ctx, genai.FunctionCall{Name: subAgentToolName("weather"), Args: map[string]any{"message": "hello"}})
+			if err != nil {
+				t.Fatalf("tool call failed: %v", err)
+			}
+			response, _ := part.(genai.FunctionResponse)
+			mu.Lock()
+			defer mu.Unlock()
+			if test.blocked {
+				errText, _ := response.Response["error"].(string)
+				if len(received) != 0 || !strings.Contains(errText, ErrAgentCallBlocked.Error()) {
+					t.Errorf("received %q, tool result %v, want the call blocked for the model", received, response.Response)
+				}
+				return
+			}
+			if len(received) != 1 || received[0] != test.sent {
+				t.Errorf("received %q, want %q", received, test.sent)
+			}
+			if response.Response["result"] != "sunny" {
+				t.Errorf("tool result = %v, want the downstream reply", response.Response)
+			}
+			if test.hook != nil && len(calls) != 1 {
+				t.Fatalf("hook calls = %d, want 1", len(calls))
+			}
+			if test.seen != nil {
+				got := calls[0]
+				if got.name != test.seen.name || got.message != test.seen.message || !maps.Equal(got.metadata, test.seen.metadata) {
+					t.Errorf("hook saw %+v, want %+v", got, *test.seen)
+				}
+			}
+			if sess.labels["tenant"] != "acme" {
+				t.Errorf("session labels = %v, changed by the hook", sess.labels)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"errors"
+	"expvar"
+)
+
+/////////
+// Agent session pool routines
+/////////
+
+// pool of stateless sessions borrowed per call, served at <base path>/metrics as agent_pool
+var poolMetric = expvar.NewMap("agent_pool")
+
+// session pool usage
+type PoolStats struct {
+	InUse int `json:"in_use"`
+	Idle  int `json:"idle"`
+}
+
+// pre-warmed stateless sessions, history is cleared when a session is returned
+type sessionPool struct {
+	idle     chan *session
+	size     int
+	borrowed map[*session]bool // sessions serving calls, guarded by the agent mutex
+}
+
+// serve calls on the default session from a pool of up to size pre-warmed stateless sessions
+// each call borrows a clean session so requests never see each other's history
+func (agent *Agent) EnableSessionPool(size int) error {
+	if err := agent.checkAgent(); err != nil {
+		return err
+	}
+	if size <= 0 {
+		return errors.New("session pool size must be positive")
+	}
+	pool := &sessionPool{idle: make(chan *session, size), size: size, borrowed: map[*session]bool{}}
+	for idx := 0; idx < size; idx++ {
+		pool.idle <- &session{chat: agent.model.StartChat()}
+	}
+	agent.mu.Lock()
+	agent.pool = pool
+	agent.mu.Unlock()
+	poolMetric.Set(agent.metricLabel(), expvar.Func(func() any { return agent.PoolStats() }))
+	agent.logger().Info("session pool enabled", "size", size)
+	return nil
+}
+
+// current session pool usage, zero when the pool is not enabled or the agent is not usable
+func (agent *Agent) PoolStats() PoolStats {
+	if err := agent.checkAgent(); err != nil {
+		return PoolStats{}
+	}
+	agent.mu.Lock()
+	pool := agent.pool
+	agent.mu.Unlock()
+	if pool == nil {
+		return PoolStats{}
+	}
+	idle := len(pool.idle)
+	return PoolStats{InUse: pool.size - idle, Idle: idle}
+}
+
+// get the session for a call, borrowing from the pool for the default session when enabled
+// the returned function must be called when the call ends
+func (agent *Agent) acquireSession(ctx context.Context, sessionID string) (*session, func(), error) {
+	agent.mu.Lock()
+	pool := agent.pool
+	agent.mu.Unlock()
+	if sessionID != "" || pool == nil {
+		sess, err := agent.lookupSession(sessionID)
+		return sess, func() {}, err
+	}
+
+	// wait for an idle session
+	select {
+	case sess := <-pool.idle:
+		agent.mu.Lock()
+		pool.borrowed[sess] = true
+		agent.mu.Unlock()
+		return sess, func() {
+			agent.mu.Lock()
+			delete(pool.borrowed, sess)
+			agent.mu.Unlock()
+			// reset before reuse
+			sess.chat.History = nil
+			pool.idle <- sess
+		}, nil
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+}
+
+// cancel the turns in flight on the borrowed sessions, false when the pool is not enabled
+func (agent *Agent) cancelBorrowed() bool {
+	agent.mu.Lock()
+	pool := agent.pool
+	var cancels []context.CancelFunc
+	if pool != nil {
+		for sess := range pool.borrowed {
+			if sess.cancel != nil {
+				cancels = append(cancels, sess.cancel)
+			}
+		}
+	}
+	agent.mu.Unlock()
+	if pool == nil {
+		return false
+	}
+	if len(cancels) > 0 {
+		agent.logger().Info("cancelling pooled session turns", "turns", len(cancels))
+	}
+	for _, cancel := range cancels {
+		cancel()
+	}
+	return true
+}
@@ -0,0 +1,105 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+func TestSessionPool(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		borrow int
+		want   PoolStats
+	}{
+		{name: "all idle", size: 3, want: PoolStats{Idle: 3}},
+		{name: "some borrowed", size: 3, borrow: 2, want: PoolStats{InUse: 2, Idle: 1}},
+		{name: "all borrowed", size: 2, borrow: 2, want: PoolStats{InUse: 2}},
+		{name: "not enabled"},
+		{name: "invalid size", size: -1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newMockAgent(t, newMockGemini(t))
+			if test.size != 0 {
+				if err := agent.EnableSessionPool(test.size); (err != nil) != (test.size < 0) {
+					t.Fatalf("enable error = %v", err)
+				}
+			}
+			for idx := 0; idx < test.borrow; idx++ {
+				_, release, err := agent.acquireSession(context.Background(), "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer release()
+			}
+			if got := agent.PoolStats(); got != test.want {
+				t.Errorf("stats = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+// a returned session is clean for the next borrower
+func TestSessionPoolResetsHistory(t *testing.T) {
+	agent := newMockAgent(t, newMockGemini(t))
+	if err := agent.EnableSessionPool(1); err != nil {
+		t.Fatal(err)
+	}
+	sess, release, err := agent.acquireSession(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.chat.History = []*genai.Content{genai.NewUserContent(genai.Text("1 + 1"))}
+	release()
+	again, release, err := agent.acquireSession(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if again != sess || len(again.chat.History) != 0 {
+		t.Errorf("reused session history = %d turns, want none", len(again.chat.History))
+	}
+}
+
+// Cancel("") reaches every call on the default session, which run on borrowed sessions
+func TestSessionPoolCancel(t *testing.T) {
+	agent := newMockAgent(t, newMockGemini(t))
+	if err := agent.EnableSessionPool(3); err != nil {
+		t.Fatal(err)
+	}
+	var turns []context.Context
+	for idx := 0; idx < 2; idx++ {
+		sess, release, err := agent.acquireSession(context.Background(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer release()
+		ctx, endTurn := agent.beginTurn(context.Background(), sess)
+		defer endTurn()
+		turns = append(turns, ctx)
+	}
+
+	if err := agent.Cancel(""); err != nil {
+		t.Fatal(err)
+	}
+	for idx, ctx := range turns {
+		if ctx.Err() == nil {
+			t.Errorf("turn %d on a borrowed session was not cancelled", idx)
+		}
+	}
+
+	// a session back in the pool has nothing to cancel and a later borrower is unaffected
+	sess, release, err := agent.acquireSession(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	ctx, endTurn := agent.beginTurn(context.Background(), sess)
+	defer endTurn()
+	if ctx.Err() != nil {
+		t.Error("a new turn started cancelled")
+	}
+}
@@ -0,0 +1,62 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"strings"
+)
+
+/////////
+// Agent tool progress and output routines
+/////////
+
+// context keys for the progress and tool output reporters of a streaming call
+type progressKey struct{}
+type toolOutputKey struct{}
+
+// attach a progress reporter to a tool call context
+func withProgress(ctx context.Context, report func(message string)) context.Context {
+	return context.WithValue(ctx, progressKey{}, report)
+}
+
+// attach a tool output reporter to a tool call context
+func withToolOutput(ctx context.Context, report func(text string)) context.Context {
+	return context.WithValue(ctx, toolOutputKey{}, report)
+}
+
+// report progress from a tool handler, e.g. "calling float agent..."
+// streaming calls surface it as a progress chunk / "progress" event, otherwise it is dropped
+// must be called before the handler returns
+func ReportProgress(ctx context.Context, message string) {
+	report, ok := ctx.Value(progressKey{}).(func(message string))
+	if !ok {
+		return
+	}
+	report(message)
+}
+
+// accumulate a streamed tool result, e.g. from CallRemoteAgentStream, into the text returned to the model
+// with forward set, streaming calls also surface each piece as it arrives as a tool output chunk /
+// "tool" event, and downstream progress is passed on through ReportProgress
+func CollectToolStream(ctx context.Context, chunks <-chan StreamChunk, forward bool) (string, error) {
+	report, _ := ctx.Value(toolOutputKey{}).(func(text string))
+	var result strings.Builder
+	for chunk := range chunks {
+		switch {
+		case chunk.Err != nil:
+			// let the stream goroutine finish
+			for range chunks {
+			}
+			return "", chunk.Err
+		case chunk.Progress != "":
+			if forward {
+				ReportProgress(ctx, chunk.Progress)
+			}
+		case chunk.Text != "":
+			result.WriteString(chunk.Text)
+			if forward && report != nil {
+				report(chunk.Text)
+			}
+		}
+	}
+	return result.String(), nil
+}
@@ -0,0 +1,95 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Agent racing tool call routines
+/////////
+
+// outcome of one racing tool call
+type raceResult struct {
+	part genai.Part
+	err  error
+}
+
+// run the function calls of each RaceGroups group in a model turn concurrently
+// the first successful result answers every call in its group and the others are cancelled
+// the results are keyed by part index
+func (agent *Agent) runRaces(ctx context.Context, sess *session, parts []genai.Part) (map[int]genai.Part, error) {
+	groups := map[string][]int{}
+	for idx, part := range parts {
+		funcall, ok := part.(genai.FunctionCall)
+		if !ok {
+			continue
+		}
+		if group, ok := agent.RaceGroups[funcall.Name]; ok {
+			groups[group] = append(groups[group], idx)
+		}
+	}
+
+	results := map[int]genai.Part{}
+	for group, members := range groups {
+		winner, err := agent.race(ctx, sess, parts, members)
+		if err != nil {
+			return nil, fmt.Errorf("race group %s: %w", group, err)
+		}
+		// every call needs a response under its own name
+		for _, idx := range members {
+			results[idx] = genai.FunctionResponse{
+				Name:     parts[idx].(genai.FunctionCall).Name,
+				Response: winner.Response,
+			}
+		}
+	}
+	return results, nil
+}
+
+// run the calls concurrently and return the first successful result, cancelling the rest
+// a result reporting an error, e.g. a panic, timeout or blocked call, does not win the race
+// the last error is returned when every call fails
+func (agent *Agent) race(ctx context.Context, sess *session, parts []genai.Part, members []int) (genai.FunctionResponse, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan raceResult, len(members))
+	for _, idx := range members {
+		funcall := parts[idx].(genai.FunctionCall)
+		go func() {
+			if !agent.toolAllowed(sess, funcall.Name) {
+				results <- raceResult{err: fmt.Errorf("%w: %s not allowed in session", ErrToolFailed, funcall.Name)}
+				return
+			}
+			part, err := agent.runTool(ctx, funcall)
+			results <- raceResult{part: part, err: err}
+		}()
+	}
+
+	var err error
+	for range members {
+		result := <-results
+		if result.err != nil {
+			err = result.err
+			continue
+		}
+		response, ok := result.part.(genai.FunctionResponse)
+		if !ok {
+			continue
+		}
+		if failure, failed := response.Response["error"]; failed {
+			agent.logger().Warn("race entrant failed", "function", response.Name, "error", failure)
+			err = fmt.Errorf("%w: %s: %v", ErrToolFailed, response.Name, failure)
+			continue
+		}
+		agent.logger().Info("race won", "function", response.Name)
+		return response, nil
+	}
+	if err == nil {
+		err = fmt.Errorf("%w: no result", ErrToolFailed)
+	}
+	return genai.FunctionResponse{}, err
+}
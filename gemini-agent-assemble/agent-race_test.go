@@ -0,0 +1,103 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+func TestRace(t *testing.T) {
+	tool := func(name string, handler ToolHandler) ToolFunc {
+		return ToolFunc{Declaration: &genai.FunctionDeclaration{Name: name}, Handler: handler}
+	}
+	slow := func(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+		select {
+		case <-time.After(20 * time.Millisecond):
+			return "slow result", nil
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	fast := func(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+		return "fast result", nil
+	}
+	panics := func(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+		panic("boom")
+	}
+	fails := func(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+		return "", errors.New("unreachable")
+	}
+	hangs := func(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+
+	tests := []struct {
+		name    string
+		members []string
+		result  string
+		err     error
+	}{
+		{name: "fastest wins", members: []string{"slow", "fast"}, result: "fast result"},
+		{name: "panic does not win", members: []string{"panics", "slow"}, result: "slow result"},
+		{name: "timeout does not win", members: []string{"hangs", "slow"}, result: "slow result"},
+		{name: "error does not win", members: []string{"fails", "slow"}, result: "slow result"},
+		{name: "every member failing fails", members: []string{"panics", "fails"}, err: ErrToolFailed},
+		{name: "ungranted tool does not run", members: []string{"granted", "panics"}, err: ErrToolFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newMockAgent(t, newMockGemini(t),
+				WithToolFuncs(tool("slow", slow), tool("fast", fast), tool("panics", panics), tool("fails", fails), tool("hangs", hangs)),
+				WithGrantableTools(tool("granted", fast)))
+			agent.ToolTimeouts = map[string]time.Duration{"hangs": time.Millisecond}
+			var parts []genai.Part
+			var members []int
+			for idx, name := range test.members {
+				parts = append(parts, genai.FunctionCall{Name: name})
+				members = append(members, idx)
+			}
+
+			response, err := agent.race(context.Background(), &session{}, parts, members)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("error = %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.Response["result"] != test.result {
+				t.Errorf("winner = %v, want %q", response.Response, test.result)
+			}
+		})
+	}
+}
+
+func TestRunRacesAnswersEveryMember(t *testing.T) {
+	agent := newMockAgent(t, newMockGemini(t))
+	agent.RaceGroups = map[string]string{"echo": "lookup"}
+	parts := []genai.Part{
+		genai.FunctionCall{Name: "echo", Args: map[string]any{"text": "a"}},
+		genai.Text("between"),
+		genai.FunctionCall{Name: "echo", Args: map[string]any{"text": "a"}},
+	}
+
+	results, err := agent.runRaces(context.Background(), &session{}, parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("results = %v, want one per racing call", results)
+	}
+	for _, idx := range []int{0, 2} {
+		response, ok := results[idx].(genai.FunctionResponse)
+		if !ok || response.Name != "echo" || response.Response["result"] != "a" {
+			t.Errorf("result %d = %v", idx, results[idx])
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Agent reflected tool routines
+/////////
+
+var (
+	contextType = reflect.TypeFor[context.Context]()
+	errorType   = reflect.TypeFor[error]()
+	stringType  = reflect.TypeFor[string]()
+)
+
+// build a tool from a plain go function func(ctx context.Context, args T) (string, error), T a struct
+// the declaration parameters are derived from the exported fields of T: the json tag names the
+// argument, a description tag describes it and an enum tag lists the allowed values of a string
+// field comma separated. fields are required unless they are pointers or tagged omitempty, and a
+// recursive T is refused. the handler decodes the call arguments into T, a mismatch is an
+// ErrInvalidArgs error reported to the model
+//
+//	type calcArgs struct {
+//		Value    string `json:"value" description:"the value as a string"`
+//		Operator string `json:"operator" enum:"+,-,*,/"`
+//		Digits   int    `json:"digits,omitempty" description:"significant digits"`
+//	}
+func NewToolFunc(name string, description string, fn any) (ToolFunc, error) {
+	if fn == nil {
+		return ToolFunc{}, fmt.Errorf("tool %s: function is nil", name)
+	}
+	value := reflect.ValueOf(fn)
+	fnType := value.Type()
+	if fnType.Kind() != reflect.Func || fnType.NumIn() != 2 || fnType.NumOut() != 2 ||
+		fnType.In(0) != contextType || fnType.Out(0) != stringType || fnType.Out(1) != errorType {
+		return ToolFunc{}, fmt.Errorf("tool %s: want func(context.Context, T) (string, error), got %s", name, fnType)
+	}
+	argsType := fnType.In(1)
+	structType := argsType
+	if structType.Kind() == reflect.Pointer {
+		structType = structType.Elem()
+	}
+	if structType.Kind() != reflect.Struct {
+		return ToolFunc{}, fmt.Errorf("tool %s: args must be a struct, got %s", name, argsType)
+	}
+	parameters, err := schemaOf(structType, map[reflect.Type]bool{})
+	if err != nil {
+		return ToolFunc{}, fmt.Errorf("tool %s: %w", name, err)
+	}
+
+	handler := func(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+		data, err := json.Marshal(funcall.Args)
+		if err != nil {
+			return "", fmt.Errorf("%w: %w", ErrInvalidArgs, err)
+		}
+		args := reflect.New(structType)
+		if err := json.Unmarshal(data, args.Interface()); err != nil {
+			return "", fmt.Errorf("%w: %w", ErrInvalidArgs, err)
+		}
+		if argsType.Kind() != reflect.Pointer {
+			args = args.Elem()
+		}
+		out := value.Call([]reflect.Value{reflect.ValueOf(ctx), args})
+		err, _ = out[1].Interface().(error)
+		return out[0].String(), err
+	}
+	return ToolFunc{
+		Declaration: &genai.FunctionDeclaration{Name: name, Description: description, Parameters: parameters},
+		Handler:     handler,
+	}, nil
+}
+
+// add a tool built by NewToolFunc to the agent model, see WithToolFuncs to add tools at init
+// register tools before the agent serves calls, the tool set is not swapped under calls in flight
+func (agent *Agent) RegisterTool(name string, description string, fn any) error {
+	if err := agent.checkAgent(); err != nil {
+		agent.logger().Error(err.Error())
+		return err
+	}
+	toolFunc, err := NewToolFunc(name, description, fn)
+	if err != nil {
+		agent.logger().Error(err.Error())
+		return err
+	}
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	if agent.cache != nil {
+		return errors.New("register tools before enabling the context cache")
+	}
+	if _, ok := agent.handlers[name]; ok {
+		return fmt.Errorf("tool %s already registered", name)
+	}
+	agent.handlers[name] = toolFunc.Handler
+	agent.tools = append(append([]*genai.Tool(nil), agent.tools...), &genai.Tool{
+		FunctionDeclarations: []*genai.FunctionDeclaration{toolFunc.Declaration},
+	})
+	agent.model.Tools = agent.tools
+	// routed models copied the previous tools
+	agent.models = map[string]*genai.GenerativeModel{}
+	agent.logger().Info("tool registered", "function", name)
+	return nil
+}
+
+// schema of a go type following encoding/json naming
+// visiting holds the structs being walked, a struct containing itself has no finite schema
+func schemaOf(goType reflect.Type, visiting map[reflect.Type]bool) (*genai.Schema, error) {
+	switch goType.Kind() {
+	case reflect.Pointer:
+		return schemaOf(goType.Elem(), visiting)
+	case reflect.String:
+		return &genai.Schema{Type: genai.TypeString}, nil
+	case reflect.Bool:
+		return &genai.Schema{Type: genai.TypeBoolean}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &genai.Schema{Type: genai.TypeInteger}, nil
+	case reflect.Float32, reflect.Float64:
+		return &genai.Schema{Type: genai.TypeNumber}, nil
+	case reflect.Slice, reflect.Array:
+		items, err := schemaOf(goType.Elem(), visiting)
+		if err != nil {
+			return nil, err
+		}
+		return &genai.Schema{Type: genai.TypeArray, Items: items}, nil
+	case reflect.Map:
+		if goType.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("unsupported map key type %s", goType.Key())
+		}
+		return &genai.Schema{Type: genai.TypeObject}, nil
+	case reflect.Struct:
+		if visiting[goType] {
+			return nil, fmt.Errorf("recursive type %s", goType)
+		}
+		visiting[goType] = true
+		defer delete(visiting, goType)
+		schema := &genai.Schema{Type: genai.TypeObject, Properties: map[string]*genai.Schema{}}
+		if err := addFields(schema, goType, visiting); err != nil {
+			return nil, err
+		}
+		return schema, nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", goType)
+}
+
+// add the exported fields of a struct to an object schema, embedded structs are flattened as encoding/json does
+func addFields(schema *genai.Schema, structType reflect.Type, visiting map[reflect.Type]bool) error {
+	for idx := 0; idx < structType.NumField(); idx++ {
+		field := structType.Field(idx)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				if visiting[embedded] {
+					return fmt.Errorf("recursive type %s", embedded)
+				}
+				visiting[embedded] = true
+				err := addFields(schema, embedded, visiting)
+				delete(visiting, embedded)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		property, err := schemaOf(field.Type, visiting)
+		if err != nil {
+			return fmt.Errorf("field %s: %w", field.Name, err)
+		}
+		property.Description = field.Tag.Get("description")
+		if enum := field.Tag.Get("enum"); enum != "" {
+			// the api only takes enum values on strings
+			if property.Type != genai.TypeString {
+				return fmt.Errorf("field %s: enum tag on non-string type %s", field.Name, field.Type)
+			}
+			property.Format = "enum"
+			property.Enum = strings.Split(enum, ",")
+		}
+		schema.Properties[name] = property
+		optional := field.Type.Kind() == reflect.Pointer || strings.Contains(","+options+",", ",omitempty,")
+		if !optional {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+type reflectNode struct {
+	Name string        `json:"name"`
+	Kids []reflectNode `json:"kids"`
+}
+
+type reflectLinked struct {
+	Value int            `json:"value"`
+	Next  *reflectLinked `json:"next,omitempty"`
+}
+
+type reflectBase struct {
+	ID string `json:"id"`
+}
+
+type reflectPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+type reflectArgs struct {
+	reflectBase
+	Value    string         `json:"value" description:"the value as a string"`
+	Operator string         `json:"operator" enum:"+,-,*,/"`
+	Digits   int            `json:"digits,omitempty"`
+	Scale    *float64       `json:"scale"`
+	From     reflectPoint   `json:"from"`
+	To       reflectPoint   `json:"to"`
+	Tags     []string       `json:"tags,omitempty"`
+	Extra    map[string]any `json:"extra,omitempty"`
+	Skipped  string         `json:"-"`
+	hidden   string
+}
+
+type reflectEmbedsSelf struct {
+	*reflectEmbedsSelf
+	Name string `json:"name"`
+}
+
+type reflectIntEnum struct {
+	Level int `json:"level" enum:"1,2,3"`
+}
+
+type reflectIntMap struct {
+	Counts map[int]string `json:"counts"`
+}
+
+func TestSchemaOf(t *testing.T) {
+	tests := []struct {
+		name   string
+		goType reflect.Type
+		err    string
+	}{
+		{name: "flat struct", goType: reflect.TypeFor[reflectArgs]()},
+		{name: "recursive slice", goType: reflect.TypeFor[reflectNode](), err: "recursive type"},
+		{name: "recursive pointer", goType: reflect.TypeFor[reflectLinked](), err: "recursive type"},
+		{name: "recursive embedding", goType: reflect.TypeFor[reflectEmbedsSelf](), err: "recursive type"},
+		{name: "enum on an int", goType: reflect.TypeFor[reflectIntEnum](), err: "enum tag on non-string"},
+		{name: "map with int keys", goType: reflect.TypeFor[reflectIntMap](), err: "unsupported map key"},
+		{name: "channel", goType: reflect.TypeFor[chan int](), err: "unsupported type"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := schemaOf(test.goType, map[reflect.Type]bool{})
+			if test.err == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("error = %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestSchemaOfFields(t *testing.T) {
+	schema, err := schemaOf(reflect.TypeFor[reflectArgs](), map[reflect.Type]bool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		property string
+		typ      genai.Type
+		required bool
+	}{
+		{property: "id", typ: genai.TypeString, required: true},
+		{property: "value", typ: genai.TypeString, required: true},
+		{property: "operator", typ: genai.TypeString, required: true},
+		{property: "digits", typ: genai.TypeInteger},
+		{property: "scale", typ: genai.TypeNumber},
+		{property: "from", typ: genai.TypeObject, required: true},
+		{property: "to", typ: genai.TypeObject, required: true},
+		{property: "tags", typ: genai.TypeArray},
+		{property: "extra", typ: genai.TypeObject},
+	}
+	for _, test := range tests {
+		t.Run(test.property, func(t *testing.T) {
+			property, ok := schema.Properties[test.property]
+			if !ok {
+				t.Fatalf("missing property, have %v", schema.Properties)
+			}
+			if property.Type != test.typ {
+				t.Errorf("type = %v, want %v", property.Type, test.typ)
+			}
+			required := false
+			for _, name := range schema.Required {
+				required = required || name == test.property
+			}
+			if required != test.required {
+				t.Errorf("required = %v, want %v", required, test.required)
+			}
+		})
+	}
+	if len(schema.Properties) != len(tests) {
+		t.Errorf("properties = %d, want %d", len(schema.Properties), len(tests))
+	}
+	if enum := schema.Properties["operator"].Enum; strings.Join(enum, ",") != "+,-,*,/" {
+		t.Errorf("enum = %v", enum)
+	}
+	if description := schema.Properties["value"].Description; description != "the value as a string" {
+		t.Errorf("description = %q", description)
+	}
+}
+
+func TestNewToolFunc(t *testing.T) {
+	calc := func(ctx context.Context, args reflectArgs) (string, error) {
+		return args.Value + args.Operator, nil
+	}
+	tests := []struct {
+		name   string
+		fn     any
+		args   map[string]any
+		result string
+		err    error
+		build  bool
+	}{
+		{name: "decodes the args", fn: calc, args: map[string]any{"value": "1", "operator": "+"}, result: "1+", build: true},
+		{name: "mismatched args", fn: calc, args: map[string]any{"value": 1}, err: ErrInvalidArgs, build: true},
+		{name: "pointer args", fn: func(ctx context.Context, args *reflectBase) (string, error) { return args.ID, nil }, args: map[string]any{"id": "x"}, result: "x", build: true},
+		{name: "nil function", fn: nil},
+		{name: "wrong signature", fn: func(args reflectArgs) string { return "" }},
+		{name: "args not a struct", fn: func(ctx context.Context, args string) (string, error) { return args, nil }},
+		{name: "recursive args", fn: func(ctx context.Context, args reflectNode) (string, error) { return "", nil }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			toolFunc, err := NewToolFunc("calc", "calculate", test.fn)
+			if !test.build {
+				if err == nil {
+					t.Fatal("expected a build error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := toolFunc.Handler(context.Background(), genai.FunctionCall{Name: "calc", Args: test.args})
+			if !errors.Is(err, test.err) {
+				t.Fatalf("error = %v, want %v", err, test.err)
+			}
+			if result != test.result {
+				t.Errorf("result = %q, want %q", result, test.result)
+			}
+		})
+	}
+}
+
+func TestRegisterTool(t *testing.T) {
+	agent := newMockAgent(t, newMockGemini(t))
+	fn := func(ctx context.Context, args reflectBase) (string, error) { return args.ID, nil }
+	if err := agent.RegisterTool("lookup", "look up an id", fn); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.RegisterTool("lookup", "look up an id", fn); err == nil {
+		t.Error("expected a duplicate registration to fail")
+	}
+	result, err := agent.dispatchTool(context.Background(), genai.FunctionCall{Name: "lookup", Args: map[string]any{"id": "a1"}})
+	if err != nil || result != "a1" {
+		t.Errorf("dispatch = %q, %v", result, err)
+	}
+	if len(agent.model.Tools) != 2 {
+		t.Errorf("model tools = %d, want the echo tool and lookup", len(agent.model.Tools))
+	}
+}
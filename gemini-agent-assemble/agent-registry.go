@@ -0,0 +1,94 @@
+package geminiagentassemble
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+/////////
+// Agent registry and discovery routines
+/////////
+
+// returned when a logical agent name has no registered endpoint
+var ErrAgentNotRegistered = errors.New("agent not registered")
+
+// resolves a logical agent name to its endpoint url
+// implement this to back discovery with consul, dns srv etc
+type Resolver interface {
+	Resolve(name string) (string, error)
+}
+
+// in-memory registry of agent endpoint urls, optionally file backed
+type Registry struct {
+	mu     sync.RWMutex
+	agents map[string]string
+}
+
+// create an empty registry
+func NewRegistry() *Registry {
+	return &Registry{agents: map[string]string{}}
+}
+
+// load a registry from a json file of {"<name>": "<url>"}
+func LoadRegistry(path string) (*Registry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	registry := NewRegistry()
+	err = json.Unmarshal(data, &registry.agents)
+	if err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+// save the registry to a json file of {"<name>": "<url>"}
+func (registry *Registry) Save(path string) error {
+	registry.mu.RLock()
+	data, err := json.MarshalIndent(registry.agents, "", "  ")
+	registry.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// register (or replace) the endpoint url for an agent name
+func (registry *Registry) Register(name string, url string) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.agents[name] = url
+}
+
+// remove an agent name
+func (registry *Registry) Deregister(name string) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	delete(registry.agents, name)
+}
+
+// resolve an agent name to its endpoint url
+func (registry *Registry) Resolve(name string) (string, error) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	url, ok := registry.agents[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrAgentNotRegistered, name)
+	}
+	return url, nil
+}
+
+// process wide registry used by Register()
+var DefaultRegistry = NewRegistry()
+
+// resolver consulted by CallAgentByName(), replace to use another discovery backend
+var DefaultResolver Resolver = DefaultRegistry
+
+// register an agent endpoint url in the default registry
+func Register(name string, url string) {
+	DefaultRegistry.Register(name, url)
+}
@@ -0,0 +1,137 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/////////
+// Remote agent client routines
+/////////
+
+// default retries of an unavailable remote agent and the first retry delay, doubled on each retry
+const (
+	DefaultRemoteRetries = 2
+	DefaultRemoteBackoff = 500 * time.Millisecond
+)
+
+// client for an agent served by RunAgent, sharing its Request / Response types
+type RemoteAgent struct {
+	// optional logical name given to the BeforeAgentCall hook, the URL when not set
+	Name string
+	// agent endpoint url, e.g. http://<hostname>:<port><base path>/agent
+	URL string
+	// optional bearer token sent in the Authorization header
+	AuthToken string
+	// http client for calls, streams use its transport without the total call timeout
+	HTTPClient *http.Client
+	// retries while the remote agent is unavailable, streams are not retried once started
+	Retries int
+	// limit on the reply body or the whole stream, DefaultMaxResponseBytes when not set
+	MaxResponseBytes int64
+	// time source for the retry backoff, RealClock when not set
+	Clock Clock
+}
+
+// create a client for the agent served at <hostname>:<port><base path>
+func NewRemoteAgent(hostname string, port string, basePath string) *RemoteAgent {
+	basePath = strings.TrimRight(basePath, "/")
+	if basePath != "" && !strings.HasPrefix(basePath, "/") {
+		basePath = "/" + basePath
+	}
+	return &RemoteAgent{
+		URL:        "http://" + hostname + ":" + port + basePath + "/agent",
+		HTTPClient: DefaultHTTPClient,
+		Retries:    DefaultRemoteRetries,
+	}
+}
+
+// call the remote agent, retrying with backoff while it is unavailable
+// retries made from a tool count against the calling agent retry budget
+func (remote *RemoteAgent) Call(ctx context.Context, input string) (Response, error) {
+	input, err := beforeAgentCall(ctx, remote.name(), input)
+	if err != nil {
+		return Response{}, err
+	}
+	var response Response
+	for attempt := 0; attempt <= remote.Retries; attempt++ {
+		if attempt > 0 {
+			if !allowRetry(ctx) {
+				break
+			}
+			select {
+			case <-remote.clock().After(DefaultRemoteBackoff << (attempt - 1)):
+			case <-ctx.Done():
+				return Response{}, ctx.Err()
+			}
+		}
+		response, err = postRemoteAgent(ctx, remote.httpClient(), remote.URL, input, remote.AuthToken, remote.maxResponseBytes())
+		if !errors.Is(err, ErrDownstreamUnavailable) {
+			return response, err
+		}
+	}
+	return Response{}, err
+}
+
+// stream the remote agent reply, see CallRemoteAgentStream
+// only the connection is retried, a stream that fails part way is not restarted
+func (remote *RemoteAgent) Stream(ctx context.Context, input string) (<-chan StreamChunk, error) {
+	input, err := beforeAgentCall(ctx, remote.name(), input)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: remote.httpClient().Transport}
+	var chunks <-chan StreamChunk
+	for attempt := 0; attempt <= remote.Retries; attempt++ {
+		if attempt > 0 {
+			if !allowRetry(ctx) {
+				break
+			}
+			select {
+			case <-remote.clock().After(DefaultRemoteBackoff << (attempt - 1)):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		chunks, err = streamRemoteAgent(ctx, client, remote.URL+"/stream", input, remote.AuthToken, remote.maxResponseBytes())
+		if !errors.Is(err, ErrDownstreamUnavailable) {
+			return chunks, err
+		}
+	}
+	return nil, err
+}
+
+// the name given to the BeforeAgentCall hook
+func (remote *RemoteAgent) name() string {
+	if remote.Name != "" {
+		return remote.Name
+	}
+	return remote.URL
+}
+
+// the retry backoff clock, RealClock when not set
+func (remote *RemoteAgent) clock() Clock {
+	if remote.Clock == nil {
+		return RealClock
+	}
+	return remote.Clock
+}
+
+// the http client for calls, DefaultHTTPClient when not set
+func (remote *RemoteAgent) httpClient() *http.Client {
+	if remote.HTTPClient == nil {
+		return DefaultHTTPClient
+	}
+	return remote.HTTPClient
+}
+
+// the reply size limit, DefaultMaxResponseBytes when not set
+func (remote *RemoteAgent) maxResponseBytes() int64 {
+	if remote.MaxResponseBytes <= 0 {
+		return DefaultMaxResponseBytes
+	}
+	return remote.MaxResponseBytes
+}
@@ -0,0 +1,172 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRemoteAgentBackoff(t *testing.T) {
+	tests := []struct {
+		name        string
+		unavailable int32
+		retries     int
+		err         error
+		attempts    int32
+		waited      time.Duration
+	}{
+		{name: "first attempt", unavailable: 0, retries: 2, attempts: 1},
+		{name: "recovers on retry", unavailable: 2, retries: 2, attempts: 3, waited: DefaultRemoteBackoff * 3},
+		{name: "stays unavailable", unavailable: 5, retries: 2, err: ErrDownstreamUnavailable, attempts: 3, waited: DefaultRemoteBackoff * 3},
+		{name: "no retries", unavailable: 1, retries: 0, err: ErrDownstreamUnavailable, attempts: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				if attempts.Add(1) <= test.unavailable {
+					http.Error(res, "Service Unavailable", http.StatusServiceUnavailable)
+					return
+				}
+				json.NewEncoder(res).Encode(Response{Content: "42"})
+			}))
+			defer server.Close()
+
+			clock := newFakeClock()
+			start := clock.Now()
+			done := make(chan struct{})
+			defer close(done)
+			clock.autoAdvance(DefaultRemoteBackoff/2, done)
+			remote := &RemoteAgent{URL: server.URL, HTTPClient: server.Client(), Retries: test.retries, Clock: clock}
+
+			response, err := remote.Call(context.Background(), "question")
+			if !errors.Is(err, test.err) {
+				t.Fatalf("error = %v, want %v", err, test.err)
+			}
+			if test.err == nil && response.Content != "42" {
+				t.Errorf("content = %q, want 42", response.Content)
+			}
+			if got := attempts.Load(); got != test.attempts {
+				t.Errorf("attempts = %d, want %d", got, test.attempts)
+			}
+			if waited := clock.Now().Sub(start); waited != test.waited {
+				t.Errorf("backoff = %v, want %v", waited, test.waited)
+			}
+		})
+	}
+}
+
+// a downstream rejecting the caller credentials fails at once with its status, it is not retried
+func TestRemoteAgentAuth(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		status int
+		err    error
+	}{
+		{name: "token accepted", token: "secret"},
+		{name: "no token", status: http.StatusUnauthorized, err: ErrDownstreamFailed},
+		{name: "wrong token", token: "guess", status: http.StatusUnauthorized, err: ErrDownstreamFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				attempts.Add(1)
+				if req.Header.Get("Authorization") != "Bearer secret" {
+					http.Error(res, "Unauthorized", http.StatusUnauthorized)
+					return
+				}
+				json.NewEncoder(res).Encode(Response{Content: "42"})
+			}))
+			defer server.Close()
+			remote := &RemoteAgent{URL: server.URL, HTTPClient: server.Client(), AuthToken: test.token, Retries: 2}
+
+			response, err := remote.Call(context.Background(), "question")
+			if !errors.Is(err, test.err) {
+				t.Fatalf("error = %v, want %v", err, test.err)
+			}
+			if attempts.Load() != 1 {
+				t.Errorf("attempts = %d, want 1", attempts.Load())
+			}
+			if test.err == nil {
+				if response.Content != "42" {
+					t.Errorf("content = %q, want 42", response.Content)
+				}
+				return
+			}
+			if ErrorCodeOf(err) != CodeDownstream || !strings.Contains(err.Error(), "401") {
+				t.Errorf("error = %v, want a downstream error carrying the 401", err)
+			}
+		})
+	}
+}
+
+// a downstream reply or stream over the size limit fails instead of being read into memory
+func TestRemoteAgentMaxResponseBytes(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int64
+		size   int
+		stream bool
+		err    bool
+	}{
+		{name: "reply under the limit", limit: 1024, size: 100},
+		{name: "reply over the limit", limit: 1024, size: 2048, err: true},
+		{name: "default limit", size: 2048},
+		{name: "stream under the limit", limit: 1024, size: 100, stream: true},
+		{name: "stream over the limit", limit: 1024, size: 2048, stream: true, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content := strings.Repeat("x", test.size)
+			server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				if strings.HasSuffix(req.URL.Path, "/stream") {
+					res.Header().Set("Content-Type", "text/event-stream")
+					// the whole stream counts, not each event
+					for sent := 0; sent < test.size; sent += 100 {
+						writeStreamEvent(res, "chunk", Response{Content: content[:100]})
+					}
+					writeStreamEvent(res, "done", Response{})
+					return
+				}
+				res.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(res).Encode(Response{Content: content})
+			}))
+			defer server.Close()
+			remote := &RemoteAgent{URL: server.URL + "/agent", MaxResponseBytes: test.limit}
+
+			var err error
+			if test.stream {
+				var chunks <-chan StreamChunk
+				chunks, err = remote.Stream(context.Background(), "question")
+				if err != nil {
+					t.Fatal(err)
+				}
+				for chunk := range chunks {
+					if chunk.Err != nil {
+						err = chunk.Err
+					}
+				}
+			} else {
+				var response Response
+				response, err = remote.Call(context.Background(), "question")
+				if err == nil && response.Content != content {
+					t.Errorf("content = %d bytes, want %d", len(response.Content), test.size)
+				}
+			}
+			if test.err != errors.Is(err, ErrResponseTooLarge) {
+				t.Errorf("error = %v, want ErrResponseTooLarge %v", err, test.err)
+			}
+			if !test.err && err != nil {
+				t.Errorf("error = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package geminiagentassemble
+
+import (
+	"container/list"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Agent response cache routines
+/////////
+
+// lru cache of final replies to fresh prompts
+type responseCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // most recently used first
+	entries map[string]*list.Element
+}
+
+// cached reply
+type responseEntry struct {
+	key     string
+	text    string
+	raw     *genai.GenerateContentResponse
+	expires time.Time
+}
+
+// answer repeated prompts from a cache of up to size replies kept for ttl, for deterministic agents
+// only prompts starting a conversation are cached, keyed by model, system instruction, tools and
+// the whitespace normalized message. replies that called a SideEffectTools tool are not cached
+func (agent *Agent) EnableResponseCache(size int, ttl time.Duration) error {
+	if err := agent.checkAgent(); err != nil {
+		return err
+	}
+	if size <= 0 || ttl <= 0 {
+		return errors.New("response cache size and ttl must be positive")
+	}
+	agent.mu.Lock()
+	agent.responses = &responseCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+	agent.mu.Unlock()
+	agent.logger().Info("response cache enabled", "size", size, "ttl", ttl)
+	return nil
+}
+
+// cache key for a prompt on a session, empty when the cache is off or the session has history
+func (agent *Agent) responseCacheKey(sess *session, modelName string, message string, history int) string {
+	agent.mu.Lock()
+	enabled := agent.responses != nil
+	agent.mu.Unlock()
+	if !enabled || history > 0 {
+		return ""
+	}
+
+	system := agent.model.SystemInstruction
+	if sess.system != nil {
+		system = sess.system
+	}
+	var instruction []string
+	if system != nil {
+		for _, part := range system.Parts {
+			if text, ok := part.(genai.Text); ok {
+				instruction = append(instruction, string(text))
+			}
+		}
+	}
+	var tools []string
+	for _, tool := range agent.model.Tools {
+		for _, declaration := range tool.FunctionDeclarations {
+			if sess.allows(declaration.Name) {
+				tools = append(tools, declaration.Name)
+			}
+		}
+	}
+	sort.Strings(tools)
+	normalized := strings.Join(strings.Fields(message), " ")
+	return strings.Join([]string{modelName, strings.Join(instruction, "\n"), strings.Join(tools, ","), normalized}, "\x00")
+}
+
+// look up a cached reply
+func (agent *Agent) cachedResponse(key string) (*responseEntry, bool) {
+	if key == "" {
+		return nil, false
+	}
+	agent.mu.Lock()
+	cache := agent.responses
+	agent.mu.Unlock()
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*responseEntry)
+	if agent.clock().Now().After(entry.expires) {
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+		return nil, false
+	}
+	cache.order.MoveToFront(element)
+	return entry, true
+}
+
+// keep a reply, evicting the least recently used when full
+func (agent *Agent) storeResponse(key string, result *callResult, called []string) {
+	if key == "" {
+		return
+	}
+	for _, name := range called {
+		for _, sideEffect := range agent.SideEffectTools {
+			if name == sideEffect {
+				return
+			}
+		}
+	}
+	agent.mu.Lock()
+	cache := agent.responses
+	agent.mu.Unlock()
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if element, ok := cache.entries[key]; ok {
+		cache.order.Remove(element)
+	}
+	entry := &responseEntry{key: key, text: result.text, raw: result.raw, expires: agent.clock().Now().Add(cache.ttl)}
+	cache.entries[key] = cache.order.PushFront(entry)
+	for cache.order.Len() > cache.size {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*responseEntry).key)
+	}
+}
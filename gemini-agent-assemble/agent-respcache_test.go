@@ -0,0 +1,160 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+func TestResponseCache(t *testing.T) {
+	requireModelCalls(t)
+	finalTool := ToolFunc{
+		Declaration: &genai.FunctionDeclaration{Name: "answer"},
+		Handler: func(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+			return "the final answer", nil
+		},
+		Final: true,
+	}
+	tests := []struct {
+		name        string
+		reply       mockReply
+		sideEffects []string
+		want        string
+		cached      bool
+	}{
+		{name: "text answer", reply: textReply("42"), want: "42", cached: true},
+		{name: "final tool answer", reply: callReply("answer", nil), want: "the final answer", cached: true},
+		{name: "side effect tool", reply: callReply("answer", nil), sideEffects: []string{"answer"}, want: "the final answer"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := newMockGemini(t, test.reply, test.reply)
+			agent := newMockAgent(t, mock, WithToolFuncs(finalTool))
+			agent.SideEffectTools = test.sideEffects
+			if err := agent.EnableResponseCache(8, time.Hour); err != nil {
+				t.Fatal(err)
+			}
+
+			// the same prompt opening two sessions
+			var history []*genai.Content
+			for call := 0; call < 2; call++ {
+				id, err := agent.NewSessionID()
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := agent.CallAgentSession(context.Background(), id, "question")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != test.want {
+					t.Errorf("call %d = %q, want %q", call, got, test.want)
+				}
+				agent.mu.Lock()
+				history = agent.sessions[id].chat.History
+				agent.mu.Unlock()
+			}
+
+			sent := len(mock.received())
+			if test.cached && sent != 1 {
+				t.Errorf("model requests = %d, want the second call from the cache", sent)
+			}
+			if !test.cached && sent < 2 {
+				t.Errorf("model requests = %d, want the second call sent to the model", sent)
+			}
+			// the session that got the reply continues from the answer
+			last := history[len(history)-1]
+			if text, ok := last.Parts[0].(genai.Text); last.Role != "model" || !ok || string(text) != test.want {
+				t.Errorf("last history turn = %s %v, want the model answer", last.Role, last.Parts)
+			}
+		})
+	}
+}
+
+func TestResponseCacheKey(t *testing.T) {
+	agent := newMockAgent(t, newMockGemini(t))
+	if err := agent.EnableResponseCache(8, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	open := &session{}
+	base := agent.responseCacheKey(open, DefaultModel, "what is 2+2?", 0)
+	tests := []struct {
+		name    string
+		sess    *session
+		model   string
+		message string
+		history int
+		same    bool
+		empty   bool
+	}{
+		{name: "same prompt", sess: open, model: DefaultModel, message: "what is 2+2?", same: true},
+		{name: "whitespace normalized", sess: open, model: DefaultModel, message: "  what is\n2+2? ", same: true},
+		{name: "other message", sess: open, model: DefaultModel, message: "what is 3+3?"},
+		{name: "other model", sess: open, model: "gemini-other", message: "what is 2+2?"},
+		{name: "scoped tools", sess: &session{tools: map[string]bool{}}, model: DefaultModel, message: "what is 2+2?"},
+		{name: "session instruction", sess: &session{system: genai.NewUserContent(genai.Text("be brief"))}, model: DefaultModel, message: "what is 2+2?"},
+		{name: "conversation under way", sess: open, model: DefaultModel, message: "what is 2+2?", history: 2, empty: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key := agent.responseCacheKey(test.sess, test.model, test.message, test.history)
+			if test.empty {
+				if key != "" {
+					t.Errorf("key = %q, want none", key)
+				}
+				return
+			}
+			if (key == base) != test.same {
+				t.Errorf("key matches = %v, want %v", key == base, test.same)
+			}
+		})
+	}
+
+	disabled := newMockAgent(t, newMockGemini(t))
+	if key := disabled.responseCacheKey(open, DefaultModel, "what is 2+2?", 0); key != "" {
+		t.Errorf("key without the cache = %q, want none", key)
+	}
+}
+
+// entries expire after the ttl and the least recently used is evicted when full
+func TestResponseCacheEviction(t *testing.T) {
+	tests := []struct {
+		name    string
+		stores  []string
+		lookups []string
+		called  []string
+		after   time.Duration
+		hits    []bool
+	}{
+		{name: "hit", stores: []string{"a"}, lookups: []string{"a", "b"}, hits: []bool{true, false}},
+		{name: "least recent evicted", stores: []string{"a", "b", "c"}, lookups: []string{"a", "b", "c"}, hits: []bool{false, true, true}},
+		{name: "expired", stores: []string{"a"}, after: 2 * time.Hour, lookups: []string{"a"}, hits: []bool{false}},
+		{name: "side effect not kept", stores: []string{"a"}, called: []string{"echo", "charge"}, lookups: []string{"a"}, hits: []bool{false}},
+		{name: "other tool kept", stores: []string{"a"}, called: []string{"echo"}, lookups: []string{"a"}, hits: []bool{true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := newFakeClock()
+			agent := newMockAgent(t, newMockGemini(t))
+			agent.Clock = clock
+			agent.SideEffectTools = []string{"charge"}
+			if err := agent.EnableResponseCache(2, time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range test.stores {
+				agent.storeResponse(key, &callResult{text: "reply " + key}, test.called)
+			}
+			clock.Advance(test.after)
+			for idx, key := range test.lookups {
+				entry, hit := agent.cachedResponse(key)
+				if hit != test.hits[idx] {
+					t.Errorf("lookup %q hit = %v, want %v", key, hit, test.hits[idx])
+				}
+				if hit && entry.text != "reply "+key {
+					t.Errorf("lookup %q = %q", key, entry.text)
+				}
+			}
+		})
+	}
+}
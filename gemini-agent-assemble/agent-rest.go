@@ -0,0 +1,71 @@
+package geminiagentassemble
+
+import (
+	"net/http"
+)
+
+/////////
+// Agent RESTful session routes
+/////////
+
+// reply to POST <base path>/sessions
+type SessionCreated struct {
+	ID string `json:"id"`
+}
+
+// reply to GET <base path>/sessions/{id}
+type SessionHistory struct {
+	ID      string `json:"id"`
+	History []Turn `json:"history"`
+}
+
+// register the session lifecycle routes, the flat /agent route is unchanged
+func (agent *Agent) registerSessionRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST "+agent.basePath+"/sessions", agent.HandleCreateSession)
+	mux.HandleFunc("POST "+agent.basePath+"/sessions/{id}/messages", agent.HandleSessionMessage)
+	mux.HandleFunc("GET "+agent.basePath+"/sessions/{id}", agent.HandleGetSession)
+	mux.HandleFunc("DELETE "+agent.basePath+"/sessions/{id}", agent.HandleDeleteSession)
+}
+
+// create session handler for POST <base path>/sessions, replies 201 with the new id
+func (agent *Agent) HandleCreateSession(res http.ResponseWriter, req *http.Request) {
+	agent.setNameHeader(res)
+	id, err := agent.NewSessionID()
+	if err != nil {
+		status := errorStatus(req.Context(), err)
+		http.Error(res, http.StatusText(status), status)
+		return
+	}
+	res.Header().Set("Location", agent.basePath+"/sessions/"+id)
+	agent.writeBody(res, http.StatusCreated, SessionCreated{ID: id})
+}
+
+// send a turn handler for POST <base path>/sessions/{id}/messages
+// the body is a Request without history, the reply a Response
+func (agent *Agent) HandleSessionMessage(res http.ResponseWriter, req *http.Request) {
+	agent.serveAgentRequest(res, req, req.PathValue("id"))
+}
+
+// history handler for GET <base path>/sessions/{id}
+func (agent *Agent) HandleGetSession(res http.ResponseWriter, req *http.Request) {
+	agent.setNameHeader(res)
+	id := req.PathValue("id")
+	history, err := agent.History(id)
+	if err != nil {
+		status := errorStatus(req.Context(), err)
+		http.Error(res, http.StatusText(status), status)
+		return
+	}
+	agent.writeBody(res, http.StatusOK, SessionHistory{ID: id, History: historyToTurns(history)})
+}
+
+// end session handler for DELETE <base path>/sessions/{id}, replies 204
+func (agent *Agent) HandleDeleteSession(res http.ResponseWriter, req *http.Request) {
+	agent.setNameHeader(res)
+	if err := agent.EndSession(req.PathValue("id")); err != nil {
+		status := errorStatus(req.Context(), err)
+		http.Error(res, http.StatusText(status), status)
+		return
+	}
+	res.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,94 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+)
+
+/////////
+// Agent retry budget routines
+/////////
+
+// retries shed by the retry budget per agent, served at <base path>/metrics as agent_retries_shed
+var retriesShedMetric = expvar.NewMap("agent_retries_shed")
+
+// retries a budget allows in a burst, e.g. just after start, before the ratio applies
+const DefaultRetryBudgetBurst = 10
+
+// token bucket shared by the retries of an agent, each turn adds ratio tokens and each retry takes one
+type retryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	tokens float64
+	label  string
+}
+
+// limit the retries of overloaded or empty model replies and of downstream agent calls made by
+// tools to a ratio of the agent turns, e.g. 0.1 for at most 10% retries, plus a small burst
+// once the budget is spent retries are shed and the failure is returned, so agents do not pile on
+// retries during a sustained outage
+func (agent *Agent) SetRetryBudget(ratio float64) error {
+	if err := agent.checkAgent(); err != nil {
+		return err
+	}
+	if ratio <= 0 || ratio > 1 {
+		return errors.New("retry budget ratio must be above 0 and at most 1")
+	}
+	budget := &retryBudget{ratio: ratio, tokens: DefaultRetryBudgetBurst, label: agent.metricLabel()}
+	agent.mu.Lock()
+	agent.retries = budget
+	agent.mu.Unlock()
+	agent.logger().Info("retry budget set", "ratio", ratio)
+	return nil
+}
+
+// the retry budget, nil when retries are not budgeted
+func (agent *Agent) retryBudget() *retryBudget {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	return agent.retries
+}
+
+// credit the budget for a turn
+func (budget *retryBudget) deposit() {
+	if budget == nil {
+		return
+	}
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+	budget.tokens = min(budget.tokens+budget.ratio, DefaultRetryBudgetBurst)
+}
+
+// take a token for a retry, false when the retry must be shed
+func (budget *retryBudget) allow() bool {
+	if budget == nil {
+		return true
+	}
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+	if budget.tokens < 1 {
+		retriesShedMetric.Add(budget.label, 1)
+		return false
+	}
+	budget.tokens--
+	return true
+}
+
+// context key for the retry budget of the agent running a turn
+type retryBudgetKey struct{}
+
+// carry the retry budget in ctx for the agent client calls made by tools
+func withRetryBudget(ctx context.Context, budget *retryBudget) context.Context {
+	if budget == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, retryBudgetKey{}, budget)
+}
+
+// take a retry token from the budget of the calling agent, always true outside a budgeted turn
+func allowRetry(ctx context.Context) bool {
+	budget, _ := ctx.Value(retryBudgetKey{}).(*retryBudget)
+	return budget.allow()
+}
@@ -0,0 +1,160 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSetRetryBudget(t *testing.T) {
+	tests := []struct {
+		ratio float64
+		err   bool
+	}{
+		{ratio: 0.1},
+		{ratio: 1},
+		{ratio: 0, err: true},
+		{ratio: -0.5, err: true},
+		{ratio: 1.5, err: true},
+	}
+	for _, test := range tests {
+		agent := newMockAgent(t, newMockGemini(t))
+		err := agent.SetRetryBudget(test.ratio)
+		if (err != nil) != test.err {
+			t.Errorf("SetRetryBudget(%v) error = %v, want error %v", test.ratio, err, test.err)
+		}
+		if budget := agent.retryBudget(); (budget == nil) != test.err {
+			t.Errorf("SetRetryBudget(%v) budget = %v, want set %v", test.ratio, budget, !test.err)
+		}
+	}
+}
+
+// each turn credits ratio tokens up to the burst and each retry takes one
+func TestRetryBudget(t *testing.T) {
+	tests := []struct {
+		name    string
+		ratio   float64
+		spent   int // retries taken before the turns
+		turns   int
+		retries int
+		allowed int
+		unset   bool
+	}{
+		{name: "no budget", unset: true, retries: 50, allowed: 50},
+		{name: "burst", ratio: 0.1, retries: 12, allowed: DefaultRetryBudgetBurst},
+		{name: "burst is the cap", ratio: 0.5, turns: 100, retries: 12, allowed: DefaultRetryBudgetBurst},
+		{name: "spent budget refilled by turns", ratio: 0.1, spent: DefaultRetryBudgetBurst, turns: 20, retries: 5, allowed: 2},
+		{name: "partial token not spent", ratio: 0.1, spent: DefaultRetryBudgetBurst, turns: 9, retries: 1, allowed: 0},
+		{name: "full ratio", ratio: 1, spent: DefaultRetryBudgetBurst, turns: 3, retries: 5, allowed: 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var budget *retryBudget
+			if !test.unset {
+				budget = &retryBudget{ratio: test.ratio, tokens: DefaultRetryBudgetBurst, label: "test"}
+			}
+			for range test.spent {
+				budget.allow()
+			}
+			for range test.turns {
+				budget.deposit()
+			}
+			allowed := 0
+			for range test.retries {
+				if budget.allow() {
+					allowed++
+				}
+			}
+			if allowed != test.allowed {
+				t.Errorf("allowed retries = %d, want %d", allowed, test.allowed)
+			}
+		})
+	}
+}
+
+// downstream calls made from a budgeted turn retry only while the budget lasts
+func TestRetryBudgetRemoteAgent(t *testing.T) {
+	tests := []struct {
+		name     string
+		tokens   float64 // budget left, negative for a call outside a budgeted turn
+		attempts int32
+	}{
+		{name: "unbudgeted", tokens: -1, attempts: 4},
+		{name: "budget covers the retries", tokens: 5, attempts: 4},
+		{name: "budget runs out", tokens: 1, attempts: 2},
+		{name: "budget spent", tokens: 0, attempts: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				attempts.Add(1)
+				http.Error(res, "Service Unavailable", http.StatusServiceUnavailable)
+			}))
+			defer server.Close()
+			clock := newFakeClock()
+			done := make(chan struct{})
+			defer close(done)
+			clock.autoAdvance(time.Minute, done)
+
+			ctx := context.Background()
+			if test.tokens >= 0 {
+				ctx = withRetryBudget(ctx, &retryBudget{ratio: 0.1, tokens: test.tokens, label: "test"})
+			}
+			remote := &RemoteAgent{URL: server.URL, Retries: 3, Clock: clock}
+			if _, err := remote.Call(ctx, "question"); !errors.Is(err, ErrDownstreamUnavailable) {
+				t.Errorf("error = %v, want %v", err, ErrDownstreamUnavailable)
+			}
+			if got := attempts.Load(); got != test.attempts {
+				t.Errorf("attempts = %d, want %d", got, test.attempts)
+			}
+		})
+	}
+}
+
+// overloaded model retries stop once the budget is spent, the turn itself credits a fraction
+func TestRetryBudgetModelRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		tokens   float64 // budget left before the turn, negative for no budget
+		requests int
+	}{
+		{name: "no budget", tokens: -1, requests: 4},
+		{name: "budget covers the retries", tokens: 5, requests: 4},
+		{name: "budget runs out", tokens: 1, requests: 2},
+		{name: "budget spent", tokens: 0, requests: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			replies := []mockReply{}
+			for range test.requests {
+				replies = append(replies, errorReply(http.StatusServiceUnavailable))
+			}
+			mock := newMockGemini(t, replies...)
+			agent := newMockAgent(t, mock)
+			agent.ModelRetries = 3
+			if test.tokens >= 0 {
+				agent.retries = &retryBudget{ratio: 0.1, tokens: test.tokens, label: "test"}
+			}
+			clock := newFakeClock()
+			done := make(chan struct{})
+			defer close(done)
+			clock.autoAdvance(time.Minute, done)
+			agent.Clock = clock
+			if err := agent.NewSession(); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := agent.callAgent(context.Background(), "", "question"); !errors.Is(err, ErrModelFailed) {
+				t.Errorf("error = %v, want %v", err, ErrModelFailed)
+			}
+			if got := len(mock.received()); got != test.requests {
+				t.Errorf("model requests = %d, want %d", got, test.requests)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Agent per request response schema routines
+/////////
+
+// returned when a request names an unknown schema or carries an invalid one
+var ErrInvalidSchema = errors.New("invalid response schema")
+
+// json form of a response schema carried on a request
+type Schema struct {
+	Type        string             `json:"type"` // string, number, integer, boolean, array or object
+	Format      string             `json:"format,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Nullable    bool               `json:"nullable,omitempty"`
+	Enum        []string           `json:"enum,omitempty"`
+	Items       *Schema            `json:"items,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+}
+
+// json schema type names
+var schemaTypes = map[string]genai.Type{
+	"string":  genai.TypeString,
+	"number":  genai.TypeNumber,
+	"integer": genai.TypeInteger,
+	"boolean": genai.TypeBoolean,
+	"array":   genai.TypeArray,
+	"object":  genai.TypeObject,
+}
+
+// validate a request schema and convert it for the model
+func (schema *Schema) genai() (*genai.Schema, error) {
+	kind, ok := schemaTypes[schema.Type]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown type %q", ErrInvalidSchema, schema.Type)
+	}
+	converted := &genai.Schema{
+		Type:        kind,
+		Format:      schema.Format,
+		Description: schema.Description,
+		Nullable:    schema.Nullable,
+		Enum:        schema.Enum,
+		Required:    schema.Required,
+	}
+	switch kind {
+	case genai.TypeArray:
+		if schema.Items == nil {
+			return nil, fmt.Errorf("%w: array without items", ErrInvalidSchema)
+		}
+		items, err := schema.Items.genai()
+		if err != nil {
+			return nil, err
+		}
+		converted.Items = items
+	case genai.TypeObject:
+		if len(schema.Properties) == 0 {
+			return nil, fmt.Errorf("%w: object without properties", ErrInvalidSchema)
+		}
+		converted.Properties = map[string]*genai.Schema{}
+		for name, property := range schema.Properties {
+			if property == nil {
+				return nil, fmt.Errorf("%w: empty property %q", ErrInvalidSchema, name)
+			}
+			value, err := property.genai()
+			if err != nil {
+				return nil, err
+			}
+			converted.Properties[name] = value
+		}
+		for _, name := range schema.Required {
+			if _, ok := schema.Properties[name]; !ok {
+				return nil, fmt.Errorf("%w: required property %q not defined", ErrInvalidSchema, name)
+			}
+		}
+	}
+	return converted, nil
+}
+
+// register a named response schema that requests select with "schema": name
+func WithResponseSchema(name string, schema *genai.Schema) Option {
+	return func(agent *Agent) {
+		agent.schemas[name] = schema
+	}
+}
+
+// the response schema a request selects by name or carries inline, nil for a free text reply
+func (agent *Agent) requestSchema(request *Request) (*genai.Schema, error) {
+	switch {
+	case request.Schema != "" && request.ResponseSchema != nil:
+		return nil, fmt.Errorf("%w: set one of schema and response_schema", ErrInvalidSchema)
+	case request.Schema != "":
+		schema, ok := agent.schemas[request.Schema]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown schema %q", ErrInvalidSchema, request.Schema)
+		}
+		return schema, nil
+	case request.ResponseSchema != nil:
+		return request.ResponseSchema.genai()
+	}
+	return nil, nil
+}
+
+// context key for a one-off response schema
+type responseSchemaKey struct{}
+
+// set a one-off response schema for a call made with ctx
+func withResponseSchema(ctx context.Context, schema *genai.Schema) context.Context {
+	return context.WithValue(ctx, responseSchemaKey{}, schema)
+}
+
+// the one-off response schema of a call made with ctx, nil when the reply is free text
+func responseSchemaFrom(ctx context.Context) *genai.Schema {
+	schema, _ := ctx.Value(responseSchemaKey{}).(*genai.Schema)
+	return schema
+}
+
+// call agent on the session with the given id for a json reply following schema
+// the reply is returned as generated, without the ResponseTransformer
+func (agent *Agent) CallAgentWithSchema(ctx context.Context, sessionID string, message string, schema *genai.Schema) (string, error) {
+	if err := agent.checkAgent(); err != nil {
+		return "", err
+	}
+	result, err := agent.callAgent(withResponseSchema(ctx, schema), sessionID, message)
+	if err != nil {
+		return "", err
+	}
+	return result.text, nil
+}
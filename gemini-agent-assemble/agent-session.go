@@ -0,0 +1,536 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Agent session routines
+/////////
+
+// returned when a session id is not known to the agent
+var ErrSessionNotFound = errors.New("session not found")
+
+// returned when a call uses the default session before NewSession() started it
+var ErrNoSession = errors.New("no session configured. run NewSession() first")
+
+// returned when seeded history does not alternate user / model turns
+var ErrInvalidHistory = errors.New("invalid session history")
+
+// chat session with its history guarded for serialized turns
+type session struct {
+	mu     sync.Mutex
+	id     string
+	chat   *genai.ChatSession
+	cancel context.CancelFunc // in-flight turn, guarded by the agent mutex
+	tools  map[string]bool    // tool allowlist, nil allows every agent tool
+	system *genai.Content     // system instruction override, nil uses the agent instruction
+	schema *genai.Schema      // json response schema for the current turn, nil replies in free text
+	extra  []*genai.Tool      // tools granted for the current turn only, see CallAgentWithTools
+	labels map[string]string  // caller metadata such as a tenant id, added to logs and metrics
+
+	// usage, guarded by the agent mutex
+	created    time.Time
+	lastAccess time.Time
+	turns      int
+}
+
+// session usage reported by ListSessions, the NewSession() session has an empty id
+type SessionInfo struct {
+	ID         string            `json:"id"`
+	Created    time.Time         `json:"created"`
+	LastAccess time.Time         `json:"last_access"`
+	Turns      int               `json:"turns"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// check a tool may run in the session
+func (sess *session) allows(name string) bool {
+	return sess.tools == nil || sess.tools[name] || sess.grants(name)
+}
+
+// check a tool was granted for the current turn
+func (sess *session) grants(name string) bool {
+	for _, tool := range sess.extra {
+		for _, declaration := range tool.FunctionDeclarations {
+			if declaration.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// start the default session used by CallAgent()
+func (agent *Agent) NewSession() error {
+	if err := agent.checkAgent(); err != nil {
+		agent.logger().Error(err.Error())
+		return err
+	}
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	now := agent.clock().Now()
+	agent.session = &session{chat: agent.model.StartChat(), created: now, lastAccess: now}
+	return nil
+}
+
+// start an empty session addressed by the returned id
+func (agent *Agent) NewSessionID() (string, error) {
+	return agent.NewSessionWithHistory(nil)
+}
+
+// start a session seeded with few-shot examples or a prior conversation
+// the history must alternate user and model turns, starting with user and ending with model
+func (agent *Agent) NewSessionWithHistory(initial []*genai.Content) (string, error) {
+	if err := agent.checkAgent(); err != nil {
+		agent.logger().Error(err.Error())
+		return "", err
+	}
+	if err := validateHistory(initial); err != nil {
+		agent.logger().Error(err.Error())
+		return "", err
+	}
+
+	// copy the history so the caller can reuse their slice
+	chat := agent.model.StartChat()
+	chat.History = append([]*genai.Content(nil), initial...)
+
+	id, err := agent.addSession(&session{chat: chat})
+	if err != nil {
+		return "", err
+	}
+	agent.logger().Info("new session", "session", id, "history", len(initial))
+	return id, nil
+}
+
+// start an empty session that can only use the named tools
+// the session model is only given the allowed function declarations, e.g. to offer
+// downstream agent calls to some tenants and not others
+func (agent *Agent) NewSessionWithTools(allowed []string) (string, error) {
+	if err := agent.checkAgent(); err != nil {
+		agent.logger().Error(err.Error())
+		return "", err
+	}
+	tools := map[string]bool{}
+	for _, name := range allowed {
+		tools[name] = true
+	}
+
+	chat := agent.scopedModel(agent.modelName, tools).StartChat()
+	id, err := agent.addSession(&session{chat: chat, tools: tools})
+	if err != nil {
+		return "", err
+	}
+	agent.logger().Info("new session", "session", id, "tools", allowed)
+	return id, nil
+}
+
+// start an empty session carrying metadata such as {"tenant_id": "acme"}
+// every request on the session logs the labels and counts its requests, errors and tokens
+// in the agent_label_* metrics, keyed <agent>/<label>=<value>
+func (agent *Agent) NewSessionWithLabels(labels map[string]string) (string, error) {
+	if err := agent.checkAgent(); err != nil {
+		agent.logger().Error(err.Error())
+		return "", err
+	}
+	copied := map[string]string{}
+	for key, value := range labels {
+		copied[key] = value
+	}
+
+	id, err := agent.addSession(&session{chat: agent.model.StartChat(), labels: copied})
+	if err != nil {
+		return "", err
+	}
+	agent.logger().Info("new session", "session", id, "labels", copied)
+	return id, nil
+}
+
+// session scoped logger, every line carries the session labels
+func (agent *Agent) sessionLogger(sess *session) *slog.Logger {
+	logger := agent.logger()
+	for key, value := range sess.labels {
+		logger = logger.With(key, value)
+	}
+	return logger
+}
+
+// copy of the agent model with the function declarations limited to an allowlist
+func (agent *Agent) scopedModel(name string, allowed map[string]bool) *genai.GenerativeModel {
+	model := agent.copyModel(name)
+	model.Tools = nil
+	for _, tool := range agent.model.Tools {
+		var declarations []*genai.FunctionDeclaration
+		for _, declaration := range tool.FunctionDeclarations {
+			if allowed[declaration.Name] {
+				declarations = append(declarations, declaration)
+			}
+		}
+		if len(declarations) > 0 {
+			model.Tools = append(model.Tools, &genai.Tool{FunctionDeclarations: declarations})
+		}
+	}
+	return model
+}
+
+// replace the system instruction of a session from its next call, keeping the history
+// the model is stateless so the whole history, prior turns included, is re-read under the new
+// instruction on every call. an empty id is the NewSession() session
+func (agent *Agent) SetSystemInstruction(sessionID string, instruction string) error {
+	if err := agent.checkAgent(); err != nil {
+		agent.logger().Error(err.Error())
+		return err
+	}
+	sess, err := agent.lookupSession(sessionID)
+	if err != nil {
+		agent.logger().Error(err.Error())
+		return err
+	}
+	// wait for any in-flight turn
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.system = genai.NewUserContent(genai.Text(instruction))
+	chat := agent.sessionModel(sess, agent.modelName).StartChat()
+	chat.History = sess.chat.History
+	sess.chat = chat
+	agent.logger().Info("session system instruction updated", "session", sessionID)
+	return nil
+}
+
+// copy of the history of a session, an empty id is the NewSession() session
+func (agent *Agent) History(sessionID string) ([]*genai.Content, error) {
+	if err := agent.checkAgent(); err != nil {
+		return nil, err
+	}
+	sess, err := agent.lookupSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	// wait for any in-flight turn
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return append([]*genai.Content(nil), sess.chat.History...), nil
+}
+
+// clear the history of a session, keeping its id, system instruction, tools and labels
+// an empty id is the NewSession() session
+func (agent *Agent) ResetSession(sessionID string) error {
+	if err := agent.checkAgent(); err != nil {
+		agent.logger().Error(err.Error())
+		return err
+	}
+	sess, err := agent.lookupSession(sessionID)
+	if err != nil {
+		agent.logger().Error(err.Error())
+		return err
+	}
+	// wait for any in-flight turn
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.chat.History = nil
+	agent.mu.Lock()
+	sess.turns = 0
+	agent.mu.Unlock()
+	agent.logger().Info("session history reset", "session", sessionID)
+	return nil
+}
+
+// end a session and release its history
+func (agent *Agent) EndSession(sessionID string) error {
+	if err := agent.checkAgent(); err != nil {
+		return err
+	}
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	if _, ok := agent.sessions[sessionID]; !ok {
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, sessionID)
+	}
+	delete(agent.sessions, sessionID)
+	return nil
+}
+
+// track the in-flight turn on a session so Cancel() can stop it
+// the returned function must be called when the turn ends
+func (agent *Agent) beginTurn(ctx context.Context, sess *session) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	ctx = context.WithValue(ctx, sessionIDKey{}, sess.id)
+	ctx = agent.withAgentCallPolicy(ctx, sess)
+	budget := agent.retryBudget()
+	budget.deposit()
+	ctx = withRetryBudget(ctx, budget)
+	agent.mu.Lock()
+	sess.cancel = cancel
+	sess.lastAccess = agent.clock().Now()
+	sess.turns++
+	agent.mu.Unlock()
+	return ctx, func() {
+		agent.mu.Lock()
+		sess.cancel = nil
+		agent.mu.Unlock()
+		cancel()
+	}
+}
+
+// list the NewSession() session and the sessions addressed by id with their usage
+// nil when the agent is not initialized or closed
+func (agent *Agent) ListSessions() []SessionInfo {
+	if err := agent.checkAgent(); err != nil {
+		return nil
+	}
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	var infos []SessionInfo
+	if agent.session != nil {
+		infos = append(infos, agent.session.info())
+	}
+	for _, sess := range agent.sessions {
+		infos = append(infos, sess.info())
+	}
+	return infos
+}
+
+// session usage, the agent mutex must be held
+func (sess *session) info() SessionInfo {
+	return SessionInfo{
+		ID:         sess.id,
+		Created:    sess.created,
+		LastAccess: sess.lastAccess,
+		Turns:      sess.turns,
+		Labels:     sess.labels,
+	}
+}
+
+// session list handler for GET <base path>/admin/sessions
+// requires the agent AdminToken as a bearer token, the route is disabled when no token is set
+func (agent *Agent) HandleListSessions(res http.ResponseWriter, req *http.Request) {
+	agent.setNameHeader(res)
+	if err := agent.checkAgent(); err != nil {
+		http.Error(res, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if agent.AdminToken == "" {
+		http.Error(res, "Not Found", http.StatusNotFound)
+		return
+	}
+	token := []byte("Bearer " + agent.AdminToken)
+	if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), token) != 1 {
+		http.Error(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	agent.writeBody(res, http.StatusOK, agent.ListSessions())
+}
+
+// cancel the in-flight turn on a session, stopping the generation and any downstream calls
+// an empty id is the NewSession() session, or every pooled session serving it when a session
+// pool is enabled. the cancelled call returns a CodeCancelled AgentError
+func (agent *Agent) Cancel(sessionID string) error {
+	if err := agent.checkAgent(); err != nil {
+		return err
+	}
+	if sessionID == "" && agent.cancelBorrowed() {
+		return nil
+	}
+	sess, err := agent.lookupSession(sessionID)
+	if err != nil {
+		return err
+	}
+	agent.mu.Lock()
+	cancel := sess.cancel
+	agent.mu.Unlock()
+	if cancel != nil {
+		agent.logger().Info("cancelling session turn", "session", sessionID)
+		cancel()
+	}
+	return nil
+}
+
+// cancel the in-flight turn on a session so a new message can replace it, e.g. a chat user
+// sending again while the previous reply is generating. the cancelled turn is dropped from the
+// history and the next call on the session runs once it has unwound. an empty id is the
+// NewSession() session, a session with no turn in flight is left as is
+func (agent *Agent) InterruptSession(sessionID string) error {
+	if err := agent.checkAgent(); err != nil {
+		return err
+	}
+	return agent.Cancel(sessionID)
+}
+
+// cancel request handler for POST <base path>/agent/{session}/cancel
+func (agent *Agent) HandleCancelRequest(res http.ResponseWriter, req *http.Request) {
+	agent.setNameHeader(res)
+	if err := agent.checkAgent(); err != nil {
+		http.Error(res, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	err := agent.Cancel(req.PathValue("session"))
+	if errors.Is(err, ErrSessionNotFound) {
+		http.Error(res, "Not Found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(res, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// find a session by id, an empty id is the NewSession() session
+func (agent *Agent) lookupSession(sessionID string) (*session, error) {
+	if err := agent.checkAgent(); err != nil {
+		return nil, err
+	}
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	if sessionID == "" {
+		if agent.session == nil {
+			return nil, ErrNoSession
+		}
+		return agent.session, nil
+	}
+	sess, ok := agent.sessions[sessionID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, sessionID)
+	}
+	return sess, nil
+}
+
+// check seeded history alternates user and model turns
+func validateHistory(history []*genai.Content) error {
+	for idx, content := range history {
+		if content == nil || len(content.Parts) == 0 {
+			return fmt.Errorf("%w: turn %d is empty", ErrInvalidHistory, idx)
+		}
+		expected := "user"
+		if idx%2 == 1 {
+			expected = "model"
+		}
+		if content.Role != expected {
+			return fmt.Errorf("%w: turn %d has role %q, expected %q", ErrInvalidHistory, idx, content.Role, expected)
+		}
+	}
+	if len(history)%2 == 1 {
+		return fmt.Errorf("%w: history must end with a model turn", ErrInvalidHistory)
+	}
+	return nil
+}
+
+// attempts at a session id not already in use before giving up
+const sessionIDAttempts = 8
+
+// returned when the SessionIDGenerator keeps producing ids already in use
+var ErrSessionIDCollision = errors.New("session id collision")
+
+// give a new session a unique id and add it to the agent
+func (agent *Agent) addSession(sess *session) (string, error) {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	for attempt := 0; attempt < sessionIDAttempts; attempt++ {
+		id, err := agent.generateSessionID()
+		if err != nil {
+			return "", err
+		}
+		// an empty id is the NewSession() session so it is regenerated like a collision
+		if _, used := agent.sessions[id]; used || id == "" {
+			agent.logger().Warn("session id collision, regenerating", "session", id, "attempt", attempt+1)
+			continue
+		}
+		now := agent.clock().Now()
+		sess.id, sess.created, sess.lastAccess = id, now, now
+		agent.sessions[id] = sess
+		agent.janitor.Do(func() { go agent.runJanitor() })
+		return id, nil
+	}
+	agent.logger().Error(ErrSessionIDCollision.Error())
+	return "", ErrSessionIDCollision
+}
+
+// time between janitor sweeps for idle sessions
+const DefaultSessionSweep = time.Minute
+
+// end idle sessions every DefaultSessionSweep until the agent closes, timed by the agent Clock
+func (agent *Agent) runJanitor() {
+	for {
+		select {
+		case <-agent.clock().After(DefaultSessionSweep):
+			agent.evictIdleSessions()
+		case <-agent.stop:
+			return
+		}
+	}
+}
+
+// end the sessions without a turn for the SessionIdleTTL, a session with a turn in flight is kept
+func (agent *Agent) evictIdleSessions() {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	if agent.SessionIdleTTL <= 0 {
+		return
+	}
+	now := agent.clock().Now()
+	for id, sess := range agent.sessions {
+		if sess.cancel == nil && now.Sub(sess.lastAccess) > agent.SessionIdleTTL {
+			delete(agent.sessions, id)
+			agent.logger().Info("idle session evicted", "session", id, "idle", now.Sub(sess.lastAccess))
+		}
+	}
+}
+
+// session id from the SessionIDGenerator, or a random uuid
+func (agent *Agent) generateSessionID() (string, error) {
+	if agent.SessionIDGenerator != nil {
+		return agent.SessionIDGenerator(), nil
+	}
+	return newSessionID()
+}
+
+// random version 4 uuid for session ids
+func newSessionID() (string, error) {
+	var b [16]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// context key for a one-off system instruction
+type systemOverrideKey struct{}
+
+// set a one-off system instruction for a call made with ctx
+func withSystemOverride(ctx context.Context, instruction string) context.Context {
+	return context.WithValue(ctx, systemOverrideKey{}, instruction)
+}
+
+// swap in a one-off system instruction, response schema or extra tools from ctx for a turn, the session mutex must be held
+// the returned function restores the session settings and must be called when the turn ends
+func (agent *Agent) overrideTurn(ctx context.Context, sess *session) func() {
+	instruction, system := ctx.Value(systemOverrideKey{}).(string)
+	schema := responseSchemaFrom(ctx)
+	extra := extraToolsFrom(ctx)
+	if !system && schema == nil && extra == nil {
+		return func() {}
+	}
+	previous, chat := sess.system, sess.chat
+	if system {
+		sess.system = genai.NewUserContent(genai.Text(instruction))
+	}
+	sess.schema, sess.extra = schema, extra
+	sess.chat = agent.sessionModel(sess, agent.modelName).StartChat()
+	sess.chat.History = chat.History
+	return func() {
+		chat.History = sess.chat.History
+		sess.system, sess.schema, sess.extra, sess.chat = previous, nil, nil, chat
+	}
+}
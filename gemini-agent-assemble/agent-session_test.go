@@ -0,0 +1,761 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// wait until the janitor is blocked on the clock, i.e. between sweeps
+func waitJanitor(t *testing.T, clock *fakeClock) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for clock.Waiting() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("janitor is not running")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// advance the clock by whole sweeps, returning once the janitor has swept each time
+func sweep(t *testing.T, clock *fakeClock, d time.Duration) {
+	t.Helper()
+	for ; d > 0; d -= DefaultSessionSweep {
+		waitJanitor(t, clock)
+		clock.Advance(DefaultSessionSweep)
+	}
+	waitJanitor(t, clock)
+}
+
+func TestSessionJanitor(t *testing.T) {
+	tests := []struct {
+		name     string
+		ttl      time.Duration
+		idle     time.Duration
+		inFlight bool
+		evicted  bool
+	}{
+		{name: "idle past the ttl", ttl: 10 * time.Minute, idle: 11 * time.Minute, evicted: true},
+		{name: "idle inside the ttl", ttl: 10 * time.Minute, idle: 9 * time.Minute},
+		{name: "turn in flight", ttl: 10 * time.Minute, idle: time.Hour, inFlight: true},
+		{name: "no ttl", ttl: 0, idle: time.Hour},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newMockAgent(t, newMockGemini(t))
+			clock := newFakeClock()
+			agent.Clock = clock
+			agent.SessionIdleTTL = test.ttl
+			if err := agent.NewSession(); err != nil {
+				t.Fatal(err)
+			}
+			id, err := agent.NewSessionID()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.inFlight {
+				agent.mu.Lock()
+				sess := agent.sessions[id]
+				agent.mu.Unlock()
+				_, end := agent.beginTurn(context.Background(), sess)
+				defer end()
+			}
+
+			sweep(t, clock, test.idle)
+			err = agent.ResetSession(id)
+			if test.evicted && !errors.Is(err, ErrSessionNotFound) {
+				t.Errorf("session kept, reset error = %v", err)
+			}
+			if !test.evicted && err != nil {
+				t.Errorf("session evicted: %v", err)
+			}
+			agent.mu.Lock()
+			defaultKept := agent.session != nil
+			agent.mu.Unlock()
+			if !defaultKept {
+				t.Error("the NewSession() session was evicted")
+			}
+		})
+	}
+}
+
+// a turn restarts the idle time
+func TestSessionJanitorTurnResetsIdle(t *testing.T) {
+	agent := newMockAgent(t, newMockGemini(t))
+	clock := newFakeClock()
+	agent.Clock = clock
+	agent.SessionIdleTTL = 10 * time.Minute
+	id, err := agent.NewSessionID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent.mu.Lock()
+	sess := agent.sessions[id]
+	agent.mu.Unlock()
+
+	sweep(t, clock, 8*time.Minute)
+	_, end := agent.beginTurn(context.Background(), sess)
+	end()
+	sweep(t, clock, 8*time.Minute)
+	if err := agent.ResetSession(id); err != nil {
+		t.Fatalf("session evicted after a turn: %v", err)
+	}
+	sweep(t, clock, 3*time.Minute)
+	if err := agent.ResetSession(id); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("session kept past the ttl, reset error = %v", err)
+	}
+}
+
+// codec tagging its bodies so a test can tell it was used
+type taggedCodec struct {
+	JSONCodec
+}
+
+func (codec taggedCodec) ContentType() string {
+	return "application/x-tagged+json"
+}
+
+func TestHandleListSessions(t *testing.T) {
+	tests := []struct {
+		name        string
+		adminToken  string
+		auth        string
+		codec       Codec
+		status      int
+		contentType string
+	}{
+		{name: "route disabled", status: http.StatusNotFound},
+		{name: "missing token", adminToken: "secret", status: http.StatusUnauthorized},
+		{name: "wrong token", adminToken: "secret", auth: "Bearer guess", status: http.StatusUnauthorized},
+		{name: "default codec", adminToken: "secret", auth: "Bearer secret", status: http.StatusOK, contentType: "application/json"},
+		{name: "configured codec", adminToken: "secret", auth: "Bearer secret", codec: taggedCodec{}, status: http.StatusOK, contentType: "application/x-tagged+json"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newMockAgent(t, newMockGemini(t))
+			agent.AdminToken = test.adminToken
+			agent.Codec = test.codec
+			id, err := agent.NewSessionWithLabels(map[string]string{"tenant_id": "acme"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/admin/sessions", nil)
+			if test.auth != "" {
+				req.Header.Set("Authorization", test.auth)
+			}
+			res := httptest.NewRecorder()
+
+			agent.HandleListSessions(res, req)
+			if res.Code != test.status {
+				t.Fatalf("status = %d, want %d", res.Code, test.status)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			if got := res.Header().Get("Content-Type"); got != test.contentType {
+				t.Errorf("content type = %s, want %s", got, test.contentType)
+			}
+			sessions := []SessionInfo{}
+			if err := json.Unmarshal(res.Body.Bytes(), &sessions); err != nil {
+				t.Fatal(err)
+			}
+			if len(sessions) != 1 || sessions[0].ID != id || sessions[0].Labels["tenant_id"] != "acme" {
+				t.Errorf("sessions = %+v, want the labelled session", sessions)
+			}
+		})
+	}
+}
+
+func TestInterruptSession(t *testing.T) {
+	tests := []struct {
+		name     string
+		session  string
+		inFlight bool
+		status   int
+	}{
+		{name: "turn in flight", inFlight: true, status: http.StatusNoContent},
+		{name: "no turn in flight", status: http.StatusNoContent},
+		{name: "unknown session", session: "unknown", status: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newMockAgent(t, newMockGemini(t))
+			id, err := agent.NewSessionID()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.session != "" {
+				id = test.session
+			}
+			ctx := context.Background()
+			if test.inFlight {
+				agent.mu.Lock()
+				sess := agent.sessions[id]
+				agent.mu.Unlock()
+				var endTurn func()
+				ctx, endTurn = agent.beginTurn(ctx, sess)
+				defer endTurn()
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/agent/"+id+"/cancel", nil)
+			req.SetPathValue("session", id)
+			res := httptest.NewRecorder()
+			agent.HandleCancelRequest(res, req)
+			if res.Code != test.status {
+				t.Fatalf("status = %d, want %d", res.Code, test.status)
+			}
+			if test.inFlight && ctx.Err() == nil {
+				t.Error("turn in flight was not cancelled")
+			}
+			if err := agent.InterruptSession(id); (err != nil) != (test.status == http.StatusNotFound) {
+				t.Errorf("InterruptSession error = %v", err)
+			}
+		})
+	}
+}
+
+// run with -race, turns on one session from many goroutines are serialized so every turn lands
+// in the history whole
+func TestConcurrentSessionTurns(t *testing.T) {
+	requireModelCalls(t)
+	tests := []struct {
+		name    string
+		callers int
+		tool    bool
+	}{
+		{name: "text turns", callers: 16},
+		{name: "tool turns", callers: 8, tool: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := newMockGemini(t)
+			// each turn is a user message and a model reply, a tool adds a call and its result
+			perTurn := 2
+			for idx := 0; idx < test.callers; idx++ {
+				if test.tool {
+					mock.push(callReply("echo", map[string]any{"text": "hi"}))
+				}
+				mock.push(textReply("done"))
+			}
+			if test.tool {
+				perTurn = 4
+			}
+			agent := newMockAgent(t, mock)
+			if err := agent.NewSession(); err != nil {
+				t.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			errs := make(chan error, test.callers)
+			for idx := 0; idx < test.callers; idx++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, err := agent.CallAgentContext(context.Background(), "question"); err != nil {
+						errs <- err
+					}
+				}()
+				// readers alongside the turns
+				go agent.ListSessions()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+
+			sess, err := agent.lookupSession("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sess.mu.Lock()
+			history := sess.chat.History
+			sess.mu.Unlock()
+			if len(history) != test.callers*perTurn {
+				t.Fatalf("history = %d turns, want %d", len(history), test.callers*perTurn)
+			}
+			// the turns alternate user and model, none interleaved
+			for idx, content := range history {
+				want := "user"
+				if idx%2 == 1 {
+					want = "model"
+				}
+				if content.Role != want {
+					t.Fatalf("history[%d] role = %s, want %s", idx, content.Role, want)
+				}
+			}
+			if info := agent.ListSessions(); len(info) != 1 || info[0].Turns != test.callers {
+				t.Errorf("sessions = %+v, want %d turns", info, test.callers)
+			}
+		})
+	}
+}
+
+// sessions started, listed and ended from many goroutines at once
+func TestConcurrentSessionLifecycle(t *testing.T) {
+	agent := newMockAgent(t, newMockGemini(t))
+	const workers = 32
+	var wg sync.WaitGroup
+	for idx := 0; idx < workers; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := agent.NewSessionID()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			agent.ListSessions()
+			if err := agent.ResetSession(id); err != nil {
+				t.Error(err)
+			}
+			agent.Cancel(id)
+			if err := agent.EndSession(id); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if sessions := agent.ListSessions(); len(sessions) != 0 {
+		t.Errorf("%d sessions left, want none", len(sessions))
+	}
+}
+
+func TestNewSessionWithHistory(t *testing.T) {
+	user := genai.NewUserContent(genai.Text("what is 2+2?"))
+	model := &genai.Content{Role: "model", Parts: []genai.Part{genai.Text("4")}}
+	tests := []struct {
+		name    string
+		history []*genai.Content
+		err     error
+	}{
+		{name: "empty"},
+		{name: "one example", history: []*genai.Content{user, model}},
+		{name: "two examples", history: []*genai.Content{user, model, user, model}},
+		{name: "ends with user", history: []*genai.Content{user, model, user}, err: ErrInvalidHistory},
+		{name: "starts with model", history: []*genai.Content{model, user}, err: ErrInvalidHistory},
+		{name: "nil turn", history: []*genai.Content{user, nil}, err: ErrInvalidHistory},
+		{name: "empty turn", history: []*genai.Content{user, {Role: "model"}}, err: ErrInvalidHistory},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newMockAgent(t, newMockGemini(t))
+			history := append([]*genai.Content(nil), test.history...)
+			id, err := agent.NewSessionWithHistory(history)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("error = %v, want %v", err, test.err)
+			}
+			agent.mu.Lock()
+			sess, ok := agent.sessions[id]
+			count := len(agent.sessions)
+			agent.mu.Unlock()
+			if test.err != nil {
+				if count != 0 {
+					t.Errorf("sessions = %d, want none for a rejected history", count)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("session %q was not added", id)
+			}
+			if len(sess.chat.History) != len(test.history) {
+				t.Fatalf("history = %d turns, want %d", len(sess.chat.History), len(test.history))
+			}
+			// the session keeps its own copy of the caller's slice
+			if len(history) > 0 {
+				history[0] = model
+				if sess.chat.History[0] != user {
+					t.Error("session history changed with the caller's slice")
+				}
+			}
+		})
+	}
+}
+
+// the seeded turns are sent ahead of the first message on the session
+func TestSessionHistorySent(t *testing.T) {
+	requireModelCalls(t)
+	mock := newMockGemini(t, textReply("6"))
+	agent := newMockAgent(t, mock)
+	id, err := agent.NewSessionWithHistory([]*genai.Content{
+		genai.NewUserContent(genai.Text("what is 2+2?")),
+		{Role: "model", Parts: []genai.Part{genai.Text("4")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := agent.CallAgentSession(context.Background(), id, "what is 3+3?"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := agent.CallAgentSession(context.Background(), "unknown", "what is 3+3?"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("unknown session error = %v, want ErrSessionNotFound", err)
+	}
+
+	requests := mock.received()
+	if len(requests) != 1 {
+		t.Fatalf("model requests = %d, want 1", len(requests))
+	}
+	contents := requests[0].Contents
+	if len(contents) != 3 {
+		t.Fatalf("request = %d contents, want the 2 seeded turns and the message", len(contents))
+	}
+	for idx, role := range []string{"user", "model", "user"} {
+		if contents[idx].Role != role {
+			t.Errorf("turn %d role = %q, want %q", idx, contents[idx].Role, role)
+		}
+	}
+	if got := requests[0].lastText(); got != "what is 3+3?" {
+		t.Errorf("last turn = %q, want the message", got)
+	}
+}
+
+// a scoped session is only offered and only runs its allowed tools
+func TestNewSessionWithTools(t *testing.T) {
+	shout := &genai.FunctionDeclaration{Name: "shout", Description: "shout the text"}
+	tests := []struct {
+		name    string
+		allowed []string
+		offered []string
+	}{
+		{name: "one tool", allowed: []string{"echo"}, offered: []string{"echo"}},
+		{name: "both tools", allowed: []string{"shout", "echo"}, offered: []string{"echo", "shout"}},
+		{name: "no tools", allowed: []string{}},
+		{name: "unknown tool", allowed: []string{"delete"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newMockAgent(t, newMockGemini(t), WithToolFuncs(ToolFunc{Declaration: shout, Handler: echoCall}))
+			id, err := agent.NewSessionWithTools(test.allowed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			agent.mu.Lock()
+			sess := agent.sessions[id]
+			agent.mu.Unlock()
+
+			var offered []string
+			for _, tool := range agent.scopedModel(agent.modelName, sess.tools).Tools {
+				for _, declaration := range tool.FunctionDeclarations {
+					offered = append(offered, declaration.Name)
+				}
+			}
+			if strings.Join(offered, ",") != strings.Join(test.offered, ",") {
+				t.Errorf("offered tools = %v, want %v", offered, test.offered)
+			}
+
+			// a call to a tool outside the scope is answered without running it
+			for _, name := range []string{"echo", "shout"} {
+				allowed := strings.Contains(strings.Join(test.offered, ","), name)
+				part, err := agent.callToolOnce(context.Background(), sess, turnCalls{}, genai.FunctionCall{Name: name, Args: map[string]any{"text": "hi"}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				response := part.(genai.FunctionResponse).Response
+				if allowed && response["result"] != "hi" {
+					t.Errorf("%s response = %v, want the tool result", name, response)
+				}
+				if !allowed && response["error"] != toolNotAllowedResult {
+					t.Errorf("%s response = %v, want the tool refused", name, response)
+				}
+			}
+		})
+	}
+}
+
+func TestListSessions(t *testing.T) {
+	tests := []struct {
+		name   string
+		def    bool
+		ids    int
+		turns  int
+		closed bool
+		listed int
+	}{
+		{name: "none"},
+		{name: "default session", def: true, listed: 1},
+		{name: "default and addressed", def: true, ids: 2, listed: 3},
+		{name: "turns counted", ids: 1, turns: 2, listed: 1},
+		{name: "closed agent", def: true, ids: 2, closed: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := newFakeClock()
+			agent := newMockAgent(t, newMockGemini(t))
+			agent.Clock = clock
+			created := clock.Now()
+			if test.def {
+				if err := agent.NewSession(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for idx := 0; idx < test.ids; idx++ {
+				id, err := agent.NewSessionID()
+				if err != nil {
+					t.Fatal(err)
+				}
+				agent.mu.Lock()
+				sess := agent.sessions[id]
+				agent.mu.Unlock()
+				for turn := 0; turn < test.turns; turn++ {
+					clock.Advance(time.Minute)
+					_, end := agent.beginTurn(context.Background(), sess)
+					end()
+				}
+			}
+			if test.closed {
+				agent.Close()
+			}
+
+			sessions := agent.ListSessions()
+			if len(sessions) != test.listed {
+				t.Fatalf("sessions = %d, want %d", len(sessions), test.listed)
+			}
+			for _, info := range sessions {
+				if !info.Created.Equal(created) {
+					t.Errorf("session %q created %v, want %v", info.ID, info.Created, created)
+				}
+				if info.Turns != test.turns || !info.LastAccess.Equal(created.Add(time.Duration(test.turns)*time.Minute)) {
+					t.Errorf("session %q = %d turns, last access %v, want %d turns", info.ID, info.Turns, info.LastAccess, test.turns)
+				}
+			}
+		})
+	}
+}
+
+// a one-off system instruction applies to one turn, the session keeps its own and the history
+func TestSystemOverride(t *testing.T) {
+	tests := []struct {
+		name     string
+		session  string
+		override string
+		set      bool
+	}{
+		{name: "agent instruction", override: "answer in french", set: true},
+		{name: "session instruction", session: "be terse", override: "answer in french", set: true},
+		{name: "no override", session: "be terse"},
+	}
+	text := func(content *genai.Content) string {
+		if content == nil {
+			return ""
+		}
+		return string(content.Parts[0].(genai.Text))
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newMockAgent(t, newMockGemini(t))
+			sess := &session{chat: agent.model.StartChat()}
+			if test.session != "" {
+				sess.system = genai.NewUserContent(genai.Text(test.session))
+			}
+			chat := sess.chat
+			ctx := context.Background()
+			if test.set {
+				ctx = withSystemOverride(ctx, test.override)
+			}
+
+			restore := agent.overrideTurn(ctx, sess)
+			want := test.session
+			if test.set {
+				want = test.override
+			}
+			if got := text(sess.system); got != want {
+				t.Errorf("turn instruction = %q, want %q", got, want)
+			}
+			// the turn adds to the history
+			sess.chat.History = append(sess.chat.History, genai.NewUserContent(genai.Text("question")))
+			restore()
+
+			if got := text(sess.system); got != test.session {
+				t.Errorf("session instruction = %q, want %q", got, test.session)
+			}
+			if sess.chat != chat || len(chat.History) != 1 {
+				t.Errorf("session chat restored = %v with %d turns, want the session chat with the turn", sess.chat == chat, len(chat.History))
+			}
+		})
+	}
+}
+
+// the override is sent to the model for its turn only
+func TestCallAgentWithSystem(t *testing.T) {
+	requireModelCalls(t)
+	mock := newMockGemini(t, textReply("bonjour"), textReply("hello"))
+	agent := newMockAgent(t, mock)
+	if err := agent.NewSession(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := agent.CallAgentWithSystem(context.Background(), "greet me", "answer in french"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := agent.CallAgentContext(context.Background(), "greet me again"); err != nil {
+		t.Fatal(err)
+	}
+	requests := mock.received()
+	if got := requests[0].systemText(); got != "answer in french" {
+		t.Errorf("first instruction = %q, want the override", got)
+	}
+	if got := requests[1].systemText(); got != "" {
+		t.Errorf("second instruction = %q, want none", got)
+	}
+	if len(requests[1].Contents) != 3 {
+		t.Errorf("second turn history = %d contents, want 3", len(requests[1].Contents))
+	}
+}
+
+// a reset session keeps its id, labels and system instruction with an empty history
+func TestResetSession(t *testing.T) {
+	history := []*genai.Content{
+		genai.NewUserContent(genai.Text("what is 2+2?")),
+		{Role: "model", Parts: []genai.Part{genai.Text("4")}},
+	}
+	tests := []struct {
+		name   string
+		start  func(agent *Agent) (string, error)
+		system string
+		err    error
+	}{
+		{name: "default session", start: func(agent *Agent) (string, error) {
+			if err := agent.NewSession(); err != nil {
+				return "", err
+			}
+			agent.session.chat.History = history
+			return "", nil
+		}},
+		{name: "seeded session", start: func(agent *Agent) (string, error) { return agent.NewSessionWithHistory(history) }},
+		{name: "system override", start: func(agent *Agent) (string, error) {
+			id, err := agent.NewSessionWithHistory(history)
+			if err != nil {
+				return "", err
+			}
+			return id, agent.SetSystemInstruction(id, "be brief")
+		}, system: "be brief"},
+		{name: "labelled session", start: func(agent *Agent) (string, error) {
+			return agent.NewSessionWithLabels(map[string]string{"tenant": "acme"})
+		}},
+		{name: "unknown session", start: func(agent *Agent) (string, error) { return "missing", nil }, err: ErrSessionNotFound},
+		{name: "no default session", start: func(agent *Agent) (string, error) { return "", nil }, err: ErrNoSession},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newMockAgent(t, newMockGemini(t))
+			id, err := test.start(agent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sess, _ := agent.lookupSession(id)
+			if sess != nil {
+				agent.mu.Lock()
+				sess.turns = 3
+				agent.mu.Unlock()
+			}
+			var labels map[string]string
+			if sess != nil {
+				labels = sess.labels
+			}
+
+			err = agent.ResetSession(id)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("error = %v, want %v", err, test.err)
+			}
+			if test.err != nil {
+				return
+			}
+			got, err := agent.History(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 0 {
+				t.Errorf("history = %d turns, want none", len(got))
+			}
+			agent.mu.Lock()
+			turns := sess.turns
+			agent.mu.Unlock()
+			if turns != 0 {
+				t.Errorf("turns = %d, want 0", turns)
+			}
+			if reset, _ := agent.lookupSession(id); reset != sess {
+				t.Error("session replaced, want the same session")
+			}
+			if len(sess.labels) != len(labels) || sess.labels["tenant"] != labels["tenant"] {
+				t.Errorf("labels = %v, want %v", sess.labels, labels)
+			}
+			system := ""
+			if sess.system != nil {
+				system = string(sess.system.Parts[0].(genai.Text))
+			}
+			if system != test.system {
+				t.Errorf("system instruction = %q, want %q", system, test.system)
+			}
+		})
+	}
+}
+
+// ids from the SessionIDGenerator are used in order, skipping ids in use and the empty id
+func TestSessionIDGenerator(t *testing.T) {
+	tests := []struct {
+		name      string
+		generated []string // ids the generator returns in turn, the last repeats, nil for uuids
+		sessions  int
+		want      []string
+		err       error
+	}{
+		{name: "random uuids", sessions: 2},
+		{name: "generated ids", generated: []string{"a", "b"}, sessions: 2, want: []string{"a", "b"}},
+		{name: "collision regenerated", generated: []string{"a", "a", "b"}, sessions: 2, want: []string{"a", "b"}},
+		{name: "empty id regenerated", generated: []string{"", "a"}, sessions: 1, want: []string{"a"}},
+		{name: "collisions run out", generated: []string{"a"}, sessions: 2, want: []string{"a"}, err: ErrSessionIDCollision},
+		{name: "only empty ids", generated: []string{""}, sessions: 1, err: ErrSessionIDCollision},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newMockAgent(t, newMockGemini(t))
+			calls := 0
+			if test.generated != nil {
+				agent.SessionIDGenerator = func() string {
+					id := test.generated[min(calls, len(test.generated)-1)]
+					calls++
+					return id
+				}
+			}
+
+			var ids []string
+			var err error
+			for range test.sessions {
+				var id string
+				if id, err = agent.NewSessionID(); err != nil {
+					break
+				}
+				ids = append(ids, id)
+			}
+			if !errors.Is(err, test.err) {
+				t.Fatalf("error = %v, want %v", err, test.err)
+			}
+			if test.generated == nil {
+				if len(ids) != 2 || len(ids[0]) != 36 || ids[0] == ids[1] {
+					t.Errorf("ids = %q, want two distinct uuids", ids)
+				}
+				return
+			}
+			if strings.Join(ids, ",") != strings.Join(test.want, ",") {
+				t.Errorf("ids = %q, want %q", ids, test.want)
+			}
+			agent.mu.Lock()
+			count := len(agent.sessions)
+			agent.mu.Unlock()
+			if count != len(test.want) {
+				t.Errorf("sessions = %d, want %d", count, len(test.want))
+			}
+			if test.err != nil && calls != len(test.want)+sessionIDAttempts {
+				t.Errorf("generator calls = %d, want %d attempts", calls, sessionIDAttempts)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package geminiagentassemble
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+/////////
+// Agent stdio service routines
+/////////
+
+// input line that clears the stdio session history
+const StdioResetCommand = "/reset"
+
+// generalized agent service over a reader and writer, e.g. os.Stdin and os.Stdout for local testing
+// and piping. each input line is a prompt and each answer is written as one line, newlines in the
+// answer becoming spaces, with every turn on a single session that a StdioResetCommand line clears
+// a failed turn is written as an "error: " line and the service carries on
+// returns nil at the end of the input or once ctx is done, which is checked between lines
+func (agent *Agent) RunAgentStdio(ctx context.Context, in io.Reader, out io.Writer) error {
+	if err := agent.checkAgent(); err != nil {
+		agent.logger().Error(err.Error())
+		return err
+	}
+	id, err := agent.NewSessionID()
+	if err != nil {
+		return err
+	}
+	defer agent.EndSession(id)
+	agent.logger().Info("agent running on stdio", "session", id)
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return nil
+		}
+		line := strings.TrimSpace(scanner.Text())
+		switch line {
+		case "":
+			continue
+		case StdioResetCommand:
+			if err := agent.ResetSession(id); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// run the turn on the shared session
+		reply := ""
+		answer, err := agent.CallAgentSession(ctx, id, line)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			reply = "error: " + err.Error()
+		} else {
+			reply = strings.ReplaceAll(strings.TrimSpace(answer), "\n", " ")
+		}
+		if _, err := fmt.Fprintln(out, reply); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
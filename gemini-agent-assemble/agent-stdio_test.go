@@ -0,0 +1,114 @@
+package geminiagentassemble
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRunAgentStdio(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		replies []mockReply
+		model   bool
+		output  []string
+		prefix  bool // output lines only start with the expected text
+		// contents sent with each model request, showing what context was kept
+		history []int
+	}{
+		{
+			name:    "context kept between lines",
+			input:   "my name is Ada\nwhat is my name?\n",
+			replies: []mockReply{textReply("hello Ada"), textReply("your name is Ada")},
+			model:   true,
+			output:  []string{"hello Ada", "your name is Ada"},
+			history: []int{1, 3},
+		},
+		{
+			name:    "blank lines skipped",
+			input:   "\n  \nfirst\n\nsecond",
+			replies: []mockReply{textReply("one"), textReply("two")},
+			model:   true,
+			output:  []string{"one", "two"},
+			history: []int{1, 3},
+		},
+		{
+			name:    "reset clears the history",
+			input:   "first\n" + StdioResetCommand + "\nsecond\n",
+			replies: []mockReply{textReply("one"), textReply("two")},
+			model:   true,
+			output:  []string{"one", "two"},
+			history: []int{1, 1},
+		},
+		{
+			name:    "multi line answer on one line",
+			input:   "list\n",
+			replies: []mockReply{textReply("a\nb\n")},
+			model:   true,
+			output:  []string{"a b"},
+			history: []int{1},
+		},
+		{
+			name:    "failed turns carry on",
+			input:   "first\nsecond\n",
+			replies: []mockReply{errorReply(http.StatusBadRequest), errorReply(http.StatusBadRequest)},
+			output:  []string{"error: ", "error: "},
+			prefix:  true,
+			history: []int{1, 1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.model {
+				requireModelCalls(t)
+			}
+			mock := newMockGemini(t, test.replies...)
+			agent := newMockAgent(t, mock)
+			var out bytes.Buffer
+
+			if err := agent.RunAgentStdio(context.Background(), strings.NewReader(test.input), &out); err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+			if len(lines) != len(test.output) {
+				t.Fatalf("output = %q, want %q", lines, test.output)
+			}
+			for idx, want := range test.output {
+				if lines[idx] != want && !(test.prefix && strings.HasPrefix(lines[idx], want)) {
+					t.Errorf("line %d = %q, want %q", idx, lines[idx], want)
+				}
+			}
+			requests := mock.received()
+			if len(requests) != len(test.history) {
+				t.Fatalf("model requests = %d, want %d", len(requests), len(test.history))
+			}
+			for idx, want := range test.history {
+				if got := len(requests[idx].Contents); got != want {
+					t.Errorf("request %d sent %d contents, want %d", idx, got, want)
+				}
+			}
+			// the stdio session ends with the input
+			if sessions := agent.ListSessions(); len(sessions) != 0 {
+				t.Errorf("sessions = %+v, want the stdio session ended", sessions)
+			}
+		})
+	}
+}
+
+// the service stops between lines once its context is done
+func TestRunAgentStdioCancelled(t *testing.T) {
+	mock := newMockGemini(t)
+	agent := newMockAgent(t, mock)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var out bytes.Buffer
+	if err := agent.RunAgentStdio(ctx, strings.NewReader("first\nsecond\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 || len(mock.received()) != 0 {
+		t.Errorf("output = %q after %d requests, want nothing", out.String(), len(mock.received()))
+	}
+}
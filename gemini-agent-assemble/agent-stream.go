@@ -0,0 +1,634 @@
+package geminiagentassemble
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/iterator"
+)
+
+/////////
+// Agent streaming routines
+/////////
+
+// a single piece of streamed agent output
+// Progress is set on chunks reported by a running tool through ReportProgress
+// ToolOutput is set on chunks of a streamed tool result forwarded by CollectToolStream
+// Commentary is set on text the model sent alongside tool calls under MixedTextCommentary
+// NeedsInput is set on the text of a question asked through the ClarificationTool
+// Err is set on the final chunk when the stream failed
+type StreamChunk struct {
+	Text       string
+	Progress   string
+	ToolOutput string
+	Commentary string
+	NeedsInput bool
+	Err        error
+}
+
+// call agent and stream the text parts as they are generated
+// the same graph flow as CallAgent, tools are run between streamed turns
+// the channel is closed when the final answer is complete or an error is sent
+func (agent *Agent) CallAgentStream(ctx context.Context, message string) (<-chan StreamChunk, error) {
+	if err := agent.checkAgent(); err != nil {
+		return nil, err
+	}
+	return agent.callAgentStream(ctx, "", message)
+}
+
+// the outcome of one streamed model turn
+type streamTurn struct {
+	calls   []genai.FunctionCall
+	results []genai.Part // the tool results, in call order
+	text    []string
+	started bool // text was streamed or a tool was run, so the turn cannot be sent again
+}
+
+// check for a turn with no text and no function call
+func (turn *streamTurn) empty() bool {
+	return len(turn.calls) == 0 && strings.TrimSpace(strings.Join(turn.text, "")) == ""
+}
+
+// stream a call on the session with the given id, an empty id uses the NewSession() session
+func (agent *Agent) callAgentStream(ctx context.Context, sessionID string, message string) (<-chan StreamChunk, error) {
+	requestsMetric.Add(agent.metricLabel(), 1)
+
+	// check the agent is usable
+	if err := agent.checkAgent(); err != nil {
+		agent.logger().Error(err.Error())
+		errorsMetric.Add(agent.metricLabel(), 1)
+		return nil, err
+	}
+
+	// check we have a session
+	sess, release, err := agent.acquireSession(ctx, sessionID)
+	if err != nil {
+		agent.logger().Error(err.Error())
+		errorsMetric.Add(agent.metricLabel(), 1)
+		return nil, err
+	}
+
+	// one turn at a time per session, held until the stream completes
+	sess.mu.Lock()
+	ctx, endTurn := agent.beginTurn(ctx, sess)
+
+	// select the model for this request
+	message = agent.prepareInput(message)
+	restore := agent.overrideTurn(ctx, sess)
+	chat, model := agent.routeSession(sess, message)
+
+	chunks := make(chan StreamChunk)
+	post := &streamPost{}
+	ctx = withStreamPost(ctx, post)
+	go func() {
+		defer release()
+		defer sess.mu.Unlock()
+		defer endTurn()
+		defer restore()
+		defer close(chunks)
+		// audit and metrics are left to the background, started before the channel closes so a
+		// consumer closing the agent once it has the answer waits for them
+		defer agent.finishStream(sess, post)
+		// routed and fallback chats write their history back to the session
+		defer func() {
+			if chat != sess.chat {
+				sess.chat.History = chat.History
+			}
+		}()
+
+		// hand a chunk to the consumer, giving up once the caller has cancelled
+		emit := func(chunk StreamChunk) bool {
+			select {
+			case chunks <- chunk:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		// surface tool progress and streamed tool output between the streamed text
+		ctx := withProgress(ctx, func(message string) {
+			emit(StreamChunk{Progress: message})
+		})
+		ctx = withToolOutput(ctx, func(text string) {
+			emit(StreamChunk{ToolOutput: text})
+		})
+
+		// send the final error chunk and drop the failed turn from the history
+		start := len(chat.History)
+		fail := func(err error) {
+			errorsMetric.Add(agent.metricLabel(), 1)
+			post.failed = true
+			chat.History = chat.History[:start]
+			chunk := StreamChunk{Err: contextError(ctx, err)}
+			// a consumer still waiting gets the error of a cancelled or timed out turn too
+			select {
+			case chunks <- chunk:
+			default:
+				emit(chunk)
+			}
+		}
+
+		// stream one model turn, running the tools as their calls arrive
+		// text is handed on as it arrives when live, otherwise it is held for the end of the turn
+		run := func(live bool, parts []genai.Part) (turn streamTurn, err error) {
+			calls := turnCalls{}
+			var usage *genai.UsageMetadata
+			defer func() { post.addUsage(usage) }()
+			// process each of the parts
+			process := func(parts []genai.Part) error {
+				for _, part := range parts {
+					switch part := part.(type) {
+					case genai.FunctionCall:
+						turn.started = true
+						funcResult, err := agent.callToolOnce(ctx, sess, calls, part)
+						if err != nil {
+							return err
+						}
+						turn.calls = append(turn.calls, part)
+						turn.results = append(turn.results, funcResult)
+					case genai.Text:
+						turn.text = append(turn.text, string(part))
+						if live {
+							turn.started = true
+							if !emit(StreamChunk{Text: string(part)}) {
+								return ctx.Err()
+							}
+						}
+					}
+				}
+				return nil
+			}
+			// the CandidateSelector choice is only known once the whole reply is in
+			selecting := agent.selectsCandidates()
+			iter := chat.SendMessageStream(ctx, parts...)
+			for {
+				resp, err := iter.Next()
+				if err == iterator.Done {
+					merged := iter.MergedResponse()
+					if !selecting || merged == nil {
+						return turn, nil
+					}
+					agent.selectCandidate(chat, merged)
+					if len(merged.Candidates) == 0 || merged.Candidates[0].Content == nil {
+						return turn, nil
+					}
+					return turn, process(merged.Candidates[0].Content.Parts)
+				}
+				if err != nil {
+					return turn, wrapModelError(err)
+				}
+				if resp.UsageMetadata != nil {
+					usage = resp.UsageMetadata
+				}
+				if selecting || len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
+					continue
+				}
+				if err := process(resp.Candidates[0].Content.Parts); err != nil {
+					return turn, err
+				}
+			}
+		}
+
+		// send a turn, an overloaded model is retried then the turn moves down the fallback models
+		// while nothing has reached the consumer, and a reply with nothing in it is generated again
+		fallbacks := agent.FallbackModels
+		send := func(live bool, parts ...genai.Part) (turn streamTurn, err error) {
+			sent := len(chat.History)
+			retries, empty := 0, 0
+			for {
+				turn, err = run(live, parts)
+				if err != nil && isOverloaded(err) && !turn.started && ctx.Err() == nil {
+					chat.History = chat.History[:sent]
+					if retries < agent.ModelRetries && allowRetry(ctx) {
+						retries++
+						agent.logger().Warn("model overloaded, retrying", "model", model, "retry", retries)
+						agent.waitBackoff(ctx, retries, err)
+						continue
+					}
+					if len(fallbacks) > 0 {
+						agent.logger().Warn("model overloaded, falling back", "model", model, "fallback", fallbacks[0])
+						next := agent.sessionModel(sess, fallbacks[0]).StartChat()
+						next.History = chat.History
+						chat, model, fallbacks, retries = next, fallbacks[0], fallbacks[1:], 0
+						continue
+					}
+				}
+				if err != nil || !turn.empty() {
+					return turn, err
+				}
+				chat.History = chat.History[:sent]
+				if empty >= agent.EmptyRetries || !allowRetry(ctx) {
+					return turn, &AgentError{Code: CodeModelError, Err: ErrEmptyResponse}
+				}
+				empty++
+				agent.logger().Warn("empty model response, retrying", "model", model, "retry", empty)
+				select {
+				case <-agent.clock().After(DefaultEmptyBackoff):
+				case <-ctx.Done():
+					return turn, ctx.Err()
+				}
+			}
+		}
+
+		// hand on the answer, transformed unless it is a structured reply or a question
+		answer := func(text string, question bool) {
+			if !question && sess.schema == nil {
+				var err error
+				text, err = agent.transformResponse(text)
+				if err != nil {
+					fail(err)
+					return
+				}
+			}
+			if !emit(StreamChunk{Text: text, NeedsInput: question}) {
+				fail(ctx.Err())
+			}
+		}
+
+		// the initial request is the message, later requests are the tool results
+		parts := inputParts(ctx, message)
+
+		// set max runs to 25
+		var interim []string
+		var trace []ToolCallTrace
+		var called []string
+		reprompts := 0
+		for idx := 0; idx < 25; idx++ {
+			// text is held back while it may still be re-prompted, transformed, placed by the MixedTextPolicy
+			// or replaced by the CandidateSelector choice
+			enforce := agent.EnforceToolUse && len(called) == 0
+			live := agent.MixedTextPolicy == "" && agent.ResponseTransformer == nil && !enforce && !agent.selectsCandidates()
+			turn, err := send(live, parts...)
+			if err != nil {
+				agent.logger().Error(err.Error())
+				fail(err)
+				return
+			}
+
+			// no tools requested so the answer is complete
+			if len(turn.calls) == 0 {
+				// a direct answer before any tool call is re-prompted when tool use is enforced
+				if enforce {
+					agent.logger().Warn("model answered without a tool", "reprompt", reprompts+1)
+					if reprompts >= toolUseReprompts {
+						fail(&AgentError{Code: CodeModelError, Err: ErrToolNotUsed})
+						return
+					}
+					reprompts++
+					parts = []genai.Part{genai.Text(toolUsePrompt)}
+					continue
+				}
+				if live {
+					return
+				}
+				text := strings.Join(turn.text, "")
+				if len(interim) > 0 && sess.schema == nil {
+					text = strings.Join(interim, "\n") + "\n" + text
+				}
+				answer(text, false)
+				return
+			}
+
+			// a final tool answers the call, the history records the results and the answer as the model reply
+			for pos, funcall := range turn.calls {
+				called = append(called, funcall.Name)
+				trace = append(trace, traceToolCall(funcall, turn.results[pos]))
+			}
+			for pos, funcall := range turn.calls {
+				if final, ok := agent.finalResult(funcall, turn.results[pos]); ok {
+					chat.History = append(chat.History,
+						&genai.Content{Role: "user", Parts: turn.results},
+						&genai.Content{Role: "model", Parts: []genai.Part{genai.Text(final)}})
+					answer(final, funcall.Name == ClarificationTool)
+					return
+				}
+			}
+
+			// text alongside the tool calls is placed by the MixedTextPolicy
+			switch agent.MixedTextPolicy {
+			case MixedTextPrepend:
+				interim = append(interim, turn.text...)
+			case MixedTextCommentary:
+				for _, text := range turn.text {
+					if !emit(StreamChunk{Commentary: text}) {
+						fail(ctx.Err())
+						return
+					}
+				}
+			default:
+				for _, text := range turn.text {
+					if !live && !emit(StreamChunk{Text: text}) {
+						fail(ctx.Err())
+						return
+					}
+				}
+			}
+			parts = turn.results
+		}
+
+		// if we are here we ran out of cycles
+		fail(maxIterationsError(interim, trace))
+	}()
+
+	return chunks, nil
+}
+
+// write a single server sent event with a json encoded response payload
+func writeStreamEvent(res http.ResponseWriter, event string, response Response) error {
+	data, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(res, "event: %s\ndata: %s\n\n", event, data)
+	if err != nil {
+		return err
+	}
+	if flusher, ok := res.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// generalized agent streaming request handler
+// replies with server sent events: "chunk" for each piece of text, "progress" for tool progress,
+// "tool" for streamed tool output, "commentary" for text alongside tool calls, then "done" or "error"
+func (agent *Agent) HandleAgentStreamRequest(res http.ResponseWriter, req *http.Request) {
+	agent.setNameHeader(res)
+
+	// check the agent is usable
+	if err := agent.checkAgent(); err != nil {
+		http.Error(res, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	// refuse new work while draining, letting in-flight requests finish
+	done, ok := agent.beginRequest(res)
+	if !ok {
+		return
+	}
+	defer done()
+	// validate and decode the request
+	reqBody, ok := agent.decodeAgentRequest(res, req)
+	if !ok {
+		return
+	}
+	// reject requests that have travelled too many agent hops
+	ctx, ok := agent.checkHops(res, req)
+	if !ok {
+		return
+	}
+	// apply any client requested time limit to the whole generation
+	ctx, cancel, ok := agent.requestTimeout(ctx, res, req)
+	if !ok {
+		return
+	}
+	defer cancel()
+	ctx = reqBody.context(ctx)
+	id := requestID(req)
+	res.Header().Set(RequestIDHeader, id)
+	ctx = withRequestID(ctx, id)
+	// bound the generations running at once, the slot is held until the stream ends
+	release, ok := agent.acquireInFlight(res, req)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// call the agent, replacing any turn in flight when asked
+	if reqBody.Interrupt {
+		agent.InterruptSession(reqBody.SessionID)
+	}
+	chunks, err := agent.callAgentStream(ctx, reqBody.SessionID, reqBody.Input)
+	if err != nil {
+		status := errorStatus(ctx, err)
+		agent.deadLetter(id, reqBody, status, err)
+		setRetryAfter(res, err)
+		http.Error(res, http.StatusText(status), status)
+		return
+	}
+
+	// stream the chunks back, draining the channel even if the client has gone
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	failed := false
+	for chunk := range chunks {
+		if chunk.Err != nil {
+			failed = true
+			// the detail stays in the logs and the dead letters, the client gets the category only
+			status := errorStatus(ctx, chunk.Err)
+			agent.deadLetter(id, reqBody, status, chunk.Err)
+			writeStreamEvent(res, "error", Response{Content: http.StatusText(status), Code: ErrorCodeOf(chunk.Err)})
+			continue
+		}
+		if chunk.Progress != "" {
+			writeStreamEvent(res, "progress", Response{Content: chunk.Progress})
+			continue
+		}
+		if chunk.ToolOutput != "" {
+			writeStreamEvent(res, "tool", Response{Content: chunk.ToolOutput})
+			continue
+		}
+		if chunk.Commentary != "" {
+			writeStreamEvent(res, "commentary", Response{Content: chunk.Commentary})
+			continue
+		}
+		if chunk.NeedsInput {
+			writeStreamEvent(res, "chunk", Response{Content: chunk.Text, NeedsInput: true, Question: chunk.Text})
+			continue
+		}
+		writeStreamEvent(res, "chunk", Response{Content: chunk.Text})
+	}
+	if !failed {
+		writeStreamEvent(res, "done", Response{})
+	}
+}
+
+// call a remote agent streaming endpoint at the full url, e.g. http://<hostname>:<port>/agent/stream
+// the text chunks are delivered as they arrive so the caller can re-stream them. the channel is
+// unbuffered so the downstream body is only read as fast as the caller drains it, cancel ctx to
+// stop reading early
+func CallRemoteAgentStream(ctx context.Context, url string, message string) (<-chan StreamChunk, error) {
+	message, err := beforeAgentCall(ctx, url, message)
+	if err != nil {
+		return nil, err
+	}
+	return streamRemoteAgent(ctx, streamHTTPClient(), url, message, "", DefaultMaxResponseBytes)
+}
+
+// stream a remote agent call with the given http client, optional bearer token and total size limit
+func streamRemoteAgent(ctx context.Context, client *http.Client, url string, message string, token string, limit int64) (<-chan StreamChunk, error) {
+
+	// build the payload
+	request := Request{
+		Input: message,
+	}
+	reqDat, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare the request
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(reqDat))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	SetHopsHeader(ctx, req.Header)
+	SetTimeoutHeader(ctx, req.Header)
+	SetRequestIDHeader(ctx, req.Header)
+	injectTrace(ctx, req.Header)
+	req.Header.Set("Accept", "text/event-stream")
+	setAuthHeader(req.Header, token)
+
+	// send the post, failing fast once the request budget is spent
+	if err := chainTimeout(ctx, 0); err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if timeout := chainTimeout(ctx, 0); timeout != nil {
+			return nil, timeout
+		}
+		return nil, fmt.Errorf("%w: %v", ErrDownstreamUnavailable, err)
+	}
+	if err := chainTimeout(ctx, resp.StatusCode); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if isUnavailableStatus(resp.StatusCode) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", ErrDownstreamUnavailable, resp.Status)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, downstreamError(resp)
+	}
+
+	chunks := make(chan StreamChunk)
+	go func() {
+		defer close(chunks)
+		defer resp.Body.Close()
+
+		// hand a chunk to the caller, giving up if the caller has cancelled
+		send := func(chunk StreamChunk) bool {
+			select {
+			case chunks <- chunk:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		// read the events line by line
+		scanner := bufio.NewScanner(limitBody(resp.Body, limit))
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		event := ""
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event:"):
+				event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+			case strings.HasPrefix(line, "data:"):
+				response := Response{}
+				err := json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(line, "data:"))), &response)
+				if err != nil {
+					// a line cut short by a failed read, e.g. over the size limit, reports the read error
+					if scanErr := scanner.Err(); scanErr != nil {
+						err = scanErr
+					}
+					send(StreamChunk{Err: err})
+					return
+				}
+				switch event {
+				case "chunk":
+					if !send(StreamChunk{Text: response.Content, NeedsInput: response.NeedsInput}) {
+						return
+					}
+				case "progress":
+					if !send(StreamChunk{Progress: response.Content}) {
+						return
+					}
+				case "tool":
+					if !send(StreamChunk{ToolOutput: response.Content}) {
+						return
+					}
+				case "commentary":
+					if !send(StreamChunk{Commentary: response.Content}) {
+						return
+					}
+				case "error":
+					send(StreamChunk{Err: errors.New(response.Content)})
+					return
+				case "done":
+					return
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			send(StreamChunk{Err: err})
+			return
+		}
+		// the stream ended without a done event
+		send(StreamChunk{Err: errors.New("remote agent stream ended unexpectedly")})
+	}()
+
+	return chunks, nil
+}
+
+// call a remote agent streaming endpoint and read the text through an io.Reader
+// text is pulled from the downstream as the reader is consumed, close to stop the stream
+func CallRemoteAgentReader(ctx context.Context, url string, message string) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	chunks, err := CallRemoteAgentStream(ctx, url, message)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &streamReader{chunks: chunks, cancel: cancel}, nil
+}
+
+// io.ReadCloser over a stream chunk channel
+type streamReader struct {
+	chunks  <-chan StreamChunk
+	cancel  context.CancelFunc
+	pending []byte
+	err     error
+}
+
+func (reader *streamReader) Read(p []byte) (int, error) {
+	// wait for the next chunk with text
+	for len(reader.pending) == 0 {
+		if reader.err != nil {
+			return 0, reader.err
+		}
+		chunk, ok := <-reader.chunks
+		if !ok {
+			reader.err = io.EOF
+			continue
+		}
+		if chunk.Err != nil {
+			reader.err = chunk.Err
+			continue
+		}
+		reader.pending = []byte(chunk.Text)
+	}
+	n := copy(p, reader.pending)
+	reader.pending = reader.pending[n:]
+	return n, nil
+}
+
+func (reader *streamReader) Close() error {
+	reader.cancel()
+	// drain so the stream goroutine can exit
+	for range reader.chunks {
+	}
+	return nil
+}
@@ -0,0 +1,537 @@
+package geminiagentassemble
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// read a stream to the end, returning the text, the tagged side chunks and the error
+func collectStream(t *testing.T, chunks <-chan StreamChunk) (text string, side []string, err error) {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case chunk, ok := <-chunks:
+			if !ok {
+				return text, side, err
+			}
+			switch {
+			case chunk.Err != nil:
+				err = chunk.Err
+			case chunk.Commentary != "":
+				side = append(side, "commentary:"+chunk.Commentary)
+			case chunk.NeedsInput:
+				side = append(side, "question:"+chunk.Text)
+			default:
+				text += chunk.Text
+			}
+		case <-timeout:
+			t.Fatal("stream did not complete")
+		}
+	}
+}
+
+func TestCallAgentStream(t *testing.T) {
+	requireModelCalls(t)
+	finalTool := ToolFunc{
+		Declaration: &genai.FunctionDeclaration{Name: "answer"},
+		Handler: func(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+			return "the final answer", nil
+		},
+		Final: true,
+	}
+	clarifyTool := ToolFunc{
+		Declaration: &genai.FunctionDeclaration{Name: ClarificationTool},
+		Handler: func(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+			return "which city?", nil
+		},
+		Final: true,
+	}
+	upper := func(text string) (string, error) { return strings.ToUpper(text), nil }
+	failing := func(text string) (string, error) { return "", errors.New("transform failed") }
+
+	tests := []struct {
+		name     string
+		replies  []mockReply
+		options  []Option
+		setup    func(agent *Agent)
+		text     string
+		side     []string
+		err      error
+		requests int
+		history  int
+	}{
+		{
+			name:     "text is streamed",
+			replies:  []mockReply{textReply("Hello ", "world")},
+			text:     "Hello world",
+			requests: 1,
+			history:  2,
+		},
+		{
+			name:     "tool turn then answer",
+			replies:  []mockReply{callReply("echo", map[string]any{"text": "hi"}), textReply("done")},
+			text:     "done",
+			requests: 2,
+			history:  4,
+		},
+		{
+			name:     "response transformer runs on the answer",
+			replies:  []mockReply{textReply("loud ", "answer")},
+			setup:    func(agent *Agent) { agent.ResponseTransformer = upper },
+			text:     "LOUD ANSWER",
+			requests: 1,
+			history:  2,
+		},
+		{
+			name:     "response transformer error fails the stream",
+			replies:  []mockReply{textReply("answer")},
+			setup:    func(agent *Agent) { agent.ResponseTransformer = failing },
+			err:      errors.New("transform failed"),
+			requests: 1,
+			history:  0,
+		},
+		{
+			name:     "final tool answers",
+			replies:  []mockReply{callReply("answer", nil)},
+			options:  []Option{WithToolFuncs(finalTool)},
+			setup:    func(agent *Agent) { agent.ResponseTransformer = upper },
+			text:     "THE FINAL ANSWER",
+			requests: 1,
+			history:  4,
+		},
+		{
+			name:     "clarification is a question",
+			replies:  []mockReply{callReply(ClarificationTool, nil)},
+			options:  []Option{WithToolFuncs(clarifyTool)},
+			side:     []string{"question:which city?"},
+			requests: 1,
+			history:  4,
+		},
+		{
+			name:     "enforced tool use re-prompts",
+			replies:  []mockReply{textReply("guess"), callReply("echo", map[string]any{"text": "hi"}), textReply("checked")},
+			setup:    func(agent *Agent) { agent.EnforceToolUse = true },
+			text:     "checked",
+			requests: 3,
+			history:  6,
+		},
+		{
+			name:     "enforced tool use gives up",
+			replies:  []mockReply{textReply("guess"), textReply("guess"), textReply("guess")},
+			setup:    func(agent *Agent) { agent.EnforceToolUse = true },
+			err:      ErrToolNotUsed,
+			requests: 3,
+			history:  0,
+		},
+		{
+			name:     "empty reply is retried",
+			replies:  []mockReply{{}, textReply("second try")},
+			text:     "second try",
+			requests: 2,
+			history:  2,
+		},
+		{
+			name:     "empty replies run out",
+			replies:  []mockReply{{}, {}},
+			setup:    func(agent *Agent) { agent.EmptyRetries = 1 },
+			err:      ErrEmptyResponse,
+			requests: 2,
+			history:  0,
+		},
+		{
+			name:     "overloaded model is retried",
+			replies:  []mockReply{errorReply(http.StatusTooManyRequests), textReply("recovered")},
+			text:     "recovered",
+			requests: 2,
+			history:  2,
+		},
+		{
+			name:     "overloaded model falls back",
+			replies:  []mockReply{errorReply(http.StatusTooManyRequests), textReply("fallback")},
+			setup:    func(agent *Agent) { agent.ModelRetries, agent.FallbackModels = 0, []string{"gemini-fallback"} },
+			text:     "fallback",
+			requests: 2,
+			history:  2,
+		},
+		{
+			name:     "commentary policy",
+			replies:  []mockReply{joinReplies(textReply("checking"), callReply("echo", nil)), textReply("done")},
+			setup:    func(agent *Agent) { agent.MixedTextPolicy = MixedTextCommentary },
+			text:     "done",
+			side:     []string{"commentary:checking"},
+			requests: 2,
+			history:  4,
+		},
+		{
+			name:     "prepend policy",
+			replies:  []mockReply{joinReplies(textReply("checking"), callReply("echo", nil)), textReply("done")},
+			setup:    func(agent *Agent) { agent.MixedTextPolicy = MixedTextPrepend },
+			text:     "checking\ndone",
+			requests: 2,
+			history:  4,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := newMockGemini(t, test.replies...)
+			agent := newMockAgent(t, mock, test.options...)
+			clock := newFakeClock()
+			agent.Clock = clock
+			done := make(chan struct{})
+			defer close(done)
+			clock.autoAdvance(time.Minute, done)
+			if test.setup != nil {
+				test.setup(agent)
+			}
+			if err := agent.NewSession(); err != nil {
+				t.Fatal(err)
+			}
+
+			chunks, err := agent.CallAgentStream(context.Background(), "question")
+			if err != nil {
+				t.Fatal(err)
+			}
+			text, side, err := collectStream(t, chunks)
+			switch {
+			case test.err == nil && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case test.err != nil && err == nil:
+				t.Fatalf("expected error %v", test.err)
+			case test.err != nil && !errors.Is(err, test.err) && err.Error() != test.err.Error():
+				t.Fatalf("error = %v, want %v", err, test.err)
+			}
+			if text != test.text {
+				t.Errorf("text = %q, want %q", text, test.text)
+			}
+			if strings.Join(side, "|") != strings.Join(test.side, "|") {
+				t.Errorf("side chunks = %q, want %q", side, test.side)
+			}
+			if got := len(mock.received()); got != test.requests {
+				t.Errorf("requests = %d, want %d", got, test.requests)
+			}
+			history, err := agent.History("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(history) != test.history {
+				t.Errorf("history = %d, want %d", len(history), test.history)
+			}
+		})
+	}
+}
+
+// a stream failing as its context ends reports the error the same way as a blocking call
+func TestCallAgentStreamErrorCodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		replies []mockReply
+		timeout time.Duration
+		cancel  bool // the tool cancels the call while it runs
+		code    ErrorCode
+		err     error
+	}{
+		{name: "cancelled", replies: []mockReply{callReply("wait", nil)}, cancel: true, code: CodeCancelled, err: context.Canceled},
+		{name: "deadline", replies: []mockReply{callReply("wait", nil)}, timeout: 20 * time.Millisecond, code: CodeTimeout, err: context.DeadlineExceeded},
+		{name: "model error", replies: []mockReply{errorReply(http.StatusBadRequest)}, err: ErrModelFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.cancel || test.timeout > 0 {
+				requireModelCalls(t)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if test.timeout > 0 {
+				ctx, cancel = context.WithTimeout(ctx, test.timeout)
+				defer cancel()
+			}
+			wait := ToolFunc{Declaration: &genai.FunctionDeclaration{Name: "wait"}, Handler: func(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+				if test.cancel {
+					cancel()
+				}
+				<-ctx.Done()
+				return "", ctx.Err()
+			}}
+			agent := newMockAgent(t, newMockGemini(t, test.replies...), WithToolFuncs(wait))
+			if err := agent.NewSession(); err != nil {
+				t.Fatal(err)
+			}
+
+			chunks, err := agent.CallAgentStream(ctx, "question")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = collectStream(t, chunks)
+			if !errors.Is(err, test.err) {
+				t.Errorf("error = %v, want %v", err, test.err)
+			}
+			if got := ErrorCodeOf(err); got != test.code {
+				t.Errorf("code = %q, want %q", got, test.code)
+			}
+		})
+	}
+}
+
+// with several candidates the stream holds each turn and sends the CandidateSelector choice
+func TestCallAgentStreamCandidateSelector(t *testing.T) {
+	requireModelCalls(t)
+	tests := []struct {
+		name     string
+		count    int32
+		selector func(candidates []*genai.Candidate) int
+		text     string
+	}{
+		{name: "no selector", count: 2, text: "first"},
+		{name: "second chosen", count: 2, selector: func([]*genai.Candidate) int { return 1 }, text: "second"},
+		{name: "first chosen", count: 2, selector: func([]*genai.Candidate) int { return 0 }, text: "first"},
+		{name: "one candidate asked for", selector: func([]*genai.Candidate) int { return 1 }, text: "first"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var options []Option
+			if test.count > 0 {
+				options = append(options, WithCandidateCount(test.count))
+			}
+			agent := newMockAgent(t, newMockGemini(t, candidatesReply("first", "second")), options...)
+			agent.CandidateSelector = test.selector
+			if err := agent.NewSession(); err != nil {
+				t.Fatal(err)
+			}
+
+			chunks, err := agent.CallAgentStream(context.Background(), "question")
+			if err != nil {
+				t.Fatal(err)
+			}
+			text, _, err := collectStream(t, chunks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text != test.text {
+				t.Errorf("text = %q, want %q", text, test.text)
+			}
+			history, _ := agent.History("")
+			if len(history) != 2 {
+				t.Fatalf("history = %d turns, want 2", len(history))
+			}
+			if got := history[1].Parts[0]; got != genai.Text(test.text) {
+				t.Errorf("history reply = %v, want %q", got, test.text)
+			}
+		})
+	}
+}
+
+func TestCallAgentStreamCancelledConsumer(t *testing.T) {
+	requireModelCalls(t)
+	mock := newMockGemini(t, textReply("one ", "two ", "three"), textReply("next"))
+	agent := newMockAgent(t, mock)
+	if err := agent.NewSession(); err != nil {
+		t.Fatal(err)
+	}
+
+	// read one chunk and walk away
+	ctx, cancel := context.WithCancel(context.Background())
+	chunks, err := agent.CallAgentStream(ctx, "question")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-chunks
+	cancel()
+
+	// the stream lets go of the session instead of blocking on the abandoned channel
+	next, err := agent.CallAgentStream(context.Background(), "again")
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, _, err := collectStream(t, next)
+	if err != nil || text != "next" {
+		t.Fatalf("next stream = %q, %v", text, err)
+	}
+	history, _ := agent.History("")
+	if len(history) != 2 {
+		t.Errorf("history = %d, want the cancelled turn dropped", len(history))
+	}
+}
+
+func TestHandleAgentStreamRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		replies []mockReply
+		closed  bool
+		status  int
+		events  []string
+		data    string // the data of the last event
+	}{
+		{
+			name:    "streams chunks then done",
+			body:    `{"input":"hi"}`,
+			replies: []mockReply{textReply("a", "b")},
+			status:  http.StatusOK,
+			events:  []string{"chunk", "chunk", "done"},
+		},
+		{
+			name:    "failed stream ends with an error event",
+			body:    `{"input":"hi"}`,
+			replies: []mockReply{errorReply(http.StatusBadRequest)},
+			status:  http.StatusOK,
+			events:  []string{"error"},
+			data:    `{"content":"Internal Server Error"}`,
+		},
+		{
+			name:   "unknown session is not found",
+			body:   `{"input":"hi","session_id":"missing"}`,
+			status: http.StatusNotFound,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if len(test.events) > 0 {
+				requireModelCalls(t)
+			}
+			mock := newMockGemini(t, test.replies...)
+			agent := newMockAgent(t, mock)
+			if err := agent.NewSession(); err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/agent/stream", strings.NewReader(test.body))
+			req.Header.Set("Content-Type", "application/json")
+			res := httptest.NewRecorder()
+			agent.HandleAgentStreamRequest(res, req)
+			if res.Code != test.status {
+				t.Fatalf("status = %d, want %d: %s", res.Code, test.status, res.Body.String())
+			}
+			var events []string
+			data := ""
+			scanner := bufio.NewScanner(bytes.NewReader(res.Body.Bytes()))
+			for scanner.Scan() {
+				if event, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+					events = append(events, event)
+				}
+				if line, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+					data = line
+				}
+			}
+			if strings.Join(events, ",") != strings.Join(test.events, ",") {
+				t.Errorf("events = %v, want %v", events, test.events)
+			}
+			// the error detail from the model stays off the wire
+			if test.data != "" && data != test.data {
+				t.Errorf("last event data = %s, want %s", data, test.data)
+			}
+		})
+	}
+}
+
+// downstream stream endpoint sending the given events, then done unless it is cut short
+func newStreamServer(t *testing.T, events [][2]string, done bool) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range events {
+			if err := writeStreamEvent(res, event[0], Response{Content: event[1]}); err != nil {
+				return
+			}
+		}
+		if done {
+			writeStreamEvent(res, "done", Response{})
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCallRemoteAgentReader(t *testing.T) {
+	tests := []struct {
+		name   string
+		events [][2]string
+		done   bool
+		text   string
+		err    string
+	}{
+		{name: "chunks", events: [][2]string{{"chunk", "the answer "}, {"chunk", "is 42"}}, done: true, text: "the answer is 42"},
+		{name: "side events skipped", events: [][2]string{{"progress", "thinking"}, {"chunk", "42"}, {"tool", "add"}}, done: true, text: "42"},
+		{name: "empty", done: true},
+		{name: "error after text", events: [][2]string{{"chunk", "the answer "}, {"error", "model failed"}}, text: "the answer ", err: "model failed"},
+		{name: "cut short", events: [][2]string{{"chunk", "the answer "}}, text: "the answer ", err: "ended unexpectedly"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newStreamServer(t, test.events, test.done)
+			reader, err := CallRemoteAgentReader(context.Background(), server.URL, "question")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+
+			// read in small pieces so chunks are split across reads
+			var text bytes.Buffer
+			buf := make([]byte, 3)
+			for {
+				n, err := reader.Read(buf)
+				text.Write(buf[:n])
+				if err == io.EOF {
+					if test.err != "" {
+						t.Errorf("stream ended cleanly, want %q", test.err)
+					}
+					break
+				}
+				if err != nil {
+					if test.err == "" || !strings.Contains(err.Error(), test.err) {
+						t.Errorf("error = %v, want %q", err, test.err)
+					}
+					break
+				}
+			}
+			if text.String() != test.text {
+				t.Errorf("text = %q, want %q", text.String(), test.text)
+			}
+		})
+	}
+}
+
+// closing the reader stops pulling from a downstream that still has text to send
+func TestCallRemoteAgentReaderClose(t *testing.T) {
+	stopped := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		defer close(stopped)
+		res.Header().Set("Content-Type", "text/event-stream")
+		for {
+			if err := writeStreamEvent(res, "chunk", Response{Content: strings.Repeat("x", 1024)}); err != nil {
+				return
+			}
+			select {
+			case <-req.Context().Done():
+				return
+			default:
+			}
+		}
+	}))
+	defer server.Close()
+
+	reader, err := CallRemoteAgentReader(context.Background(), server.URL, "question")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("downstream kept streaming after the reader was closed")
+	}
+}
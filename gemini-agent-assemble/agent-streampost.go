@@ -0,0 +1,87 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"sync"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Agent stream post-processing routines
+/////////
+
+// bookkeeping of a streamed call, run in the background once the answer has been streamed
+type streamPost struct {
+	mu     sync.Mutex
+	audits []ToolAudit // audit records of the tool calls, written after the stream
+	tokens int64
+	failed bool
+}
+
+// context key for the bookkeeping of the stream running with ctx
+type streamPostKey struct{}
+
+// defer the bookkeeping of a stream running with ctx
+func withStreamPost(ctx context.Context, post *streamPost) context.Context {
+	return context.WithValue(ctx, streamPostKey{}, post)
+}
+
+// bookkeeping of the stream running with ctx, nil for a blocking call
+func streamPostFrom(ctx context.Context) *streamPost {
+	post, _ := ctx.Value(streamPostKey{}).(*streamPost)
+	return post
+}
+
+// hold an audit record until the stream ends
+func (post *streamPost) queueAudit(record ToolAudit) {
+	post.mu.Lock()
+	defer post.mu.Unlock()
+	post.audits = append(post.audits, record)
+}
+
+// count the tokens of a streamed model turn, the last chunk carries the turn totals
+func (post *streamPost) addUsage(usage *genai.UsageMetadata) {
+	if usage == nil {
+		return
+	}
+	post.mu.Lock()
+	defer post.mu.Unlock()
+	post.tokens += int64(usage.TotalTokenCount)
+}
+
+// write the audit records and label metrics of a finished stream off the stream goroutine
+// the consumer has the whole answer by then, the records already hold the request values so the
+// audit trail completes after the stream is closed and its context cancelled. Close and Shutdown
+// wait for the writes
+func (agent *Agent) finishStream(sess *session, post *streamPost) {
+	agent.posts.Add(1)
+	go func() {
+		defer agent.posts.Done()
+		post.mu.Lock()
+		defer post.mu.Unlock()
+		for _, record := range post.audits {
+			agent.writeAudit(record)
+		}
+		agent.addLabelMetric(labelRequestsMetric, sess, 1)
+		agent.addLabelMetric(labelTokensMetric, sess, post.tokens)
+		if post.failed {
+			agent.addLabelMetric(labelErrorsMetric, sess, 1)
+		}
+	}()
+}
+
+// wait for the post-processing of finished streams, or until ctx is done
+func (agent *Agent) waitPosts(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		agent.posts.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,179 @@
+package geminiagentassemble
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// audit sink safe to read while the stream bookkeeping writes to it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sink *syncBuffer) Write(data []byte) (int, error) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	return sink.buf.Write(data)
+}
+
+func (sink *syncBuffer) String() string {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	return sink.buf.String()
+}
+
+// a streamed call holds its audit records and label metrics until finishStream writes them
+func TestFinishStream(t *testing.T) {
+	tests := []struct {
+		name   string
+		calls  []string
+		usage  []int32
+		failed bool
+	}{
+		{name: "answer", usage: []int32{10}},
+		{name: "tool calls", calls: []string{"echo", "lookup"}, usage: []int32{10, 15}},
+		{name: "failed", calls: []string{"echo"}, usage: []int32{5}, failed: true},
+		{name: "no usage"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sink := &syncBuffer{}
+			agent := &Agent{Name: "streamer", AuditSink: sink}
+			// the metrics are process wide, a tenant of its own keeps repeated runs apart
+			tenant := fmt.Sprintf("%s-%d", strings.ReplaceAll(t.Name(), "/", "-"), time.Now().UnixNano())
+			sess := &session{labels: map[string]string{"tenant": tenant}}
+			post := &streamPost{}
+			ctx := withStreamPost(context.Background(), post)
+
+			// records and usage are held while the stream runs
+			var tokens int64
+			for _, name := range test.calls {
+				agent.audit(ctx, genai.FunctionCall{Name: name}, "ok", nil)
+			}
+			for _, total := range test.usage {
+				post.addUsage(&genai.UsageMetadata{TotalTokenCount: total})
+				tokens += int64(total)
+			}
+			post.addUsage(nil)
+			post.failed = test.failed
+			if got := sink.String(); got != "" {
+				t.Fatalf("audit written before the stream finished: %q", got)
+			}
+
+			agent.finishStream(sess, post)
+			key := agent.metricLabel() + "/tenant=" + tenant
+			waitMetric(t, labelTokensMetric, key)
+			if got := metricValue(labelRequestsMetric, key); got != 1 {
+				t.Errorf("label requests = %d, want 1", got)
+			}
+			if got := metricValue(labelTokensMetric, key); got != tokens {
+				t.Errorf("label tokens = %d, want %d", got, tokens)
+			}
+			if test.failed {
+				waitMetric(t, labelErrorsMetric, key)
+			} else if got := metricValue(labelErrorsMetric, key); got != 0 {
+				t.Errorf("label errors = %d, want 0", got)
+			}
+			lines := strings.Fields(sink.String())
+			if len(lines) != len(test.calls) {
+				t.Fatalf("audit lines = %q, want %d", lines, len(test.calls))
+			}
+			for idx, name := range test.calls {
+				if !strings.Contains(lines[idx], `"function":"`+name+`"`) {
+					t.Errorf("audit line %d = %q, want %s", idx, lines[idx], name)
+				}
+			}
+		})
+	}
+}
+
+// audit sink holding its writes until released
+type gatedSink struct {
+	syncBuffer
+	gate chan struct{}
+}
+
+func (sink *gatedSink) Write(data []byte) (int, error) {
+	<-sink.gate
+	return sink.syncBuffer.Write(data)
+}
+
+// a stream closes once the answer is sent, its audit records are written after and Close waits for them
+func TestCallAgentStreamAuditAfterClose(t *testing.T) {
+	requireModelCalls(t)
+	sink := &gatedSink{gate: make(chan struct{})}
+	mock := newMockGemini(t, callReply("echo", map[string]any{"text": "hi"}), textReply("answer"))
+	agent := newMockAgent(t, mock)
+	agent.AuditSink = sink
+	if err := agent.NewSession(); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks, err := agent.CallAgentStream(context.Background(), "question")
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, _, err := collectStream(t, chunks)
+	if err != nil || text != "answer" {
+		t.Fatalf("stream = %q, %v, want answer", text, err)
+	}
+	if got := sink.String(); got != "" {
+		t.Fatalf("audit written before the stream closed: %q", got)
+	}
+
+	closed := make(chan error)
+	go func() { closed <- agent.Close() }()
+	select {
+	case err := <-closed:
+		t.Fatalf("Close returned before the audit was written: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(sink.gate)
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	if got := sink.String(); !strings.Contains(got, `"function":"echo"`) {
+		t.Errorf("audit = %q, want the echo record", got)
+	}
+}
+
+// a blocking call writes its audit records at once
+func TestAuditOutsideStream(t *testing.T) {
+	sink := &syncBuffer{}
+	agent := &Agent{AuditSink: sink}
+	agent.audit(context.Background(), genai.FunctionCall{Name: "echo"}, "", errors.New("failed"))
+	if got := sink.String(); !strings.Contains(got, `"error":"failed"`) {
+		t.Errorf("audit = %q, want the record written", got)
+	}
+}
+
+// the value of a counter in an expvar map, 0 when not set
+func metricValue(metric *expvar.Map, key string) int64 {
+	value, ok := metric.Get(key).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return value.Value()
+}
+
+// wait until a counter has been set
+func waitMetric(t *testing.T, metric *expvar.Map, key string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for metric.Get(key) == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("metric %s not set", key)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
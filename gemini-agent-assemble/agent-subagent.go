@@ -0,0 +1,76 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"strings"
+	"unicode"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Agent as a tool routines
+/////////
+
+// expose the remote agent as a tool for another agent, e.g. remote.Tool("float", "Performs high
+// precision floating point calculations") registers a callFloatAgent function taking a message
+// the handler forwards the message with the hop, timeout, request id and auth headers and returns
+// the reply. a clarifying question from the remote agent is returned marked as such
+func (remote *RemoteAgent) Tool(name string, description string) ToolFunc {
+	declaration := &genai.FunctionDeclaration{
+		Name:        subAgentToolName(name),
+		Description: "Make a request to the " + name + " agent. " + description,
+		Parameters: &genai.Schema{
+			Type: genai.TypeObject,
+			Properties: map[string]*genai.Schema{
+				"message": {
+					Type:        genai.TypeString,
+					Description: "The natural language request message for the " + name + " agent",
+				},
+			},
+			Required: []string{"message"},
+		},
+	}
+	// the policy hook sees the tool name unless the remote agent has its own
+	named := *remote
+	if named.Name == "" {
+		named.Name = name
+	}
+	handler := func(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+		message, err := ArgString(funcall.Args, "message")
+		if err != nil {
+			return "", err
+		}
+		ReportProgress(ctx, "calling "+name+" agent...")
+		response, err := named.Call(ctx, message)
+		if err != nil {
+			return "", err
+		}
+		if response.NeedsInput {
+			return "the " + name + " agent needs more information: " + response.Question, nil
+		}
+		return response.Content, nil
+	}
+	return ToolFunc{Declaration: declaration, Handler: handler}
+}
+
+// function name for a sub agent, "float" is callFloatAgent
+func subAgentToolName(name string) string {
+	var out strings.Builder
+	upper := true
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		out.WriteRune(r)
+	}
+	if out.Len() == 0 {
+		return "callAgent"
+	}
+	return "call" + out.String() + "Agent"
+}
@@ -0,0 +1,92 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/////////
+// Agent request timeout routines
+/////////
+
+// header carrying the client requested processing time limit, in seconds or as a duration (e.g. "5s")
+const TimeoutHeader = "X-Request-Timeout"
+
+// default cap on a client requested timeout
+const DefaultMaxRequestTimeout = 2 * time.Minute
+
+// parse a timeout header value as whole seconds or a go duration
+func parseTimeout(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds <= 0 {
+			return 0, errors.New("timeout must be positive")
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if timeout <= 0 {
+		return 0, errors.New("timeout must be positive")
+	}
+	return timeout, nil
+}
+
+// derive the request context deadline from the timeout header, capped at MaxRequestTimeout
+// an error reply is written when the header is invalid
+func (agent *Agent) requestTimeout(ctx context.Context, res http.ResponseWriter, req *http.Request) (context.Context, context.CancelFunc, bool) {
+	value := req.Header.Get(TimeoutHeader)
+	if value == "" {
+		ctx, cancel := context.WithCancel(ctx)
+		return ctx, cancel, true
+	}
+	timeout, err := parseTimeout(value)
+	if err != nil {
+		http.Error(res, "Bad Request", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	if agent.MaxRequestTimeout > 0 && timeout > agent.MaxRequestTimeout {
+		agent.logger().Warn("capping requested timeout", "requested", timeout, "max", agent.MaxRequestTimeout)
+		timeout = agent.MaxRequestTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, cancel, true
+}
+
+// set the outbound timeout header on an agent to agent request to the time left before the ctx
+// deadline, so the downstream agent works to the remaining budget rather than a fresh one
+func SetTimeoutHeader(ctx context.Context, header http.Header) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+	remaining := time.Until(deadline).Truncate(time.Millisecond)
+	if remaining <= 0 {
+		// the call fails on the expired ctx, still never send a fresh budget
+		remaining = time.Millisecond
+	}
+	header.Set(TimeoutHeader, remaining.String())
+}
+
+// classify an agent to agent call failure as the request deadline running out, nil otherwise
+// the deadline passing here, or a 504 from a downstream agent sent the remaining budget, is a
+// CodeTimeout error returned up the chain rather than an unavailable agent to retry or degrade
+func chainTimeout(ctx context.Context, status int) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &AgentError{Code: CodeTimeout, Err: ErrChainTimeout}
+	}
+	if _, ok := ctx.Deadline(); ok && status == http.StatusGatewayTimeout {
+		return &AgentError{Code: CodeTimeout, Err: fmt.Errorf("%w: at downstream agent", ErrChainTimeout)}
+	}
+	return nil
+}
+
+// report whether a call failed because the request deadline passed
+func deadlineExceeded(ctx context.Context, err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded)
+}
@@ -0,0 +1,117 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSetTimeoutHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration // ctx deadline from now, 0 for no deadline
+		min     time.Duration
+		max     time.Duration
+	}{
+		{name: "no deadline"},
+		{name: "remaining budget", timeout: 5 * time.Second, min: 4 * time.Second, max: 5 * time.Second},
+		{name: "sub second budget", timeout: 500 * time.Millisecond, min: 100 * time.Millisecond, max: 500 * time.Millisecond},
+		{name: "expired", timeout: -time.Second, min: time.Millisecond, max: time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			if test.timeout != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.timeout)
+				defer cancel()
+			}
+			header := http.Header{}
+			SetTimeoutHeader(ctx, header)
+			value := header.Get(TimeoutHeader)
+			if test.timeout == 0 {
+				if value != "" {
+					t.Errorf("%s = %q, want none", TimeoutHeader, value)
+				}
+				return
+			}
+			// the downstream agent reads the value back as its own budget
+			got, err := parseTimeout(value)
+			if err != nil {
+				t.Fatalf("%s = %q: %v", TimeoutHeader, value, err)
+			}
+			if got < test.min || got > test.max {
+				t.Errorf("%s = %v, want between %v and %v", TimeoutHeader, got, test.min, test.max)
+			}
+		})
+	}
+}
+
+// blocking and streaming calls to a downstream agent send it the remaining budget
+func TestRemoteAgentTimeoutHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		stream  bool
+		timeout time.Duration
+	}{
+		{name: "call"},
+		{name: "call with deadline", timeout: time.Minute},
+		{name: "stream", stream: true},
+		{name: "stream with deadline", stream: true, timeout: time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			sent := ""
+			server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				mu.Lock()
+				sent = req.Header.Get(TimeoutHeader)
+				mu.Unlock()
+				if test.stream {
+					res.Header().Set("Content-Type", "text/event-stream")
+					writeStreamEvent(res, "chunk", Response{Content: "42"})
+					writeStreamEvent(res, "done", Response{})
+					return
+				}
+				res.Header().Set("Content-Type", "application/json")
+				res.Write([]byte(`{"content":"42"}`))
+			}))
+			defer server.Close()
+
+			ctx := context.Background()
+			if test.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.timeout)
+				defer cancel()
+			}
+			remote := &RemoteAgent{URL: server.URL}
+			if test.stream {
+				chunks, err := remote.Stream(ctx, "question")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, _, err := collectStream(t, chunks); err != nil {
+					t.Fatal(err)
+				}
+			} else if _, err := remote.Call(ctx, "question"); err != nil {
+				t.Fatal(err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if test.timeout == 0 {
+				if sent != "" {
+					t.Errorf("%s = %q, want none without a deadline", TimeoutHeader, sent)
+				}
+				return
+			}
+			got, err := parseTimeout(sent)
+			if err != nil || got <= 0 || got > test.timeout {
+				t.Errorf("%s = %q, want the remaining budget up to %v", TimeoutHeader, sent, test.timeout)
+			}
+		})
+	}
+}
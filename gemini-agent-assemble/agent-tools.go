@@ -0,0 +1,60 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Agent tool registration routines
+/////////
+
+// function declaration with its own handler
+// a Final tool result is the answer to the call, returned without sending it back to the model
+type ToolFunc struct {
+	Declaration *genai.FunctionDeclaration
+	Handler     ToolHandler
+	Final       bool
+}
+
+// register each function declaration with its own handler in place of a single tool callback
+// the declarations are added to the model tools and calls are dispatched by function name
+func WithToolFuncs(funcs ...ToolFunc) Option {
+	return func(agent *Agent) {
+		tool := &genai.Tool{}
+		for _, toolFunc := range funcs {
+			tool.FunctionDeclarations = append(tool.FunctionDeclarations, toolFunc.Declaration)
+			agent.handlers[toolFunc.Declaration.Name] = toolFunc.Handler
+			if toolFunc.Final {
+				agent.finals[toolFunc.Declaration.Name] = true
+			}
+		}
+		agent.tools = append(append([]*genai.Tool(nil), agent.tools...), tool)
+	}
+}
+
+// dispatch a function call to its registered handler, falling back to the agent tool callback
+func (agent *Agent) dispatchTool(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+	if handler, ok := agent.handlers[funcall.Name]; ok {
+		return handler(ctx, funcall)
+	}
+	if agent.toolCall == nil {
+		return "", errors.New("unhandled function name: " + funcall.Name)
+	}
+	return agent.toolCall(ctx, funcall)
+}
+
+// the result of a successful Final tool call, the answer for the caller
+func (agent *Agent) finalResult(funcall genai.FunctionCall, result genai.Part) (string, bool) {
+	if !agent.finals[funcall.Name] {
+		return "", false
+	}
+	response, ok := result.(genai.FunctionResponse)
+	if !ok {
+		return "", false
+	}
+	text, ok := response.Response["result"].(string)
+	return text, ok
+}
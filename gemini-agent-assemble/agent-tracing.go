@@ -0,0 +1,71 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/generative-ai-go/genai"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+/////////
+// Agent tracing routines
+/////////
+
+// instrumentation name reported on agent spans
+const tracerName = "gemini-agents/gemini-agent-assemble"
+
+// trace agent calls, model turns and tool invocations with the given provider
+// spans are "agent.call" for each call, with an "agent.generate" child per model turn and
+// "agent.tool" per tool invocation. call before the agent is shared
+func (agent *Agent) EnableTracing(tp trace.TracerProvider) {
+	if err := agent.checkAgent(); err != nil {
+		agent.logger().Error(err.Error())
+		return
+	}
+	agent.tracer = tp.Tracer(tracerName)
+}
+
+// start a span when tracing is enabled, otherwise a no-op span
+func (agent *Agent) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if agent.tracer == nil {
+		return ctx, noop.Span{}
+	}
+	return agent.tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// end a span, recording a failure
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// token counts of a model reply
+func usageAttributes(resp *genai.GenerateContentResponse) []attribute.KeyValue {
+	if resp == nil || resp.UsageMetadata == nil {
+		return nil
+	}
+	return []attribute.KeyValue{
+		attribute.Int("gen_ai.usage.input_tokens", int(resp.UsageMetadata.PromptTokenCount)),
+		attribute.Int("gen_ai.usage.output_tokens", int(resp.UsageMetadata.CandidatesTokenCount)),
+		attribute.Int("gen_ai.usage.total_tokens", int(resp.UsageMetadata.TotalTokenCount)),
+	}
+}
+
+// set the trace context from ctx on an agent to agent request with the global propagator
+func injectTrace(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// continue the caller trace from an inbound agent request
+func extractTrace(ctx context.Context, header http.Header) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(header))
+}
@@ -0,0 +1,162 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// in-memory tracer provider recording every span started through it
+type recordingProvider struct {
+	noop.TracerProvider
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+func (provider *recordingProvider) Tracer(name string, options ...trace.TracerOption) trace.Tracer {
+	return recordingTracer{provider: provider}
+}
+
+type recordingTracer struct {
+	noop.Tracer
+	provider *recordingProvider
+}
+
+func (tracer recordingTracer) Start(ctx context.Context, name string, options ...trace.SpanStartOption) (context.Context, trace.Span) {
+	span := &recordedSpan{name: name, attrs: map[string]attribute.Value{}}
+	span.parent, _ = trace.SpanFromContext(ctx).(*recordedSpan)
+	config := trace.NewSpanStartConfig(options...)
+	span.SetAttributes(config.Attributes()...)
+	tracer.provider.mu.Lock()
+	tracer.provider.spans = append(tracer.provider.spans, span)
+	tracer.provider.mu.Unlock()
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+// the recorded spans, in start order
+func (provider *recordingProvider) recorded() []*recordedSpan {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	return append([]*recordedSpan(nil), provider.spans...)
+}
+
+type recordedSpan struct {
+	noop.Span
+	mu     sync.Mutex
+	name   string
+	parent *recordedSpan
+	attrs  map[string]attribute.Value
+	status codes.Code
+	ended  bool
+}
+
+func (span *recordedSpan) SetAttributes(attrs ...attribute.KeyValue) {
+	span.mu.Lock()
+	defer span.mu.Unlock()
+	for _, attr := range attrs {
+		span.attrs[string(attr.Key)] = attr.Value
+	}
+}
+
+func (span *recordedSpan) SetStatus(code codes.Code, description string) {
+	span.mu.Lock()
+	defer span.mu.Unlock()
+	span.status = code
+}
+
+func (span *recordedSpan) End(options ...trace.SpanEndOption) {
+	span.mu.Lock()
+	defer span.mu.Unlock()
+	span.ended = true
+}
+
+// the span as "<parent> > <name>", with the status when it failed
+func (span *recordedSpan) path() string {
+	span.mu.Lock()
+	defer span.mu.Unlock()
+	path := span.name
+	if span.parent != nil {
+		path = span.parent.name + " > " + path
+	}
+	if span.status == codes.Error {
+		path += " (error)"
+	}
+	return path
+}
+
+func TestTracing(t *testing.T) {
+	tests := []struct {
+		name    string
+		replies []mockReply
+		model   bool
+		spans   []string
+	}{
+		{
+			name:    "one tool conversation",
+			replies: []mockReply{callReply("echo", map[string]any{"text": "hi"}), textReply("done")},
+			model:   true,
+			spans:   []string{"agent.call", "agent.call > agent.generate", "agent.call > agent.tool", "agent.call > agent.generate"},
+		},
+		{
+			name:    "direct answer",
+			replies: []mockReply{textReply("done")},
+			model:   true,
+			spans:   []string{"agent.call", "agent.call > agent.generate"},
+		},
+		{
+			name:    "model error",
+			replies: []mockReply{errorReply(http.StatusBadRequest)},
+			spans:   []string{"agent.call (error)", "agent.call > agent.generate (error)"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.model {
+				requireModelCalls(t)
+			}
+			agent := newMockAgent(t, newMockGemini(t, test.replies...))
+			provider := &recordingProvider{}
+			agent.EnableTracing(provider)
+			if err := agent.NewSession(); err != nil {
+				t.Fatal(err)
+			}
+			agent.CallAgentContext(context.Background(), "say hi")
+
+			spans := provider.recorded()
+			var paths []string
+			for _, span := range spans {
+				paths = append(paths, span.path())
+				if !span.ended {
+					t.Errorf("span %s was not ended", span.name)
+				}
+			}
+			if strings.Join(paths, ", ") != strings.Join(test.spans, ", ") {
+				t.Fatalf("spans = %q, want %q", paths, test.spans)
+			}
+			for _, span := range spans {
+				switch span.name {
+				case "agent.tool":
+					if got := span.attrs["gen_ai.tool.name"].AsString(); got != "echo" {
+						t.Errorf("tool span name = %q, want echo", got)
+					}
+				case "agent.generate":
+					if _, ok := span.attrs["gen_ai.request.model"]; !ok {
+						t.Error("generate span has no model")
+					}
+					if test.model {
+						if _, ok := span.attrs["gen_ai.usage.total_tokens"]; !ok {
+							t.Error("generate span has no token usage")
+						}
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Agent transcript record and replay routines
+/////////
+
+// returned when a replayed call does not match the next recorded step
+var ErrTranscriptMismatch = errors.New("call does not match the transcript")
+
+// recorded model reply or tool call
+type TranscriptStep struct {
+	Model  *Turn                   `json:"model,omitempty"`
+	Call   *genai.FunctionCall     `json:"call,omitempty"`
+	Result *genai.FunctionResponse `json:"result,omitempty"`
+}
+
+// sequence of model replies and tool calls from a generation loop
+// recorded from a live run it can be saved, loaded and replayed offline without calling the api
+type Transcript struct {
+	mu     sync.Mutex
+	Steps  []TranscriptStep `json:"steps"`
+	next   int
+	replay bool
+}
+
+// load a transcript saved with Save
+func LoadTranscript(path string) (*Transcript, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	transcript := &Transcript{}
+	err = json.Unmarshal(data, transcript)
+	if err != nil {
+		return nil, err
+	}
+	return transcript, nil
+}
+
+// save the transcript to a json file
+func (transcript *Transcript) Save(path string) error {
+	transcript.mu.Lock()
+	data, err := json.MarshalIndent(transcript, "", "  ")
+	transcript.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// record every model reply and tool call of the agent's blocking calls to the returned transcript
+// nil when the agent is not initialized or closed
+func (agent *Agent) RecordTranscript() *Transcript {
+	if err := agent.checkAgent(); err != nil {
+		agent.logger().Error(err.Error())
+		return nil
+	}
+	transcript := &Transcript{}
+	agent.mu.Lock()
+	agent.record = transcript
+	agent.mu.Unlock()
+	return transcript
+}
+
+// answer the agent's blocking calls from a recorded transcript instead of the model and tools
+func (agent *Agent) ReplayTranscript(transcript *Transcript) {
+	if err := agent.checkAgent(); err != nil {
+		agent.logger().Error(err.Error())
+		return
+	}
+	transcript.mu.Lock()
+	transcript.replay = true
+	transcript.next = 0
+	transcript.mu.Unlock()
+	agent.mu.Lock()
+	agent.record = transcript
+	agent.mu.Unlock()
+}
+
+// the active transcript, nil when not recording or replaying
+func (agent *Agent) activeTranscript() *Transcript {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	return agent.record
+}
+
+// send a message to the model, or answer it from the transcript when replaying
+func (agent *Agent) sendMessage(ctx context.Context, chat *genai.ChatSession, parts ...genai.Part) (*genai.GenerateContentResponse, error) {
+	transcript := agent.activeTranscript()
+	if transcript == nil {
+		return agent.sendChat(ctx, chat, parts...)
+	}
+	transcript.mu.Lock()
+	defer transcript.mu.Unlock()
+
+	if transcript.replay {
+		step, err := transcript.nextStep()
+		if err != nil || step.Model == nil {
+			return nil, fmt.Errorf("%w: expected a model reply", ErrTranscriptMismatch)
+		}
+		content := turnsToHistory([]Turn{*step.Model})[0]
+		content.Role = "model"
+		chat.History = append(chat.History, genai.NewUserContent(parts...), content)
+		return &genai.GenerateContentResponse{Candidates: []*genai.Candidate{{Content: content}}}, nil
+	}
+
+	resp, err := agent.sendChat(ctx, chat, parts...)
+	if err == nil && len(resp.Candidates) > 0 && resp.Candidates[0].Content != nil {
+		turn := historyToTurns([]*genai.Content{resp.Candidates[0].Content})[0]
+		transcript.Steps = append(transcript.Steps, TranscriptStep{Model: &turn})
+	}
+	return resp, err
+}
+
+// run a tool, or answer it from the transcript when replaying
+func (agent *Agent) runTool(ctx context.Context, funcall genai.FunctionCall) (genai.Part, error) {
+	transcript := agent.activeTranscript()
+	if transcript == nil {
+		return agent.callTool(ctx, funcall)
+	}
+
+	if transcript.replaying() {
+		transcript.mu.Lock()
+		defer transcript.mu.Unlock()
+		step, err := transcript.nextStep()
+		if err != nil || step.Call == nil || step.Result == nil || step.Call.Name != funcall.Name {
+			return nil, fmt.Errorf("%w: expected tool call %s", ErrTranscriptMismatch, funcall.Name)
+		}
+		return *step.Result, nil
+	}
+
+	part, err := agent.callTool(ctx, funcall)
+	if response, ok := part.(genai.FunctionResponse); ok && err == nil {
+		transcript.mu.Lock()
+		transcript.Steps = append(transcript.Steps, TranscriptStep{Call: &funcall, Result: &response})
+		transcript.mu.Unlock()
+	}
+	return part, err
+}
+
+// check for replay mode
+func (transcript *Transcript) replaying() bool {
+	transcript.mu.Lock()
+	defer transcript.mu.Unlock()
+	return transcript.replay
+}
+
+// the next recorded step, the transcript lock must be held
+func (transcript *Transcript) nextStep() (TranscriptStep, error) {
+	if transcript.next >= len(transcript.Steps) {
+		return TranscriptStep{}, errors.New("transcript exhausted")
+	}
+	step := transcript.Steps[transcript.next]
+	transcript.next++
+	return step, nil
+}
@@ -0,0 +1,71 @@
+package geminiagentassemble
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+/////////
+// Agent response length routines
+/////////
+
+// how a reply over the agent MaxResponseLength is handled
+type TruncateMode string
+
+const (
+	// cut the reply to the limit, ending with an ellipsis marker
+	TruncateEllipsis TruncateMode = "ellipsis"
+	// fail the request with ErrResponseTooLong
+	TruncateError TruncateMode = "error"
+)
+
+// marker ending a truncated reply
+const truncationMarker = "…"
+
+// marker appended to a tool result cut to MaxToolResultBytes
+const toolTruncationMarker = " [truncated]"
+
+// cap the reply content at MaxResponseLength characters, a zero limit leaves it unchanged
+func (agent *Agent) limitResponse(text string) (string, error) {
+	limit := agent.MaxResponseLength
+	length := utf8.RuneCountInString(text)
+	if limit <= 0 || length <= limit {
+		return text, nil
+	}
+	if agent.ResponseTruncation == TruncateError {
+		agent.logger().Warn("reply over the length limit", "length", length, "limit", limit)
+		return "", fmt.Errorf("%w: %d characters, limit %d", ErrResponseTooLong, length, limit)
+	}
+	agent.logger().Warn("reply truncated", "length", length, "limit", limit)
+	kept := limit - utf8.RuneCountInString(truncationMarker)
+	runes := 0
+	for idx := range text {
+		if runes == kept {
+			return text[:idx] + truncationMarker, nil
+		}
+		runes++
+	}
+	return text, nil
+}
+
+// cut a tool result to MaxToolResultBytes on a character boundary and mark it, a zero limit leaves it unchanged
+func (agent *Agent) limitToolResult(name string, result string) string {
+	limit := agent.MaxToolResultBytes
+	if limit <= 0 || len(result) <= limit {
+		return result
+	}
+	agent.logger().Warn("tool result truncated", "function", name, "bytes", len(result), "limit", limit)
+	return truncateUTF8(result, limit) + toolTruncationMarker
+}
+
+// cut text to at most limit bytes without splitting a character
+func truncateUTF8(text string, limit int) string {
+	if len(text) <= limit {
+		return text
+	}
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut]
+}
@@ -0,0 +1,35 @@
+package geminiagentassemble
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestLimitToolResult(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int
+		result string
+		want   string
+	}{
+		{name: "unlimited", result: strings.Repeat("x", 100), want: strings.Repeat("x", 100)},
+		{name: "under the limit", limit: 10, result: "short", want: "short"},
+		{name: "at the limit", limit: 5, result: "exact", want: "exact"},
+		{name: "over the limit", limit: 4, result: "too long", want: "too " + toolTruncationMarker},
+		{name: "multibyte boundary", limit: 4, result: "aé€b", want: "aé" + toolTruncationMarker},
+		{name: "first character too wide", limit: 2, result: "€uro", want: toolTruncationMarker},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := &Agent{MaxToolResultBytes: test.limit}
+			got := agent.limitToolResult("search", test.result)
+			if got != test.want {
+				t.Errorf("result = %q, want %q", got, test.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("result %q is not valid utf-8", got)
+			}
+		})
+	}
+}
@@ -4,11 +4,21 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"log"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/generative-ai-go/genai"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/api/option"
 )
 
@@ -16,19 +26,200 @@ import (
 // Agent Assemble routines
 /////////
 
+// tool result given to the model when DegradeOnUnavailable handles a downstream outage
+const degradedToolResult = "the downstream agent is unavailable, answer as best you can without it"
+
+// re-prompt sent when the model answers directly with EnforceToolUse set, and the times it is sent
+const (
+	toolUsePrompt    = "Do not answer directly. Call one of the available tools to get the answer."
+	toolUseReprompts = 2
+)
+
+// returned by a tool handler that panicked
+var errToolPanicked = errors.New("the tool failed unexpectedly")
+
+// tool result given to the model when it calls a tool outside the session allowlist
+const toolNotAllowedResult = "this tool is not available in this session"
+
+// agent specific tool call handler
+// ctx carries the request scope (hop count, cancellation) for any downstream calls
+type ToolHandler func(ctx context.Context, funcall genai.FunctionCall) (string, error)
+
+// response header identifying the replying agent
+const NameHeader = "X-Agent-Name"
+
+// time allowed for in-flight requests when RunAgentCtx shuts down
+const DefaultShutdownTimeout = 30 * time.Second
+
+// default model used by agents
+const DefaultModel = "gemini-2.0-flash-exp"
+
+// genai client creation retries in InitAgent and the first retry delay, doubled on each retry
+const (
+	DefaultInitRetries = 3
+	DefaultInitBackoff = time.Second
+)
+
 // agent context handle
+// an Agent is safe for concurrent use. calls on the same session are serialized so the
+// history stays consistent, configuration fields should be set before the agent is shared
 type Agent struct {
-	ctx      context.Context
-	Client   *genai.Client
-	model    *genai.GenerativeModel
-	session  *genai.ChatSession
-	system   *string
-	tools    []*genai.Tool
-	toolCall func(funcall genai.FunctionCall) (string, error)
+	ctx       context.Context
+	Client    *genai.Client
+	model     *genai.GenerativeModel
+	modelName string
+	models    map[string]*genai.GenerativeModel
+	session   *session
+	sessions  map[string]*session
+	system    *string
+	tools     []*genai.Tool
+	toolCall  ToolHandler
+	handlers  map[string]ToolHandler
+	finals    map[string]bool          // tools whose result is the final answer
+	granted   map[string]bool          // tools only run on a call granting them, see WithGrantableTools
+	schemas   map[string]*genai.Schema // named response schemas selected per request
+	closed    atomic.Bool
+	stop      chan struct{}  // closed by Close to stop background routines
+	janitor   sync.Once      // starts the idle session janitor with the first session
+	posts     sync.WaitGroup // stream post-processing still writing, waited for by Close and Shutdown
+	waiting   atomic.Bool    // WaitForDependencies has not seen every dependency healthy
+	basePath  string
+	server    *http.Server
+	pool      *sessionPool
+	jobs      map[string]*Job
+	cache     *contextCache
+	replies   map[idempotencyKey]*idempotentEntry
+	record    *Transcript
+	tracer    trace.Tracer
+	responses *responseCache
+	mu        sync.Mutex // guards session, sessions, models, server, pool, jobs, cache, replies, record, responses, inFlight, embedder, active, draining and retries
+
+	baseLogger  *slog.Logger
+	argRules    map[string]ArgRule // tool argument logging per tool
+	defaultArgs ArgRule            // tool argument logging for tools without a rule
+	noPreflight bool
+	candidates  int32
+
+	// agent name used in logs, metrics labels and the X-Agent-Name response header
+	Name string
+	// maximum inbound agent to agent hops accepted by the service, 0 disables the check
+	MaxHops int
+	// optional per request model selection, an empty return uses the default model
+	ModelRouter func(input string) string
+	// optional post-processing of the final answer (trim, extract, parse), nil is identity
+	ResponseTransformer func(string) (string, error)
+	// optional scrubbing (e.g. pii masking) of the input before it reaches the model, nil is identity
+	InputSanitizer func(string) string
+	// also apply the InputSanitizer to tool results before they reach the model
+	SanitizeToolResults bool
+	// text added before and after every user message, e.g. "Return the result with no commentary: "
+	// the wrapped message is what the model sees and what the history keeps
+	InputPrefix string
+	InputSuffix string
+	// reject requests with unknown json fields (e.g. a misspelt "inpt") instead of ignoring them
+	StrictDecoding bool
+	// wire format of request and response bodies, a JSONCodec following StrictDecoding when not set
+	Codec Codec
+	// bearer token for the admin routes, empty disables them
+	AdminToken string
+	// also serve the RESTful session routes under <base path>/sessions
+	SessionRoutes bool
+	// optional policy check on each downstream agent call made by the tools, e.g. to keep some
+	// tenants from calling an agent. it may rewrite the message, and an error blocks the call and is
+	// reported to the model as the tool result. the metadata holds the session labels, agent name,
+	// session id and request id
+	BeforeAgentCall func(name string, message *string, metadata map[string]string) error
+	// never answer without calling a tool, a direct answer is re-prompted and then fails with
+	// ErrToolNotUsed. pair with the ANY function calling mode in Model().ToolConfig
+	EnforceToolUse bool
+	// optional session id source (e.g. ulids or ids derived from a user id), nil generates random uuids
+	// ids already in use are regenerated, it is called with the agent mutex held
+	SessionIDGenerator func() string
+	// leave the system instruction out of Info() and the /agent/info reply
+	RedactSystemInstruction bool
+	// tools with side effects, replies that called them are never served from the response cache
+	SideEffectTools []string
+	// report an unavailable downstream agent to the model as the tool result instead of failing
+	DegradeOnUnavailable bool
+	// cap on the client requested X-Request-Timeout, 0 honors any value
+	MaxRequestTimeout time.Duration
+	// shared secret signing async job callbacks in the X-Agent-Signature header, a job with a
+	// callback_url is refused when it is not set
+	WebhookSecret []byte
+	// hosts, with the port when not the scheme default, an async job callback_url may post to.
+	// a callback to any other host is refused, so a request cannot reach internal addresses
+	WebhookHosts []string
+	// http client posting async job callbacks, DefaultHTTPClient when not set
+	WebhookClient *http.Client
+	// time a reply is replayed for a repeated Idempotency-Key, 0 disables idempotency keys
+	IdempotencyTTL time.Duration
+	// time a finished async job is kept for polling, 0 keeps jobs until the agent closes
+	JobTTL time.Duration
+	// time an id addressed session is kept without a turn before the janitor ends it, 0 keeps
+	// sessions until they are ended. the NewSession() session is never evicted
+	SessionIdleTTL time.Duration
+	// time source for ttls, expiry and backoff, defaults to RealClock
+	Clock Clock
+	// models tried in order for a turn when the model stays overloaded after ModelRetries
+	FallbackModels []string
+	// retries of an overloaded model before falling back, with exponential backoff
+	ModelRetries int
+	// handling of text the model returns alongside function calls, dropped when not set
+	MixedTextPolicy MixedTextPolicy
+	// index of the candidate a turn continues with when WithCandidateCount asks for several, the first when not set
+	CandidateSelector func(candidates []*genai.Candidate) int
+	// retries of a model reply with no text and no function call, then the call fails with CodeModelError
+	EmptyRetries int
+	// function name to race group, calls of one group in a model turn run concurrently and the
+	// first successful result answers them all. applies to blocking calls, streams run tools in order
+	RaceGroups map[string]string
+	// per tool time limits by function name, a timed out tool is reported to the model as a
+	// tool error. tools without an entry run until the request deadline
+	ToolTimeouts map[string]time.Duration
+	// return the thoughts of a thinking model in the response Reasoning, apart from the Content
+	IncludeReasoning bool
+	// limit in bytes on a tool result given to the model, longer results are cut and marked, 0 is unlimited
+	MaxToolResultBytes int
+	// limit in characters on the reply content returned over http, 0 is unlimited
+	MaxResponseLength int
+	// how a longer reply is handled, TruncateEllipsis when not set
+	ResponseTruncation TruncateMode
+	// receives each failed request with its input and error, e.g. DeadLetterWriter(file)
+	DeadLetter func(FailedRequest)
+	// record failed requests without their input
+	RedactDeadLetters bool
+	// retries of a failed genai client creation in InitAgent, with exponential backoff
+	InitRetries int
+	InitBackoff time.Duration
+	// genai client options added by WithGenaiOptions
+	genaiOptions []option.ClientOption
+	// receives a ToolAudit json line for every tool call, e.g. an append-only file
+	AuditSink io.Writer
+	// record tool calls without their arguments
+	RedactAuditArgs bool
+	auditMu         sync.Mutex // serializes AuditSink writes
+
+	// in-flight generation slots and queue wait, nil is unlimited
+	inFlight     chan struct{}
+	inFlightWait time.Duration
+
+	// requests being served and the channel closed once a drain has seen them all finish
+	active   int
+	draining chan struct{}
+
+	// embedding model used by Embed, DefaultEmbeddingModel when not set
+	EmbeddingModel string
+	embedder       *embedBatcher // coalesces Embed calls, nil sends each on its own
+
+	// retry token bucket, nil does not limit retries
+	retries *retryBudget
 }
 
+// optional InitAgent configuration
+type Option func(agent *Agent)
+
 // initializer
-func InitAgent(ctx context.Context, system *string, tools []*genai.Tool, toolCall func(funcall genai.FunctionCall) (string, error)) (*Agent, error) {
+func InitAgent(ctx context.Context, system *string, tools []*genai.Tool, toolCall ToolHandler, options ...Option) (*Agent, error) {
 
 	// get the api key
 	apiKey, ok := os.LookupEnv("GEMINI_API_KEY")
@@ -36,155 +227,1114 @@ func InitAgent(ctx context.Context, system *string, tools []*genai.Tool, toolCal
 		return nil, errors.New("environment variable GEMINI_API_KEY not set")
 	}
 
-	// create a new genai client
-	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
+	// create a new genai client, retrying transient failures
+	agent := newAgent(ctx, system, tools, toolCall, options...)
+	client, err := agent.newClient(ctx, apiKey)
 	if err != nil {
 		return nil, err
 	}
+	agent.setClient(client)
+	if err := agent.checkPreflight(ctx); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return agent, nil
+}
+
+// retry genai client creation on failure
+func WithInitRetries(retries int, backoff time.Duration) Option {
+	return func(agent *Agent) {
+		agent.InitRetries = retries
+		agent.InitBackoff = backoff
+	}
+}
+
+// extra genai client options for InitAgent after the api key, e.g. option.WithEndpoint for a
+// regional endpoint or a proxy. see InitAgentWithClient to supply a whole client instead
+func WithGenaiOptions(options ...option.ClientOption) Option {
+	return func(agent *Agent) {
+		agent.genaiOptions = append(agent.genaiOptions, options...)
+	}
+}
+
+// create the genai client with up to InitRetries retries, failing once they are exhausted
+func (agent *Agent) newClient(ctx context.Context, apiKey string) (*genai.Client, error) {
+	backoff := agent.InitBackoff
+	options := append([]option.ClientOption{option.WithAPIKey(apiKey)}, agent.genaiOptions...)
+	for attempt := 0; ; attempt++ {
+		client, err := genai.NewClient(ctx, options...)
+		if err == nil {
+			return client, nil
+		}
+		if attempt >= agent.InitRetries {
+			return nil, fmt.Errorf("genai client creation failed after %d attempts: %w", attempt+1, err)
+		}
+		agent.logger().Warn("genai client creation failed, retrying", "attempt", attempt+1, "backoff", backoff, "error", err)
+		select {
+		case <-agent.clock().After(backoff):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("genai client creation cancelled: %w", err)
+		}
+		backoff *= 2
+	}
+}
+
+// initializer with a pre-built genai client, e.g. one created with option.WithHTTPClient and
+// option.WithEndpoint to point the agent at a mock server in tests. the agent closes the client on Close()
+func InitAgentWithClient(ctx context.Context, client *genai.Client, system *string, tools []*genai.Tool, toolCall ToolHandler, options ...Option) (*Agent, error) {
+	if client == nil {
+		return nil, errors.New("genai client is nil")
+	}
+	agent := newAgent(ctx, system, tools, toolCall, options...)
+	agent.setClient(client)
+	if err := agent.checkPreflight(ctx); err != nil {
+		return nil, err
+	}
+	return agent, nil
+}
+
+// check the api key and model with a token count during init, failing fast on a bad setup
+// Deprecated: the check runs by default, see WithoutPreflight
+func WithPreflight() Option {
+	return func(agent *Agent) {
+		agent.noPreflight = false
+	}
+}
+
+// skip the init token count check, e.g. for offline tests or agents that start without network
+func WithoutPreflight() Option {
+	return func(agent *Agent) {
+		agent.noPreflight = true
+	}
+}
+
+// check the api key and model with a token count, an error wraps ErrInvalidCredentials when the
+// api rejected the key and ErrAPIUnreachable when it could not be reached
+func (agent *Agent) checkPreflight(ctx context.Context) error {
+	if agent.noPreflight {
+		return nil
+	}
+	_, err := agent.model.CountTokens(ctx, genai.Text("preflight"))
+	if err != nil {
+		err = wrapStartupError(err)
+		agent.logger().Error("preflight failed", "model", agent.modelName, "error", err)
+		return fmt.Errorf("preflight failed for model %s: %w", agent.modelName, err)
+	}
+	agent.logger().Info("preflight passed", "model", agent.modelName)
+	return nil
+}
+
+// agent with the defaults and options applied, the model is set up by setClient
+func newAgent(ctx context.Context, system *string, tools []*genai.Tool, toolCall ToolHandler, options ...Option) *Agent {
+	agent := &Agent{
+		ctx:       ctx,
+		modelName: DefaultModel,
+		models:    map[string]*genai.GenerativeModel{},
+		sessions:  map[string]*session{},
+		jobs:      map[string]*Job{},
+		replies:   map[idempotencyKey]*idempotentEntry{},
+		system:    system,
+		tools:     tools,
+		toolCall:  toolCall,
+		handlers:  map[string]ToolHandler{},
+		finals:    map[string]bool{},
+		granted:   map[string]bool{},
+		schemas:   map[string]*genai.Schema{},
+		stop:      make(chan struct{}),
+		MaxHops:   DefaultMaxHops,
+
+		MaxRequestTimeout: DefaultMaxRequestTimeout,
+		IdempotencyTTL:    DefaultIdempotencyTTL,
+		JobTTL:            DefaultJobTTL,
+		Clock:             RealClock,
+		ModelRetries:      DefaultModelRetries,
+		EmptyRetries:      DefaultEmptyRetries,
+		StrictDecoding:    true,
+		InitRetries:       DefaultInitRetries,
+		InitBackoff:       DefaultInitBackoff,
+	}
+	for _, apply := range options {
+		apply(agent)
+	}
+	return agent
+}
+
+// attach the genai client and set up the agent model
+func (agent *Agent) setClient(client *genai.Client) {
 
 	// select the model and configure to be a NL text agent
-	model := client.GenerativeModel("gemini-2.0-flash-exp")
+	model := client.GenerativeModel(DefaultModel)
 	model.SetTemperature(0)
 	model.SetTopK(40)
 	model.SetTopP(0.95)
 	model.SetMaxOutputTokens(8192)
-	if system != nil {
-		model.SystemInstruction = genai.NewUserContent(genai.Text(*system))
+	if agent.system != nil {
+		model.SystemInstruction = genai.NewUserContent(genai.Text(*agent.system))
 	}
-	if tools != nil {
-		model.Tools = tools
+	if agent.tools != nil {
+		model.Tools = agent.tools
 	}
 	model.ResponseMIMEType = "text/plain"
+	if agent.candidates > 0 {
+		model.SetCandidateCount(agent.candidates)
+	}
+
+	agent.Client = client
+	agent.model = model
+}
 
-	// populate the agent and return
-	agent := Agent{
-		ctx:      ctx,
-		Client:   client,
-		model:    model,
-		system:   system,
-		tools:    tools,
-		toolCall: toolCall,
+// escape hatch to the underlying genai model for settings the package does not wrap
+// (cached content, tuned models, safety settings etc). changes apply from the next call,
+// routed models copy the settings when first created. the package still owns the generation loop
+// nil when the agent is not initialized or closed
+func (agent *Agent) Model() *genai.GenerativeModel {
+	if err := agent.checkAgent(); err != nil {
+		return nil
 	}
+	return agent.model
+}
 
-	return &agent, nil
+// check the agent has been initialized and not closed
+func (agent *Agent) checkAgent() error {
+	if agent == nil || agent.Client == nil || agent.model == nil {
+		return ErrAgentNotInitialized
+	}
+	if agent.closed.Load() {
+		return ErrAgentClosed
+	}
+	return nil
 }
 
-func (agent *Agent) NewSession() {
-	agent.session = agent.model.StartChat()
+// close the client and mark the agent as unusable, once finished streams have written their
+// audit records and metrics
+func (agent *Agent) Close() error {
+	if err := agent.checkAgent(); err != nil {
+		return err
+	}
+	if !agent.closed.CompareAndSwap(false, true) {
+		return ErrAgentClosed
+	}
+	close(agent.stop)
+	// let finished streams write their audit records and metrics
+	agent.posts.Wait()
+	agent.mu.Lock()
+	agent.session = nil
+	agent.sessions = map[string]*session{}
+	agent.mu.Unlock()
+	return agent.Client.Close()
 }
 
 // call agent and run tools as required before returning the result
 // pre-determined graph flow of request, call tools as required, return final answer
 func (agent *Agent) CallAgent(message string) (string, error) {
+	if err := agent.checkAgent(); err != nil {
+		return "", err
+	}
+	return agent.CallAgentContext(agent.ctx, message)
+}
 
-	// check we have a session
-	if agent.session == nil {
-		err := errors.New("CallAgent(): no session configued. run NewSession() first")
-		log.Println(err)
+// call agent with a request scoped context passed through to the model and tools
+func (agent *Agent) CallAgentContext(ctx context.Context, message string) (string, error) {
+	if err := agent.checkAgent(); err != nil {
 		return "", err
 	}
+	return agent.CallAgentSession(ctx, "", message)
+}
 
-	// make the initial request
-	resp, err := agent.session.SendMessage(agent.ctx, genai.Text(message))
+// call agent and return the final raw genai response (finish reason, safety ratings, citations)
+// the text calls are a convenience over this. the ResponseTransformer is not applied to the raw response
+func (agent *Agent) CallAgentRaw(ctx context.Context, message string) (*genai.GenerateContentResponse, error) {
+	if err := agent.checkAgent(); err != nil {
+		return nil, err
+	}
+	result, err := agent.callAgent(ctx, "", message)
+	if err != nil {
+		return nil, err
+	}
+	return result.raw, nil
+}
+
+// call agent on the NewSession() session with a one-off system instruction
+// the session instruction and history are kept, the call turn is added to the history
+func (agent *Agent) CallAgentWithSystem(ctx context.Context, message string, system string) (string, error) {
+	if err := agent.checkAgent(); err != nil {
+		return "", err
+	}
+	result, err := agent.callAgent(withSystemOverride(ctx, system), "", message)
 	if err != nil {
-		log.Println(err)
 		return "", err
 	}
+	return result.text, nil
+}
+
+// call agent on the session with the given id, an empty id uses the NewSession() session
+func (agent *Agent) CallAgentSession(ctx context.Context, sessionID string, message string) (string, error) {
+	if err := agent.checkAgent(); err != nil {
+		return "", err
+	}
+	result, err := agent.callAgent(ctx, sessionID, message)
+	if err != nil {
+		return "", err
+	}
+	return result.text, nil
+}
+
+// outcome of a single agent call
+type callResult struct {
+	text       string
+	model      string
+	reasoning  string
+	needsInput bool // text is a clarifying question for the caller
+	iterations int  // model turns that called tools
+	retries    int  // overloaded model retries
+	empty      int  // empty reply retries
+	fallbacks  int  // moves down the fallback models
+	raw        *genai.GenerateContentResponse
+}
+
+// separate the thoughts of a text only reply from the answer
+// this genai version has no thought flag on parts, thinking models reply with the thoughts as
+// the leading text parts and the answer as the last one
+func splitReasoning(parts []genai.Part) (string, genai.Text, bool) {
+	var texts []string
+	for _, part := range parts {
+		switch part := part.(type) {
+		case genai.FunctionCall:
+			return "", "", false
+		case genai.Text:
+			texts = append(texts, string(part))
+		}
+	}
+	if len(texts) < 2 {
+		return "", "", false
+	}
+	return strings.Join(texts[:len(texts)-1], "\n"), genai.Text(texts[len(texts)-1]), true
+}
+
+// run the graph flow and return the final answer with details of how it was produced
+func (agent *Agent) callAgent(ctx context.Context, sessionID string, message string) (result *callResult, err error) {
+	requestsMetric.Add(agent.metricLabel(), 1)
+	defer func() {
+		if err != nil {
+			errorsMetric.Add(agent.metricLabel(), 1)
+		}
+	}()
+
+	// check the agent is usable
+	if err := agent.checkAgent(); err != nil {
+		agent.logger().Error(err.Error())
+		return nil, err
+	}
+
+	// check we have a session
+	sess, release, err := agent.acquireSession(ctx, sessionID)
+	if err != nil {
+		agent.logger().Error(err.Error())
+		return nil, err
+	}
+	defer release()
+
+	return agent.callSession(ctx, sess, message)
+}
+
+// run the graph flow on a session
+func (agent *Agent) callSession(ctx context.Context, sess *session, message string) (result *callResult, err error) {
+	message = agent.prepareInput(message)
+	ctx, span := agent.startSpan(ctx, "agent.call", attribute.String("agent.name", agent.Name), attribute.String("agent.session", sess.id))
+	defer func() { endSpan(span, err) }()
+	logger := agent.sessionLogger(sess)
+	agent.addLabelMetric(labelRequestsMetric, sess, 1)
+
+	// one turn at a time per session, cancelable through Cancel()
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	ctx, endTurn := agent.beginTurn(ctx, sess)
+	defer endTurn()
+
+	// select the model for this request, routed, cached and fallback chats write their history back to the session
+	defer agent.overrideTurn(ctx, sess)()
+	chat, modelName := agent.routeSession(sess, message)
+	defer func() {
+		if chat != sess.chat {
+			sess.chat.History = chat.History
+		}
+	}()
+	// drop a failed or cancelled turn so the history stays consistent
+	start := len(chat.History)
+	defer func() {
+		if err != nil {
+			agent.addLabelMetric(labelErrorsMetric, sess, 1)
+			chat.History = chat.History[:start]
+			err = contextError(ctx, err)
+		}
+	}()
+	result = &callResult{model: modelName}
+	span.SetAttributes(attribute.String("gen_ai.request.model", modelName))
+
+	// answer a repeated prompt from the response cache, requests with attachments, a schema or extra tools are not cached
+	cacheKey := ""
+	structured := sess.schema != nil
+	if ctx.Value(attachmentsKey{}) == nil && !structured && sess.extra == nil {
+		cacheKey = agent.responseCacheKey(sess, modelName, message, start)
+	}
+	if entry, ok := agent.cachedResponse(cacheKey); ok {
+		logger.Info("agent reply from response cache", "content", entry.text)
+		chat.History = append(chat.History, genai.NewUserContent(genai.Text(message)))
+		if len(entry.raw.Candidates) > 0 && entry.raw.Candidates[0].Content != nil {
+			reply := entry.raw.Candidates[0].Content
+			// a final tool answer is recorded as the model reply, not the calls that produced it
+			if hasFunctionCall(reply.Parts) {
+				reply = &genai.Content{Role: "model", Parts: []genai.Part{genai.Text(entry.text)}}
+			}
+			chat.History = append(chat.History, reply)
+		}
+		result.text, result.raw = entry.text, entry.raw
+		return result, nil
+	}
+	var called []string
+
+	// send to the model, retrying once on a re-created context cache
+	// an overloaded model is retried, then the turn moves down the fallback models
+	cached := chat != sess.chat && modelName == agent.modelName
+	fallbacks := agent.FallbackModels
+	send := func(parts ...genai.Part) (resp *genai.GenerateContentResponse, err error) {
+		ctx, span := agent.startSpan(ctx, "agent.generate")
+		defer func() {
+			span.SetAttributes(attribute.String("gen_ai.request.model", result.model))
+			span.SetAttributes(usageAttributes(resp)...)
+			if resp != nil && resp.UsageMetadata != nil {
+				agent.addLabelMetric(labelTokensMetric, sess, int64(resp.UsageMetadata.TotalTokenCount))
+			}
+			endSpan(span, err)
+		}()
+		sent := len(chat.History)
+		resp, err = agent.sendMessage(ctx, chat, parts...)
+		if err != nil && cached {
+			if retry, ok := agent.recoverContextCache(ctx, chat, sent); ok {
+				chat = retry
+				resp, err = agent.sendMessage(ctx, chat, parts...)
+			}
+		}
+		retries := 0
+		for err != nil && isOverloaded(err) && ctx.Err() == nil {
+			chat.History = chat.History[:sent]
+			if retries < agent.ModelRetries && allowRetry(ctx) {
+				retries++
+				result.retries++
+				logger.Warn("model overloaded, retrying", "model", result.model, "retry", retries)
+				agent.waitBackoff(ctx, retries, err)
+			} else if len(fallbacks) > 0 {
+				logger.Warn("model overloaded, falling back", "model", result.model, "fallback", fallbacks[0])
+				next := agent.sessionModel(sess, fallbacks[0]).StartChat()
+				next.History = chat.History
+				chat, result.model, fallbacks, retries = next, fallbacks[0], fallbacks[1:], 0
+				result.fallbacks++
+			} else {
+				break
+			}
+			resp, err = agent.sendMessage(ctx, chat, parts...)
+		}
+		// a reply with nothing in it is generated again
+		for empty := 0; err == nil && isEmptyResponse(resp); empty++ {
+			chat.History = chat.History[:sent]
+			if empty >= agent.EmptyRetries || !allowRetry(ctx) {
+				return nil, &AgentError{Code: CodeModelError, Err: ErrEmptyResponse}
+			}
+			logger.Warn("empty model response, retrying", "model", result.model, "retry", empty+1)
+			result.empty++
+			select {
+			case <-agent.clock().After(DefaultEmptyBackoff):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			resp, err = agent.sendMessage(ctx, chat, parts...)
+		}
+		return resp, err
+	}
+
+	// make the initial request
+	input := inputParts(ctx, message)
+	resp, err := send(input...)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, wrapModelError(err)
+	}
 
 	// set max runs to 25
+	var interim []string
+	var trace []ToolCallTrace
+	reprompts := 0
 	for idx := 0; idx < 25; idx++ {
+		// run any racing tool calls first
+		parts := resp.Candidates[0].Content.Parts
+		toolTurn := hasFunctionCall(parts)
+		var raced map[int]genai.Part
+		raced, err = agent.runRaces(ctx, sess, parts)
+		if err != nil {
+			return nil, err
+		}
+
 		// process each of the parts
 		var funcResults []genai.Part
-		for _, part := range resp.Candidates[0].Content.Parts {
+		var final string
+		var question bool
+		finished := false
+		reprompt := false
+		calls := turnCalls{}
+		for pos, part := range parts {
 			// check for a function call
 			funcall, ok := part.(genai.FunctionCall)
 			if ok {
 				// call the agent specific handler to get the response
-				result, err := agent.toolCall(funcall)
-				if err != nil {
-					log.Println(err)
-					return "", err
+				funcResult, ok := raced[pos]
+				if !ok {
+					funcResult, err = agent.callToolOnce(ctx, sess, calls, funcall)
+					if err != nil {
+						return nil, err
+					}
 				}
 				// save the result in the result slice
-				funcResult := genai.FunctionResponse{
-					Name: funcall.Name,
-					Response: map[string]any{
-						"result": result,
-					},
+				funcResults = append(funcResults, funcResult)
+				called = append(called, funcall.Name)
+				trace = append(trace, traceToolCall(funcall, funcResult))
+				if text, ok := agent.finalResult(funcall, funcResult); ok && !finished {
+					final, finished = text, true
+					question = funcall.Name == ClarificationTool
 				}
-				funcResults = append(funcResults, funcResult) // implicit interface cast
 			}
 
-			// check for ONLY a text answer and end here (text can be in function list)
+			// text alongside function calls is interim, kept or dropped by the MixedTextPolicy
 			content, ok := part.(genai.Text)
-			if len(funcResults) == 0 && ok {
+			if ok && toolTurn {
+				logger.Debug("interim text", "content", string(content))
+				interim = append(interim, string(content))
+				continue
+			}
+
+			// a direct answer before any tool call is re-prompted when tool use is enforced
+			if ok && agent.EnforceToolUse && len(called) == 0 {
+				logger.Warn("model answered without a tool", "content", string(content), "reprompt", reprompts+1)
+				if reprompts >= toolUseReprompts {
+					return nil, &AgentError{Code: CodeModelError, Err: ErrToolNotUsed}
+				}
+				reprompts++
+				reprompt = true
+				break
+			}
+
+			// check for ONLY a text answer and end here
+			if ok {
 				// drop out with the reply
-				log.Println("agent reply: " + content)
-				return string(content), nil
+				if reasoning, answer, ok := splitReasoning(parts); ok && agent.IncludeReasoning {
+					result.reasoning, content = reasoning, answer
+					logger.Debug("agent reasoning", "reasoning", reasoning)
+				}
+				if agent.MixedTextPolicy == MixedTextPrepend && len(interim) > 0 && !structured {
+					content = genai.Text(strings.Join(interim, "\n") + "\n" + string(content))
+				}
+				logger.Info("agent reply", "content", string(content), "model", result.model)
+				result.raw = resp
+				if structured {
+					// a structured reply is returned as generated
+					result.text = string(content)
+					return result, nil
+				}
+				result.text, err = agent.transformResponse(string(content))
+				if err != nil {
+					return nil, err
+				}
+				agent.storeResponse(cacheKey, result, called)
+				return result, nil
 			}
 		}
 
+		// ask again for the answer to come from a tool
+		if reprompt {
+			resp, err = send(genai.Text(toolUsePrompt))
+			if err != nil {
+				logger.Error(err.Error())
+				return nil, wrapModelError(err)
+			}
+			continue
+		}
+
+		// a final tool answers the call, the history records the results and the answer as the model reply
+		if finished {
+			logger.Info("agent reply from final tool", "content", final, "model", result.model)
+			result.iterations++
+			chat.History = append(chat.History,
+				&genai.Content{Role: "user", Parts: funcResults},
+				&genai.Content{Role: "model", Parts: []genai.Part{genai.Text(final)}})
+			result.raw = resp
+			if question {
+				// a question is returned as asked, not transformed as an answer
+				logger.Info("agent needs input", "question", final)
+				result.text, result.needsInput = final, true
+				return result, nil
+			}
+			result.text, err = agent.transformResponse(final)
+			if err != nil {
+				return nil, err
+			}
+			agent.storeResponse(cacheKey, result, called)
+			return result, nil
+		}
+
 		// pass the result back to the session
-		resp, err = agent.session.SendMessage(agent.ctx, funcResults...)
+		result.iterations++
+		resp, err = send(funcResults...)
 		if err != nil {
-			log.Println(err)
-			return "", err
+			logger.Error(err.Error())
+			return nil, wrapModelError(err)
+		}
+	}
+
+	// if we are here we ran out of cycles, returning the work done so far
+	return nil, maxIterationsError(interim, trace)
+}
+
+// apply the response transformer to the final answer
+func (agent *Agent) transformResponse(text string) (string, error) {
+	if agent.ResponseTransformer == nil {
+		return text, nil
+	}
+	transformed, err := agent.ResponseTransformer(text)
+	if err != nil {
+		agent.logger().Error("response transform failed", "error", err)
+		return "", err
+	}
+	return transformed, nil
+}
+
+// apply the input sanitizer
+func (agent *Agent) sanitizeInput(text string) string {
+	if agent.InputSanitizer == nil {
+		return text
+	}
+	return agent.InputSanitizer(text)
+}
+
+// sanitize a user message and wrap it in the InputPrefix and InputSuffix
+func (agent *Agent) prepareInput(message string) string {
+	return agent.InputPrefix + agent.sanitizeInput(message) + agent.InputSuffix
+}
+
+// select the model for a request and return a chat sharing the session history
+// the session chat itself is returned when no routing applies
+func (agent *Agent) routeSession(sess *session, input string) (*genai.ChatSession, string) {
+	name := ""
+	if agent.ModelRouter != nil {
+		name = agent.ModelRouter(input)
+	}
+	if name == "" || name == agent.modelName {
+		agent.logger().Info("agent model", "model", agent.modelName)
+		// the context cache holds the agent tools and instruction so scoped sessions send their own
+		if model := agent.cachedModel(); model != nil && sess.tools == nil && sess.system == nil && sess.schema == nil && sess.extra == nil {
+			chat := model.StartChat()
+			chat.History = sess.chat.History
+			return chat, agent.modelName
+		}
+		return sess.chat, agent.modelName
+	}
+	agent.logger().Info("agent model", "model", name, "routed", true)
+	chat := agent.sessionModel(sess, name).StartChat()
+	chat.History = sess.chat.History
+	return chat, name
+}
+
+// model for a session under the given model name with the session tool scope and system instruction
+func (agent *Agent) sessionModel(sess *session, name string) *genai.GenerativeModel {
+	if sess.tools == nil && sess.system == nil && sess.schema == nil && sess.extra == nil {
+		return agent.routedModel(name)
+	}
+	var model *genai.GenerativeModel
+	if sess.tools != nil {
+		model = agent.scopedModel(name, sess.tools)
+	} else {
+		model = agent.copyModel(name)
+	}
+	if sess.system != nil {
+		model.SystemInstruction = sess.system
+	}
+	if sess.schema != nil {
+		model.ResponseMIMEType = "application/json"
+		model.ResponseSchema = sess.schema
+	}
+	if sess.extra != nil {
+		model.Tools = append(append([]*genai.Tool(nil), model.Tools...), sess.extra...)
+	}
+	return model
+}
+
+// get or create a model with the agent configuration under a different model name
+func (agent *Agent) routedModel(name string) *genai.GenerativeModel {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	model, ok := agent.models[name]
+	if ok {
+		return model
+	}
+	model = agent.copyModel(name)
+	agent.models[name] = model
+	return model
+}
+
+// new model with the agent configuration under the given model name
+func (agent *Agent) copyModel(name string) *genai.GenerativeModel {
+	model := agent.Client.GenerativeModel(name)
+	model.GenerationConfig = agent.model.GenerationConfig
+	model.SafetySettings = agent.model.SafetySettings
+	model.Tools = agent.model.Tools
+	model.ToolConfig = agent.model.ToolConfig
+	model.SystemInstruction = agent.model.SystemInstruction
+	return model
+}
+
+// tool results within one model turn keyed by function name and canonical args
+type turnCalls map[string]genai.Part
+
+// run a tool once per turn, identical calls reuse the first result
+// a response is still returned for every call so the model sees one per request
+func (agent *Agent) callToolOnce(ctx context.Context, sess *session, calls turnCalls, funcall genai.FunctionCall) (genai.Part, error) {
+	// the model only sees the allowed declarations but never run a tool outside the session scope
+	if !agent.toolAllowed(sess, funcall.Name) {
+		agent.logger().Warn("tool not allowed in session", "function", funcall.Name, "session", sess.id)
+		return genai.FunctionResponse{
+			Name: funcall.Name,
+			Response: map[string]any{
+				"error": toolNotAllowedResult,
+			},
+		}, nil
+	}
+	key := callKey(funcall)
+	if funcResult, ok := calls[key]; ok && key != "" {
+		agent.logger().Info("duplicate tool call reused", "function", funcall.Name)
+		return funcResult, nil
+	}
+	funcResult, err := agent.runTool(ctx, funcall)
+	if err != nil {
+		return nil, err
+	}
+	if key != "" {
+		calls[key] = funcResult
+	}
+	return funcResult, nil
+}
+
+// check a tool is in the session scope and, for a grantable tool, granted to the call
+func (agent *Agent) toolAllowed(sess *session, name string) bool {
+	return sess.allows(name) && (!agent.granted[name] || sess.grants(name))
+}
+
+// dedup key for a function call from its canonical args so equal args match
+// empty when the args cannot be encoded
+func callKey(funcall genai.FunctionCall) string {
+	args, err := CanonicalJSON(funcall.Args)
+	if err != nil {
+		return ""
+	}
+	return funcall.Name + ":" + string(args)
+}
+
+// run the agent specific tool handler and wrap the result for the session
+func (agent *Agent) callTool(ctx context.Context, funcall genai.FunctionCall) (part genai.Part, err error) {
+	ctx, span := agent.startSpan(ctx, "agent.tool", attribute.String("gen_ai.tool.name", funcall.Name))
+	defer func() { endSpan(span, err) }()
+	toolCallsMetric.Add(agent.metricLabel(), 1)
+	agent.logToolCall(funcall.Name, funcall.Args)
+	toolCtx := ctx
+	timeout := agent.ToolTimeouts[funcall.Name]
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		toolCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	result, err := agent.invokeTool(toolCtx, funcall)
+	agent.audit(ctx, funcall, result, err)
+	if err != nil {
+		agent.logger().Error(err.Error())
+		// a panicking tool or bad arguments are a tool error for the model, the request carries on
+		if errors.Is(err, errToolPanicked) || errors.Is(err, ErrInvalidArgs) || errors.Is(err, ErrAgentCallBlocked) {
+			return genai.FunctionResponse{
+				Name: funcall.Name,
+				Response: map[string]any{
+					"error": err.Error(),
+				},
+			}, nil
+		}
+		// a tool over its own time limit is a tool error for the model, not a failed request
+		if timeout > 0 && ctx.Err() == nil && errors.Is(toolCtx.Err(), context.DeadlineExceeded) {
+			agent.logger().Warn("tool timed out", "function", funcall.Name, "timeout", timeout)
+			return genai.FunctionResponse{
+				Name: funcall.Name,
+				Response: map[string]any{
+					"error": fmt.Sprintf("the tool timed out after %s", timeout),
+				},
+			}, nil
+		}
+		// let the model carry on without the downstream agent
+		if agent.DegradeOnUnavailable && errors.Is(err, ErrDownstreamUnavailable) {
+			agent.logger().Warn("degraded tool result", "function", funcall.Name)
+			return genai.FunctionResponse{
+				Name: funcall.Name,
+				Response: map[string]any{
+					"error": degradedToolResult,
+				},
+			}, nil
 		}
+		return nil, fmt.Errorf("%w: %s: %w", ErrToolFailed, funcall.Name, err)
+	}
+	if agent.SanitizeToolResults {
+		result = agent.sanitizeInput(result)
+	}
+	result = agent.limitToolResult(funcall.Name, result)
+	funcResult := genai.FunctionResponse{
+		Name: funcall.Name,
+		Response: map[string]any{
+			"result": result,
+		},
 	}
+	return funcResult, nil // implicit interface cast
+}
 
-	// if we are here we ran out of cycles
-	return "", errors.New("message cycles exceeded")
+// run the tool handler, converting a panic into an error and logging its stack
+func (agent *Agent) invokeTool(ctx context.Context, funcall genai.FunctionCall) (result string, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			agent.logger().Error("tool panicked", "function", funcall.Name, "panic", recovered, "stack", string(debug.Stack()))
+			err = fmt.Errorf("%w: %v", errToolPanicked, recovered)
+		}
+	}()
+	return agent.dispatchTool(ctx, funcall)
 }
 
 // base agent request / response
+// a request carrying History (an empty list to start) is run statelessly and the
+// Response returns the updated history for the client to send with the next request
 type Request struct {
-	Input string `json:"input"`
+	Input       string `json:"input"`
+	SessionID   string `json:"session_id,omitempty"`
+	CallbackURL string `json:"callback_url,omitempty"`
+	History     []Turn `json:"history,omitempty"`
+	// inline files sent with the input, placed before it unless part_order is "text_first"
+	Attachments []Attachment `json:"attachments,omitempty"`
+	PartOrder   PartOrder    `json:"part_order,omitempty"`
+	// one-off system instruction for this request, the session keeps its own
+	SystemOverride string `json:"system_override,omitempty"`
+	// cancel any turn in flight on the session and run this one in its place
+	Interrupt bool `json:"interrupt,omitempty"`
+	// return how the reply was generated in the response diagnostics
+	Diagnostics bool `json:"diagnostics,omitempty"`
+	// json reply for this request, following a schema registered with WithResponseSchema or one sent inline
+	Schema         string  `json:"schema,omitempty"`
+	ResponseSchema *Schema `json:"response_schema,omitempty"`
+
+	schema *genai.Schema // resolved response schema
 }
 type Response struct {
-	Content string `json:"content"`
+	Content   string          `json:"content"`
+	Data      json.RawMessage `json:"data,omitempty"` // the reply as json when the request set a schema
+	Model     string          `json:"model,omitempty"`
+	Reasoning string          `json:"reasoning,omitempty"`
+	History   []Turn          `json:"history,omitempty"`
+	// the model asked a clarifying question instead of answering, the question is also the content
+	NeedsInput bool   `json:"needs_input,omitempty"`
+	Question   string `json:"question,omitempty"`
+	// how the reply was generated, when the request asked for diagnostics
+	Diagnostics *Diagnostics `json:"diagnostics,omitempty"`
+	// category of the failure on a stream error event, the content is then the generic status text
+	Code ErrorCode `json:"code,omitempty"`
 }
 
 // generalized agent request handler
 func (agent *Agent) HandleAgentRequest(res http.ResponseWriter, req *http.Request) {
+	agent.serveAgentRequest(res, req, "")
+}
 
+// run a request, a non empty sessionID from the route replaces the body session_id
+func (agent *Agent) serveAgentRequest(res http.ResponseWriter, req *http.Request, sessionID string) {
+	agent.setNameHeader(res)
+
+	// check the agent is usable
+	if err := agent.checkAgent(); err != nil {
+		http.Error(res, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	// refuse new work while draining, letting in-flight requests finish
+	done, ok := agent.beginRequest(res)
+	if !ok {
+		return
+	}
+	defer done()
+	// validate and decode the request
+	reqBody, ok := agent.decodeAgentRequest(res, req)
+	if !ok {
+		return
+	}
+	if sessionID != "" {
+		if reqBody.History != nil {
+			http.Error(res, "Bad Request: history is not allowed on a session", http.StatusBadRequest)
+			return
+		}
+		reqBody.SessionID = sessionID
+	}
+	// reject requests that have travelled too many agent hops
+	ctx, ok := agent.checkHops(res, req)
+	if !ok {
+		return
+	}
+	// apply any client requested time limit to the whole generation
+	ctx, cancel, ok := agent.requestTimeout(ctx, res, req)
+	if !ok {
+		return
+	}
+	defer cancel()
+	ctx = reqBody.context(ctx)
+	id := requestID(req)
+	res.Header().Set(RequestIDHeader, id)
+	ctx = withRequestID(ctx, id)
+	// bound the generations running at once
+	release, ok := agent.acquireInFlight(res, req)
+	if !ok {
+		return
+	}
+	defer release()
+	// a retried request with the same Idempotency-Key gets the first reply without re-running
+	// a key is scoped to the session and must be repeated with the same request
+	key, hash := req.Header.Get(IdempotencyHeader), ""
+	if key != "" {
+		hash = requestHash(reqBody)
+	}
+	entry, seen := agent.claimIdempotencyKey(reqBody.SessionID, key, hash)
+	plain := agent.acceptsPlainText(req)
+	if seen {
+		agent.replayIdempotent(ctx, res, plain, hash, entry)
+		return
+	}
+
+	// call the agent, statelessly when the request carries the history
+	var result *callResult
+	var history []*genai.Content
+	var err error
+	if reqBody.History != nil {
+		result, history, err = agent.callAgentHistory(ctx, turnsToHistory(reqBody.History), reqBody.Input)
+	} else {
+		if reqBody.Interrupt {
+			agent.InterruptSession(reqBody.SessionID)
+		}
+		result, err = agent.callAgent(ctx, reqBody.SessionID, reqBody.Input)
+	}
+	// hold the reply to the length limit at the transport boundary
+	if err == nil {
+		result.text, err = agent.limitResponse(result.text)
+	}
+	if err != nil {
+		status := errorStatus(ctx, err)
+		agent.deadLetter(id, reqBody, status, err)
+		agent.completeIdempotent(entry, status, Response{})
+		setRetryAfter(res, err)
+		http.Error(res, http.StatusText(status), status)
+		return
+	}
+
+	// send the result back
+	response := Response{
+		Content:   result.text,
+		Model:     result.model,
+		Reasoning: result.reasoning,
+	}
+	if reqBody.History != nil {
+		response.History = historyToTurns(history)
+	}
+	if reqBody.schema != nil && json.Valid([]byte(result.text)) {
+		response.Data = json.RawMessage(result.text)
+	}
+	if result.needsInput {
+		response.NeedsInput, response.Question = true, result.text
+	}
+	if reqBody.Diagnostics {
+		response.Diagnostics = result.diagnostics()
+	}
+	agent.completeIdempotent(entry, http.StatusOK, response)
+	agent.writeResponse(res, plain, response)
+}
+
+// identify the agent on every reply
+func (agent *Agent) setNameHeader(res http.ResponseWriter) {
+	if agent != nil && agent.Name != "" {
+		res.Header().Set(NameHeader, agent.Name)
+	}
+}
+
+// validate the method and mime type and decode the request body
+// an error reply is written when the request is rejected
+func (agent *Agent) decodeAgentRequest(res http.ResponseWriter, req *http.Request) (*Request, bool) {
 	// check for post
 	if req.Method != "POST" {
 		http.Error(res, "Bad Request", http.StatusBadRequest)
-		return
+		return nil, false
 	}
-	// check for json mime type
+	// check for the codec mime type
+	codec := agent.codec()
 	contentType := req.Header.Get("Content-Type")
-	if contentType == "" || contentType != "application/json" {
+	if contentType == "" || contentType != codec.ContentType() {
 		http.Error(res, "Bad Request", http.StatusBadRequest)
-		return
+		return nil, false
 	}
-	// decode the body
+	// decode the body, naming any unknown field when strict
 	var reqBody Request
-	err := json.NewDecoder(req.Body).Decode(&reqBody)
+	err := codec.Decode(req.Body, &reqBody)
 	if err != nil {
-		http.Error(res, "Bad Request", http.StatusBadRequest)
+		http.Error(res, "Bad Request: "+strings.TrimPrefix(err.Error(), "json: "), http.StatusBadRequest)
+		return nil, false
+	}
+	if err := validPartOrder(reqBody.PartOrder); err != nil {
+		http.Error(res, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	reqBody.schema, err = agent.requestSchema(&reqBody)
+	if err != nil {
+		http.Error(res, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return &reqBody, true
+}
+
+// set the path prefix for the agent routes, e.g. "/math" serves /math/agent
+func (agent *Agent) SetBasePath(path string) {
+	if err := agent.checkAgent(); err != nil {
+		agent.logger().Error(err.Error())
 		return
 	}
+	path = strings.TrimRight(path, "/")
+	if path != "" && !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	agent.basePath = path
+}
 
-	// call the agent
-	result, err := agent.CallAgent(reqBody.Input)
-	if err != nil {
-		http.Error(res, "Bad Request", http.StatusBadRequest)
+// register the agent routes under the base path on a shared mux
+// the routes of an agent that is not initialized or is closed reply 503
+func (agent *Agent) RegisterRoutes(mux *http.ServeMux) {
+	if err := agent.checkAgent(); err != nil {
+		agent.logger().Warn("agent routes unavailable", "error", err)
+		if agent == nil {
+			return
+		}
+	}
+	mux.HandleFunc(agent.basePath+"/agent", agent.HandleAgentRequest)
+	mux.HandleFunc(agent.basePath+"/agent/stream", agent.HandleAgentStreamRequest)
+	mux.HandleFunc("POST "+agent.basePath+"/agent/{session}/cancel", agent.HandleCancelRequest)
+	mux.HandleFunc("POST "+agent.basePath+"/agent/jobs", agent.HandleJobRequest)
+	mux.HandleFunc("GET "+agent.basePath+"/agent/jobs/{id}", agent.HandleJobStatus)
+	mux.HandleFunc("GET "+agent.basePath+"/agent/info", agent.HandleInfoRequest)
+	mux.HandleFunc("GET "+agent.basePath+"/health", agent.HandleHealthRequest)
+	mux.HandleFunc("GET "+agent.basePath+"/admin/sessions", agent.HandleListSessions)
+	if agent.SessionRoutes {
+		agent.registerSessionRoutes(mux)
+	}
+	mux.Handle(agent.basePath+"/metrics", expvar.Handler())
+}
+
+// health handler for GET <base path>/health, 200 while the agent is usable otherwise 503
+func (agent *Agent) HandleHealthRequest(res http.ResponseWriter, req *http.Request) {
+	agent.setNameHeader(res)
+	if err := agent.checkAgent(); err != nil {
+		http.Error(res, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if agent.waiting.Load() {
+		http.Error(res, "Waiting For Dependencies", http.StatusServiceUnavailable)
+		return
+	}
+	if agent.isDraining() {
+		http.Error(res, "Draining", http.StatusServiceUnavailable)
 		return
 	}
+	res.WriteHeader(http.StatusOK)
+}
 
-	// send the result back
-	response := Response{
-		Content: result,
+// generalized agent service at <hostname>:<port><base path>/agent and <hostname>:<port><base path>/agent/stream
+func (agent *Agent) RunAgent(hostname string, port string) error {
+	if err := agent.checkAgent(); err != nil {
+		agent.logger().Error(err.Error())
+		return err
+	}
+	server := agent.newServer(hostname, port)
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			agent.logger().Error("agent service failed", "error", err)
+		}
+	}()
+	agent.logger().Info("agent running", "address", hostname+":"+port+agent.basePath+"/agent")
+	return nil
+}
+
+// generalized agent service that runs until ctx is done, then shuts down gracefully
+// returns nil on a clean shutdown or the error that stopped the service
+func (agent *Agent) RunAgentCtx(ctx context.Context, hostname string, port string) error {
+	if err := agent.checkAgent(); err != nil {
+		agent.logger().Error(err.Error())
+		return err
+	}
+	server := agent.newServer(hostname, port)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServe()
+	}()
+	agent.logger().Info("agent running", "address", hostname+":"+port+agent.basePath+"/agent")
+
+	select {
+	case err := <-served:
+		agent.logger().Error("agent service failed", "error", err)
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+		defer cancel()
+		if err := agent.Shutdown(shutdownCtx); err != nil {
+			return err
+		}
+		<-served
+		return nil
 	}
-	res.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(res).Encode(response)
 }
 
-// generalized agent service at <hostname>:<port>/agent
-func (agent *Agent) RunAgent(hostname string, port string) {
+// stop the agent service, draining in-flight requests until ctx is done
+// new requests get 503 while draining so callers retry another replica, then waits for finished
+// streams to write their audit records and metrics
+func (agent *Agent) Shutdown(ctx context.Context) error {
+	if err := agent.checkAgent(); err != nil {
+		return err
+	}
+	agent.mu.Lock()
+	server := agent.server
+	agent.server = nil
+	agent.mu.Unlock()
+	if server == nil {
+		return agent.waitPosts(ctx)
+	}
+	agent.logger().Info("agent shutting down")
+	if err := agent.Drain(ctx); err != nil {
+		agent.logger().Warn("agent drain incomplete", "error", err)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		return err
+	}
+	return agent.waitPosts(ctx)
+}
+
+// create the http server for the agent routes
+func (agent *Agent) newServer(hostname string, port string) *http.Server {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/agent", agent.HandleAgentRequest)
-	go http.ListenAndServe(hostname+":"+port, mux)
-	log.Println("agent running at: " + hostname + ":" + port)
+	agent.RegisterRoutes(mux)
+	server := &http.Server{
+		Addr:    hostname + ":" + port,
+		Handler: mux,
+	}
+	agent.mu.Lock()
+	agent.server = server
+	agent.mu.Unlock()
+	return server
 }
@@ -0,0 +1,932 @@
+package geminiagentassemble
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/api/option"
+)
+
+// transport answering requests in process with the mock api handler, no listener involved
+type mockTransport struct {
+	mock *mockGemini
+}
+
+func (transport mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res := httptest.NewRecorder()
+	transport.mock.handle(res, req)
+	return res.Result(), nil
+}
+
+// agent on a genai client whose http transport is the mock handler
+func newTransportAgent(t *testing.T, mock *mockGemini) *Agent {
+	t.Helper()
+	ctx := context.Background()
+	client, err := genai.NewClient(ctx, option.WithAPIKey("test"), option.WithEndpoint("http://gemini.test"),
+		option.WithHTTPClient(&http.Client{Transport: mockTransport{mock: mock}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := []*genai.Tool{{FunctionDeclarations: []*genai.FunctionDeclaration{echoTool}}}
+	agent, err := InitAgentWithClient(ctx, client, nil, tools, echoCall)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { agent.Close() })
+	return agent
+}
+
+func TestInitAgentWithClient(t *testing.T) {
+	tests := []struct {
+		name       string
+		countError int
+		options    []Option
+		err        bool
+	}{
+		{name: "preflight passes"},
+		{name: "preflight fails", countError: http.StatusUnauthorized, err: true},
+		{name: "preflight skipped", countError: http.StatusUnauthorized, options: []Option{WithoutPreflight()}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := newMockGemini(t)
+			mock.countError = test.countError
+			client, err := genai.NewClient(context.Background(), option.WithAPIKey("test"), option.WithEndpoint("http://gemini.test"),
+				option.WithHTTPClient(&http.Client{Transport: mockTransport{mock: mock}}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			agent, err := InitAgentWithClient(context.Background(), client, nil, nil, nil, test.options...)
+			if test.err != (err != nil) {
+				t.Fatalf("error = %v, want error %v", err, test.err)
+			}
+			if agent != nil {
+				agent.Close()
+			}
+		})
+	}
+	if _, err := InitAgentWithClient(context.Background(), nil, nil, nil, nil); err == nil {
+		t.Error("nil client accepted")
+	}
+}
+
+// a tool call and the answer after it, over the injected transport
+func TestInjectedTransportToolConversation(t *testing.T) {
+	requireModelCalls(t)
+	mock := newMockGemini(t, callReply("echo", map[string]any{"text": "from the tool"}), textReply("the tool said hi"))
+	agent := newTransportAgent(t, mock)
+	if err := agent.NewSession(); err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := agent.CallAgentContext(context.Background(), "call the tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "the tool said hi" {
+		t.Errorf("reply = %q", reply)
+	}
+
+	requests := mock.received()
+	if len(requests) != 2 {
+		t.Fatalf("model requests = %d, want 2", len(requests))
+	}
+	if got := requests[0].lastText(); got != "call the tool" {
+		t.Errorf("first turn = %q, want the user message", got)
+	}
+	// the second turn sends the tool result after the model call
+	second := requests[1].Contents
+	if len(second) != 3 {
+		t.Fatalf("second turn history = %d contents, want 3", len(second))
+	}
+	result, ok := second[2].Parts[0]["functionResponse"].(map[string]any)
+	if !ok || result["name"] != "echo" {
+		t.Fatalf("second turn = %v, want the echo result", second[2].Parts)
+	}
+	if response, _ := result["response"].(map[string]any); response["result"] != "from the tool" {
+		t.Errorf("tool result = %v", result["response"])
+	}
+}
+
+// startup failures are classified so a bad key is told apart from an outage
+func TestInitAgentPreflightErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		countError int
+		down       bool
+		err        error
+	}{
+		{name: "key accepted"},
+		{name: "key rejected", countError: http.StatusUnauthorized, err: ErrInvalidCredentials},
+		{name: "key forbidden", countError: http.StatusForbidden, err: ErrInvalidCredentials},
+		{name: "model request failed", countError: http.StatusNotFound, err: ErrModelFailed},
+		{name: "api unreachable", down: true, err: ErrAPIUnreachable},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("GEMINI_API_KEY", "test")
+			mock := newMockGemini(t)
+			mock.countError = test.countError
+			if test.down {
+				mock.server.Close()
+			}
+
+			agent, err := InitAgent(context.Background(), nil, nil, nil,
+				WithGenaiOptions(option.WithEndpoint(mock.server.URL), option.WithHTTPClient(mock.server.Client())),
+				WithInitRetries(0, 0))
+			if test.err == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				agent.Close()
+				return
+			}
+			if !errors.Is(err, test.err) {
+				t.Fatalf("error = %v, want %v", err, test.err)
+			}
+			if agent != nil {
+				t.Error("agent returned with the error")
+			}
+		})
+	}
+}
+
+// every entry point refuses an agent that was never initialized or has been closed
+func TestAgentGuards(t *testing.T) {
+	closed := func(t *testing.T) *Agent {
+		agent := newMockAgent(t, newMockGemini(t))
+		if err := agent.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return agent
+	}
+	tests := []struct {
+		name  string
+		agent func(t *testing.T) *Agent
+		err   error
+	}{
+		{name: "nil agent", agent: func(t *testing.T) *Agent { return nil }, err: ErrAgentNotInitialized},
+		{name: "zero agent", agent: func(t *testing.T) *Agent { return &Agent{} }, err: ErrAgentNotInitialized},
+		{name: "closed agent", agent: closed, err: ErrAgentClosed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := test.agent(t)
+			ctx := context.Background()
+			calls := map[string]func() error{
+				"NewSession": agent.NewSession,
+				"NewSessionID": func() error {
+					_, err := agent.NewSessionID()
+					return err
+				},
+				"NewSessionWithHistory": func() error {
+					_, err := agent.NewSessionWithHistory(nil)
+					return err
+				},
+				"NewSessionWithTools": func() error {
+					_, err := agent.NewSessionWithTools([]string{"echo"})
+					return err
+				},
+				"NewSessionWithLabels": func() error {
+					_, err := agent.NewSessionWithLabels(map[string]string{"tenant": "acme"})
+					return err
+				},
+				"SetSystemInstruction": func() error { return agent.SetSystemInstruction("", "be brief") },
+				"History": func() error {
+					_, err := agent.History("")
+					return err
+				},
+				"ResetSession":     func() error { return agent.ResetSession("") },
+				"EndSession":       func() error { return agent.EndSession("id") },
+				"Cancel":           func() error { return agent.Cancel("") },
+				"InterruptSession": func() error { return agent.InterruptSession("") },
+				"CallAgent": func() error {
+					_, err := agent.CallAgent("question")
+					return err
+				},
+				"CallAgentContext": func() error {
+					_, err := agent.CallAgentContext(ctx, "question")
+					return err
+				},
+				"CallAgentRaw": func() error {
+					_, err := agent.CallAgentRaw(ctx, "question")
+					return err
+				},
+				"CallAgentWithSystem": func() error {
+					_, err := agent.CallAgentWithSystem(ctx, "question", "be brief")
+					return err
+				},
+				"CallAgentSession": func() error {
+					_, err := agent.CallAgentSession(ctx, "id", "question")
+					return err
+				},
+				"CallAgentWithTools": func() error {
+					_, err := agent.CallAgentWithTools(ctx, "question", nil)
+					return err
+				},
+				"CallAgentWithHistory": func() error {
+					_, _, err := agent.CallAgentWithHistory(ctx, nil, "question")
+					return err
+				},
+				"CallAgentWithSchema": func() error {
+					_, err := agent.CallAgentWithSchema(ctx, "", "question", &genai.Schema{Type: genai.TypeObject})
+					return err
+				},
+				"CallAgentStream": func() error {
+					_, err := agent.CallAgentStream(ctx, "question")
+					return err
+				},
+				"BuildRequest": func() error {
+					_, err := agent.BuildRequest(ctx, "", "question")
+					return err
+				},
+				"Embed": func() error {
+					_, err := agent.Embed(ctx, "text")
+					return err
+				},
+				"CountTokens": func() error {
+					_, err := agent.CountTokens(ctx, "text")
+					return err
+				},
+				"EnableContextCache":  func() error { return agent.EnableContextCache(ctx, time.Minute) },
+				"EnableEmbedBatching": func() error { return agent.EnableEmbedBatching(time.Millisecond, 10) },
+				"EnableInFlightLimit": func() error { return agent.EnableInFlightLimit(1, 0) },
+				"EnableSessionPool":   func() error { return agent.EnableSessionPool(1) },
+				"EnableResponseCache": func() error { return agent.EnableResponseCache(1, time.Minute) },
+				"SetRetryBudget":      func() error { return agent.SetRetryBudget(0.1) },
+				"RegisterTool": func() error {
+					return agent.RegisterTool("lookup", "look up a key", func(ctx context.Context, args struct{ Key string }) (string, error) { return args.Key, nil })
+				},
+				"WaitForDependencies": func() error { return agent.WaitForDependencies(ctx, nil) },
+				"RunAgent":            func() error { return agent.RunAgent("localhost", "0") },
+				"RunAgentCtx":         func() error { return agent.RunAgentCtx(ctx, "localhost", "0") },
+				"RunAgentStdio":       func() error { return agent.RunAgentStdio(ctx, strings.NewReader("question\n"), &bytes.Buffer{}) },
+				"Drain":               func() error { return agent.Drain(ctx) },
+				"Shutdown":            func() error { return agent.Shutdown(ctx) },
+				"Close":               agent.Close,
+			}
+			for name, call := range calls {
+				if err := call(); !errors.Is(err, test.err) {
+					t.Errorf("%s error = %v, want %v", name, err, test.err)
+				}
+			}
+
+			// methods with no error return the zero value or leave the agent as it is
+			noErrors := map[string]func() bool{
+				"Model":            func() bool { return agent.Model() == nil },
+				"ListSessions":     func() bool { return agent.ListSessions() == nil },
+				"Info":             func() bool { return agent.Info().Model == "" && agent.Info().Tools == nil },
+				"PoolStats":        func() bool { return agent.PoolStats() == PoolStats{} },
+				"RecordTranscript": func() bool { return agent.RecordTranscript() == nil },
+				"ReplayTranscript": func() bool {
+					agent.ReplayTranscript(&Transcript{})
+					return agent == nil || agent.record == nil
+				},
+				"EnableTracing": func() bool {
+					agent.EnableTracing(noop.NewTracerProvider())
+					return agent == nil || agent.tracer == nil
+				},
+				"SetBasePath": func() bool {
+					agent.SetBasePath("/math")
+					return agent == nil || agent.basePath == ""
+				},
+			}
+			for name, unchanged := range noErrors {
+				if !unchanged() {
+					t.Errorf("%s changed an unusable agent", name)
+				}
+			}
+
+			// handlers reply 503, routes of a non nil agent are registered and reply the same
+			handlers := []struct {
+				name    string
+				method  string
+				path    string
+				handler http.HandlerFunc
+			}{
+				{name: "HandleAgentRequest", method: http.MethodPost, path: "/agent", handler: agent.HandleAgentRequest},
+				{name: "HandleAgentStreamRequest", method: http.MethodPost, path: "/agent/stream", handler: agent.HandleAgentStreamRequest},
+				{name: "HandleCancelRequest", method: http.MethodPost, path: "/agent/id/cancel", handler: agent.HandleCancelRequest},
+				{name: "HandleJobRequest", method: http.MethodPost, path: "/agent/jobs", handler: agent.HandleJobRequest},
+				{name: "HandleJobStatus", method: http.MethodGet, path: "/agent/jobs/id", handler: agent.HandleJobStatus},
+				{name: "HandleInfoRequest", method: http.MethodGet, path: "/agent/info", handler: agent.HandleInfoRequest},
+				{name: "HandleHealthRequest", method: http.MethodGet, path: "/health", handler: agent.HandleHealthRequest},
+				{name: "HandleListSessions", method: http.MethodGet, path: "/admin/sessions", handler: agent.HandleListSessions},
+				{name: "HandleCreateSession", method: http.MethodPost, path: "/sessions", handler: agent.HandleCreateSession},
+				{name: "HandleSessionMessage", method: http.MethodPost, path: "/sessions/id/messages", handler: agent.HandleSessionMessage},
+				{name: "HandleGetSession", method: http.MethodGet, path: "/sessions/id", handler: agent.HandleGetSession},
+				{name: "HandleDeleteSession", method: http.MethodDelete, path: "/sessions/id", handler: agent.HandleDeleteSession},
+			}
+			mux := http.NewServeMux()
+			agent.RegisterRoutes(mux)
+			for _, handler := range handlers {
+				res := httptest.NewRecorder()
+				handler.handler(res, httptest.NewRequest(handler.method, handler.path, strings.NewReader(`{"input":"question"}`)))
+				if res.Code != http.StatusServiceUnavailable {
+					t.Errorf("%s status = %d, want 503", handler.name, res.Code)
+				}
+				if agent == nil || strings.HasPrefix(handler.path, "/sessions") {
+					continue
+				}
+				res = httptest.NewRecorder()
+				mux.ServeHTTP(res, httptest.NewRequest(handler.method, handler.path, strings.NewReader(`{"input":"question"}`)))
+				if res.Code != http.StatusServiceUnavailable {
+					t.Errorf("%s route status = %d, want 503", handler.name, res.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestSetBasePath(t *testing.T) {
+	tests := []struct {
+		path   string
+		want   string
+		remote string
+	}{
+		{path: "", want: "", remote: "http://localhost:8080/agent"},
+		{path: "/", want: "", remote: "http://localhost:8080/agent"},
+		{path: "math", want: "/math", remote: "http://localhost:8080/math/agent"},
+		{path: "/math/", want: "/math", remote: "http://localhost:8080/math/agent"},
+		{path: "/tools/math", want: "/tools/math", remote: "http://localhost:8080/tools/math/agent"},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			agent := newMockAgent(t, newMockGemini(t))
+			agent.SetBasePath(test.path)
+			if agent.basePath != test.want {
+				t.Errorf("base path = %q, want %q", agent.basePath, test.want)
+			}
+			if got := NewRemoteAgent("localhost", "8080", test.path).URL; got != test.remote {
+				t.Errorf("remote url = %q, want %q", got, test.remote)
+			}
+		})
+	}
+}
+
+// agents under different base paths share one mux
+func TestRegisterRoutes(t *testing.T) {
+	math := newMockAgent(t, newMockGemini(t))
+	math.SetBasePath("/math")
+	text := newMockAgent(t, newMockGemini(t))
+	text.SetBasePath("/text")
+	text.Close()
+	mux := http.NewServeMux()
+	math.RegisterRoutes(mux)
+	text.RegisterRoutes(mux)
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{path: "/math/health", status: http.StatusOK},
+		{path: "/text/health", status: http.StatusServiceUnavailable},
+		{path: "/health", status: http.StatusNotFound},
+		{path: "/math/agent/jobs/unknown", status: http.StatusNotFound},
+		{path: "/math/agent/info", status: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			res := httptest.NewRecorder()
+			mux.ServeHTTP(res, httptest.NewRequest(http.MethodGet, test.path, nil))
+			if res.Code != test.status {
+				t.Errorf("status = %d, want %d", res.Code, test.status)
+			}
+		})
+	}
+}
+
+// the raw response is the final model turn, after any tool calls
+func TestCallAgentRaw(t *testing.T) {
+	tests := []struct {
+		name    string
+		replies []mockReply
+		model   bool
+		text    string
+		err     bool
+	}{
+		{name: "direct answer", replies: []mockReply{textReply("42")}, model: true, text: "42"},
+		{name: "after a tool call", replies: []mockReply{callReply("echo", map[string]any{"text": "hi"}), textReply("done")}, model: true, text: "done"},
+		{name: "model error", replies: []mockReply{errorReply(http.StatusBadRequest)}, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.model {
+				requireModelCalls(t)
+			}
+			agent := newMockAgent(t, newMockGemini(t, test.replies...))
+			if err := agent.NewSession(); err != nil {
+				t.Fatal(err)
+			}
+			raw, err := agent.CallAgentRaw(context.Background(), "question")
+			if test.err {
+				if err == nil || raw != nil {
+					t.Fatalf("raw = %v, error = %v, want only an error", raw, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(raw.Candidates) != 1 {
+				t.Fatalf("candidates = %d, want 1", len(raw.Candidates))
+			}
+			candidate := raw.Candidates[0]
+			if candidate.FinishReason != genai.FinishReasonStop {
+				t.Errorf("finish reason = %v, want stop", candidate.FinishReason)
+			}
+			if text, _ := candidate.Content.Parts[0].(genai.Text); string(text) != test.text {
+				t.Errorf("text = %q, want %q", text, test.text)
+			}
+			if raw.UsageMetadata == nil || raw.UsageMetadata.TotalTokenCount == 0 {
+				t.Error("raw response has no usage metadata")
+			}
+		})
+	}
+}
+
+// the agent name is carried by the logs, metric labels and reply headers
+func TestAgentName(t *testing.T) {
+	tests := []struct {
+		name   string
+		label  string
+		logged string
+	}{
+		{name: "", label: "unnamed"},
+		{name: "math", label: "math", logged: "agent=math"},
+	}
+	for _, test := range tests {
+		t.Run(test.label, func(t *testing.T) {
+			var logs bytes.Buffer
+			agent := newMockAgent(t, newMockGemini(t), WithLogConfig(LogConfig{Handler: slog.NewTextHandler(&logs, nil)}))
+			agent.Name = test.name
+
+			if got := agent.metricLabel(); got != test.label {
+				t.Errorf("metric label = %q, want %q", got, test.label)
+			}
+			if _, err := agent.NewSessionID(); err != nil {
+				t.Fatal(err)
+			}
+			if test.logged != "" && !strings.Contains(logs.String(), test.logged) {
+				t.Errorf("logs = %q, want %q", logs.String(), test.logged)
+			}
+			if test.logged == "" && strings.Contains(logs.String(), "agent=") {
+				t.Errorf("logs = %q, want no agent attribute", logs.String())
+			}
+
+			for _, handler := range []http.HandlerFunc{agent.HandleHealthRequest, agent.HandleInfoRequest} {
+				res := httptest.NewRecorder()
+				handler(res, httptest.NewRequest(http.MethodGet, "/", nil))
+				if got := res.Header().Get(NameHeader); got != test.name {
+					t.Errorf("%s header = %q, want %q", NameHeader, got, test.name)
+				}
+			}
+		})
+	}
+}
+
+// a free local port for an agent service
+func freePort(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+// the service runs until its context is cancelled, then shuts down cleanly
+func TestRunAgentCtx(t *testing.T) {
+	tests := []struct {
+		name  string
+		inUse bool
+		err   bool
+	}{
+		{name: "cancelled"},
+		{name: "port in use", inUse: true, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newMockAgent(t, newMockGemini(t))
+			port := freePort(t)
+			if test.inUse {
+				listener, err := net.Listen("tcp", "127.0.0.1:"+port)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer listener.Close()
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ran := make(chan error, 1)
+			go func() { ran <- agent.RunAgentCtx(ctx, "127.0.0.1", port) }()
+
+			if !test.inUse {
+				// wait for the service to come up
+				deadline := time.Now().Add(5 * time.Second)
+				for {
+					res, err := http.Get("http://127.0.0.1:" + port + "/health")
+					if err == nil {
+						res.Body.Close()
+						break
+					}
+					if time.Now().After(deadline) {
+						t.Fatalf("service did not start: %v", err)
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				cancel()
+			}
+
+			select {
+			case err := <-ran:
+				if test.err != (err != nil) {
+					t.Fatalf("error = %v, want error %v", err, test.err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("RunAgentCtx did not return")
+			}
+			if !test.inUse {
+				if _, err := http.Get("http://127.0.0.1:" + port + "/health"); err == nil {
+					t.Error("service still answering after shutdown")
+				}
+			}
+			// nothing is left to shut down
+			if err := agent.Shutdown(context.Background()); err != nil {
+				t.Errorf("second shutdown error = %v", err)
+			}
+		})
+	}
+}
+
+// identical calls in one model turn run the tool once and all get its result
+func TestCallToolOnce(t *testing.T) {
+	tests := []struct {
+		name  string
+		calls []genai.FunctionCall
+		runs  int
+	}{
+		{
+			name:  "identical",
+			calls: []genai.FunctionCall{{Name: "echo", Args: map[string]any{"text": "hi"}}, {Name: "echo", Args: map[string]any{"text": "hi"}}},
+			runs:  1,
+		},
+		{
+			name:  "different args",
+			calls: []genai.FunctionCall{{Name: "echo", Args: map[string]any{"text": "hi"}}, {Name: "echo", Args: map[string]any{"text": "bye"}}},
+			runs:  2,
+		},
+		{
+			name: "equal args in another order",
+			calls: []genai.FunctionCall{
+				{Name: "echo", Args: map[string]any{"text": "hi", "loud": true}},
+				{Name: "echo", Args: map[string]any{"loud": true, "text": "hi"}},
+			},
+			runs: 1,
+		},
+		{
+			name:  "different tools",
+			calls: []genai.FunctionCall{{Name: "echo", Args: map[string]any{"text": "hi"}}, {Name: "shout", Args: map[string]any{"text": "hi"}}},
+			runs:  2,
+		},
+		{
+			name:  "args that cannot be keyed",
+			calls: []genai.FunctionCall{{Name: "echo", Args: map[string]any{"text": make(chan int)}}, {Name: "echo", Args: map[string]any{"text": make(chan int)}}},
+			runs:  2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newMockAgent(t, newMockGemini(t))
+			runs := 0
+			agent.toolCall = func(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+				runs++
+				return "result", nil
+			}
+			calls := turnCalls{}
+			for _, call := range test.calls {
+				part, err := agent.callToolOnce(context.Background(), &session{}, calls, call)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if response, ok := part.(genai.FunctionResponse); !ok || response.Name != call.Name {
+					t.Errorf("response = %v, want a %s response", part, call.Name)
+				}
+			}
+			if runs != test.runs {
+				t.Errorf("tool runs = %d, want %d", runs, test.runs)
+			}
+		})
+	}
+}
+
+// a tool over its own time limit answers the model with an error instead of failing the request
+func TestToolTimeouts(t *testing.T) {
+	tests := []struct {
+		name     string
+		tool     string
+		timeouts map[string]time.Duration
+		delay    time.Duration
+		cancel   bool
+		result   any
+		errText  string
+		err      bool
+	}{
+		{name: "no limit", tool: "echo", delay: 10 * time.Millisecond, result: "done"},
+		{name: "in time", tool: "echo", timeouts: map[string]time.Duration{"echo": time.Second}, result: "done"},
+		{name: "timed out", tool: "echo", timeouts: map[string]time.Duration{"echo": 20 * time.Millisecond}, delay: time.Second, errText: "the tool timed out after 20ms"},
+		{name: "other tool limited", tool: "echo", timeouts: map[string]time.Duration{"slow": time.Millisecond}, delay: 10 * time.Millisecond, result: "done"},
+		{name: "caller cancelled", tool: "echo", timeouts: map[string]time.Duration{"echo": time.Second}, delay: time.Second, cancel: true, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newMockAgent(t, newMockGemini(t))
+			agent.ToolTimeouts = test.timeouts
+			agent.toolCall = func(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+				select {
+				case <-time.After(test.delay):
+					return "done", nil
+				case <-ctx.Done():
+					return "", ctx.Err()
+				}
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if test.cancel {
+				cancel()
+			}
+
+			part, err := agent.callTool(ctx, genai.FunctionCall{Name: test.tool})
+			if test.err {
+				if !errors.Is(err, ErrToolFailed) {
+					t.Fatalf("error = %v, want ErrToolFailed", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			response := part.(genai.FunctionResponse).Response
+			if test.errText != "" {
+				if response["error"] != test.errText {
+					t.Errorf("response = %v, want error %q", response, test.errText)
+				}
+				return
+			}
+			if response["result"] != test.result {
+				t.Errorf("response = %v, want result %v", response, test.result)
+			}
+		})
+	}
+}
+
+// the sanitizer scrubs user messages, and tool results when SanitizeToolResults is set
+func TestInputSanitizer(t *testing.T) {
+	mask := func(text string) string { return strings.ReplaceAll(text, "555-1234", "[phone]") }
+	tests := []struct {
+		name      string
+		sanitizer func(string) string
+		tools     bool
+		prefix    string
+		input     string
+		result    string
+	}{
+		{name: "no sanitizer", input: "call 555-1234", result: "call 555-1234"},
+		{name: "message only", sanitizer: mask, input: "call [phone]", result: "call 555-1234"},
+		{name: "message and tools", sanitizer: mask, tools: true, input: "call [phone]", result: "call [phone]"},
+		{name: "prefix kept", sanitizer: mask, prefix: "555-1234: ", input: "555-1234: call [phone]", result: "call 555-1234"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newMockAgent(t, newMockGemini(t))
+			agent.InputSanitizer, agent.SanitizeToolResults, agent.InputPrefix = test.sanitizer, test.tools, test.prefix
+
+			if got := agent.prepareInput("call 555-1234"); got != test.input {
+				t.Errorf("model input = %q, want %q", got, test.input)
+			}
+			part, err := agent.callTool(context.Background(), genai.FunctionCall{Name: "echo", Args: map[string]any{"text": "call 555-1234"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := part.(genai.FunctionResponse).Response["result"]; got != test.result {
+				t.Errorf("tool result = %v, want %q", got, test.result)
+			}
+		})
+	}
+}
+
+// a panicking tool is reported to the model as a tool error and the agent carries on
+func TestToolPanicRecovered(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler ToolHandler
+		result  any
+		errText string
+	}{
+		{name: "returns", handler: echoCall, result: "hi"},
+		{name: "panics with a value", handler: func(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+			panic("index out of range")
+		}, errText: "the tool failed unexpectedly: index out of range"},
+		{name: "panics with an error", handler: func(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+			var args map[string]string
+			args["text"] = "hi"
+			return "", nil
+		}, errText: "the tool failed unexpectedly: assignment to entry in nil map"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newMockAgent(t, newMockGemini(t))
+			agent.toolCall = test.handler
+			for call := 0; call < 2; call++ {
+				part, err := agent.callTool(context.Background(), genai.FunctionCall{Name: "echo", Args: map[string]any{"text": "hi"}})
+				if err != nil {
+					t.Fatalf("call %d error = %v, want a tool response", call, err)
+				}
+				response := part.(genai.FunctionResponse).Response
+				if test.errText != "" && response["error"] != test.errText {
+					t.Errorf("response = %v, want error %q", response, test.errText)
+				}
+				if test.errText == "" && response["result"] != test.result {
+					t.Errorf("response = %v, want result %v", response, test.result)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitReasoning(t *testing.T) {
+	tests := []struct {
+		name      string
+		parts     []genai.Part
+		reasoning string
+		answer    genai.Text
+		ok        bool
+	}{
+		{name: "answer only", parts: []genai.Part{genai.Text("42")}},
+		{name: "one thought", parts: []genai.Part{genai.Text("add them"), genai.Text("42")}, reasoning: "add them", answer: "42", ok: true},
+		{name: "thoughts joined", parts: []genai.Part{genai.Text("read it"), genai.Text("add them"), genai.Text("42")}, reasoning: "read it\nadd them", answer: "42", ok: true},
+		{name: "tool call", parts: []genai.Part{genai.Text("add them"), genai.FunctionCall{Name: "add"}}},
+		{name: "empty"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reasoning, answer, ok := splitReasoning(test.parts)
+			if reasoning != test.reasoning || answer != test.answer || ok != test.ok {
+				t.Errorf("split = %q, %q, %v, want %q, %q, %v", reasoning, answer, ok, test.reasoning, test.answer, test.ok)
+			}
+		})
+	}
+}
+
+// the thoughts are split from the answer only when IncludeReasoning is set
+// genai joins the texts of separate stream responses, so the thoughts and answer come in one
+func TestIncludeReasoning(t *testing.T) {
+	requireModelCalls(t)
+	tests := []struct {
+		name      string
+		include   bool
+		reply     mockReply
+		text      string
+		reasoning string
+	}{
+		{name: "included", include: true, reply: textReply("add 2 and 2", "4"), text: "4", reasoning: "add 2 and 2"},
+		// as before the option, the reply ends at the first text part
+		{name: "not included", reply: textReply("add 2 and 2", "4"), text: "add 2 and 2"},
+		{name: "no thoughts", include: true, reply: textReply("4"), text: "4"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.reply.oneChunk = true
+			agent := newMockAgent(t, newMockGemini(t, test.reply))
+			agent.IncludeReasoning = test.include
+			if err := agent.NewSession(); err != nil {
+				t.Fatal(err)
+			}
+			result, err := agent.callAgent(context.Background(), "", "what is 2+2?")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.text != test.text || result.reasoning != test.reasoning {
+				t.Errorf("reply = %q reasoning %q, want %q reasoning %q", result.text, result.reasoning, test.text, test.reasoning)
+			}
+		})
+	}
+}
+
+// a direct answer is re-prompted toolUseReprompts times before the call fails with ErrToolNotUsed
+func TestEnforceToolUse(t *testing.T) {
+	requireModelCalls(t)
+	tests := []struct {
+		name      string
+		replies   []mockReply
+		text      string
+		err       error
+		reprompts int
+	}{
+		{
+			name:    "tool called",
+			replies: []mockReply{callReply("echo", map[string]any{"text": "42"}), textReply("42")},
+			text:    "42",
+		},
+		{
+			name:      "tool called after a reprompt",
+			replies:   []mockReply{textReply("guess"), callReply("echo", map[string]any{"text": "42"}), textReply("42")},
+			text:      "42",
+			reprompts: 1,
+		},
+		{
+			name:      "reprompts run out",
+			replies:   []mockReply{textReply("guess"), textReply("guess"), textReply("guess")},
+			err:       ErrToolNotUsed,
+			reprompts: toolUseReprompts,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := newMockGemini(t, test.replies...)
+			agent := newMockAgent(t, mock)
+			agent.EnforceToolUse = true
+			if err := agent.NewSession(); err != nil {
+				t.Fatal(err)
+			}
+
+			text, err := agent.CallAgentContext(context.Background(), "question")
+			if !errors.Is(err, test.err) {
+				t.Fatalf("error = %v, want %v", err, test.err)
+			}
+			if text != test.text {
+				t.Errorf("text = %q, want %q", text, test.text)
+			}
+			if test.err != nil {
+				if status := errorStatus(context.Background(), err); status != http.StatusInternalServerError {
+					t.Errorf("http status = %d, want 500", status)
+				}
+			}
+			reprompts := 0
+			for _, req := range mock.received() {
+				if req.lastText() == toolUsePrompt {
+					reprompts++
+				}
+			}
+			if reprompts != test.reprompts {
+				t.Errorf("reprompts = %d, want %d", reprompts, test.reprompts)
+			}
+		})
+	}
+}
+
+// the InputPrefix and InputSuffix wrap the sanitized message the model and the router see
+func TestInputWrapping(t *testing.T) {
+	mask := func(text string) string { return strings.ReplaceAll(text, "555-1234", "[phone]") }
+	tests := []struct {
+		name      string
+		prefix    string
+		suffix    string
+		sanitizer func(string) string
+		want      string
+	}{
+		{name: "unwrapped", want: "call 555-1234"},
+		{name: "prefix", prefix: "Reply tersely: ", want: "Reply tersely: call 555-1234"},
+		{name: "suffix", suffix: " (no commentary)", want: "call 555-1234 (no commentary)"},
+		{name: "prefix and suffix", prefix: "<msg>", suffix: "</msg>", want: "<msg>call 555-1234</msg>"},
+		{name: "wrapper not sanitized", prefix: "555-1234: ", sanitizer: mask, want: "555-1234: call [phone]"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newMockAgent(t, newMockGemini(t))
+			agent.InputPrefix, agent.InputSuffix, agent.InputSanitizer = test.prefix, test.suffix, test.sanitizer
+			routed := ""
+			agent.ModelRouter = func(input string) string {
+				routed = input
+				return ""
+			}
+			if err := agent.NewSession(); err != nil {
+				t.Fatal(err)
+			}
+
+			dryRun, err := agent.BuildRequest(context.Background(), "", "call 555-1234")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := dryRun.Input.Parts[0].Text; got != test.want {
+				t.Errorf("model input = %q, want %q", got, test.want)
+			}
+			if routed != test.want {
+				t.Errorf("router input = %q, want %q", routed, test.want)
+			}
+		})
+	}
+}
@@ -1,15 +1,14 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
-	"io"
+	"fmt"
 	"log"
 	"math"
-	"net/http"
+	"math/big"
 	"os"
+	"regexp"
 	"strconv"
 	"time"
 
@@ -23,6 +22,9 @@ import (
 // high precision floating point agent
 
 // calc tool description
+// the values are declared as strings so a precise calculation gets every digit the model wrote,
+// the api sends json numbers as doubles. a model that sends numbers anyway is accepted, the handler
+// reads either form through ArgString
 var performCalculationTool = &genai.Tool{
 	FunctionDeclarations: []*genai.FunctionDeclaration{{
 		Name:        "performCalculation",
@@ -32,27 +34,46 @@ var performCalculationTool = &genai.Tool{
 			Properties: map[string]*genai.Schema{
 				"valueOne": {
 					Type:        genai.TypeString,
-					Description: "The first floating point value as a string",
+					Description: "The first floating point value as a string, e.g. \"0.1\", to keep every digit. a number is also accepted",
 				},
 				"valueTwo": {
 					Type:        genai.TypeString,
-					Description: "The second floating point value as a string",
+					Description: "The second floating point value as a string, e.g. \"0.2\", to keep every digit. a number is also accepted",
 				},
 				"operator": {
 					Type:        genai.TypeString,
 					Description: "the operator for the calculation. can be one of +, -, *, /, %",
 				},
+				"precision": {
+					Type:        genai.TypeInteger,
+					Description: "optional number of significant digits for an arbitrary precision result, at most 1000. omit for standard double precision",
+				},
 			},
 			Required: []string{"valueOne", "valueTwo", "operator"},
 		},
 	}},
 }
 
-// calc tool
-func performCalculation(valueOne string, valueTwo string, operator string) string {
-	log.Println("running performCalculation tool for " + valueOne + " " + operator + " " + valueTwo)
-	one, _ := strconv.ParseFloat(valueOne, 64)
-	two, _ := strconv.ParseFloat(valueTwo, 64)
+// most significant digits a calculation is asked for, bounding the working precision
+const maxPrecision = 1000
+
+// calc tool, a positive precision calculates with big.Float to that many significant digits
+// an invalid value, unsupported operator or precision out of range is an error
+func performCalculation(valueOne string, valueTwo string, operator string, precision int) (string, error) {
+	if precision < 0 || precision > maxPrecision {
+		return "", fmt.Errorf("precision %d out of range, want at most %d significant digits", precision, maxPrecision)
+	}
+	if precision > 0 {
+		return performPreciseCalculation(valueOne, valueTwo, operator, precision)
+	}
+	one, err := strconv.ParseFloat(valueOne, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid value one %q", valueOne)
+	}
+	two, err := strconv.ParseFloat(valueTwo, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid value two %q", valueTwo)
+	}
 	var result float64
 	switch operator {
 	case "+":
@@ -66,167 +87,139 @@ func performCalculation(valueOne string, valueTwo string, operator string) strin
 	case "%":
 		result = math.Mod(one, two)
 	default:
-		log.Println("unsupported operator: " + operator)
+		return "", fmt.Errorf("unsupported operator %q", operator)
 	}
-	return strconv.FormatFloat(result, 'f', -1, 64)
+	return strconv.FormatFloat(result, 'f', -1, 64), nil
+}
+
+// arbitrary precision calc, the working precision covers the requested digits plus guard bits
+// a division by zero is NaN
+func performPreciseCalculation(valueOne string, valueTwo string, operator string, precision int) (string, error) {
+	bits := uint(math.Ceil(float64(precision)*math.Log2(10))) + 64
+	one, _, err := big.ParseFloat(valueOne, 10, bits, big.ToNearestEven)
+	if err != nil {
+		return "", fmt.Errorf("invalid value one %q", valueOne)
+	}
+	two, _, err := big.ParseFloat(valueTwo, 10, bits, big.ToNearestEven)
+	if err != nil {
+		return "", fmt.Errorf("invalid value two %q", valueTwo)
+	}
+	result := new(big.Float).SetPrec(bits)
+	switch operator {
+	case "+":
+		result.Add(one, two)
+	case "-":
+		result.Sub(one, two)
+	case "*":
+		result.Mul(one, two)
+	case "/":
+		if two.Sign() == 0 {
+			log.Println("division by zero")
+			return "NaN", nil
+		}
+		result.Quo(one, two)
+	case "%":
+		if two.Sign() == 0 {
+			log.Println("division by zero")
+			return "NaN", nil
+		}
+		// truncated remainder, matching math.Mod
+		quotient, _ := new(big.Float).SetPrec(bits).Quo(one, two).Int(nil)
+		result.Sub(one, new(big.Float).SetPrec(bits).Mul(new(big.Float).SetInt(quotient), two))
+	default:
+		return "", fmt.Errorf("unsupported operator %q", operator)
+	}
+	return result.Text('g', precision), nil
 }
 
 // agent initialization
 func initFloatAgent(ctx context.Context) (*agentassemble.Agent, error) {
 	system := `Your task is to perform high precision floating point calculations.
 Reply ONLY with the calculated result.`
-	var tools = []*genai.Tool{performCalculationTool}
-	agentFloat, err := agentassemble.InitAgent(ctx, &system, tools, callFloatTool)
+	// the calculation is the answer so it is returned without another model turn
+	// its arguments are plain numbers so they are logged by the agent in full
+	agentFloat, err := agentassemble.InitAgent(ctx, &system, nil, nil, agentassemble.WithToolFuncs(
+		agentassemble.ToolFunc{Declaration: performCalculationTool.FunctionDeclarations[0], Handler: callFloatTool, Final: true},
+	), agentassemble.WithLogConfig(agentassemble.LogConfig{
+		ToolArgRules: map[string]agentassemble.ArgRule{
+			"performCalculation": {Fields: []string{"valueOne", "valueTwo", "operator", "precision"}},
+		},
+	}))
 	if err != nil {
 		log.Println("Error initializing the float agent")
 		return nil, err
 	}
+	agentFloat.Name = "float"
+	agentFloat.ResponseTransformer = firstNumber
 	return agentFloat, err
 }
 
-// tool call handler
-func callFloatTool(funcall genai.FunctionCall) (string, error) {
+// reduce the float agent reply to the first number in case the model adds prose
+// the NaN of a division by zero and the ±Inf of an overflow are numbers too
+var numberPattern = regexp.MustCompile(`[-+]?(\d+\.?\d*|\.\d+)([eE][-+]?\d+)?|[-+]?\bInf\b|\bNaN\b`)
 
-	result := ""
-	// find the function to call
-	if funcall.Name == performCalculationTool.FunctionDeclarations[0].Name {
-		// check the params are populated
-		valueOne, exists := funcall.Args["valueOne"]
-		if !exists {
-			log.Fatalln("Missing value one")
-		}
-		valueTwo, exists := funcall.Args["valueTwo"]
-		if !exists {
-			log.Fatalln("Missing value two")
-		}
-		operator, exists := funcall.Args["operator"]
-		if !exists {
-			log.Fatalln("Missing value operator")
-		}
-		// call the calc tool
-		result = performCalculation(valueOne.(string), valueTwo.(string), operator.(string))
-		log.Println("calculation result: " + result)
-	} else {
-		log.Println("unhandled function name: " + funcall.Name)
-		return "", errors.New("unhandled function name: " + funcall.Name)
+func firstNumber(reply string) (string, error) {
+	number := numberPattern.FindString(reply)
+	if number == "" {
+		return "", errors.New("no number in reply: " + reply)
 	}
-	return result, nil
+	return number, nil
 }
 
-// client tool for the floating point agent description
-var callFloatAgentTool = &genai.Tool{
-	FunctionDeclarations: []*genai.FunctionDeclaration{{
-		Name:        "callFloatAgent",
-		Description: "Make a request to the floating point agent. The agent will perform the calculation and return the result.",
-		Parameters: &genai.Schema{
-			Type: genai.TypeObject,
-			Properties: map[string]*genai.Schema{
-				"message": {
-					Type:        genai.TypeString,
-					Description: "The natural language request message for the floating point calculation agent",
-				},
-			},
-			Required: []string{"message"},
-		},
-	}},
-}
-
-// client tool for the floating point agent
-func callFloatAgent(message string) (string, error) {
-	log.Println("running callFloatAgent tool for :" + message)
+// calc tool handler
+func callFloatTool(ctx context.Context, funcall genai.FunctionCall) (string, error) {
 
-	// get the float agent endpoint
-	floatHostname, ok := os.LookupEnv("FLOAT_AGENT_HOSTNAME")
-	if !ok {
-		log.Fatalln("environment variable FLOAT_AGENT_HOSTNAME not set")
-	}
-	floatPort, ok := os.LookupEnv("FLOAT_AGENT_PORT")
-	if !ok {
-		log.Fatalln("environment variable FLOAT_AGENT_PORT not set")
-	}
-
-	// build the payload
-	request := agentassemble.Request{
-		Input: message,
-	}
-	reqDat, err := json.Marshal(request)
+	// check the params are populated, values sent as json numbers are accepted too
+	valueOne, err := agentassemble.ArgString(funcall.Args, "valueOne")
 	if err != nil {
 		return "", err
 	}
-
-	// repare the request
-	req, err := http.NewRequest("POST", "http://"+floatHostname+":"+floatPort+"/agent", bytes.NewBuffer(reqDat))
+	valueTwo, err := agentassemble.ArgString(funcall.Args, "valueTwo")
 	if err != nil {
 		return "", err
 	}
-	req.Header.Set("Content-Type", "application/json")
-
-	// send the post
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	operator, err := agentassemble.ArgString(funcall.Args, "operator")
 	if err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
-
-	// extract and decode the reply
-	response := agentassemble.Response{}
-	respDat, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+	// optional significant digits
+	precision := 0
+	if _, exists := funcall.Args["precision"]; exists {
+		precision, err = agentassemble.ArgInt(funcall.Args, "precision")
+		if err != nil {
+			return "", err
+		}
 	}
-	err = json.Unmarshal(respDat, &response)
+	// call the calc tool, a bad calculation is reported back to the model to correct
+	result, err := performCalculation(valueOne, valueTwo, operator, precision)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("%w: %w", agentassemble.ErrInvalidArgs, err)
 	}
-
-	return response.Content, nil
+	log.Println("calculation result: " + result)
+	return result, nil
 }
 
 /////////////////////
 // general math agent
 
-// agent initialization
-func initMathAgent(ctx context.Context) (*agentassemble.Agent, error) {
+// agent initialization, the float agent is called as a tool
+func initMathAgent(ctx context.Context, float *agentassemble.RemoteAgent) (*agentassemble.Agent, error) {
 	system := `Your task is to perform math calculations.
 For floating point requests use agent tools to help with your results.
 Reply ONLY with the calculated result.`
-	var tools = []*genai.Tool{callFloatAgentTool}
-	agentMath, err := agentassemble.InitAgent(ctx, &system, tools, callMathTool)
+	agentMath, err := agentassemble.InitAgent(ctx, &system, nil, nil, agentassemble.WithToolFuncs(
+		float.Tool("float", "The agent will perform the floating point calculation and return the result."),
+	))
 	if err != nil {
 		log.Println("error initializing the math agent")
 		return nil, err
 	}
+	agentMath.Name = "math"
+	// keep answering at lower precision if the float agent is down
+	agentMath.DegradeOnUnavailable = true
 	return agentMath, err
 }
 
-// tool call handler
-func callMathTool(funcall genai.FunctionCall) (string, error) {
-
-	result := ""
-	// find the function to call
-	if funcall.Name == callFloatAgentTool.FunctionDeclarations[0].Name {
-		// check the params are populated
-		message, exists := funcall.Args["message"]
-		if !exists {
-			log.Println("error missing message")
-			return "", errors.New("error missing message")
-		}
-		// call the float agent
-		var err error
-		result, err = callFloatAgent(message.(string))
-		if err != nil {
-			log.Println(err)
-			return "", err
-		}
-		log.Println("float agent result: " + result)
-	} else {
-		log.Println("unhandled function name: " + funcall.Name)
-		return "", errors.New("unhandled function name: " + funcall.Name)
-	}
-	return result, nil
-}
-
 // agent list
 var agentFloat *agentassemble.Agent
 var agentMath *agentassemble.Agent
@@ -239,6 +232,15 @@ func main() {
 	if err != nil {
 		log.Fatalln("error loading .env file")
 	}
+	// check all the required config before starting any agent
+	err = agentassemble.ValidateEnv(
+		agentassemble.EnvVar{Name: "GEMINI_API_KEY"},
+		agentassemble.EnvVar{Name: "FLOAT_AGENT_HOSTNAME"},
+		agentassemble.EnvVar{Name: "FLOAT_AGENT_PORT", Port: true},
+	)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	// initialise the float agent
 	ctxFloat := context.Background()
@@ -246,29 +248,32 @@ func main() {
 	if err != nil {
 		log.Fatalln("error initializing the Float Agent")
 	}
-	defer agentFloat.Client.Close()
+	defer agentFloat.Close()
 
-	// run the float agent as a service with a single session
-	floatHostname, ok := os.LookupEnv("FLOAT_AGENT_HOSTNAME")
-	if !ok {
-		log.Fatalln("environment variable FLOAT_AGENT_HOSTNAME not set")
-	}
-	floatPort, ok := os.LookupEnv("FLOAT_AGENT_PORT")
-	if !ok {
-		log.Fatalln("environment variable FLOAT_AGENT_PORT not set")
-	}
-	agentFloat.NewSession()
+	// run the float agent as a service with pooled stateless sessions
+	floatHostname := os.Getenv("FLOAT_AGENT_HOSTNAME")
+	floatPort := os.Getenv("FLOAT_AGENT_PORT")
+	agentFloat.EnableSessionPool(4)
+	agentFloat.SetBasePath(os.Getenv("FLOAT_AGENT_PATH"))
 	agentFloat.RunAgent(floatHostname, floatPort)
-
-	time.Sleep(2000)
+	floatRemote := agentassemble.NewRemoteAgent(floatHostname, floatPort, os.Getenv("FLOAT_AGENT_PATH"))
+	floatURL := floatRemote.URL
 
 	// initialize the math agent
 	ctxMath := context.Background()
-	agentMath, err = initMathAgent(ctxMath)
+	agentMath, err = initMathAgent(ctxMath, floatRemote)
 	if err != nil {
 		log.Fatalln("error initializing the Math Agent")
 	}
-	defer agentMath.Client.Close()
+	defer agentMath.Close()
+
+	// wait for the float agent to serve
+	ctxWait, cancel := context.WithTimeout(ctxMath, 30*time.Second)
+	err = agentMath.WaitForDependencies(ctxWait, []string{floatURL})
+	cancel()
+	if err != nil {
+		log.Fatalln("float agent not ready")
+	}
 
 	// start a new math session
 	agentMath.NewSession()
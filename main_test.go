@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	agentassemble "gemini-agents/gemini-agent-assemble"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+func TestPerformCalculation(t *testing.T) {
+	tests := []struct {
+		name      string
+		one, two  string
+		operator  string
+		precision int
+		result    string
+		err       string
+	}{
+		{name: "add", one: "1.5", two: "2.25", operator: "+", result: "3.75"},
+		{name: "subtract", one: "1", two: "0.25", operator: "-", result: "0.75"},
+		{name: "multiply", one: "1.5", two: "4", operator: "*", result: "6"},
+		{name: "divide", one: "1", two: "4", operator: "/", result: "0.25"},
+		{name: "remainder", one: "7.5", two: "2", operator: "%", result: "1.5"},
+		{name: "unknown operator", one: "1", two: "2", operator: "^", err: "unsupported operator"},
+		{name: "invalid value one", one: "one", two: "2", operator: "+", err: "invalid value one"},
+		{name: "invalid value two", one: "1", two: "", operator: "+", err: "invalid value two"},
+		{name: "precise add", one: "0.1", two: "0.2", operator: "+", precision: 30, result: "0.3"},
+		{name: "precise divide", one: "1", two: "3", operator: "/", precision: 20, result: "0.33333333333333333333"},
+		{name: "precise remainder", one: "7.5", two: "2", operator: "%", precision: 10, result: "1.5"},
+		{name: "precise divide by zero", one: "1", two: "0", operator: "/", precision: 10, result: "NaN"},
+		{name: "precise unknown operator", one: "1", two: "2", operator: "^", precision: 10, err: "unsupported operator"},
+		{name: "precise invalid value", one: "1", two: "two", operator: "+", precision: 10, err: "invalid value two"},
+		{name: "precision at the cap", one: "1", two: "3", operator: "/", precision: maxPrecision, result: "0." + strings.Repeat("3", maxPrecision)},
+		{name: "precision over the cap", one: "1", two: "3", operator: "/", precision: maxPrecision + 1, err: "out of range"},
+		{name: "negative precision", one: "1", two: "3", operator: "/", precision: -1, err: "out of range"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := performCalculation(test.one, test.two, test.operator, test.precision)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != test.result {
+				t.Errorf("result = %s, want %s", result, test.result)
+			}
+		})
+	}
+}
+
+func TestFirstNumber(t *testing.T) {
+	tests := []struct {
+		reply  string
+		number string
+		err    bool
+	}{
+		{reply: "42", number: "42"},
+		{reply: "The result is -3.75.", number: "-3.75"},
+		{reply: "about 1.5e-7 or so", number: "1.5e-7"},
+		{reply: ".5", number: ".5"},
+		{reply: "NaN", number: "NaN"},
+		{reply: "The result is NaN", number: "NaN"},
+		{reply: "+Inf", number: "+Inf"},
+		{reply: "-Inf", number: "-Inf"},
+		{reply: "Infinity", err: true},
+		{reply: "Information: 7", number: "7"},
+		{reply: "no result", err: true},
+		{reply: "", err: true},
+	}
+	for _, test := range tests {
+		number, err := firstNumber(test.reply)
+		if (err != nil) != test.err {
+			t.Errorf("firstNumber(%q) error = %v, want error %v", test.reply, err, test.err)
+		}
+		if number != test.number {
+			t.Errorf("firstNumber(%q) = %q, want %q", test.reply, number, test.number)
+		}
+	}
+
+	// the final tool answers of the float agent pass through the transformer as they are
+	for _, calc := range [][3]string{{"1", "0", "/"}, {"-1", "0", "/"}, {"0", "0", "/"}, {"1e308", "10", "*"}} {
+		result, err := performCalculation(calc[0], calc[1], calc[2], 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if number, err := firstNumber(result); err != nil || number != result {
+			t.Errorf("firstNumber(%q) = %q, %v, want the result", result, number, err)
+		}
+	}
+}
+
+func TestCallFloatTool(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   map[string]any
+		result string
+		err    error
+	}{
+		{name: "string values", args: map[string]any{"valueOne": "2", "valueTwo": "3", "operator": "*"}, result: "6"},
+		{name: "number values", args: map[string]any{"valueOne": 2.5, "valueTwo": 2.0, "operator": "+"}, result: "4.5"},
+		{name: "precision", args: map[string]any{"valueOne": "2", "valueTwo": "3", "operator": "/", "precision": 5.0}, result: "0.66667"},
+		{name: "missing value", args: map[string]any{"valueOne": "2", "operator": "+"}, err: agentassemble.ErrInvalidArgs},
+		{name: "unknown operator", args: map[string]any{"valueOne": "2", "valueTwo": "3", "operator": "x"}, err: agentassemble.ErrInvalidArgs},
+		{name: "precision too high", args: map[string]any{"valueOne": "2", "valueTwo": "3", "operator": "/", "precision": 1e6}, err: agentassemble.ErrInvalidArgs},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := callFloatTool(context.Background(), genai.FunctionCall{Name: "performCalculation", Args: test.args})
+			if !errors.Is(err, test.err) {
+				t.Fatalf("error = %v, want %v", err, test.err)
+			}
+			if result != test.result {
+				t.Errorf("result = %q, want %q", result, test.result)
+			}
+		})
+	}
+}